@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// appendOnlyFile is the log every write command is appended to while
+// appendonly is on
+const appendOnlyFile = "appendonly.aof"
+
+const (
+	// fsyncAlways syncs the append only file after every write command
+	fsyncAlways = "always"
+	// fsyncEverysec syncs the append only file once a second in the background
+	fsyncEverysec = "everysec"
+	// fsyncNo leaves syncing the append only file to the operating system
+	fsyncNo = "no"
+)
+
+// aofFsyncInterval is how often the append only file is synced with everysec
+const aofFsyncInterval = time.Second
+
+var errAOFRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// appendCommandRESP encodes a command as a RESP array of bulk strings, which
+// is the format the append only file is written in
+func appendCommandRESP(buf []byte, args ...string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, Delimeter...)
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, Delimeter...)
+		buf = append(buf, arg...)
+		buf = append(buf, Delimeter...)
+	}
+	return buf
+}
+
+// appendDBCommands encodes the commands that rebuild db from nothing. Keys are
+// written in order so the same dataset always gives the same file. The values
+// of cold keys are read from t
+func appendDBCommands(buf []byte, dbIndex int, db *DB, t *tier) ([]byte, error) {
+	if len(db.tstore) == 0 {
+		return buf, nil
+	}
+	buf = appendCommandRESP(buf, "SELECT", strconv.Itoa(dbIndex))
+	keys := make([]string, 0, len(db.tstore))
+	for key := range db.tstore {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		vdb, err := t.valueDB(dbIndex, db, key)
+		if err != nil {
+			return buf, err
+		}
+		switch vdb.tstore[key] {
+		case tString:
+			buf = appendCommandRESP(buf, "SET", key, vdb.kv[key])
+		case tList:
+			for e := vdb.ll[key].Front(); e != nil; e = e.Next() {
+				buf = appendCommandRESP(buf, "RPUSH", key, e.Value)
+			}
+		case tSet:
+			members := make([]string, 0, len(vdb.s[key]))
+			for member := range vdb.s[key] {
+				members = append(members, member)
+			}
+			sort.Strings(members)
+			for _, member := range members {
+				buf = appendCommandRESP(buf, "SADD", key, member)
+			}
+		case tHash:
+			fields := make([]string, 0, len(vdb.h[key]))
+			for field := range vdb.h[key] {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				buf = appendCommandRESP(buf, "HSET", key, field, vdb.h[key][field])
+			}
+		case tZset:
+			for e := vdb.z[key].zsl.Front(); e != nil; e = e.Next() {
+				buf = appendCommandRESP(buf, "ZADD", key, formatScore(e.Score), e.Member)
+			}
+		case tStream:
+			buf = appendStreamCommands(buf, key, vdb.x[key])
+		}
+		if at, ok := vdb.expires[key]; ok {
+			buf = appendCommandRESP(buf, "PEXPIREAT", key, strconv.FormatInt(at, 10))
+		}
+	}
+	return buf, nil
+}
+
+// appendStreamCommands encodes the commands that rebuild the stream st at key
+// with its groups. A stream without entries is made by adding one that is
+// trimmed right away, or when its last id is 0-0 (which XADD cannot use) by
+// creating a group with MKSTREAM that is destroyed again. A pending entry
+// outlives the entry of the stream it was for, so a stand in is added for
+// each deleted entry that is still pending and deleted again once the
+// pending entries are claimed
+func appendStreamCommands(buf []byte, key string, st *stream) []byte {
+	var standIns []streamID
+	seen := make(map[streamID]bool)
+	for _, g := range st.groups {
+		for id := range g.pending {
+			if _, ok := st.entry(id); !ok && !seen[id] {
+				seen[id] = true
+				standIns = append(standIns, id)
+			}
+		}
+	}
+	sort.Slice(standIns, func(i, j int) bool { return standIns[i].less(standIns[j]) })
+
+	switch {
+	case len(st.entries) == 0 && len(standIns) == 0 && st.lastID == (streamID{}):
+		buf = appendCommandRESP(buf, "XGROUP", "CREATE", key, "", "0", "MKSTREAM")
+		buf = appendCommandRESP(buf, "XGROUP", "DESTROY", key, "")
+	case len(st.entries) == 0 && len(standIns) == 0:
+		buf = appendCommandRESP(buf, "XADD", key, "MAXLEN", "0", st.lastID.String(), "", "")
+	default:
+		// the entries and stand ins are added in id order
+		var last streamID
+		entries, rest := st.entries, standIns
+		for len(entries) > 0 || len(rest) > 0 {
+			if len(rest) == 0 || (len(entries) > 0 && entries[0].id.less(rest[0])) {
+				last = entries[0].id
+				buf = appendCommandRESP(buf, append([]string{"XADD", key, last.String()}, entries[0].fields...)...)
+				entries = entries[1:]
+				continue
+			}
+			last = rest[0]
+			buf = appendCommandRESP(buf, "XADD", key, last.String(), "", "")
+			rest = rest[1:]
+		}
+		if last != st.lastID {
+			buf = appendCommandRESP(buf, "XSETID", key, st.lastID.String())
+		}
+	}
+	for _, name := range st.sortedGroups() {
+		g := st.groups[name]
+		buf = appendCommandRESP(buf, "XGROUP", "CREATE", key, name, g.lastID.String())
+		consumers := make([]string, 0, len(g.consumers))
+		for consumer := range g.consumers {
+			consumers = append(consumers, consumer)
+		}
+		sort.Strings(consumers)
+		for _, consumer := range consumers {
+			buf = appendCommandRESP(buf, "XGROUP", "CREATECONSUMER", key, name, consumer)
+		}
+		for _, id := range g.pendingIDs(streamID{}, maxStreamID, "") {
+			buf = appendCommandRESP(buf, groupClaimCommand(key, name, id, g.pending[id])...)
+		}
+	}
+	if len(standIns) > 0 {
+		del := []string{"XDEL", key}
+		for _, id := range standIns {
+			del = append(del, id.String())
+		}
+		buf = appendCommandRESP(buf, del...)
+	}
+	return buf
+}
+
+// logAppendOnly adds a command to the ones the running XREADGROUP, XCLAIM,
+// XAUTOCLAIM or SPOP is logged to the append only file as. What they do
+// depends on the time they run at or on chance, so a replay is given the
+// changes they made instead. Every change logged here has to go with a change
+// to dirty or nothing is written
+func (rs *RedisServer) logAppendOnly(args ...string) {
+	if rs.aof != nil {
+		rs.aofLog = append(rs.aofLog, args)
+	}
+}
+
+// feedAppendOnlyFile logs a write command that changed the dataset of db
+// dbIndex. Commands are logged the way they need to be replayed, so a relative
+// ttl is logged as the absolute time it resolved to. The caller must hold
+// rs.lock
+func (rs *RedisServer) feedAppendOnlyFile(dbIndex int, command string, args []string) {
+	var buf []byte
+	if dbIndex != rs.aofSelectedDB {
+		buf = appendCommandRESP(buf, "SELECT", strconv.Itoa(dbIndex))
+		rs.aofSelectedDB = dbIndex
+	}
+	db := rs.store[dbIndex]
+	switch command {
+	case "EXPIRE", "PEXPIRE", "EXPIREAT":
+		if at, ok := db.expires[args[0]]; ok {
+			buf = appendCommandRESP(buf, "PEXPIREAT", args[0], strconv.FormatInt(at, 10))
+		} else {
+			// the time was already in the past so the key was deleted
+			buf = appendCommandRESP(buf, "DEL", args[0])
+		}
+	case "SETEX":
+		buf = appendCommandRESP(buf, "SET", args[0], args[2])
+		buf = appendCommandRESP(buf, "PEXPIREAT", args[0], strconv.FormatInt(db.expires[args[0]], 10))
+	case "HINCRBYFLOAT":
+		// the float is logged as it was formatted so a replay cannot round
+		// it differently
+		buf = appendCommandRESP(buf, "HSET", args[0], args[1], db.h[args[0]][args[1]])
+	case "XADD":
+		// the id XADD picked is logged so a replay adds the same entry
+		a, _ := parseXaddArgs(args)
+		logged := append([]string{command}, args...)
+		logged[a.idIndex+1] = db.x[args[0]].lastID.String()
+		buf = appendCommandRESP(buf, logged...)
+	case "XREADGROUP", "XCLAIM", "XAUTOCLAIM", "SPOP":
+		// these depend on the time they ran at or on chance, the changes
+		// they made are logged instead
+		for _, logged := range rs.aofLog {
+			buf = appendCommandRESP(buf, logged...)
+		}
+		rs.aofLog = nil
+	case "BLPOP", "BRPOP", "BRPOPLPUSH", "BLMOVE":
+		// the pops were logged as they were served, see servePop
+	case "EVAL", "EVALSHA":
+		// the commands the script called were logged as they ran, see
+		// scriptRun.call
+	case "SNAPSHOT":
+		// a restore depends on what is in the save db, log what it restored
+		for i := range rs.store {
+			if len(args) == 4 && args[3] != strconv.Itoa(i) {
+				continue
+			}
+			buf = appendCommandRESP(buf, "SELECT", strconv.Itoa(i))
+			buf = appendCommandRESP(buf, "FLUSHDB")
+			// a restored db starts out with every key in memory
+			buf, _ = appendDBCommands(buf, i, rs.store[i], nil)
+		}
+		rs.aofSelectedDB = -1
+	default:
+		buf = appendCommandRESP(buf, append([]string{command}, args...)...)
+	}
+	rs.writeAppendOnlyFile(buf)
+}
+
+// writeAppendOnlyFile appends buf to the append only file, and to the rewrite
+// buffer while a rewrite is running. The caller must hold rs.lock
+func (rs *RedisServer) writeAppendOnlyFile(buf []byte) {
+	if atomic.LoadInt32(&rs.aofRewriteInProgress) == 1 {
+		rs.aofRewriteBuf = append(rs.aofRewriteBuf, buf...)
+	}
+	_, err := rs.aof.Write(buf)
+	if err == nil && rs.config.appendFsync == fsyncAlways {
+		err = rs.aof.Sync()
+	}
+	if err != nil {
+		serverLog(logWarning, "Failed to Write Append Only File: %v\n", err)
+		rs.aofLastWriteStatus = "err"
+		return
+	}
+	rs.aofLastWriteStatus = "ok"
+}
+
+// openAppendOnlyFile starts appending write commands to the append only file
+// as it is. The caller must hold rs.lock
+func (rs *RedisServer) openAppendOnlyFile() error {
+	f, err := os.OpenFile(appendOnlyFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	rs.aof = f
+	// the file may end in any db so the next command selects its own
+	rs.aofSelectedDB = -1
+	rs.aofLog = nil
+	return nil
+}
+
+// startAppendOnly writes the dataset to a new append only file and then
+// starts appending write commands to it. The caller must hold rs.lock
+func (rs *RedisServer) startAppendOnly() error {
+	if err := writeAppendOnlyFileFrom(appendOnlyFile, rs.store, rs.tier, nil); err != nil {
+		return err
+	}
+	return rs.openAppendOnlyFile()
+}
+
+// stopAppendOnly syncs and closes the append only file. The caller must hold
+// rs.lock
+func (rs *RedisServer) stopAppendOnly() error {
+	if rs.aof == nil {
+		return nil
+	}
+	err := rs.aof.Sync()
+	if cerr := rs.aof.Close(); err == nil {
+		err = cerr
+	}
+	rs.aof = nil
+	return err
+}
+
+// writeAppendOnlyFileFrom writes the commands that rebuild store (with the
+// values of cold keys read from t), followed by tail, to a temp file and then
+// moves it over path, so path always holds a complete log
+func writeAppendOnlyFileFrom(path string, store []*DB, t *tier, tail []byte) error {
+	tmp := fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for i, db := range store {
+		var buf []byte
+		if buf, err = appendDBCommands(nil, i, db, t); err != nil {
+			break
+		}
+		if _, err = w.Write(buf); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = w.Write(tail)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// bgrewriteAppendOnlyFile compacts the append only file in the background
+// from a copy of the dataset. Writes made while it runs are kept in the
+// rewrite buffer and added to the end of the new file before it replaces the
+// old one. The caller must hold rs.lock
+func (rs *RedisServer) bgrewriteAppendOnlyFile() error {
+	if !atomic.CompareAndSwapInt32(&rs.aofRewriteInProgress, 0, 1) {
+		return errAOFRewriteInProgress
+	}
+	store, t := rs.frozenStore(), rs.tier
+	rs.aofRewriteBuf = make([]byte, 0)
+	// the rewrite buffer must start by selecting its db
+	rs.aofSelectedDB = -1
+	go func() {
+		// the frozen copy is written under a temp name first which keeps
+		// the lock free for clients, then the buffer is added under the lock
+		tmp := fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid())
+		err := writeAppendOnlyFileFrom(tmp, store, t, nil)
+		rs.lock.Lock()
+		if err == nil {
+			err = rs.finishAppendOnlyFileRewrite(tmp)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			serverLog(logWarning, "Failed to Rewrite Append Only File: %v\n", err)
+			rs.aofLastRewriteStatus = "err"
+		} else {
+			rs.aofLastRewriteStatus = "ok"
+		}
+		rs.aofRewriteBuf = nil
+		atomic.StoreInt32(&rs.aofRewriteInProgress, 0)
+		rs.lock.Unlock()
+	}()
+	return nil
+}
+
+// finishAppendOnlyFileRewrite adds the rewrite buffer to the end of the
+// rewritten file at tmp and swaps it in. The caller must hold rs.lock
+func (rs *RedisServer) finishAppendOnlyFileRewrite(tmp string) error {
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(rs.aofRewriteBuf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, appendOnlyFile); err != nil {
+		return err
+	}
+	if rs.aof == nil {
+		return nil
+	}
+	// the old file was replaced so keep appending to the new one
+	rs.aof.Close()
+	f, err = os.OpenFile(appendOnlyFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		rs.aof = nil
+		return err
+	}
+	rs.aof = f
+	return nil
+}
+
+// aofFsyncCycle is the background job that syncs the append only file once a
+// second when appendfsync is everysec
+func (rs *RedisServer) aofFsyncCycle() {
+	ticker := time.NewTicker(aofFsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+		}
+		rs.lock.Lock()
+		f := rs.aof
+		policy := rs.config.appendFsync
+		rs.lock.Unlock()
+		if f == nil || policy != fsyncEverysec {
+			continue
+		}
+		// the sync runs without the lock, the file may have been closed since
+		if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			serverLog(logWarning, "Failed to Sync Append Only File: %v\n", err)
+		}
+	}
+}
+
+// nopConn is the connection of the client that replays the append only file.
+// Replies to it are thrown away
+type nopConn struct{}
+
+func (nopConn) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (nopConn) Write(p []byte) (int, error) { return len(p), nil }
+func (nopConn) Close() error                { return nil }
+
+// loadAppendOnlyFile replays every command in the append only file. A log
+// that ends part way through a command (like after a crash) is truncated to
+// its last complete command, and one that ends inside a transaction is
+// truncated to before its MULTI so the commands appended later are not
+// queued by the next replay
+func (rs *RedisServer) loadAppendOnlyFile() error {
+	f, err := os.Open(appendOnlyFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	cr := &countingReader{r: f}
+	r := bufio.NewReader(cr)
+	cl := NewRedisClient(-1, nopConn{})
+	var valid int64
+	// multiAt is the offset of the MULTI of the transaction being read, -1
+	// outside of one
+	multiAt := int64(-1)
+	commands := 0
+	for {
+		commandAndArgs, err := readCommand(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// only a broken command at the very end is a truncated log
+			if _, peekErr := r.Peek(1); peekErr != io.EOF {
+				return fmt.Errorf("bad format of append only file at offset %d: %v", valid, err)
+			}
+			break
+		}
+		start := valid
+		valid = cr.n - int64(r.Buffered())
+		if len(commandAndArgs) == 0 {
+			continue
+		}
+		command := strings.ToUpper(commandAndArgs[0])
+		switch command {
+		case "MULTI":
+			multiAt = start
+		case "EXEC", "DISCARD":
+			multiAt = -1
+		}
+		rs.ExecuteCommand(cl, command, commandAndArgs[1:])
+		commands++
+	}
+	if multiAt != -1 {
+		// the queued commands of the replay client are dropped with it
+		valid = multiAt
+	}
+	if valid < cr.n {
+		serverLog(logWarning, "Append Only File is truncated, discarding the last %d bytes", cr.n-valid)
+		if err := os.Truncate(appendOnlyFile, valid); err != nil {
+			return err
+		}
+	}
+	serverLog(logNotice, "Loaded %d commands from the Append Only File in %v", commands, time.Since(start))
+	return nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Commands Operating on the Append Only File
+
+func bgrewriteaofCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if err := rs.bgrewriteAppendOnlyFile(); err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	return replySimpleString(cl.conn, "Background append only file rewriting started")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// autoSaveInterval is how often the save rules are checked
+	autoSaveInterval = 100 * time.Millisecond
+	// autoSaveRetryDelay is how many seconds to wait after a failed save before
+	// the save rules may start another one
+	autoSaveRetryDelay = 5
+)
+
+// saveRule is met once at least changes writes were made and seconds have
+// passed since the last save, like "save 900 1" in redis.conf
+type saveRule struct {
+	seconds int64
+	changes uint64
+}
+
+// parseSaveRules parses pairs of seconds and changes such as "900 1 60 10000".
+// An empty string removes every rule
+func parseSaveRules(val string) ([]saveRule, error) {
+	fields := strings.Fields(val)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("save rules must be pairs of seconds and changes")
+	}
+	rules := make([]saveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("save seconds must be a non negative integer")
+		}
+		changes, err := strconv.ParseUint(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("save changes must be a non negative integer")
+		}
+		rules = append(rules, saveRule{seconds: seconds, changes: changes})
+	}
+	return rules, nil
+}
+
+func formatSaveRules(rules []saveRule) string {
+	fields := make([]string, 0, len(rules)*2)
+	for _, rule := range rules {
+		fields = append(fields, strconv.FormatInt(rule.seconds, 10), strconv.FormatUint(rule.changes, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+// dueSaveRule returns the first save rule that is met at now (a unix time).
+// The caller must hold rs.lock
+func (rs *RedisServer) dueSaveRule(now int64) (saveRule, bool) {
+	if atomic.LoadInt32(&rs.bgsaveInProgress) == 1 {
+		return saveRule{}, false
+	}
+	// do not hammer a save db that just failed
+	if rs.lastBgsaveStatus.Load() == "err" && now-rs.lastBgsaveTry < autoSaveRetryDelay {
+		return saveRule{}, false
+	}
+	since := atomic.LoadInt64(&rs.lastsave)
+	if since < rs.timeStarted {
+		since = rs.timeStarted
+	}
+	for _, rule := range rs.config.saveRules {
+		if rs.dirty >= rule.changes && now-since >= rule.seconds {
+			return rule, true
+		}
+	}
+	return saveRule{}, false
+}
+
+// autoSaveCycle is the background job that starts a BGSAVE whenever one of
+// the save rules is met
+func (rs *RedisServer) autoSaveCycle() {
+	ticker := time.NewTicker(autoSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+		}
+		rs.lock.Lock()
+		if rule, ok := rs.dueSaveRule(time.Now().Unix()); ok {
+			serverLog(logNotice, "%d changes in %d seconds. Saving...", rule.changes, rule.seconds)
+			if err := rs.bgsave(); err != nil {
+				serverLog(logWarning, "Failed to Start Background Save: %v\n", err)
+			}
+		}
+		rs.lock.Unlock()
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Clients block on keys in one of two ways. XREAD and XREADGROUP are woken
+// when a key they wait on changes and look at it again themselves. The list
+// pops (BLPOP, BRPOP, BRPOPLPUSH and BLMOVE) are served instead: whichever
+// client adds to a list they wait on pops for them, in the order they
+// blocked, before its command returns, so a waiting client can not lose the
+// element to one that did not wait
+
+var (
+	errTimeoutNotFloat = errors.New("ERR timeout is not a float or out of range")
+	errTimeoutNegative = errors.New("ERR timeout is negative")
+)
+
+// blockKey is a key of one db that clients can wait on
+type blockKey struct {
+	dbIndex int
+	key     string
+}
+
+// blockedPop is the pop a client blocked by a list pop is waiting to have
+// served
+type blockedPop struct {
+	// left pops from the head of the list rather than the tail
+	left bool
+	// move pushes the element onto dst (onto its head with dstLeft) as
+	// BRPOPLPUSH and BLMOVE do
+	move    bool
+	dst     string
+	dstLeft bool
+
+	// served is set along with the key and value that were popped once the
+	// pop was served. err is set instead when dst no longer holds a list
+	served   bool
+	key, val string
+	err      error
+}
+
+// parseBlockTimeout parses the timeout of a blocking list pop in seconds into
+// the deadline blockClient takes. A timeout of 0 never times out
+func parseBlockTimeout(s string) (time.Time, error) {
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return time.Time{}, errTimeoutNotFloat
+	}
+	if secs < 0 {
+		return time.Time{}, errTimeoutNegative
+	}
+	if secs == 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(time.Duration(secs * float64(time.Second))), nil
+}
+
+// readDeadliner is a connection whose reads can be interrupted, a blocked
+// client is only watched for disconnecting when its connection is one
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// watchDisconnect watches the connection of the blocked client cl and
+// unblocks it, marked as closed, if the connection is closed so it is not
+// served a pop nobody will read. A command sent while blocked is left to be
+// read once the client is done. The returned func stops the watch, it has to
+// be called without holding rs.lock
+func (rs *RedisServer) watchDisconnect(cl *RedisClient) func() {
+	c := cl.conn
+	if h, ok := c.(*heldConn); ok {
+		c = h.ReadWriteCloser
+	}
+	conn, ok := c.(readDeadliner)
+	if !ok {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := cl.r.Peek(1)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err != nil {
+			rs.lock.Lock()
+			cl.flags |= flagClosed
+			rs.unblockClient(cl)
+			rs.lock.Unlock()
+		}
+	}()
+	return func() {
+		close(stop)
+		// interrupt the read and wait for the watch to be done with the
+		// reader before it is used again
+		conn.SetReadDeadline(time.Now())
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// blockClient waits for one of keys of the clients db to be modified and
+// reports whether one was. It gives up at deadline (never when it is zero),
+// when the client disconnects or when the server shuts down. The server lock
+// is released while waiting so other clients can write, the caller must hold
+// rs.lock and holds it again when blockClient returns. A client blocked by a
+// list pop sets cl.pop first and looks at it afterwards to see whether the
+// pop was served. Inside EXEC or a script it never blocks
+func (rs *RedisServer) blockClient(cl *RedisClient, keys []string, deadline time.Time) bool {
+	// a transaction or a script can not let go of the lock, it is run as if
+	// it timed out
+	if cl.hasFlag(flagMulti | flagScript) {
+		return false
+	}
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return false
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for _, key := range keys {
+		k := blockKey{cl.db, key}
+		rs.blockedClients[k] = append(rs.blockedClients[k], cl)
+		cl.blockedOn = append(cl.blockedOn, k)
+	}
+	// a wake up left over from an earlier wait is not for this one
+	select {
+	case <-cl.unblocked:
+	default:
+	}
+
+	rs.lock.Unlock()
+	stopWatch := rs.watchDisconnect(cl)
+	woken := false
+	select {
+	case <-cl.unblocked:
+		woken = true
+	case <-timeout:
+	case <-rs.done:
+	}
+	stopWatch()
+	rs.lock.Lock()
+
+	rs.unblockClient(cl)
+	return woken && !cl.hasFlag(flagClosed)
+}
+
+// unblockClient takes cl out of the clients blocked on keys and wakes it. The
+// caller must hold rs.lock
+func (rs *RedisServer) unblockClient(cl *RedisClient) {
+	if len(cl.blockedOn) == 0 {
+		return
+	}
+	for _, k := range cl.blockedOn {
+		waiting := rs.blockedClients[k]
+		for i, other := range waiting {
+			if other == cl {
+				waiting = append(waiting[:i], waiting[i+1:]...)
+				break
+			}
+		}
+		if len(waiting) == 0 {
+			delete(rs.blockedClients, k)
+		} else {
+			rs.blockedClients[k] = waiting
+		}
+	}
+	cl.blockedOn = nil
+	select {
+	case cl.unblocked <- struct{}{}:
+	default:
+	}
+}
+
+// signalKeyAsReady wakes the clients blocked on key of db dbIndex so they
+// check the key again themselves, and queues the key to serve the list pops
+// blocked on it
+func (rs *RedisServer) signalKeyAsReady(dbIndex int, key string) {
+	k := blockKey{dbIndex, key}
+	pops := false
+	for _, cl := range rs.blockedClients[k] {
+		if cl.pop != nil {
+			pops = true
+			continue
+		}
+		select {
+		case cl.unblocked <- struct{}{}:
+		default:
+		}
+	}
+	if !pops {
+		return
+	}
+	for _, ready := range rs.readyKeys {
+		if ready == k {
+			return
+		}
+	}
+	rs.readyKeys = append(rs.readyKeys, k)
+}
+
+// signalDBAsReady wakes every client blocked on a key of db dbIndex
+func (rs *RedisServer) signalDBAsReady(dbIndex int) {
+	for k := range rs.blockedClients {
+		if k.dbIndex == dbIndex {
+			rs.signalKeyAsReady(k.dbIndex, k.key)
+		}
+	}
+}
+
+// servePop pops an element off the list at key for p, pushing it onto p.dst
+// for a move, and returns it. It is logged to the append only file as the
+// LPOP or RPOP (and LPUSH or RPUSH) it was so a replay never blocks
+func (rs *RedisServer) servePop(dbIndex int, key string, p *blockedPop) string {
+	db := rs.store[dbIndex]
+	pop, val := "RPOP", ""
+	if p.left {
+		pop, val = "LPOP", rs.lpop(db, key)
+	} else {
+		val = rs.rpop(db, key)
+	}
+	if rs.aof != nil {
+		rs.feedAppendOnlyFile(dbIndex, pop, []string{key})
+	}
+	if !p.move {
+		return val
+	}
+	push := "RPUSH"
+	if p.dstLeft {
+		push = "LPUSH"
+		rs.lpush(db, p.dst, val)
+	} else {
+		rs.rpush(db, p.dst, val)
+	}
+	if rs.aof != nil {
+		rs.feedAppendOnlyFile(dbIndex, push, []string{p.dst, val})
+	}
+	return val
+}
+
+// serveBlockedPops serves the list pops blocked on the keys that were
+// signalled as ready, in the order the clients blocked. It runs after every
+// command, a pop that pushes onto a list another client waits on serves that
+// client too. The caller must hold rs.lock
+func (rs *RedisServer) serveBlockedPops() {
+	for len(rs.readyKeys) > 0 {
+		ready := rs.readyKeys
+		rs.readyKeys = nil
+		for _, k := range ready {
+			rs.serveBlockedPopsOn(k)
+		}
+	}
+}
+
+func (rs *RedisServer) serveBlockedPopsOn(k blockKey) {
+	db := rs.store[k.dbIndex]
+	// serving a client takes it out of the waiting clients
+	waiting := append([]*RedisClient(nil), rs.blockedClients[k]...)
+	for _, cl := range waiting {
+		p := cl.pop
+		if p == nil {
+			continue
+		}
+		rs.expireIfNeeded(db, k.key)
+		if l, ok := db.ll[k.key]; !ok || l.Len() == 0 {
+			return
+		}
+		if p.move {
+			if err := rs.prepareKeys(cl, []string{p.dst}, tList); err != nil {
+				p.err = err
+				rs.unblockClient(cl)
+				continue
+			}
+		}
+		p.key, p.val, p.served = k.key, rs.servePop(k.dbIndex, k.key, p), true
+		rs.unblockClient(cl)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// clientFlag holds the state bits of a connected client
+type clientFlag uint32
+
+const (
+	// flagClosed is set once the client has sent QUIT or the server closed it
+	flagClosed clientFlag = 1 << iota
+	// flagMulti is set while the client is in a transaction and
+	// flagMultiError once a command of the transaction could not be queued
+	flagMulti
+	flagMultiError
+	// flagScript is set on the client a script calls commands as
+	flagScript
+)
+
+// RedisClient is the server side object for a single connection. Anything
+// that is scoped to a connection (rather than the whole server) lives here,
+// such as the currently selected database
+type RedisClient struct {
+	id   int
+	conn io.ReadWriteCloser
+	// r is kept for the life of the connection so that buffered bytes from
+	// pipelined requests are not thrown away between commands
+	r *bufio.Reader
+
+	// db is the index into the server store that this client has selected
+	db   int
+	name string
+
+	createdAt int64
+	// lastCmdAt is the unix time of the last command, it is read by the
+	// idle timeout job so it is only accessed atomically
+	lastCmdAt int64
+
+	flags clientFlag
+
+	// channels and patterns are the pub/sub subscriptions of the client, while
+	// it has any it may only send the subscriberCommands
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	// blockedOn holds the keys the client is waiting on while a blocking
+	// command has it blocked and unblocked is sent to when one of them changes.
+	// pop is the list pop it waits to have served while it is blocked by one
+	blockedOn []blockKey
+	unblocked chan struct{}
+	pop       *blockedPop
+
+	// queued holds the commands of the transaction the client is in and
+	// watched the version each key it watches had when it was watched
+	queued  []queuedCommand
+	watched map[blockKey]uint64
+}
+
+// NewRedisClient returns a pointer to a RedisClient for the connection with
+// database 0 selected
+func NewRedisClient(id int, conn io.ReadWriteCloser) *RedisClient {
+	now := time.Now().Unix()
+	return &RedisClient{
+		id:        id,
+		conn:      conn,
+		r:         bufio.NewReader(conn),
+		db:        0,
+		createdAt: now,
+		lastCmdAt: now,
+		channels:  make(map[string]struct{}),
+		patterns:  make(map[string]struct{}),
+		unblocked: make(chan struct{}, 1),
+		watched:   make(map[blockKey]uint64),
+	}
+}
+
+func (cl *RedisClient) hasFlag(f clientFlag) bool {
+	return cl.flags&f != 0
+}
+
+// close shuts the connection down and marks the client as closed
+func (cl *RedisClient) close() error {
+	cl.flags |= flagClosed
+	return cl.conn.Close()
+}
+
+// clientTimeoutInterval is how often idle clients are looked for
+const clientTimeoutInterval = 100 * time.Millisecond
+
+// clientTimeoutCycle is the background job that closes clients which sent no
+// command for longer than the timeout option
+func (rs *RedisServer) clientTimeoutCycle() {
+	ticker := time.NewTicker(clientTimeoutInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+		}
+		rs.lock.Lock()
+		if rs.config.timeout > 0 {
+			now := time.Now().Unix()
+			for _, cl := range rs.clients {
+				// subscribers and blocked clients are waiting rather than
+				// idle so they never time out
+				if cl.subscriptions() == 0 && len(cl.blockedOn) == 0 && now-atomic.LoadInt64(&cl.lastCmdAt) > rs.config.timeout {
+					// the read of the clients goroutine fails and it
+					// removes the client
+					cl.conn.Close()
+				}
+			}
+		}
+		rs.lock.Unlock()
+	}
+}
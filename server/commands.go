@@ -0,0 +1,1110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// cmdFlag describes how a command behaves so the dispatcher (and anything
+// built on top of the command table) does not need to know about each command
+type cmdFlag uint32
+
+const (
+	// cmdWrite commands may modify the dataset
+	cmdWrite cmdFlag = 1 << iota
+	// cmdReadOnly commands only read from the dataset
+	cmdReadOnly
+	// cmdAdmin commands operate on the server rather than on keys
+	cmdAdmin
+	// cmdBlocking commands may block the client waiting on other clients
+	cmdBlocking
+	// cmdPubSub commands are related to publish/subscribe messaging
+	cmdPubSub
+	// cmdNoScript commands can not be called from scripts
+	cmdNoScript
+	// cmdNoMulti commands can not be queued in a transaction
+	cmdNoMulti
+)
+
+// commandProc performs a command for a client and writes the reply to it.
+// It returns false when the client can no longer be served
+type commandProc func(rs *RedisServer, cl *RedisClient, args []string) bool
+
+// redisCommand is a single entry of the command table
+type redisCommand struct {
+	name string
+	// arity is the number of arguments including the command name itself.
+	// A negative arity means at least -arity arguments
+	arity int
+	flags cmdFlag
+	// firstKey, lastKey and keyStep are the positions of the keys in the
+	// arguments where the command name is position 0. A lastKey of -1 means
+	// the last argument and a firstKey of 0 means the command takes no keys
+	firstKey, lastKey, keyStep int
+	// keyType is the type every existing key of the command must hold or
+	// a wrongtype error is returned. An empty keyType skips the check
+	keyType dbTyp
+	proc    commandProc
+}
+
+// commandTable maps the upper cased command name to its command
+var commandTable map[string]*redisCommand
+
+func init() {
+	commands := []*redisCommand{
+		// Connection and Server Commands
+		{name: "PING", arity: -1, proc: pingCommand},
+		{name: "QUIT", arity: 1, flags: cmdNoScript, proc: quitCommand},
+		{name: "INFO", arity: 1, flags: cmdAdmin, proc: infoCommand},
+		{name: "CLIENT", arity: -2, flags: cmdAdmin | cmdNoScript, proc: clientCommand},
+		// Persistent Control Commands
+		{name: "SAVE", arity: 1, flags: cmdAdmin | cmdNoScript, proc: saveCommand},
+		{name: "BGSAVE", arity: 1, flags: cmdAdmin | cmdNoScript, proc: bgsaveCommand},
+		{name: "LASTSAVE", arity: 1, flags: cmdAdmin, proc: lastsaveCommand},
+		{name: "BGREWRITEAOF", arity: 1, flags: cmdAdmin | cmdNoScript, proc: bgrewriteaofCommand},
+		{name: "CONFIG", arity: -2, flags: cmdAdmin | cmdNoScript, proc: configCommand},
+		{name: "SNAPSHOT", arity: -2, flags: cmdAdmin | cmdWrite | cmdNoScript, proc: snapshotCommand},
+		{name: "SHUTDOWN", arity: 1, flags: cmdAdmin | cmdNoScript | cmdNoMulti, proc: shutdownCommand},
+		// Commands Operating on Transactions
+		{name: "MULTI", arity: 1, flags: cmdNoScript, proc: multiCommand},
+		{name: "EXEC", arity: 1, flags: cmdNoScript, proc: execCommand},
+		{name: "DISCARD", arity: 1, flags: cmdNoScript, proc: discardCommand},
+		{name: "WATCH", arity: -2, flags: cmdNoScript, firstKey: 1, lastKey: -1, keyStep: 1, proc: watchCommand},
+		{name: "UNWATCH", arity: 1, flags: cmdNoScript, proc: unwatchCommand},
+		// Commands Operating on Scripts, the keys of a script follow its count
+		// and the commands it calls look them up themselves
+		{name: "EVAL", arity: -3, flags: cmdWrite | cmdNoScript, proc: evalCommand},
+		{name: "EVALSHA", arity: -3, flags: cmdWrite | cmdNoScript, proc: evalshaCommand},
+		{name: "SCRIPT", arity: -2, flags: cmdAdmin | cmdNoScript, proc: scriptCommand},
+		// Commands Operating on Key Space
+		{name: "KEYS", arity: 2, flags: cmdReadOnly, proc: keysCommand},
+		{name: "RANDOMKEY", arity: 1, flags: cmdReadOnly, proc: randomkeyCommand},
+		{name: "RENAME", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 2, keyStep: 1, proc: renameCommand},
+		{name: "RENAMENX", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 2, keyStep: 1, proc: renamenxCommand},
+		{name: "DBSIZE", arity: 1, flags: cmdReadOnly, proc: dbsizeCommand},
+		{name: "EXISTS", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, proc: existsCommand},
+		{name: "DEL", arity: 2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: delCommand},
+		{name: "TYPE", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, proc: typeCommand},
+		// Commands Operating on DB
+		{name: "SELECT", arity: 2, proc: selectCommand},
+		{name: "MOVE", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: moveCommand},
+		{name: "FLUSHDB", arity: 1, flags: cmdWrite, proc: flushdbCommand},
+		{name: "FLUSHALL", arity: 1, flags: cmdWrite, proc: flushallCommand},
+		// Commands Operating on Strings
+		{name: "SET", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: setCommand},
+		{name: "SETNX", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: setnxCommand},
+		{name: "SETEX", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: setexCommand},
+		{name: "GET", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tString, proc: getCommand},
+		{name: "INCR", arity: 2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tString, proc: incrCommand},
+		{name: "INCRBY", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tString, proc: incrbyCommand},
+		{name: "DECR", arity: 2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tString, proc: decrCommand},
+		{name: "DECRBY", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tString, proc: decrbyCommand},
+		// Commands Operating on Lists
+		{name: "LPUSH", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tList, proc: lpushCommand},
+		{name: "RPUSH", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tList, proc: rpushCommand},
+		{name: "LLEN", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tList, proc: llenCommand},
+		{name: "LRANGE", arity: 4, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tList, proc: lrangeCommand},
+		{name: "LINDEX", arity: 3, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tList, proc: lindexCommand},
+		{name: "LPOP", arity: 2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tList, proc: lpopCommand},
+		{name: "RPOP", arity: 2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tList, proc: rpopCommand},
+		{name: "BLPOP", arity: -3, flags: cmdWrite | cmdBlocking, firstKey: 1, lastKey: -2, keyStep: 1, keyType: tList, proc: blpopCommand},
+		{name: "BRPOP", arity: -3, flags: cmdWrite | cmdBlocking, firstKey: 1, lastKey: -2, keyStep: 1, keyType: tList, proc: brpopCommand},
+		{name: "BRPOPLPUSH", arity: 4, flags: cmdWrite | cmdBlocking, firstKey: 1, lastKey: 2, keyStep: 1, keyType: tList, proc: brpoplpushCommand},
+		{name: "BLMOVE", arity: 6, flags: cmdWrite | cmdBlocking, firstKey: 1, lastKey: 2, keyStep: 1, keyType: tList, proc: blmoveCommand},
+		{name: "LTRIM", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tList, proc: ltrimCommand},
+		{name: "LSET", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tList, proc: lsetCommand},
+		// LREM keeps the 1.0 behaviour of replying -2 on the wrong type
+		{name: "LREM", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: lremCommand},
+		// Commands Operating on Sets
+		// SADD, SREM, SCARD, SISMEMBER and SMEMBERS keep the 1.0 behaviour
+		// for the wrong type so they do not declare a keyType
+		{name: "SADD", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: saddCommand},
+		{name: "SREM", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: sremCommand},
+		{name: "SCARD", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, proc: scardCommand},
+		{name: "SISMEMBER", arity: 3, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, proc: sismemberCommand},
+		{name: "SMISMEMBER", arity: -3, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tSet, proc: smismemberCommand},
+		{name: "SINTER", arity: -2, flags: cmdReadOnly, firstKey: 1, lastKey: -1, keyStep: 1, keyType: tSet, proc: sinterCommand},
+		{name: "SINTERSTORE", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: -1, keyStep: 1, keyType: tSet, proc: sinterstoreCommand},
+		// the keys of SINTERCARD follow its count so it looks them up itself
+		{name: "SINTERCARD", arity: -3, flags: cmdReadOnly, proc: sintercardCommand},
+		{name: "SUNION", arity: -2, flags: cmdReadOnly, firstKey: 1, lastKey: -1, keyStep: 1, keyType: tSet, proc: sunionCommand},
+		{name: "SUNIONSTORE", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: -1, keyStep: 1, keyType: tSet, proc: sunionstoreCommand},
+		{name: "SDIFF", arity: -2, flags: cmdReadOnly, firstKey: 1, lastKey: -1, keyStep: 1, keyType: tSet, proc: sdiffCommand},
+		{name: "SDIFFSTORE", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: -1, keyStep: 1, keyType: tSet, proc: sdiffstoreCommand},
+		{name: "SMOVE", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 2, keyStep: 1, keyType: tSet, proc: smoveCommand},
+		{name: "SPOP", arity: -2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tSet, proc: spopCommand},
+		{name: "SRANDMEMBER", arity: -2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tSet, proc: srandmemberCommand},
+		{name: "SMEMBERS", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, proc: smembersCommand},
+		// Commands Operating on Expiration
+		{name: "EXPIRE", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: expireCommand},
+		{name: "EXPIREAT", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: expireatCommand},
+		{name: "PEXPIRE", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: pexpireCommand},
+		{name: "PEXPIREAT", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: pexpireatCommand},
+		{name: "TTL", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, proc: ttlCommand},
+		{name: "PTTL", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, proc: pttlCommand},
+		{name: "PERSIST", arity: 2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: persistCommand},
+		// Commands Operating on Past Snapshots
+		// the key belongs to a snapshot rather than the in memory db so no key
+		// positions are declared (they would expire and type check live keys)
+		{name: "GETAT", arity: 3, flags: cmdReadOnly, proc: getatCommand},
+		{name: "TYPEAT", arity: 3, flags: cmdReadOnly, proc: typeatCommand},
+		{name: "LRANGEAT", arity: 5, flags: cmdReadOnly, proc: lrangeatCommand},
+		{name: "SMEMBERSAT", arity: 3, flags: cmdReadOnly, proc: smembersatCommand},
+		// Commands Operating on Hashes
+		{name: "HSET", arity: -4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hsetCommand},
+		{name: "HMSET", arity: -4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hmsetCommand},
+		{name: "HSETNX", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hsetnxCommand},
+		{name: "HGET", arity: 3, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hgetCommand},
+		{name: "HMGET", arity: -3, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hmgetCommand},
+		{name: "HGETALL", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hgetallCommand},
+		{name: "HDEL", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hdelCommand},
+		{name: "HEXISTS", arity: 3, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hexistsCommand},
+		{name: "HLEN", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hlenCommand},
+		{name: "HKEYS", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hkeysCommand},
+		{name: "HVALS", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hvalsCommand},
+		{name: "HINCRBY", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hincrbyCommand},
+		{name: "HINCRBYFLOAT", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hincrbyfloatCommand},
+		{name: "HSTRLEN", arity: 3, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tHash, proc: hstrlenCommand},
+		// Commands Operating on Sorted Sets
+		{name: "ZADD", arity: -4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zaddCommand},
+		{name: "ZINCRBY", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zincrbyCommand},
+		{name: "ZREM", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zremCommand},
+		{name: "ZSCORE", arity: 3, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zscoreCommand},
+		{name: "ZCARD", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zcardCommand},
+		{name: "ZCOUNT", arity: 4, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zcountCommand},
+		{name: "ZRANK", arity: 3, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zrankCommand},
+		{name: "ZREVRANK", arity: 3, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zrevrankCommand},
+		{name: "ZRANGE", arity: -4, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zrangeCommand},
+		{name: "ZRANGEBYSCORE", arity: -4, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zrangebyscoreCommand},
+		{name: "ZREMRANGEBYSCORE", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zremrangebyscoreCommand},
+		{name: "ZREMRANGEBYRANK", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zremrangebyrankCommand},
+		{name: "ZREMRANGEBYLEX", arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zremrangebylexCommand},
+		{name: "ZPOPMIN", arity: -2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zpopminCommand},
+		{name: "ZPOPMAX", arity: -2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tZset, proc: zpopmaxCommand},
+		// the sources of ZUNIONSTORE and ZINTERSTORE follow their count and may
+		// be sets as well so they look their keys up themselves
+		{name: "ZUNIONSTORE", arity: -4, flags: cmdWrite, proc: zunionstoreCommand},
+		{name: "ZINTERSTORE", arity: -4, flags: cmdWrite, proc: zinterstoreCommand},
+		// Commands Operating on Pub/Sub
+		{name: "SUBSCRIBE", arity: -2, flags: cmdPubSub | cmdNoScript, proc: subscribeCommand},
+		{name: "UNSUBSCRIBE", arity: -1, flags: cmdPubSub | cmdNoScript, proc: unsubscribeCommand},
+		{name: "PSUBSCRIBE", arity: -2, flags: cmdPubSub | cmdNoScript, proc: psubscribeCommand},
+		{name: "PUNSUBSCRIBE", arity: -1, flags: cmdPubSub | cmdNoScript, proc: punsubscribeCommand},
+		{name: "PUBLISH", arity: 3, flags: cmdPubSub, proc: publishCommand},
+		{name: "PUBSUB", arity: -2, flags: cmdPubSub, proc: pubsubCommand},
+		// Commands Operating on Streams
+		{name: "XADD", arity: -5, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tStream, proc: xaddCommand},
+		{name: "XLEN", arity: 2, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tStream, proc: xlenCommand},
+		{name: "XRANGE", arity: -4, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tStream, proc: xrangeCommand},
+		{name: "XREVRANGE", arity: -4, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tStream, proc: xrevrangeCommand},
+		{name: "XDEL", arity: -3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tStream, proc: xdelCommand},
+		{name: "XTRIM", arity: -4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tStream, proc: xtrimCommand},
+		{name: "XSETID", arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tStream, proc: xsetidCommand},
+		// the keys of XREAD follow its options so it looks them up itself
+		{name: "XREAD", arity: -4, flags: cmdReadOnly | cmdBlocking, proc: xreadCommand},
+		// Commands Operating on Stream Consumer Groups
+		{name: "XGROUP", arity: -4, flags: cmdWrite, firstKey: 2, lastKey: 2, keyStep: 1, keyType: tStream, proc: xgroupCommand},
+		// XREADGROUP looks its keys up itself like XREAD
+		{name: "XREADGROUP", arity: -7, flags: cmdWrite | cmdBlocking, proc: xreadgroupCommand},
+		{name: "XACK", arity: -4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tStream, proc: xackCommand},
+		{name: "XPENDING", arity: -3, flags: cmdReadOnly, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tStream, proc: xpendingCommand},
+		{name: "XCLAIM", arity: -6, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tStream, proc: xclaimCommand},
+		{name: "XAUTOCLAIM", arity: -6, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, keyType: tStream, proc: xautoclaimCommand},
+		{name: "XINFO", arity: -3, flags: cmdReadOnly, firstKey: 2, lastKey: 2, keyStep: 1, keyType: tStream, proc: xinfoCommand},
+	}
+
+	commandTable = make(map[string]*redisCommand, len(commands))
+	for _, cmd := range commands {
+		commandTable[cmd.name] = cmd
+	}
+}
+
+// checkArity reports whether argc (which includes the command name) is a
+// valid number of arguments for the command
+func (cmd *redisCommand) checkArity(argc int) bool {
+	if cmd.arity < 0 {
+		return argc >= -cmd.arity
+	}
+	return argc == cmd.arity
+}
+
+// keys returns the keys of the command found in args (which does not include
+// the command name)
+func (cmd *redisCommand) keys(args []string) []string {
+	if cmd.firstKey == 0 {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last = len(args) + 1 + last
+	}
+	keys := make([]string, 0, 1)
+	for i := cmd.firstKey; i <= last && i <= len(args); i += cmd.keyStep {
+		keys = append(keys, args[i-1])
+	}
+	return keys
+}
+
+func (cmd *redisCommand) hasFlag(f cmdFlag) bool {
+	return cmd.flags&f != 0
+}
+
+// Connection and Server Commands
+
+func pingCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	if cl.subscriptions() > 0 && len(args) <= 1 {
+		// a subscribed client can only be sent pushes
+		msg := ""
+		if len(args) == 1 {
+			msg = args[0]
+		}
+		return replyMultiBulkString(c, []string{"pong", msg})
+	}
+	if len(args) == 0 {
+		return replySimpleString(c, "PONG")
+	}
+	if len(args) == 1 {
+		return replySimpleString(c, args[0])
+	}
+	return replyInvalidNumberOfArgsError(c, "PING")
+}
+
+func quitCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	cl.close()
+	delete(rs.clients, cl.id)
+	return true
+}
+
+func infoCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyMultiBulkString(cl.conn, rs.info())
+}
+
+func clientCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	argsLen := len(args)
+	switch strings.ToUpper(args[0]) {
+	case "ID":
+		if argsLen != 1 {
+			return replyInvalidNumberOfArgsError(c, "CLIENT")
+		}
+		return replyInteger(c, strconv.Itoa(cl.id))
+	case "GETNAME":
+		if argsLen != 1 {
+			return replyInvalidNumberOfArgsError(c, "CLIENT")
+		}
+		if cl.name == "" {
+			return replyEmptyBulkString(c)
+		}
+		return replyBulkString(c, cl.name)
+	case "SETNAME":
+		if argsLen != 2 {
+			return replyInvalidNumberOfArgsError(c, "CLIENT")
+		}
+		if strings.ContainsAny(args[1], " \n") {
+			return replySimpleError(c, "ERR Client names cannot contain spaces or newlines")
+		}
+		cl.name = args[1]
+		return replyOK(c)
+	}
+	return replyInvalidCommandError(c)
+}
+
+// Persistent Control Commands
+
+func saveCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if atomic.LoadInt32(&rs.bgsaveInProgress) == 1 {
+		return replySimpleError(cl.conn, errBgsaveInProgress.Error())
+	}
+	if err := rs.save(); err != nil {
+		return replySimpleError(cl.conn, "ERR "+err.Error())
+	}
+	return replyOK(cl.conn)
+}
+
+func bgsaveCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if err := rs.bgsave(); err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	return replyOK(cl.conn)
+}
+
+func lastsaveCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, fmt.Sprintf("%d", atomic.LoadInt64(&rs.lastsave)))
+}
+
+func shutdownCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	// keep running rather than lose the dataset when it cannot be saved
+	if err := rs.save(); err != nil {
+		return replySimpleError(cl.conn, "ERR Errors trying to SHUTDOWN. Check logs.")
+	}
+	if err := rs.stopAppendOnly(); err != nil {
+		serverLog(logWarning, "Failed to Close Append Only File: %v\n", err)
+	}
+	if err := rs.stopWriteThrough(); err != nil {
+		serverLog(logWarning, "Failed to Close Write Through DB: %v\n", err)
+	}
+	if rs.tier != nil {
+		// the tier only extends memory so there is nothing to keep
+		if err := rs.tier.close(); err != nil {
+			serverLog(logWarning, "Failed to Close Tier DB: %v\n", err)
+		}
+		rs.tier = nil
+	}
+	if rs.config.pidFile != "" {
+		os.Remove(rs.config.pidFile)
+	}
+	for _, client := range rs.clients {
+		client.close()
+	}
+	rs.closeDone()
+	rs.l.Close()
+	return false
+}
+
+// Commands Operating on Key Space
+
+func keysCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	val, ok := rs.keys(rs.store[cl.db], args[0])
+	if !ok {
+		return replyInvalidGlobPatternError(c, args[0])
+	}
+	if len(val) == 0 {
+		return replyEmptySetOrList(c)
+	}
+	return replyMultiBulkString(c, val)
+}
+
+func randomkeyCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyBulkString(cl.conn, rs.random_key(rs.store[cl.db]))
+}
+
+func renameCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if args[0] == args[1] {
+		return replySimpleError(cl.conn, "Keys Must be Different")
+	}
+	rs.rename(rs.store[cl.db], args[0], args[1])
+	return replyOK(cl.conn)
+}
+
+func renamenxCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, rs.rename_nx(rs.store[cl.db], args[0], args[1]))
+}
+
+func dbsizeCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, rs.dbsize(rs.store[cl.db]))
+}
+
+func existsCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	// TODO: Eventually support variable number of args
+	if rs.getDBType(rs.store[cl.db], args[0]) != tNone {
+		return replyInteger(cl.conn, "1")
+	}
+	return replyInteger(cl.conn, "0")
+}
+
+func delCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if rs.del(rs.store[cl.db], args[0]) {
+		return replyInteger(cl.conn, "1")
+	}
+	return replyInteger(cl.conn, "0")
+}
+
+func typeCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replySimpleString(cl.conn, string(rs.getDBType(rs.store[cl.db], args[0])))
+}
+
+// Commands Operating on DB
+
+func selectCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	index, err := strconv.Atoi(args[0])
+	if err != nil {
+		return replyInvalidTypeIntegerError(cl.conn)
+	}
+	if index >= len(rs.store) || index < 0 {
+		return replyInvalidTypeIntegerError(cl.conn)
+	}
+	cl.db = index
+	return replyOK(cl.conn)
+}
+
+func moveCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	dbIndex, err := strconv.Atoi(args[1])
+	if err != nil {
+		return replyInvalidTypeIntegerError(cl.conn)
+	}
+	return replyInteger(cl.conn, rs.move(cl.db, args[0], dbIndex))
+}
+
+func flushdbCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	rs.flushDB(rs.store[cl.db])
+	return replyOK(cl.conn)
+}
+
+func flushallCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	rs.flushall()
+	return replyOK(cl.conn)
+}
+
+// Commands Operating on Strings
+
+func setCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	rs.set(db, args[0], args[1])
+	// SET replaces the key so any ttl it had is dropped
+	delete(db.expires, args[0])
+	return replyOK(cl.conn)
+}
+
+func setnxCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	if _, ok := rs.get(db, args[0]); !ok {
+		rs.set(db, args[0], args[1])
+		return replyInteger(cl.conn, "1")
+	}
+	return replyInteger(cl.conn, "0")
+}
+
+func getCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	val, ok := rs.get(rs.store[cl.db], args[0])
+	if !ok {
+		return replyEmptyBulkString(cl.conn)
+	}
+	return replyBulkString(cl.conn, val)
+}
+
+// incrBy adds delta to the integer stored at key (a missing key counts as 0)
+// and replies with the new value. This backs INCRBY, DECR and DECRBY
+func incrBy(rs *RedisServer, cl *RedisClient, key string, delta int) bool {
+	db := rs.store[cl.db]
+	val := 0
+	if v, ok := rs.get(db, key); ok {
+		var err error
+		val, err = strconv.Atoi(v)
+		if err != nil {
+			return replyInvalidTypeIntegerError(cl.conn)
+		}
+	}
+	vs := fmt.Sprintf("%d", val+delta)
+	rs.set(db, key, vs)
+	return replyInteger(cl.conn, vs)
+}
+
+func incrCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	if _, ok := rs.get(db, args[0]); !ok {
+		// a missing key starts at 0 rather than being incremented to 1
+		rs.set(db, args[0], "0")
+		return replyInteger(cl.conn, "0")
+	}
+	return incrBy(rs, cl, args[0], 1)
+}
+
+func incrbyCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	delta, err := strconv.Atoi(args[1])
+	if err != nil {
+		return replyInvalidTypeIntegerError(cl.conn)
+	}
+	return incrBy(rs, cl, args[0], delta)
+}
+
+func decrCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return incrBy(rs, cl, args[0], -1)
+}
+
+func decrbyCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	delta, err := strconv.Atoi(args[1])
+	if err != nil {
+		return replyInvalidTypeIntegerError(cl.conn)
+	}
+	return incrBy(rs, cl, args[0], -delta)
+}
+
+// Commands Operating on Lists
+
+func lpushCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, rs.lpush(rs.store[cl.db], args[0], args[1]))
+}
+
+func rpushCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, rs.rpush(rs.store[cl.db], args[0], args[1]))
+}
+
+func llenCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	if rs.getDBType(db, args[0]) == tNone {
+		// 0 if the key doesnt exist
+		return replyInteger(cl.conn, "0")
+	}
+	return replyInteger(cl.conn, rs.llen(db, args[0]))
+}
+
+func lrangeCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	db := rs.store[cl.db]
+	if rs.getDBType(db, args[0]) == tNone {
+		return replyEmptySetOrList(c)
+	}
+	start, err := strconv.Atoi(args[1])
+	if err != nil {
+		return replyInvalidTypeIntegerError(c)
+	}
+	end, err := strconv.Atoi(args[2])
+	if err != nil {
+		return replyInvalidTypeIntegerError(c)
+	}
+	val := rs.lrange(db, args[0], start, end)
+	if len(val) == 0 {
+		return replyEmptySetOrList(c)
+	}
+	return replyMultiBulkString(c, val)
+}
+
+func lindexCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	db := rs.store[cl.db]
+	if rs.getDBType(db, args[0]) == tNone {
+		return replyEmptyBulkString(c)
+	}
+	index, err := strconv.Atoi(args[1])
+	if err != nil {
+		return replyInvalidTypeIntegerError(c)
+	}
+	val := rs.lindex(db, args[0], index)
+	if val == emptyBulkString {
+		return replyEmptyBulkString(c)
+	}
+	return replyBulkString(c, val)
+}
+
+func lpopCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	if rs.getDBType(db, args[0]) == tNone {
+		return replyEmptyBulkString(cl.conn)
+	}
+	return replyBulkString(cl.conn, rs.lpop(db, args[0]))
+}
+
+func rpopCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	if rs.getDBType(db, args[0]) == tNone {
+		return replyEmptyBulkString(cl.conn)
+	}
+	return replyBulkString(cl.conn, rs.rpop(db, args[0]))
+}
+
+// blockingPop pops an element for p off the first of keys that holds a list,
+// or blocks until one of them gets an element or deadline passes. It replies
+// with the key and the element, or with just the element for a move
+func blockingPop(rs *RedisServer, cl *RedisClient, keys []string, timeout string, p *blockedPop) bool {
+	c := cl.conn
+	deadline, err := parseBlockTimeout(timeout)
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	db := rs.store[cl.db]
+	for _, key := range keys {
+		if l, ok := db.ll[key]; ok && l.Len() > 0 {
+			p.key, p.val, p.served = key, rs.servePop(cl.db, key, p), true
+			break
+		}
+	}
+	if !p.served {
+		cl.pop = p
+		rs.blockClient(cl, keys, deadline)
+		cl.pop = nil
+	}
+	switch {
+	case p.err != nil:
+		return replySimpleError(c, p.err.Error())
+	case !p.served:
+		return replyEmptySetOrList(c)
+	case p.move:
+		return replyBulkString(c, p.val)
+	}
+	return replyMultiBulkString(c, []string{p.key, p.val})
+}
+
+func blpopCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return blockingPop(rs, cl, args[:len(args)-1], args[len(args)-1], &blockedPop{left: true})
+}
+
+func brpopCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return blockingPop(rs, cl, args[:len(args)-1], args[len(args)-1], &blockedPop{})
+}
+
+func brpoplpushCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return blockingPop(rs, cl, args[:1], args[2], &blockedPop{move: true, dst: args[1], dstLeft: true})
+}
+
+// blmoveCommand moves an element from one end of a list to an end of another:
+//
+//	BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func blmoveCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	var left [2]bool
+	for i, where := range args[2:4] {
+		switch strings.ToUpper(where) {
+		case "LEFT":
+			left[i] = true
+		case "RIGHT":
+		default:
+			return replySimpleError(cl.conn, errSyntax.Error())
+		}
+	}
+	return blockingPop(rs, cl, args[:1], args[4], &blockedPop{left: left[0], move: true, dst: args[1], dstLeft: left[1]})
+}
+
+func ltrimCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	db := rs.store[cl.db]
+	if rs.getDBType(db, args[0]) == tNone {
+		return replyEmptySetOrList(c)
+	}
+	start, err := strconv.Atoi(args[1])
+	if err != nil {
+		return replyInvalidTypeIntegerError(c)
+	}
+	end, err := strconv.Atoi(args[2])
+	if err != nil {
+		return replyInvalidTypeIntegerError(c)
+	}
+	ok := rs.ltrim(db, args[0], start, end)
+	if !ok {
+		// delete the key because the indexes resulted in an empty list
+		rs.del(db, args[0])
+		return replyEmptySetOrList(c)
+	}
+	return replyOK(c)
+}
+
+func lsetCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	db := rs.store[cl.db]
+	if rs.getDBType(db, args[0]) == tNone {
+		return replyNoSuchKey(c)
+	}
+	index, err := strconv.Atoi(args[1])
+	if err != nil {
+		return replyInvalidTypeIntegerError(c)
+	}
+	if !rs.lset(db, args[0], index, args[2]) {
+		return replyInvalidTypeIntegerError(c)
+	}
+	return replyOK(c)
+}
+
+func lremCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	db := rs.store[cl.db]
+	typ := rs.getDBType(db, args[0])
+	if typ == tNone {
+		return replyInteger(c, "-1")
+	}
+	if typ != tList {
+		return replyInteger(c, "-2")
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		return replyInvalidTypeIntegerError(c)
+	}
+	return replyInteger(c, rs.lrem(db, args[0], count, args[2]))
+}
+
+// Commands Operating on Sets
+
+func saddCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, rs.sadd(rs.store[cl.db], args[0], args[1:]...))
+}
+
+func sremCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, rs.srem(rs.store[cl.db], args[0], args[1:]...))
+}
+
+func scardCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, rs.scard(rs.store[cl.db], args[0]))
+}
+
+func sismemberCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, rs.sismember(rs.store[cl.db], args[0], args[1]))
+}
+
+// smismemberCommand replies with 1 or 0 for each member depending on whether
+// it is in the set
+func smismemberCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	set := rs.store[cl.db].s[args[0]]
+	buf := []byte("*" + strconv.Itoa(len(args)-1) + Delimeter)
+	for _, member := range args[1:] {
+		if _, ok := set[member]; ok {
+			buf = append(buf, ":1"+Delimeter...)
+		} else {
+			buf = append(buf, ":0"+Delimeter...)
+		}
+	}
+	_, err := cl.conn.Write(buf)
+	return isNil(err)
+}
+
+// replySetMembers replies with the members of set in order
+func replySetMembers(c io.Writer, set map[string]struct{}) bool {
+	if len(set) == 0 {
+		return replyEmptySetOrList(c)
+	}
+	return replyMultiBulkString(c, sortedMembers(set))
+}
+
+func sinterCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replySetMembers(cl.conn, sinterMembers(rs.store[cl.db], args, 0))
+}
+
+// sinterstoreCommand keeps the 1.0 behaviour of replying +OK rather than the
+// size of the new set
+func sinterstoreCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	for _, key := range args[1:] {
+		if rs.getDBType(db, key) == tNone {
+			return replyEmptySetOrList(cl.conn)
+		}
+	}
+	rs.sinterstore(db, args[0], args[1:]...)
+	return replyOK(cl.conn)
+}
+
+// sintercardCommand replies with the size of the intersection of the sets:
+//
+//	SINTERCARD numkeys key [key ...] [LIMIT limit]
+//
+// counting stops at limit when it is above 0
+func sintercardCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return replyInvalidTypeIntegerError(c)
+	}
+	if numKeys < 1 {
+		return replySimpleError(c, "ERR numkeys should be greater than 0")
+	}
+	if numKeys > len(args)-1 {
+		return replySimpleError(c, "ERR Number of keys can't be greater than number of args")
+	}
+	keys := args[1 : 1+numKeys]
+	limit := 0
+	for i := 1 + numKeys; i < len(args); i++ {
+		if strings.ToUpper(args[i]) != "LIMIT" || i+1 == len(args) {
+			return replySimpleError(c, errSyntax.Error())
+		}
+		limit, err = strconv.Atoi(args[i+1])
+		if err != nil {
+			return replyInvalidTypeIntegerError(c)
+		}
+		if limit < 0 {
+			return replySimpleError(c, "ERR LIMIT can't be negative")
+		}
+		i++
+	}
+	if err := rs.prepareKeys(cl, keys, tSet); err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	return replyInteger(c, strconv.Itoa(len(sinterMembers(rs.store[cl.db], keys, limit))))
+}
+
+func sunionCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replySetMembers(cl.conn, sunionMembers(rs.store[cl.db], args))
+}
+
+func sunionstoreCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	return replyInteger(cl.conn, strconv.Itoa(rs.sstore(db, args[0], sunionMembers(db, args[1:]))))
+}
+
+func sdiffCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replySetMembers(cl.conn, sdiffMembers(rs.store[cl.db], args))
+}
+
+func sdiffstoreCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	return replyInteger(cl.conn, strconv.Itoa(rs.sstore(db, args[0], sdiffMembers(db, args[1:]))))
+}
+
+func smoveCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if rs.smove(rs.store[cl.db], args[0], args[1], args[2]) {
+		return replyInteger(cl.conn, "1")
+	}
+	return replyInteger(cl.conn, "0")
+}
+
+// errCountOutOfRange is returned for a count that can not be negated
+var errCountOutOfRange = errors.New("ERR value is out of range")
+
+// srandmemberChunk is how many members SRANDMEMBER with a negative count
+// writes to the client at a time
+const srandmemberChunk = 1024
+
+// parseSetCount parses the optional count of SPOP and SRANDMEMBER. ok is
+// false when there is none
+func parseSetCount(args []string) (count int, ok bool, err error) {
+	switch len(args) {
+	case 1:
+		return 0, false, nil
+	case 2:
+		count, err = strconv.Atoi(args[1])
+		if err != nil {
+			return 0, false, errNotInteger
+		}
+		if count == math.MinInt {
+			return 0, false, errCountOutOfRange
+		}
+		return count, true, nil
+	}
+	return 0, false, errSyntax
+}
+
+// spopCommand removes and replies with a random member, or with up to count
+// of them. It is logged to the append only file as the SREM of what it
+// popped so a replay pops the same members
+func spopCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	count, hasCount, err := parseSetCount(args)
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	if hasCount && count < 0 {
+		return replySimpleError(c, errNotPositive.Error())
+	}
+	db := rs.store[cl.db]
+	if !hasCount {
+		popped := rs.spop(db, args[0], 1)
+		if len(popped) == 0 {
+			return replyEmptyBulkString(c)
+		}
+		rs.logAppendOnly(append([]string{"SREM", args[0]}, popped...)...)
+		return replyBulkString(c, popped[0])
+	}
+	popped := rs.spop(db, args[0], count)
+	if len(popped) == 0 {
+		return replyEmptySetOrList(c)
+	}
+	rs.logAppendOnly(append([]string{"SREM", args[0]}, popped...)...)
+	return replyMultiBulkString(c, popped)
+}
+
+// srandmemberCommand replies with a random member, or with up to count
+// distinct members. A negative count replies with exactly -count members
+// which may repeat
+func srandmemberCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	count, hasCount, err := parseSetCount(args)
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	set := rs.store[cl.db].s[args[0]]
+	if !hasCount {
+		members := randomMembers(set, 1)
+		if len(members) == 0 {
+			return replyEmptyBulkString(c)
+		}
+		return replyBulkString(c, members[0])
+	}
+	if count == 0 || len(set) == 0 {
+		return replyEmptySetOrList(c)
+	}
+	if count > 0 {
+		return replyMultiBulkString(c, randomMembers(set, count))
+	}
+	// the members are written a chunk at a time rather than -count of them
+	// being built up first
+	all := randomMembers(set, len(set))
+	if _, err := fmt.Fprintf(c, "*%d\r\n", -count); err != nil {
+		return false
+	}
+	var buf []byte
+	for i := 0; i < -count; i++ {
+		buf = appendBulkString(buf, all[rand.Intn(len(all))])
+		if (i+1)%srandmemberChunk == 0 || i == -count-1 {
+			if _, err := c.Write(buf); err != nil {
+				return false
+			}
+			buf = buf[:0]
+		}
+	}
+	return true
+}
+
+func smembersCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	val, ok := rs.smembers(rs.store[cl.db], args[0])
+	if !ok {
+		return replyEmptySetOrList(cl.conn)
+	}
+	return replyMultiBulkString(cl.conn, val)
+}
+
+// Commands Operating on Hashes
+
+// hsetFields sets every field value pair of args (which starts with the key)
+// and returns how many fields were new. ok is false when a field has no value
+func hsetFields(rs *RedisServer, cl *RedisClient, args []string) (int, bool) {
+	if len(args)%2 != 1 {
+		return 0, false
+	}
+	db := rs.store[cl.db]
+	added := 0
+	for i := 1; i < len(args); i += 2 {
+		if rs.hset(db, args[0], args[i], args[i+1]) {
+			added++
+		}
+	}
+	return added, true
+}
+
+func hsetCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	added, ok := hsetFields(rs, cl, args)
+	if !ok {
+		return replyInvalidNumberOfArgsError(cl.conn, "HSET")
+	}
+	return replyInteger(cl.conn, strconv.Itoa(added))
+}
+
+func hmsetCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if _, ok := hsetFields(rs, cl, args); !ok {
+		return replyInvalidNumberOfArgsError(cl.conn, "HMSET")
+	}
+	return replyOK(cl.conn)
+}
+
+func hsetnxCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	if _, ok := rs.hget(db, args[0], args[1]); ok {
+		return replyInteger(cl.conn, "0")
+	}
+	rs.hset(db, args[0], args[1], args[2])
+	return replyInteger(cl.conn, "1")
+}
+
+func hgetCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	val, ok := rs.hget(rs.store[cl.db], args[0], args[1])
+	if !ok {
+		return replyEmptyBulkString(cl.conn)
+	}
+	return replyBulkString(cl.conn, val)
+}
+
+func hmgetCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	vals := make([]string, len(args)-1)
+	exists := make([]bool, len(args)-1)
+	for i, field := range args[1:] {
+		vals[i], exists[i] = rs.hget(db, args[0], field)
+	}
+	return replyMultiBulkStringOrNil(cl.conn, vals, exists)
+}
+
+func hgetallCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	fields := rs.hfields(db, args[0])
+	if len(fields) == 0 {
+		return replyEmptySetOrList(cl.conn)
+	}
+	result := make([]string, 0, len(fields)*2)
+	for _, field := range fields {
+		result = append(result, field, db.h[args[0]][field])
+	}
+	return replyMultiBulkString(cl.conn, result)
+}
+
+func hdelCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	deleted := 0
+	for _, field := range args[1:] {
+		if rs.hdel(db, args[0], field) {
+			deleted++
+		}
+	}
+	return replyInteger(cl.conn, strconv.Itoa(deleted))
+}
+
+func hexistsCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if _, ok := rs.hget(rs.store[cl.db], args[0], args[1]); ok {
+		return replyInteger(cl.conn, "1")
+	}
+	return replyInteger(cl.conn, "0")
+}
+
+func hlenCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, strconv.Itoa(len(rs.store[cl.db].h[args[0]])))
+}
+
+func hkeysCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	fields := rs.hfields(rs.store[cl.db], args[0])
+	if len(fields) == 0 {
+		return replyEmptySetOrList(cl.conn)
+	}
+	return replyMultiBulkString(cl.conn, fields)
+}
+
+func hvalsCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	fields := rs.hfields(db, args[0])
+	if len(fields) == 0 {
+		return replyEmptySetOrList(cl.conn)
+	}
+	vals := make([]string, 0, len(fields))
+	for _, field := range fields {
+		vals = append(vals, db.h[args[0]][field])
+	}
+	return replyMultiBulkString(cl.conn, vals)
+}
+
+func hincrbyCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	delta, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return replyInvalidTypeIntegerError(cl.conn)
+	}
+	db := rs.store[cl.db]
+	var val int64
+	if v, ok := rs.hget(db, args[0], args[1]); ok {
+		val, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return replySimpleError(cl.conn, "ERR hash value is not an integer")
+		}
+	}
+	if (delta > 0 && val > math.MaxInt64-delta) || (delta < 0 && val < math.MinInt64-delta) {
+		return replySimpleError(cl.conn, "ERR increment or decrement would overflow")
+	}
+	vs := strconv.FormatInt(val+delta, 10)
+	rs.hset(db, args[0], args[1], vs)
+	return replyInteger(cl.conn, vs)
+}
+
+func hincrbyfloatCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	delta, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return replySimpleError(cl.conn, "ERR value is not a valid float")
+	}
+	db := rs.store[cl.db]
+	var val float64
+	if v, ok := rs.hget(db, args[0], args[1]); ok {
+		val, err = strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+			return replySimpleError(cl.conn, "ERR hash value is not a float")
+		}
+	}
+	val += delta
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return replySimpleError(cl.conn, "ERR increment would produce NaN or Infinity")
+	}
+	vs := strconv.FormatFloat(val, 'f', -1, 64)
+	rs.hset(db, args[0], args[1], vs)
+	return replyBulkString(cl.conn, vs)
+}
+
+func hstrlenCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	val, _ := rs.hget(rs.store[cl.db], args[0], args[1])
+	return replyInteger(cl.conn, strconv.Itoa(len(val)))
+}
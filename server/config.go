@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gobwas/glob"
+)
+
+// serverConfig holds the options read from the config file, most of which can
+// also be changed while the server runs
+type serverConfig struct {
+	// port and bind are the tcp port and address the server listens on
+	// (an empty bind listens on every interface)
+	port int
+	bind string
+	// databases is the number of dbs the server holds
+	databases int
+	// dir is the working directory the server keeps its files in
+	dir string
+	// dbFilename is the save db that snapshots are written to
+	dbFilename string
+	// pidFile is where the process id is written to while the server runs
+	// (empty writes none)
+	pidFile string
+	// logLevel is the least severe level that is logged
+	logLevel int32
+	// maxClients is how many clients may be connected at once
+	maxClients int
+	// timeout is how many seconds a client may sit idle before it is closed
+	// (0 never closes idle clients)
+	timeout int64
+
+	// snapshotKeep is how many of the newest snapshots are kept in the save
+	// db (0 keeps them all)
+	snapshotKeep int
+	// snapshotMaxAge is the age in seconds after which a snapshot is pruned
+	// (0 means snapshots never get too old)
+	snapshotMaxAge int64
+	// snapshotVacuum runs VACUUM on the save db after snapshots are pruned
+	snapshotVacuum bool
+	// saveRules start a background save once any of them is met (none means
+	// the dataset is only saved on request)
+	saveRules []saveRule
+	// appendOnly logs every write command to the append only file
+	appendOnly bool
+	// appendFsync is when the append only file is synced to disk, one of
+	// fsyncAlways, fsyncEverysec or fsyncNo
+	appendFsync string
+	// writeThrough applies every write command to the write through db
+	// before the next command runs
+	writeThrough bool
+	// maxmemory is the estimated size in bytes the dataset may take in
+	// memory before the least recently used keys are moved to the tier db
+	// (0 keeps everything in memory)
+	maxmemory int64
+	// luaTimeLimit is how many milliseconds a script may run before other
+	// clients are told the server is busy (0 never tells them)
+	luaTimeLimit int64
+}
+
+// defaultConfig keeps every snapshot which is how the save db always worked
+func defaultConfig() serverConfig {
+	return serverConfig{
+		port:        8081,
+		databases:   NumDBs,
+		dir:         ".",
+		dbFilename:  saveDBFile,
+		logLevel:    logNotice,
+		maxClients:  10000,
+		appendFsync: fsyncEverysec,
+
+		luaTimeLimit: 5000,
+	}
+}
+
+// configParam is an option that can be read and changed with CONFIG
+type configParam struct {
+	name string
+	get  func(cfg *serverConfig) string
+	set  func(cfg *serverConfig, val string) error
+	// apply is called after a CONFIG SET of the option for options that need
+	// more than a new value in rs.config to take effect (nil for most). On
+	// error the old config is put back
+	apply func(rs *RedisServer) error
+	// immutable options are only read from the config file at startup
+	immutable bool
+}
+
+// configParams lists every option known to CONFIG in the order they are
+// reported
+var configParams []*configParam
+
+func init() {
+	configParams = []*configParam{
+		{
+			name: "port",
+			get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.port) },
+			set: func(cfg *serverConfig, val string) error {
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 || n > 65535 {
+					return fmt.Errorf("argument must be a port between 0 and 65535")
+				}
+				cfg.port = n
+				return nil
+			},
+			immutable: true,
+		},
+		{
+			name: "bind",
+			get:  func(cfg *serverConfig) string { return cfg.bind },
+			set: func(cfg *serverConfig, val string) error {
+				cfg.bind = val
+				return nil
+			},
+			immutable: true,
+		},
+		{
+			name: "databases",
+			get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.databases) },
+			set: func(cfg *serverConfig, val string) error {
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 1 {
+					return fmt.Errorf("argument must be a positive integer")
+				}
+				cfg.databases = n
+				return nil
+			},
+			immutable: true,
+		},
+		{
+			name: "dir",
+			get:  func(cfg *serverConfig) string { return cfg.dir },
+			set: func(cfg *serverConfig, val string) error {
+				if val == "" {
+					return fmt.Errorf("argument must be a directory")
+				}
+				cfg.dir = val
+				return nil
+			},
+			immutable: true,
+		},
+		{
+			name: "dbfilename",
+			get:  func(cfg *serverConfig) string { return cfg.dbFilename },
+			set: func(cfg *serverConfig, val string) error {
+				if val == "" || strings.ContainsRune(val, '/') {
+					return fmt.Errorf("argument must be a file name without a path")
+				}
+				cfg.dbFilename = val
+				return nil
+			},
+		},
+		{
+			name: "pidfile",
+			get:  func(cfg *serverConfig) string { return cfg.pidFile },
+			set: func(cfg *serverConfig, val string) error {
+				cfg.pidFile = val
+				return nil
+			},
+			immutable: true,
+		},
+		{
+			name: "loglevel",
+			get:  func(cfg *serverConfig) string { return logLevelNames[cfg.logLevel] },
+			set: func(cfg *serverConfig, val string) error {
+				level, err := parseLogLevel(val)
+				cfg.logLevel = level
+				return err
+			},
+			apply: func(rs *RedisServer) error {
+				setLogLevel(rs.config.logLevel)
+				return nil
+			},
+		},
+		{
+			name: "maxclients",
+			get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.maxClients) },
+			set: func(cfg *serverConfig, val string) error {
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 1 {
+					return fmt.Errorf("argument must be a positive integer")
+				}
+				cfg.maxClients = n
+				return nil
+			},
+		},
+		{
+			name: "timeout",
+			get:  func(cfg *serverConfig) string { return strconv.FormatInt(cfg.timeout, 10) },
+			set: func(cfg *serverConfig, val string) error {
+				n, err := parseNonNegative(val)
+				cfg.timeout = n
+				return err
+			},
+		},
+		{
+			name: "snapshot-keep",
+			get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.snapshotKeep) },
+			set: func(cfg *serverConfig, val string) error {
+				n, err := parseNonNegative(val)
+				cfg.snapshotKeep = int(n)
+				return err
+			},
+		},
+		{
+			name: "snapshot-max-age",
+			get:  func(cfg *serverConfig) string { return strconv.FormatInt(cfg.snapshotMaxAge, 10) },
+			set: func(cfg *serverConfig, val string) error {
+				n, err := parseNonNegative(val)
+				cfg.snapshotMaxAge = n
+				return err
+			},
+		},
+		{
+			name: "snapshot-vacuum",
+			get:  func(cfg *serverConfig) string { return formatYesNo(cfg.snapshotVacuum) },
+			set: func(cfg *serverConfig, val string) error {
+				b, err := parseYesNo(val)
+				cfg.snapshotVacuum = b
+				return err
+			},
+		},
+		{
+			name: "save",
+			get:  func(cfg *serverConfig) string { return formatSaveRules(cfg.saveRules) },
+			set: func(cfg *serverConfig, val string) error {
+				rules, err := parseSaveRules(val)
+				cfg.saveRules = rules
+				return err
+			},
+		},
+		{
+			name: "appendonly",
+			get:  func(cfg *serverConfig) string { return formatYesNo(cfg.appendOnly) },
+			set: func(cfg *serverConfig, val string) error {
+				b, err := parseYesNo(val)
+				cfg.appendOnly = b
+				return err
+			},
+			apply: func(rs *RedisServer) error {
+				if rs.config.appendOnly == (rs.aof != nil) {
+					return nil
+				}
+				if atomic.LoadInt32(&rs.aofRewriteInProgress) == 1 {
+					return errAOFRewriteInProgress
+				}
+				if rs.config.appendOnly {
+					return rs.startAppendOnly()
+				}
+				return rs.stopAppendOnly()
+			},
+		},
+		{
+			name: "appendfsync",
+			get:  func(cfg *serverConfig) string { return cfg.appendFsync },
+			set: func(cfg *serverConfig, val string) error {
+				switch strings.ToLower(val) {
+				case fsyncAlways, fsyncEverysec, fsyncNo:
+					cfg.appendFsync = strings.ToLower(val)
+					return nil
+				}
+				return fmt.Errorf("argument must be 'always', 'everysec' or 'no'")
+			},
+		},
+		{
+			name: "writethrough",
+			get:  func(cfg *serverConfig) string { return formatYesNo(cfg.writeThrough) },
+			set: func(cfg *serverConfig, val string) error {
+				b, err := parseYesNo(val)
+				cfg.writeThrough = b
+				return err
+			},
+			apply: func(rs *RedisServer) error {
+				if rs.config.writeThrough == (rs.wt != nil) {
+					return nil
+				}
+				if rs.config.writeThrough {
+					return rs.startWriteThrough()
+				}
+				return rs.stopWriteThrough()
+			},
+		},
+		{
+			name: "maxmemory",
+			get:  func(cfg *serverConfig) string { return strconv.FormatInt(cfg.maxmemory, 10) },
+			set: func(cfg *serverConfig, val string) error {
+				n, err := parseMemory(val)
+				cfg.maxmemory = n
+				return err
+			},
+			apply: func(rs *RedisServer) error {
+				if (rs.config.maxmemory > 0) == (rs.tier != nil) {
+					return nil
+				}
+				if rs.config.maxmemory > 0 {
+					return rs.startTier()
+				}
+				return rs.stopTier()
+			},
+		},
+		{
+			name: "lua-time-limit",
+			get:  func(cfg *serverConfig) string { return strconv.FormatInt(cfg.luaTimeLimit, 10) },
+			set: func(cfg *serverConfig, val string) error {
+				n, err := parseNonNegative(val)
+				cfg.luaTimeLimit = n
+				return err
+			},
+		},
+	}
+}
+
+func lookupConfigParam(name string) *configParam {
+	for _, p := range configParams {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func parseNonNegative(val string) (int64, error) {
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("argument must be a non negative integer")
+	}
+	return n, nil
+}
+
+// parseMemory parses a number of bytes with an optional kb, mb or gb unit
+func parseMemory(val string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}}
+	lower := strings.ToLower(val)
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, mult = strings.TrimSuffix(lower, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/mult {
+		return 0, fmt.Errorf("argument must be a memory value")
+	}
+	return n * mult, nil
+}
+
+func parseYesNo(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
+
+func formatYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func configCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) != 2 {
+			return replyInvalidNumberOfArgsError(c, "CONFIG")
+		}
+		g, err := glob.Compile(strings.ToLower(args[1]))
+		if err != nil {
+			return replyInvalidGlobPatternError(c, args[1])
+		}
+		result := make([]string, 0)
+		for _, p := range configParams {
+			if g.Match(p.name) {
+				result = append(result, p.name, p.get(&rs.config))
+			}
+		}
+		return replyMultiBulkString(c, result)
+	case "SET":
+		if len(args) != 3 {
+			return replyInvalidNumberOfArgsError(c, "CONFIG")
+		}
+		p := lookupConfigParam(strings.ToLower(args[1]))
+		if p == nil {
+			return replySimpleError(c, "ERR Unsupported CONFIG parameter: "+args[1])
+		}
+		if p.immutable {
+			return replySimpleError(c, fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", p.name))
+		}
+		// apply to a copy so a bad value leaves the running config alone
+		cfg := rs.config
+		if err := p.set(&cfg, args[2]); err != nil {
+			return replySimpleError(c, fmt.Sprintf("ERR Invalid argument '%s' for CONFIG SET '%s' - %v", args[2], p.name, err))
+		}
+		old := rs.config
+		rs.config = cfg
+		if p.apply != nil {
+			if err := p.apply(rs); err != nil {
+				rs.config = old
+				return replySimpleError(c, "ERR "+strings.TrimPrefix(err.Error(), "ERR "))
+			}
+		}
+		return replyOK(c)
+	case "REWRITE":
+		if len(args) != 1 {
+			return replyInvalidNumberOfArgsError(c, "CONFIG")
+		}
+		if rs.configFile == "" {
+			return replySimpleError(c, "ERR The server is running without a config file")
+		}
+		if err := rewriteConfigFile(rs.configFile, &rs.config); err != nil {
+			return replySimpleError(c, "ERR Rewriting config file: "+err.Error())
+		}
+		return replyOK(c)
+	}
+	return replyInvalidCommandError(c)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The config file is in the redis.conf format, one option per line followed
+// by its arguments. Arguments that hold spaces are quoted and lines starting
+// with # are comments:
+//
+//	port 6379
+//	dbfilename "my save.db"
+//	save 900 1
+//	save 60 10000
+//
+// Every save line adds its rules to those before it and save "" removes them
+
+// splitConfigLine splits a line of the config file into its words. Double
+// quoted words may use \", \\, \n, \r and \t, single quoted words are taken as
+// they are
+func splitConfigLine(line string) ([]string, error) {
+	words := make([]string, 0)
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			return words, nil
+		}
+		var sb strings.Builder
+		switch line[i] {
+		case '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] != '\\' || i+1 == len(line) {
+					sb.WriteByte(line[i])
+					continue
+				}
+				i++
+				switch line[i] {
+				case 'n':
+					sb.WriteByte('\n')
+				case 'r':
+					sb.WriteByte('\r')
+				case 't':
+					sb.WriteByte('\t')
+				default:
+					sb.WriteByte(line[i])
+				}
+			}
+			if i == len(line) {
+				return nil, fmt.Errorf("unbalanced quotes")
+			}
+			i++
+		case '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end == -1 {
+				return nil, fmt.Errorf("unbalanced quotes")
+			}
+			sb.WriteString(line[i+1 : i+1+end])
+			i += end + 2
+		default:
+			for ; i < len(line) && line[i] != ' ' && line[i] != '\t'; i++ {
+				sb.WriteByte(line[i])
+			}
+			words = append(words, sb.String())
+			continue
+		}
+		// a closing quote must end the word
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			return nil, fmt.Errorf("closing quote must be followed by a space")
+		}
+		words = append(words, sb.String())
+	}
+}
+
+// quoteConfigArg returns val the way it is written to the config file
+func quoteConfigArg(val string) string {
+	if val != "" && !strings.ContainsAny(val, " \t\r\n\"'\\#") {
+		return val
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(val) + `"`
+}
+
+// parseConfig sets the options of cfg from a config file read from r
+func parseConfig(r io.Reader, cfg *serverConfig) error {
+	scanner := bufio.NewScanner(r)
+	sawSave := false
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		words, err := splitConfigLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		name := strings.ToLower(words[0])
+		p := lookupConfigParam(name)
+		if p == nil || len(words) < 2 || (name != "save" && len(words) != 2) {
+			return fmt.Errorf("line %d: Bad directive or wrong number of arguments", lineNum)
+		}
+		val := strings.Join(words[1:], " ")
+		if name == "save" && sawSave && val != "" {
+			val = p.get(cfg) + " " + val
+		}
+		sawSave = sawSave || name == "save"
+		if err := p.set(cfg, val); err != nil {
+			return fmt.Errorf("line %d: Invalid argument '%s' for '%s' - %v", lineNum, val, p.name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// loadConfigFile sets the options of cfg from the config file at path
+func loadConfigFile(path string, cfg *serverConfig) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := parseConfig(f, cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// configLines returns the lines that set p to its value in cfg
+func configLines(p *configParam, cfg *serverConfig) []string {
+	if p.name == "save" {
+		if len(cfg.saveRules) == 0 {
+			return []string{`save ""`}
+		}
+		lines := make([]string, 0, len(cfg.saveRules))
+		for _, rule := range cfg.saveRules {
+			lines = append(lines, fmt.Sprintf("save %d %d", rule.seconds, rule.changes))
+		}
+		return lines
+	}
+	return []string{p.name + " " + quoteConfigArg(p.get(cfg))}
+}
+
+// rewriteConfigGenerated marks the options CONFIG REWRITE added to the file
+const rewriteConfigGenerated = "# Generated by CONFIG REWRITE"
+
+// rewriteConfigFile updates the config file at path to match cfg. Comments and
+// lines that are not options are kept, each option is written where it first
+// appeared and options the file does not have yet are only added when they
+// differ from their default
+func rewriteConfigFile(path string, cfg *serverConfig) error {
+	var old []string
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		old = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	written := make(map[string]bool)
+	generated := false
+	lines := make([]string, 0, len(old))
+	for _, line := range old {
+		words, err := splitConfigLine(strings.TrimSpace(line))
+		var p *configParam
+		if err == nil && len(words) > 0 && !strings.HasPrefix(words[0], "#") {
+			p = lookupConfigParam(strings.ToLower(words[0]))
+		}
+		if p == nil {
+			generated = generated || line == rewriteConfigGenerated
+			lines = append(lines, line)
+			continue
+		}
+		if !written[p.name] {
+			lines = append(lines, configLines(p, cfg)...)
+			written[p.name] = true
+		}
+	}
+
+	defaults := defaultConfig()
+	for _, p := range configParams {
+		if written[p.name] || p.get(cfg) == p.get(&defaults) {
+			continue
+		}
+		if !generated {
+			lines = append(lines, rewriteConfigGenerated)
+			generated = true
+		}
+		lines = append(lines, configLines(p, cfg)...)
+	}
+
+	// write a temp file next to the config so the rename never crosses
+	// devices and the file is never left half written
+	tmp, err := os.CreateTemp(filepath.Dir(path), "temp-config-*.conf")
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	err = tmp.Chmod(mode)
+	if err == nil {
+		_, err = tmp.WriteString(strings.Join(lines, "\n") + "\n")
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
 	"os"
 	"runtime"
 	"sc/list"
 	"sort"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -18,6 +20,10 @@ import (
 	_ "modernc.org/sqlite"
 )
 
+// saveDBFile is the sqlite file that snapshots are saved to and loaded from
+// unless dbfilename is set
+const saveDBFile = "save.db"
+
 type dbTyp string
 
 const (
@@ -27,6 +33,12 @@ const (
 	tSet dbTyp = "set"
 	// tString is the string database type
 	tString dbTyp = "string"
+	// tHash is the hash database type
+	tHash dbTyp = "hash"
+	// tStream is the stream database type
+	tStream dbTyp = "stream"
+	// tZset is the sorted set database type
+	tZset dbTyp = "zset"
 	// tNone is the none database type
 	tNone dbTyp = "none"
 )
@@ -39,35 +51,95 @@ type DB struct {
 	s map[string]map[string]struct{}
 	// ll is our doubly linked list for our list store
 	ll map[string]*list.List
+	// h is our hash store of field value maps
+	h map[string]map[string]string
+	// x is our stream store
+	x map[string]*stream
+	// z is our sorted set store
+	z map[string]*zset
 
 	// tstore contains the database type for each of the keys in the database
 	tstore map[string]dbTyp
+	// expires holds the unix time in milliseconds that a key expires at for
+	// every key that has a ttl
+	expires map[string]int64
+	// cold holds the keys whose value was moved out to the tier db, they are
+	// still in tstore and expires but not in kv, s, ll, h, x or z
+	cold map[string]struct{}
 }
 
 // NewDB returns a db object with all fields initialized
 func NewDB() *DB {
 	return &DB{
-		kv:     make(map[string]string),
-		s:      make(map[string]map[string]struct{}),
-		ll:     make(map[string]*list.List),
-		tstore: make(map[string]dbTyp),
+		kv:      make(map[string]string),
+		s:       make(map[string]map[string]struct{}),
+		ll:      make(map[string]*list.List),
+		h:       make(map[string]map[string]string),
+		x:       make(map[string]*stream),
+		z:       make(map[string]*zset),
+		tstore:  make(map[string]dbTyp),
+		expires: make(map[string]int64),
+		cold:    make(map[string]struct{}),
+	}
+}
+
+// clone returns a deep copy of the db that shares no maps or lists with it
+func (db *DB) clone() *DB {
+	c := NewDB()
+	for key, val := range db.kv {
+		c.kv[key] = val
+	}
+	for key, members := range db.s {
+		set := make(map[string]struct{}, len(members))
+		for member := range members {
+			set[member] = struct{}{}
+		}
+		c.s[key] = set
+	}
+	for key, l := range db.ll {
+		ll := list.New()
+		for e := l.Front(); e != nil; e = e.Next() {
+			ll.PushBack(e.Value)
+		}
+		c.ll[key] = ll
+	}
+	for key, fields := range db.h {
+		hash := make(map[string]string, len(fields))
+		for field, val := range fields {
+			hash[field] = val
+		}
+		c.h[key] = hash
+	}
+	for key, st := range db.x {
+		c.x[key] = st.clone()
+	}
+	for key, z := range db.z {
+		c.z[key] = z.clone()
+	}
+	for key, typ := range db.tstore {
+		c.tstore[key] = typ
+	}
+	for key, at := range db.expires {
+		c.expires[key] = at
+	}
+	for key := range db.cold {
+		c.cold[key] = struct{}{}
 	}
+	return c
 }
 
 // DB Commands for String based commands
-func (rs *RedisServer) set(key, value string) {
-	rs.lock.Lock()
-	defer rs.lock.Unlock()
-	rs.store[rs.sp].kv[key] = value
+func (rs *RedisServer) set(db *DB, key, value string) {
+	db.kv[key] = value
 	// set our type so we know what type its associated with
-	rs.store[rs.sp].tstore[key] = tString
+	db.tstore[key] = tString
+	rs.dirty++
+	rs.signalModifiedKey(db, key)
 }
 
-func (rs *RedisServer) get(key string) (string, bool) {
-	// rs.lock.Lock()
-	// defer rs.lock.Unlock()
-	// log.Printf("key = %q, val = %q", key, rs.store[rs.sp][key])
-	val, ok := rs.store[rs.sp].kv[key]
+func (rs *RedisServer) get(db *DB, key string) (string, bool) {
+	// log.Printf("key = %q, val = %q", key, db.kv[key])
+	val, ok := db.kv[key]
 	if !ok {
 		return "-1", false
 	}
@@ -76,28 +148,48 @@ func (rs *RedisServer) get(key string) (string, bool) {
 
 // del supports deleting any key no matter the type and
 // will return the proper response depending on whether it exists
-func (rs *RedisServer) del(key string) bool {
-	delete(rs.store[rs.sp].tstore, key)
-	_, okkv := rs.get(key)
+func (rs *RedisServer) del(db *DB, key string) bool {
+	if _, ok := db.tstore[key]; ok {
+		rs.dirty++
+		rs.signalModifiedKey(db, key)
+	}
+	delete(db.tstore, key)
+	delete(db.expires, key)
+	_, okkv := rs.get(db, key)
 	if okkv {
-		delete(rs.store[rs.sp].kv, key)
+		delete(db.kv, key)
 		return okkv
 	}
-	_, oks := rs.store[rs.sp].s[key]
+	_, oks := db.s[key]
 	if oks {
-		delete(rs.store[rs.sp].s, key)
+		delete(db.s, key)
 		return oks
 	}
-	_, okll := rs.store[rs.sp].ll[key]
+	_, okll := db.ll[key]
 	if okll {
-		delete(rs.store[rs.sp].ll, key)
+		delete(db.ll, key)
 		return okll
 	}
+	_, okh := db.h[key]
+	if okh {
+		delete(db.h, key)
+		return okh
+	}
+	_, okx := db.x[key]
+	if okx {
+		delete(db.x, key)
+		return okx
+	}
+	_, okz := db.z[key]
+	if okz {
+		delete(db.z, key)
+		return okz
+	}
 	return false
 }
 
-func (rs *RedisServer) getDBType(key string) dbTyp {
-	val, exists := rs.store[rs.sp].tstore[key]
+func (rs *RedisServer) getDBType(db *DB, key string) dbTyp {
+	val, exists := db.tstore[key]
 	if exists {
 		return val
 	}
@@ -106,47 +198,47 @@ func (rs *RedisServer) getDBType(key string) dbTyp {
 
 // Methods for operating on list portion of db
 
-func (rs *RedisServer) lpush(key, value string) string {
-	rs.lock.Lock()
-	defer rs.lock.Unlock()
+func (rs *RedisServer) lpush(db *DB, key, value string) string {
 	// set our type so we know what type its associated with
-	rs.store[rs.sp].tstore[key] = tList
+	db.tstore[key] = tList
 
-	_, ok := rs.store[rs.sp].ll[key]
+	_, ok := db.ll[key]
 	if !ok {
-		rs.store[rs.sp].ll[key] = list.New().Init()
+		db.ll[key] = list.New().Init()
 	}
 
-	rs.store[rs.sp].ll[key].PushFront(value)
-	size := rs.store[rs.sp].ll[key].Len()
+	db.ll[key].PushFront(value)
+	rs.dirty++
+	rs.signalModifiedList(db, key, listOp{push: true, left: true, val: value})
+	size := db.ll[key].Len()
 	return strconv.Itoa(size)
 }
 
-func (rs *RedisServer) rpush(key, value string) string {
-	rs.lock.Lock()
-	defer rs.lock.Unlock()
+func (rs *RedisServer) rpush(db *DB, key, value string) string {
 	// set our type so we know what type its associated with
-	rs.store[rs.sp].tstore[key] = tList
+	db.tstore[key] = tList
 
-	_, ok := rs.store[rs.sp].ll[key]
+	_, ok := db.ll[key]
 	if !ok {
-		rs.store[rs.sp].ll[key] = list.New().Init()
+		db.ll[key] = list.New().Init()
 	}
 
-	rs.store[rs.sp].ll[key].PushBack(value)
-	size := rs.store[rs.sp].ll[key].Len()
+	db.ll[key].PushBack(value)
+	rs.dirty++
+	rs.signalModifiedList(db, key, listOp{push: true, val: value})
+	size := db.ll[key].Len()
 	return strconv.Itoa(size)
 }
 
-func (rs *RedisServer) llen(key string) string {
-	return strconv.Itoa(rs.store[rs.sp].ll[key].Len())
+func (rs *RedisServer) llen(db *DB, key string) string {
+	return strconv.Itoa(db.ll[key].Len())
 }
 
-func (rs *RedisServer) lrange(key string, start, end int) []string {
+func (rs *RedisServer) lrange(db *DB, key string, start, end int) []string {
 	// We know the key exists and start and end are valid ints
 	l := make([]string, 0)
 	i := 0
-	size := rs.store[rs.sp].ll[key].Len()
+	size := db.ll[key].Len()
 
 	_start := 0
 	if start < 0 {
@@ -164,7 +256,7 @@ func (rs *RedisServer) lrange(key string, start, end int) []string {
 		_end = end
 	}
 
-	for e := rs.store[rs.sp].ll[key].Front(); e != nil; e = e.Next() {
+	for e := db.ll[key].Front(); e != nil; e = e.Next() {
 		if i >= _start && i <= _end {
 			l = append(l, e.Value)
 		}
@@ -173,8 +265,8 @@ func (rs *RedisServer) lrange(key string, start, end int) []string {
 	return l
 }
 
-func (rs *RedisServer) lindex(key string, index int) string {
-	size := rs.store[rs.sp].ll[key].Len()
+func (rs *RedisServer) lindex(db *DB, key string, index int) string {
+	size := db.ll[key].Len()
 	end := 0
 	if index < 0 {
 		end = size + index
@@ -183,7 +275,7 @@ func (rs *RedisServer) lindex(key string, index int) string {
 	}
 
 	i := 0
-	for e := rs.store[rs.sp].ll[key].Front(); e != nil; e = e.Next() {
+	for e := db.ll[key].Front(); e != nil; e = e.Next() {
 		if i == end {
 			return e.Value
 		}
@@ -192,11 +284,9 @@ func (rs *RedisServer) lindex(key string, index int) string {
 	return emptyBulkString
 }
 
-func (rs *RedisServer) ltrim(key string, start, end int) bool {
-	rs.lock.Lock()
-	defer rs.lock.Unlock()
+func (rs *RedisServer) ltrim(db *DB, key string, start, end int) bool {
 	i := 0
-	size := rs.store[rs.sp].ll[key].Len()
+	size := db.ll[key].Len()
 
 	_start := 0
 	if start < 0 {
@@ -221,7 +311,7 @@ func (rs *RedisServer) ltrim(key string, start, end int) bool {
 		return false
 	}
 
-	for e := rs.store[rs.sp].ll[key].Front(); e != nil; e = e.Next() {
+	for e := db.ll[key].Front(); e != nil; e = e.Next() {
 		if i >= _start && i <= _end {
 			i++
 			continue
@@ -230,30 +320,55 @@ func (rs *RedisServer) ltrim(key string, start, end int) bool {
 		// prev will be the one we were just before so we wont skip over
 		// any elements (using Next() will)
 		next := e.Prev()
-		rs.store[rs.sp].ll[key].Remove(e)
+		db.ll[key].Remove(e)
+		rs.dirty++
+		rs.signalModifiedKey(db, key)
 		e = next
 		i++
 	}
 	return true
 }
 
-func (rs *RedisServer) lpop(key string) string {
-	return rs.store[rs.sp].ll[key].Remove(rs.store[rs.sp].ll[key].Front())
+func (rs *RedisServer) lpop(db *DB, key string) string {
+	return rs.popList(db, key, true)
 }
 
-func (rs *RedisServer) rpop(key string) string {
-	return rs.store[rs.sp].ll[key].Remove(rs.store[rs.sp].ll[key].Back())
+func (rs *RedisServer) rpop(db *DB, key string) string {
+	return rs.popList(db, key, false)
+}
+
+// popList removes the first element of the list at key, or the last one when
+// left is false, and returns its value. The list is removed along with its
+// last element
+func (rs *RedisServer) popList(db *DB, key string, left bool) string {
+	e := db.ll[key].Back()
+	if left {
+		e = db.ll[key].Front()
+	}
+	val := db.ll[key].Remove(e)
+	rs.dirty++
+	if db.ll[key].Len() == 0 {
+		delete(db.ll, key)
+		delete(db.tstore, key)
+		delete(db.expires, key)
+		rs.signalModifiedKey(db, key)
+		return val
+	}
+	rs.signalModifiedList(db, key, listOp{left: left})
+	return val
 }
 
-func (rs *RedisServer) lset(key string, index int, val string) bool {
+func (rs *RedisServer) lset(db *DB, key string, index int, val string) bool {
 	i := 0
-	if i > rs.store[rs.sp].ll[key].Len() {
+	if i > db.ll[key].Len() {
 		return false
 	}
 
-	for e := rs.store[rs.sp].ll[key].Front(); e != nil; e = e.Next() {
+	for e := db.ll[key].Front(); e != nil; e = e.Next() {
 		if i == index {
-			rs.store[rs.sp].ll[key].InsertBefore(val, e)
+			db.ll[key].InsertBefore(val, e)
+			rs.dirty++
+			rs.signalModifiedKey(db, key)
 			return true
 		}
 		i++
@@ -261,16 +376,16 @@ func (rs *RedisServer) lset(key string, index int, val string) bool {
 	return false
 }
 
-func (rs *RedisServer) lrem(key string, count int, val string) string {
+func (rs *RedisServer) lrem(db *DB, key string, count int, val string) string {
 	// if count is negative we want to delete elements in reverse
 	elemsDeleted := 0
 	totToDelete := 0
 	if count < 0 {
 		totToDelete = count * -1
-		for e := rs.store[rs.sp].ll[key].Back(); e != nil; e = e.Prev() {
+		for e := db.ll[key].Back(); e != nil; e = e.Prev() {
 			if e.Value == val {
 				next := e.Next()
-				rs.store[rs.sp].ll[key].Remove(e)
+				db.ll[key].Remove(e)
 				e = next
 				elemsDeleted++
 				if elemsDeleted == totToDelete {
@@ -280,10 +395,10 @@ func (rs *RedisServer) lrem(key string, count int, val string) string {
 		}
 	} else if count > 0 {
 		totToDelete = count
-		for e := rs.store[rs.sp].ll[key].Front(); e != nil; e = e.Next() {
+		for e := db.ll[key].Front(); e != nil; e = e.Next() {
 			if e.Value == val {
 				next := e.Prev()
-				rs.store[rs.sp].ll[key].Remove(e)
+				db.ll[key].Remove(e)
 				e = next
 				elemsDeleted++
 				if elemsDeleted == totToDelete {
@@ -292,19 +407,23 @@ func (rs *RedisServer) lrem(key string, count int, val string) string {
 			}
 		}
 	} else {
-		for e := rs.store[rs.sp].ll[key].Front(); e != nil; e = e.Next() {
+		for e := db.ll[key].Front(); e != nil; e = e.Next() {
 			if e.Value == val {
 				next := e.Prev()
-				rs.store[rs.sp].ll[key].Remove(e)
+				db.ll[key].Remove(e)
 				e = next
 				elemsDeleted++
 			}
 		}
 	}
+	rs.dirty += uint64(elemsDeleted)
+	if elemsDeleted > 0 {
+		rs.signalModifiedKey(db, key)
+	}
 	return strconv.Itoa(elemsDeleted)
 }
 
-func (rs *RedisServer) keys(pattern string) ([]string, bool) {
+func (rs *RedisServer) keys(db *DB, pattern string) ([]string, bool) {
 	var g glob.Glob
 	g, err := glob.Compile(pattern)
 	if err != nil {
@@ -312,7 +431,10 @@ func (rs *RedisServer) keys(pattern string) ([]string, bool) {
 	}
 
 	result := make([]string, 0)
-	for s := range rs.store[rs.sp].tstore {
+	for s := range db.tstore {
+		if rs.expireIfNeeded(db, s) {
+			continue
+		}
 		if g.Match(s) {
 			result = append(result, s)
 		}
@@ -321,45 +443,77 @@ func (rs *RedisServer) keys(pattern string) ([]string, bool) {
 	return result, true
 }
 
-func (rs *RedisServer) random_key() string {
-	for s := range rs.store[rs.sp].tstore {
+func (rs *RedisServer) random_key(db *DB) string {
+	for s := range db.tstore {
+		if rs.expireIfNeeded(db, s) {
+			continue
+		}
 		return s
 	}
 	return ""
 }
 
-func (rs *RedisServer) rename(oldkey, newkey string) {
-	t := rs.getDBType(oldkey)
-	if t == "none" {
+func (rs *RedisServer) rename(db *DB, oldkey, newkey string) {
+	t := rs.getDBType(db, oldkey)
+	if t == "none" || oldkey == newkey {
 		return
 	}
-	delete(rs.store[rs.sp].tstore, oldkey)
-	rs.store[rs.sp].tstore[newkey] = dbTyp(t)
+	// whatever newkey held goes first, it may be of another type and so
+	// not be overwritten by the move
+	rs.del(db, newkey)
+	rs.dirty++
+	rs.signalModifiedKey(db, oldkey)
+	rs.signalModifiedKey(db, newkey)
+	delete(db.tstore, oldkey)
+	db.tstore[newkey] = dbTyp(t)
+	// the ttl follows the value to its new key
+	if at, ok := db.expires[oldkey]; ok {
+		delete(db.expires, oldkey)
+		db.expires[newkey] = at
+	}
 	switch t {
 	case "string":
-		if v, ok := rs.store[rs.sp].kv[oldkey]; ok {
-			rs.store[rs.sp].kv[newkey] = v
-			delete(rs.store[rs.sp].kv, oldkey)
+		if v, ok := db.kv[oldkey]; ok {
+			db.kv[newkey] = v
+			delete(db.kv, oldkey)
 			return
 		}
 	case "list":
-		if v, ok := rs.store[rs.sp].ll[oldkey]; ok {
-			rs.store[rs.sp].ll[newkey] = v
-			delete(rs.store[rs.sp].ll, oldkey)
+		if v, ok := db.ll[oldkey]; ok {
+			db.ll[newkey] = v
+			delete(db.ll, oldkey)
 			return
 		}
 	case "set":
-		if v, ok := rs.store[rs.sp].s[oldkey]; ok {
-			rs.store[rs.sp].s[newkey] = v
-			delete(rs.store[rs.sp].s, oldkey)
+		if v, ok := db.s[oldkey]; ok {
+			db.s[newkey] = v
+			delete(db.s, oldkey)
+			return
+		}
+	case "hash":
+		if v, ok := db.h[oldkey]; ok {
+			db.h[newkey] = v
+			delete(db.h, oldkey)
+			return
+		}
+	case "stream":
+		if v, ok := db.x[oldkey]; ok {
+			db.x[newkey] = v
+			delete(db.x, oldkey)
+			return
+		}
+	case "zset":
+		if v, ok := db.z[oldkey]; ok {
+			db.z[newkey] = v
+			delete(db.z, oldkey)
 			return
 		}
 	}
 }
 
-func (rs *RedisServer) rename_nx(oldkey, newkey string) string {
-	t := rs.getDBType(oldkey)
-	t1 := rs.getDBType(newkey)
+func (rs *RedisServer) rename_nx(db *DB, oldkey, newkey string) string {
+	t := rs.getDBType(db, oldkey)
+	t1 := rs.getDBType(db, newkey)
 	if oldkey == newkey {
 		return "-3"
 	}
@@ -369,264 +523,504 @@ func (rs *RedisServer) rename_nx(oldkey, newkey string) string {
 	if t == "none" {
 		return "-1"
 	}
-	rs.rename(oldkey, newkey)
+	rs.rename(db, oldkey, newkey)
 	return "1"
 }
 
-func (rs *RedisServer) dbsize() string {
-	return strconv.Itoa(len(rs.store[rs.sp].tstore))
+func (rs *RedisServer) dbsize(db *DB) string {
+	rs.purgeExpired(db)
+	return strconv.Itoa(len(db.tstore))
 }
 
 // Set Operations
 
-func (rs *RedisServer) sadd(key, member string) string {
-	t := rs.getDBType(key)
+// sadd adds members to the set at key, creating the set if needed, and
+// returns how many of them were new
+func (rs *RedisServer) sadd(db *DB, key string, members ...string) string {
+	t := rs.getDBType(db, key)
 	if t != "none" && t != "set" {
 		return "-2"
 	}
-	rs.lock.Lock()
-	defer rs.lock.Unlock()
 	// set our type so we know what type its associated with
-	rs.store[rs.sp].tstore[key] = tSet
+	db.tstore[key] = tSet
 
-	_, ok := rs.store[rs.sp].s[key]
+	_, ok := db.s[key]
 	if !ok {
-		rs.store[rs.sp].s[key] = make(map[string]struct{})
+		db.s[key] = make(map[string]struct{})
 	}
 
-	if _, ok := rs.store[rs.sp].s[key][member]; ok {
-		return "0"
+	added := 0
+	for _, member := range members {
+		if _, ok := db.s[key][member]; ok {
+			continue
+		}
+		db.s[key][member] = struct{}{}
+		added++
 	}
-
-	rs.store[rs.sp].s[key][member] = struct{}{}
-	return "1"
+	if added > 0 {
+		rs.dirty++
+		rs.signalModifiedMembers(db, key, members...)
+	}
+	return strconv.Itoa(added)
 }
 
-func (rs *RedisServer) smembers(key string) ([]string, bool) {
-	_, ok := rs.store[rs.sp].s[key]
+func (rs *RedisServer) smembers(db *DB, key string) ([]string, bool) {
+	_, ok := db.s[key]
 	if !ok {
 		return nil, false
 	}
 
 	result := make([]string, 0)
 
-	for v := range rs.store[rs.sp].s[key] {
+	for v := range db.s[key] {
 		result = append(result, v)
 	}
 	sort.Strings(result)
 	return result, true
 }
 
-func (rs *RedisServer) srem(key, member string) string {
-	t := rs.getDBType(key)
+// srem removes members from the set at key and returns how many of them were
+// there. The set is removed along with its last member
+func (rs *RedisServer) srem(db *DB, key string, members ...string) string {
+	t := rs.getDBType(db, key)
 	if t != "none" && t != "set" {
 		return "-2"
 	}
-	rs.lock.Lock()
-	defer rs.lock.Unlock()
 
-	_, ok := rs.store[rs.sp].s[key][member]
-	if ok {
-		delete(rs.store[rs.sp].s[key], member)
-		return "1"
+	removed := 0
+	for _, member := range members {
+		if _, ok := db.s[key][member]; ok {
+			delete(db.s[key], member)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return "0"
+	}
+	rs.dirty++
+	if len(db.s[key]) == 0 {
+		delete(db.s, key)
+		delete(db.tstore, key)
+		delete(db.expires, key)
+		rs.signalModifiedKey(db, key)
+		return strconv.Itoa(removed)
 	}
-	return "0"
+	rs.signalModifiedMembers(db, key, members...)
+	return strconv.Itoa(removed)
 }
 
-func (rs *RedisServer) scard(key string) string {
-	t := rs.getDBType(key)
+func (rs *RedisServer) scard(db *DB, key string) string {
+	t := rs.getDBType(db, key)
 	if t != "none" && t != "set" {
 		return "-2"
 	}
-	return strconv.Itoa(len(rs.store[rs.sp].s[key]))
+	return strconv.Itoa(len(db.s[key]))
 }
 
-func (rs *RedisServer) sismember(key, member string) string {
-	t := rs.getDBType(key)
+func (rs *RedisServer) sismember(db *DB, key, member string) string {
+	t := rs.getDBType(db, key)
 	if t != "none" && t != "set" {
 		return "-2"
 	}
 
-	_, ok := rs.store[rs.sp].s[key][member]
+	_, ok := db.s[key][member]
 	if !ok {
 		return "0"
 	}
 	return "1"
 }
 
-func (rs *RedisServer) sinter(keys ...string) []string {
-	result := make([]string, 0)
-
-	// TODO: This is probably super slow and maybe not great on mem
-	set := make(map[string]int)
+// sinterMembers returns the members that are in every set at keys, a missing
+// key counts as an empty set. It walks the smallest set and looks its members
+// up in the others, stopping once it has limit members when limit is above 0
+func sinterMembers(db *DB, keys []string, limit int) map[string]struct{} {
+	result := make(map[string]struct{})
+	sets := make([]map[string]struct{}, len(keys))
+	for i, key := range keys {
+		sets[i] = db.s[key]
+		if len(sets[i]) == 0 {
+			return result
+		}
+	}
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+
+	for member := range sets[0] {
+		inAll := true
+		for _, set := range sets[1:] {
+			if _, ok := set[member]; !ok {
+				inAll = false
+				break
+			}
+		}
+		if !inAll {
+			continue
+		}
+		result[member] = struct{}{}
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+	return result
+}
 
+// sunionMembers returns the members that are in any of the sets at keys
+func sunionMembers(db *DB, keys []string) map[string]struct{} {
+	result := make(map[string]struct{})
 	for _, key := range keys {
-		for k := range rs.store[rs.sp].s[key] {
-			set[k]++
+		for member := range db.s[key] {
+			result[member] = struct{}{}
 		}
 	}
+	return result
+}
 
-	for member, i := range set {
-		if i == len(keys) {
-			result = append(result, member)
+// sdiffMembers returns the members of the set at the first key that are in
+// none of the sets at the other keys
+func sdiffMembers(db *DB, keys []string) map[string]struct{} {
+	result := make(map[string]struct{})
+	for member := range db.s[keys[0]] {
+		inOther := false
+		for _, key := range keys[1:] {
+			if _, ok := db.s[key][member]; ok {
+				inOther = true
+				break
+			}
+		}
+		if !inOther {
+			result[member] = struct{}{}
 		}
 	}
+	return result
+}
 
+// sortedMembers returns the members of set in order so replies do not
+// depend on map iteration
+func sortedMembers(set map[string]struct{}) []string {
+	result := make([]string, 0, len(set))
+	for member := range set {
+		result = append(result, member)
+	}
 	sort.Strings(result)
 	return result
 }
 
-func (rs *RedisServer) sinterstore(dstKey string, keys ...string) {
-	set := make(map[string]int)
-	for _, key := range keys {
-		for k := range rs.store[rs.sp].s[key] {
-			set[k]++
-		}
+// randomMembers returns count distinct members of set picked at random, or
+// every member when set has no more than count
+func randomMembers(set map[string]struct{}, count int) []string {
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	if count >= len(members) {
+		return members
 	}
+	// only the first count places need to be shuffled
+	for i := 0; i < count; i++ {
+		j := i + rand.Intn(len(members)-i)
+		members[i], members[j] = members[j], members[i]
+	}
+	return members[:count]
+}
 
-	newSet := make(map[string]struct{})
+func (rs *RedisServer) sinter(db *DB, keys ...string) []string {
+	return sortedMembers(sinterMembers(db, keys, 0))
+}
 
-	rs.lock.Lock()
-	defer rs.lock.Unlock()
+// sstore replaces whatever is at key with set and returns its size, an empty
+// set removes key
+func (rs *RedisServer) sstore(db *DB, key string, set map[string]struct{}) int {
+	rs.del(db, key)
+	if len(set) == 0 {
+		return 0
+	}
+	db.tstore[key] = tSet
+	db.s[key] = set
+	rs.dirty++
+	rs.signalModifiedKey(db, key)
+	return len(set)
+}
 
-	for member, i := range set {
-		if i == len(keys) {
-			newSet[member] = struct{}{}
-		}
+func (rs *RedisServer) sinterstore(db *DB, dstKey string, keys ...string) {
+	rs.sstore(db, dstKey, sinterMembers(db, keys, 0))
+}
+
+// smove moves member from the set at src to the set at dst and reports
+// whether it was in src
+func (rs *RedisServer) smove(db *DB, src, dst, member string) bool {
+	if _, ok := db.s[src][member]; !ok {
+		return false
+	}
+	if src == dst {
+		return true
 	}
+	rs.srem(db, src, member)
+	rs.sadd(db, dst, member)
+	return true
+}
 
-	rs.store[rs.sp].tstore[dstKey] = tSet
-	rs.store[rs.sp].s[dstKey] = newSet
+// spop removes count members picked at random from the set at key and
+// returns them
+func (rs *RedisServer) spop(db *DB, key string, count int) []string {
+	popped := randomMembers(db.s[key], count)
+	if len(popped) > 0 {
+		rs.srem(db, key, popped...)
+	}
+	return popped
 }
 
-func (rs *RedisServer) move(key string, dbIndex int) string {
+// Hash Operations
+
+// hset sets field of the hash at key to value and reports whether the field is
+// new
+func (rs *RedisServer) hset(db *DB, key, field, value string) bool {
+	// set our type so we know what type its associated with
+	db.tstore[key] = tHash
+
+	if _, ok := db.h[key]; !ok {
+		db.h[key] = make(map[string]string)
+	}
+	_, exists := db.h[key][field]
+	db.h[key][field] = value
+	rs.dirty++
+	rs.signalModifiedMembers(db, key, field)
+	return !exists
+}
+
+func (rs *RedisServer) hget(db *DB, key, field string) (string, bool) {
+	val, ok := db.h[key][field]
+	return val, ok
+}
+
+// hdel removes field from the hash at key and reports whether it was there.
+// Like lists and sets a hash is removed along with its last field
+func (rs *RedisServer) hdel(db *DB, key, field string) bool {
+	if _, ok := db.h[key][field]; !ok {
+		return false
+	}
+	delete(db.h[key], field)
+	rs.dirty++
+	if len(db.h[key]) == 0 {
+		delete(db.h, key)
+		delete(db.tstore, key)
+		delete(db.expires, key)
+		rs.signalModifiedKey(db, key)
+		return true
+	}
+	rs.signalModifiedMembers(db, key, field)
+	return true
+}
+
+// hfields returns the fields of the hash at key in order
+func (rs *RedisServer) hfields(db *DB, key string) []string {
+	fields := make([]string, 0, len(db.h[key]))
+	for field := range db.h[key] {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// move takes the index of the db the key currently lives in (the clients
+// selected db) so that it can be compared against the target db index
+func (rs *RedisServer) move(srcIndex int, key string, dbIndex int) string {
 	// target db index matches the current db index
-	if int64(dbIndex) == rs.sp {
+	if dbIndex == srcIndex {
 		return "-3"
 	}
-	if dbIndex < 0 || int64(dbIndex) > NumDBs {
+	if dbIndex < 0 || dbIndex >= len(rs.store) {
 		// db index is out of range
 		return "-4"
 	}
 
+	db := rs.store[srcIndex]
+	rs.expireIfNeeded(rs.store[dbIndex], key)
 	// If it doesnt exist in our db or does exist in the target db return 0
-	typValue, existsInOurDB := rs.store[rs.sp].tstore[key]
+	typValue, existsInOurDB := db.tstore[key]
 	_, existsInTargetDB := rs.store[dbIndex].tstore[key]
 	if !existsInOurDB || existsInTargetDB {
 		return "0"
 	}
 
-	rs.lock.Lock()
-	defer rs.lock.Unlock()
-
 	switch typValue {
 	case tList:
-		value := rs.store[rs.sp].ll[key]
-		delete(rs.store[rs.sp].ll, key)
+		value := db.ll[key]
+		delete(db.ll, key)
 		rs.store[dbIndex].ll[key] = value
 	case tSet:
-		value := rs.store[rs.sp].s[key]
-		delete(rs.store[rs.sp].s, key)
+		value := db.s[key]
+		delete(db.s, key)
 		rs.store[dbIndex].s[key] = value
 	case tString:
-		value := rs.store[rs.sp].kv[key]
-		delete(rs.store[rs.sp].kv, key)
+		value := db.kv[key]
+		delete(db.kv, key)
 		rs.store[dbIndex].kv[key] = value
+	case tHash:
+		value := db.h[key]
+		delete(db.h, key)
+		rs.store[dbIndex].h[key] = value
+	case tStream:
+		value := db.x[key]
+		delete(db.x, key)
+		rs.store[dbIndex].x[key] = value
+	case tZset:
+		value := db.z[key]
+		delete(db.z, key)
+		rs.store[dbIndex].z[key] = value
 	}
 
 	rs.store[dbIndex].tstore[key] = typValue
-	delete(rs.store[rs.sp].tstore, key)
+	delete(db.tstore, key)
+	if at, ok := db.expires[key]; ok {
+		rs.store[dbIndex].expires[key] = at
+		delete(db.expires, key)
+	}
+	rs.dirty++
+	rs.signalModifiedKey(db, key)
+	rs.signalModifiedKey(rs.store[dbIndex], key)
 	return "1"
 }
 
-func (rs *RedisServer) flushDB() {
-	rs.store[rs.sp] = NewDB()
+func (rs *RedisServer) flushDB(db *DB) {
+	// reset the db in place so every client that has it selected sees the flush
+	*db = *NewDB()
+	rs.dirty++
+	rs.signalModifiedDB(db)
 }
 
 func (rs *RedisServer) flushall() {
-	rs.store[0] = NewDB()
-	rs.store[1] = NewDB()
-	rs.store[2] = NewDB()
-	rs.store[3] = NewDB()
-	rs.store[4] = NewDB()
-	rs.store[5] = NewDB()
-	rs.store[6] = NewDB()
-	rs.store[7] = NewDB()
-	rs.store[8] = NewDB()
-	rs.store[9] = NewDB()
-}
-
-func createSaveDBTablesIfNotExists(saveDb *sql.DB) {
-	typeStoreTableSQL := `CREATE TABLE IF NOT EXISTS typeStore(
+	for i := range rs.store {
+		rs.store[i] = NewDB()
+	}
+	rs.dirty++
+	for _, db := range rs.store {
+		rs.signalModifiedDB(db)
+	}
+}
+
+// saveDBTableSQL creates the tables of the save db, a snapshot has rows in
+// every one of them
+var saveDBTableSQL = []string{
+	`CREATE TABLE IF NOT EXISTS typeStore(
 		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"dbID" INTEGER NOT NULL,
 		"key" TEXT NOT NULL,
 		"typ" TEXT NOT NULL,
 		"saveID" TEXT NOT NULL
-	);`
-
-	kvStoreTableSQL := `CREATE TABLE IF NOT EXISTS kvStore(
+	);`,
+	`CREATE TABLE IF NOT EXISTS kvStore(
 		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"dbID" INTEGER NOT NULL,
 		"key" TEXT NOT NULL,
 		"val" TEXT NOT NULL,
 		"saveID" TEXT NOT NULL
-	);`
-
-	setStoreTableSQL := `CREATE TABLE IF NOT EXISTS setStore(
+	);`,
+	`CREATE TABLE IF NOT EXISTS setStore(
 		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"dbID" INTEGER NOT NULL,
 		"key" TEXT NOT NULL,
 		"val" TEXT NOT NULL,
 		"saveID" TEXT NOT NULL
-	);`
-
-	listStoreTableSQL := `CREATE TABLE IF NOT EXISTS listStore(
+	);`,
+	`CREATE TABLE IF NOT EXISTS listStore(
 		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"dbID" INTEGER NOT NULL,
 		"key" TEXT NOT NULL,
 		"elemIndex" INTEGER NOT NULL,
 		"val" TEXT NOT NULL,
 		"saveID" TEXT NOT NULL
-	);`
-
-	lastSaveTableSQL := `CREATE TABLE IF NOT EXISTS lastsave(
+	);`,
+	`CREATE TABLE IF NOT EXISTS hashStore(
+		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"dbID" INTEGER NOT NULL,
+		"key" TEXT NOT NULL,
+		"field" TEXT NOT NULL,
+		"val" TEXT NOT NULL,
+		"saveID" TEXT NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS zsetStore(
+		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"dbID" INTEGER NOT NULL,
+		"key" TEXT NOT NULL,
+		"member" TEXT NOT NULL,
+		"score" TEXT NOT NULL,
+		"saveID" TEXT NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS streamStore(
+		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"dbID" INTEGER NOT NULL,
+		"key" TEXT NOT NULL,
+		"lastID" TEXT NOT NULL,
+		"saveID" TEXT NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS streamEntryStore(
+		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"dbID" INTEGER NOT NULL,
+		"key" TEXT NOT NULL,
+		"entryIndex" INTEGER NOT NULL,
+		"entryID" TEXT NOT NULL,
+		"fieldIndex" INTEGER NOT NULL,
+		"field" TEXT NOT NULL,
+		"val" TEXT NOT NULL,
+		"saveID" TEXT NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS streamGroupStore(
+		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"dbID" INTEGER NOT NULL,
+		"key" TEXT NOT NULL,
+		"groupName" TEXT NOT NULL,
+		"lastID" TEXT NOT NULL,
+		"saveID" TEXT NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS streamConsumerStore(
+		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"dbID" INTEGER NOT NULL,
+		"key" TEXT NOT NULL,
+		"groupName" TEXT NOT NULL,
+		"consumer" TEXT NOT NULL,
+		"seenTime" INTEGER NOT NULL,
+		"saveID" TEXT NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS streamPendingStore(
+		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"dbID" INTEGER NOT NULL,
+		"key" TEXT NOT NULL,
+		"groupName" TEXT NOT NULL,
+		"entryID" TEXT NOT NULL,
+		"consumer" TEXT NOT NULL,
+		"deliveryTime" INTEGER NOT NULL,
+		"deliveryCount" INTEGER NOT NULL,
+		"saveID" TEXT NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS expireStore(
+		"ID" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"dbID" INTEGER NOT NULL,
+		"key" TEXT NOT NULL,
+		"expireAt" INTEGER NOT NULL,
+		"saveID" TEXT NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS lastsave(
 		"saveID" TEXT NOT NULL PRIMARY KEY,
 		"lastsave" INTEGER NOT NULL
-	);`
-
-	prepTypeStore, err := saveDb.Prepare(typeStoreTableSQL)
-	check(err)
-	defer prepTypeStore.Close()
-
-	prepKvStore, err := saveDb.Prepare(kvStoreTableSQL)
-	check(err)
-	defer prepKvStore.Close()
-
-	prepSetStore, err := saveDb.Prepare(setStoreTableSQL)
-	check(err)
-	defer prepSetStore.Close()
-
-	prepListStore, err := saveDb.Prepare(listStoreTableSQL)
-	check(err)
-	defer prepListStore.Close()
+	);`,
+}
 
-	prepLastSave, err := saveDb.Prepare(lastSaveTableSQL)
-	check(err)
-	defer prepLastSave.Close()
+func createSaveDBTablesIfNotExists(saveDb *sql.DB) error {
+	for _, tableSQL := range saveDBTableSQL {
+		if _, err := saveDb.Exec(tableSQL); err != nil {
+			return err
+		}
+	}
 
-	_, err = prepTypeStore.Exec()
-	check(err)
-	_, err = prepKvStore.Exec()
-	check(err)
-	_, err = prepSetStore.Exec()
-	check(err)
-	_, err = prepListStore.Exec()
-	check(err)
-	_, err = prepLastSave.Exec()
-	check(err)
+	// every read of a snapshot looks its rows up by saveID
+	for _, table := range snapshotStoreTables {
+		_, err := saveDb.Exec(`CREATE INDEX IF NOT EXISTS ` + table + `SaveID ON ` + table + `(saveID);`)
+		if err != nil {
+			return err
+		}
+	}
 
-	log.Printf("Created DB Tables for Save")
+	serverLog(logVerbose, "Created DB Tables for Save")
+	return nil
 }
 
 type dbFile struct {
@@ -634,92 +1028,318 @@ type dbFile struct {
 	f  *os.File
 }
 
-func createSaveDBIfNotExists() *dbFile {
+func createSaveDBIfNotExists(dbName string) (*dbFile, error) {
 	// Put this into separate file and make a struct with it
 	// then this wont be messed up
-	dbName := "save.db"
 	_, err := os.Stat(dbName)
 	if err != nil {
 		file, err := os.Create(dbName)
-		check(err)
+		if err != nil {
+			return nil, err
+		}
 		file.Close()
 	}
 
 	file, err := os.Open(dbName)
-	check(err)
+	if err != nil {
+		return nil, err
+	}
+
+	// WAL lets the time travel commands and SNAPSHOT read the save db while
+	// a save writes its snapshot
+	saveDb, err := sql.Open("sqlite", "file:"+dbName+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &dbFile{db: saveDb, f: file}, nil
+}
+
+// save serializes the dataset to the save db. The caller must hold rs.lock so
+// that nothing writes to the store while it is read
+func (rs *RedisServer) save() error {
+	if err := rs.saveStore(rs.store, rs.config, rs.tier); err != nil {
+		return err
+	}
+	rs.dirty = 0
+	return nil
+}
 
-	saveDb, err := sql.Open("sqlite", "./save.db")
-	check(err)
+var errBgsaveInProgress = errors.New("ERR Background save already in progress")
 
-	return &dbFile{db: saveDb, f: file}
+// bgsave copies the dataset and writes the copy out in the background, so the
+// snapshot is exactly the dataset at the time of the call and clients can keep
+// writing while it is saved. The caller must hold rs.lock
+func (rs *RedisServer) bgsave() error {
+	if !atomic.CompareAndSwapInt32(&rs.bgsaveInProgress, 0, 1) {
+		return errBgsaveInProgress
+	}
+	store, cfg, t, dirty := rs.frozenStore(), rs.config, rs.tier, rs.dirty
+	rs.lastBgsaveTry = time.Now().Unix()
+	go func() {
+		err := rs.saveStore(store, cfg, t)
+		rs.lock.Lock()
+		if err == nil {
+			// writes made while saving still count towards the next save
+			if rs.dirty >= dirty {
+				rs.dirty -= dirty
+			} else {
+				rs.dirty = 0
+			}
+		}
+		rs.lock.Unlock()
+		atomic.StoreInt32(&rs.bgsaveInProgress, 0)
+	}()
+	return nil
 }
 
-// Serializing in memory db to physical db using sqlite
-func (rs *RedisServer) save() {
-	saveDb := createSaveDBIfNotExists()
+// frozenStore returns a copy of every db as it is right now which can be
+// written out by saveStore after rs.lock is released. The values of cold keys
+// are not copied, the tier keeps their rows while a background job runs. The
+// caller must hold rs.lock
+func (rs *RedisServer) frozenStore() []*DB {
+	store := make([]*DB, len(rs.store))
+	for i, db := range rs.store {
+		store[i] = db.clone()
+	}
+	return store
+}
+
+// saveStore serializes store to the save db (sqlite) as a new snapshot, with
+// the values of cold keys read from t, and prunes old ones by cfg. Only one
+// snapshot is written at a time. The result is recorded as the last save
+// status
+func (rs *RedisServer) saveStore(store []*DB, cfg serverConfig, t *tier) error {
+	rs.saveLock.Lock()
+	defer rs.saveLock.Unlock()
 
-	createSaveDBTablesIfNotExists(saveDb.db)
+	err := rs.writeSnapshot(store, cfg, t)
+	if err != nil {
+		serverLog(logWarning, "Failed to Save Snapshot: %v\n", err)
+		rs.lastBgsaveStatus.Store("err")
+		return err
+	}
+	rs.lastBgsaveStatus.Store("ok")
+	return nil
+}
+
+func (rs *RedisServer) writeSnapshot(store []*DB, cfg serverConfig, t *tier) error {
+	saveDb, err := createSaveDBIfNotExists(cfg.dbFilename)
+	if err != nil {
+		return err
+	}
 	defer saveDb.db.Close()
 	defer saveDb.f.Close()
 
-	insertTypeStoreSQL := `INSERT INTO typeStore(dbID, key, typ, saveID) VALUES (?, ?, ?, ?);`
-	prepTypeStore, err := saveDb.db.Prepare(insertTypeStoreSQL)
-	check(err)
-	defer prepTypeStore.Close()
+	if err := createSaveDBTablesIfNotExists(saveDb.db); err != nil {
+		return err
+	}
+
+	// the whole snapshot goes in one transaction so it is either fully
+	// present or not there at all
+	tx, err := saveDb.db.Begin()
+	if err != nil {
+		return err
+	}
+	saveID := uuid.New().String()
+	lastSave := time.Now().Unix()
+	if err := insertSnapshot(tx, store, t, saveID, lastSave); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 
-	insertKvStoreSQL := `INSERT INTO kvStore(dbID, key, val, saveID) VALUES (?, ?, ?, ?);`
-	prepKvStore, err := saveDb.db.Prepare(insertKvStoreSQL)
-	check(err)
-	defer prepKvStore.Close()
+	atomic.StoreInt64(&rs.lastsave, lastSave)
 
-	inserSetStoreSQL := `INSERT INTO setStore(dbID, key, val, saveID) VALUES (?, ?, ?, ?);`
-	prepSetStore, err := saveDb.db.Prepare(inserSetStoreSQL)
-	check(err)
-	defer prepSetStore.Close()
+	pruned, err := pruneSnapshots(saveDb.db, cfg)
+	if err != nil {
+		// the snapshot itself is saved so only report the failure
+		serverLog(logWarning, "Failed to Prune Snapshots: %v\n", err)
+	}
+	atomic.AddUint64(&rs.snapshotsPruned, uint64(pruned))
+	return nil
+}
 
-	insertListStoreSQL := `INSERT INTO listStore(dbID, key, elemIndex, val, saveID) VALUES (?, ?, ?, ?, ?);`
-	prepListStore, err := saveDb.db.Prepare(insertListStoreSQL)
-	check(err)
-	defer prepListStore.Close()
+// insertSnapshot writes every row of store under saveID in tx. The values of
+// cold keys are read from t
+func insertSnapshot(tx *sql.Tx, store []*DB, t *tier, saveID string, lastSave int64) error {
+	typeStore := newBatchInserter(tx, "typeStore", "dbID", "key", "typ", "saveID")
+	kvStore := newBatchInserter(tx, "kvStore", "dbID", "key", "val", "saveID")
+	setStore := newBatchInserter(tx, "setStore", "dbID", "key", "val", "saveID")
+	listStore := newBatchInserter(tx, "listStore", "dbID", "key", "elemIndex", "val", "saveID")
+	hashStore := newBatchInserter(tx, "hashStore", "dbID", "key", "field", "val", "saveID")
+	zsetStore := newBatchInserter(tx, "zsetStore", "dbID", "key", "member", "score", "saveID")
+	streamStore := newBatchInserter(tx, "streamStore", "dbID", "key", "lastID", "saveID")
+	streamEntryStore := newBatchInserter(tx, "streamEntryStore", "dbID", "key", "entryIndex", "entryID", "fieldIndex", "field", "val", "saveID")
+	streamGroupStore := newBatchInserter(tx, "streamGroupStore", "dbID", "key", "groupName", "lastID", "saveID")
+	streamConsumerStore := newBatchInserter(tx, "streamConsumerStore", "dbID", "key", "groupName", "consumer", "seenTime", "saveID")
+	streamPendingStore := newBatchInserter(tx, "streamPendingStore", "dbID", "key", "groupName", "entryID", "consumer", "deliveryTime", "deliveryCount", "saveID")
+	expireStore := newBatchInserter(tx, "expireStore", "dbID", "key", "expireAt", "saveID")
+	inserters := []*batchInserter{typeStore, kvStore, setStore, listStore, hashStore, zsetStore, streamStore, streamEntryStore, streamGroupStore, streamConsumerStore, streamPendingStore, expireStore}
+	defer func() {
+		for _, b := range inserters {
+			b.close()
+		}
+	}()
 
-	saveID := uuid.New().String()
-	for dbIndex := 0; dbIndex < NumDBs; dbIndex++ {
-		dbi := fmt.Sprintf("%d", dbIndex)
-		for key, val := range rs.store[dbIndex].tstore {
-			_, err := prepTypeStore.Exec(dbi, key, string(val), saveID)
-			check(err)
-		}
-		for key, val := range rs.store[dbIndex].kv {
-			_, err := prepKvStore.Exec(dbi, key, val, saveID)
-			check(err)
-		}
-		for key, val := range rs.store[dbIndex].s {
-			for k := range val {
-				_, err := prepSetStore.Exec(dbi, key, k, saveID)
-				check(err)
+	for dbIndex := range store {
+		for key, typ := range store[dbIndex].tstore {
+			if err := typeStore.add(dbIndex, key, string(typ), saveID); err != nil {
+				return err
+			}
+			db, err := t.valueDB(dbIndex, store[dbIndex], key)
+			if err != nil {
+				return err
+			}
+			switch typ {
+			case tString:
+				if err := kvStore.add(dbIndex, key, db.kv[key], saveID); err != nil {
+					return err
+				}
+			case tSet:
+				for k := range db.s[key] {
+					if err := setStore.add(dbIndex, key, k, saveID); err != nil {
+						return err
+					}
+				}
+			case tList:
+				i := 0
+				for e := db.ll[key].Front(); e != nil; e = e.Next() {
+					if err := listStore.add(dbIndex, key, i, e.Value, saveID); err != nil {
+						return err
+					}
+					i++
+				}
+			case tHash:
+				for field, val := range db.h[key] {
+					if err := hashStore.add(dbIndex, key, field, val, saveID); err != nil {
+						return err
+					}
+				}
+			case tZset:
+				for e := db.z[key].zsl.Front(); e != nil; e = e.Next() {
+					if err := zsetStore.add(dbIndex, key, e.Member, formatScore(e.Score), saveID); err != nil {
+						return err
+					}
+				}
+			case tStream:
+				st := db.x[key]
+				if err := streamStore.add(dbIndex, key, st.lastID.String(), saveID); err != nil {
+					return err
+				}
+				for i, e := range st.entries {
+					for j := 0; j < len(e.fields); j += 2 {
+						if err := streamEntryStore.add(dbIndex, key, i, e.id.String(), j/2, e.fields[j], e.fields[j+1], saveID); err != nil {
+							return err
+						}
+					}
+				}
+				for name, g := range st.groups {
+					if err := streamGroupStore.add(dbIndex, key, name, g.lastID.String(), saveID); err != nil {
+						return err
+					}
+					for consumer, cons := range g.consumers {
+						if err := streamConsumerStore.add(dbIndex, key, name, consumer, cons.seenTime, saveID); err != nil {
+							return err
+						}
+					}
+					for id, p := range g.pending {
+						if err := streamPendingStore.add(dbIndex, key, name, id.String(), p.consumer, p.deliveryTime, p.deliveryCount, saveID); err != nil {
+							return err
+						}
+					}
+				}
 			}
 		}
-		for key, val := range rs.store[dbIndex].ll {
-			i := 0
-			for e := val.Front(); e != nil; e = e.Next() {
-				_, err := prepListStore.Exec(dbi, key, i, e.Value, saveID)
-				check(err)
-				i++
+		for key, at := range store[dbIndex].expires {
+			if err := expireStore.add(dbIndex, key, at, saveID); err != nil {
+				return err
 			}
 		}
 	}
+	for _, b := range inserters {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
 
 	// Update Lastsave
 	// write lastsave val and uuid to new table that will be our mapping
-	lastSave := time.Now().Unix()
-	lastSaveInsertSQL := fmt.Sprintf(`INSERT INTO lastsave(saveID, lastsave) VALUES ("%s", %d);`, saveID, lastSave)
-	prepLastSaveInsert, err := saveDb.db.Prepare(lastSaveInsertSQL)
-	check(err)
-	defer prepLastSaveInsert.Close()
-	_, err = prepLastSaveInsert.Exec()
-	check(err)
+	_, err := tx.Exec(`INSERT INTO lastsave(saveID, lastsave) VALUES (?, ?);`, saveID, lastSave)
+	return err
+}
 
-	atomic.StoreInt64(&rs.lastsave, lastSave)
+// saveBatchSize is how many rows a single INSERT of a snapshot writes
+const saveBatchSize = 128
+
+// batchInserter inserts rows into one table saveBatchSize rows at a time
+// using a statement that is prepared once per save
+type batchInserter struct {
+	tx      *sql.Tx
+	table   string
+	columns []string
+	// full is prepared on first use to insert a whole batch
+	full *sql.Stmt
+	args []interface{}
+	rows int
+}
+
+func newBatchInserter(tx *sql.Tx, table string, columns ...string) *batchInserter {
+	return &batchInserter{tx: tx, table: table, columns: columns}
+}
+
+// insertSQL returns an INSERT of n rows into the table
+func (b *batchInserter) insertSQL(n int) string {
+	row := "(?" + strings.Repeat(", ?", len(b.columns)-1) + ")"
+	rows := make([]string, n)
+	for i := range rows {
+		rows[i] = row
+	}
+	return `INSERT INTO ` + b.table + `(` + strings.Join(b.columns, ", ") + `) VALUES ` + strings.Join(rows, ", ") + `;`
+}
+
+// add queues a row and writes the batch once it is full
+func (b *batchInserter) add(vals ...interface{}) error {
+	b.args = append(b.args, vals...)
+	b.rows++
+	if b.rows < saveBatchSize {
+		return nil
+	}
+	if b.full == nil {
+		stmt, err := b.tx.Prepare(b.insertSQL(saveBatchSize))
+		if err != nil {
+			return err
+		}
+		b.full = stmt
+	}
+	if _, err := b.full.Exec(b.args...); err != nil {
+		return err
+	}
+	b.args = b.args[:0]
+	b.rows = 0
+	return nil
+}
+
+// flush writes the rows of the last partial batch
+func (b *batchInserter) flush() error {
+	if b.rows == 0 {
+		return nil
+	}
+	if _, err := b.tx.Exec(b.insertSQL(b.rows), b.args...); err != nil {
+		return err
+	}
+	b.args = b.args[:0]
+	b.rows = 0
+	return nil
+}
+
+func (b *batchInserter) close() {
+	if b.full != nil {
+		b.full.Close()
+	}
 }
 
 func (rs *RedisServer) info() []string {
@@ -740,11 +1360,50 @@ func (rs *RedisServer) info() []string {
 	uptimeInDays := uptimeInSecs / 60 / 60 / 24
 
 	versionString := fmt.Sprintf("server_version:%s\n", ServerVersion)
-	connsString := fmt.Sprintf("connected_clients:%d\n", len(rs.conns))
+	connsString := fmt.Sprintf("connected_clients:%d\n", len(rs.clients))
 	usedMemString := fmt.Sprintf("used_memory:%d\n", m.Alloc)
-	lastSaveString := fmt.Sprintf("last_save_time:%d\n", rs.lastsave)
+	lastSaveString := fmt.Sprintf("last_save_time:%d\n", atomic.LoadInt64(&rs.lastsave))
+	bgsaveInProgress := fmt.Sprintf("bgsave_in_progress:%d\n", atomic.LoadInt32(&rs.bgsaveInProgress))
+	lastBgsaveStatus := fmt.Sprintf("rdb_last_bgsave_status:%s\n", rs.lastBgsaveStatus.Load())
+	changesSinceLastSave := fmt.Sprintf("changes_since_last_save:%d\n", rs.dirty)
+	aofOn := 0
+	if rs.aof != nil {
+		aofOn = 1
+	}
+	aofEnabled := fmt.Sprintf("aof_enabled:%d\n", aofOn)
+	aofRewriteInProgress := fmt.Sprintf("aof_rewrite_in_progress:%d\n", atomic.LoadInt32(&rs.aofRewriteInProgress))
+	aofLastRewriteStatus := fmt.Sprintf("aof_last_bgrewrite_status:%s\n", rs.aofLastRewriteStatus)
+	aofLastWriteStatus := fmt.Sprintf("aof_last_write_status:%s\n", rs.aofLastWriteStatus)
+	wtOn := 0
+	if rs.wt != nil {
+		wtOn = 1
+	}
+	wtEnabled := fmt.Sprintf("writethrough_enabled:%d\n", wtOn)
+	wtLastWriteStatus := fmt.Sprintf("writethrough_last_write_status:%s\n", rs.wtLastWriteStatus)
+	var tierUsed int64
+	var coldKeys int
+	var tierEvicted, tierLoaded uint64
+	if rs.tier != nil {
+		rs.tier.updateSizes(rs.store)
+		tierUsed, tierEvicted, tierLoaded = rs.tier.used, rs.tier.evicted, rs.tier.loaded
+		for _, db := range rs.store {
+			coldKeys += len(db.cold)
+		}
+	}
+	maxmemory := fmt.Sprintf("maxmemory:%d\n", rs.config.maxmemory)
+	tierUsedMemory := fmt.Sprintf("tier_used_memory:%d\n", tierUsed)
+	tierColdKeys := fmt.Sprintf("tier_cold_keys:%d\n", coldKeys)
+	tierEvictedKeys := fmt.Sprintf("tier_evicted_keys:%d\n", tierEvicted)
+	tierLoadedKeys := fmt.Sprintf("tier_loaded_keys:%d\n", tierLoaded)
+	pubsubChannels := fmt.Sprintf("pubsub_channels:%d\n", len(rs.pubsubChannels))
+	pubsubPatterns := fmt.Sprintf("pubsub_patterns:%d\n", len(rs.pubsubPatterns))
 	totConnRecv := fmt.Sprintf("total_connections_received:%d\n", rs.totalConnsReceived)
 	totCommProc := fmt.Sprintf("total_commands_processed:%d\n", rs.commandsProcessed)
+	expiredKeysString := fmt.Sprintf("expired_keys:%d\n", rs.expiredKeys)
+	snapshotKeepString := fmt.Sprintf("snapshot_keep:%d\n", rs.config.snapshotKeep)
+	snapshotMaxAgeString := fmt.Sprintf("snapshot_max_age:%d\n", rs.config.snapshotMaxAge)
+	snapshotVacuumString := fmt.Sprintf("snapshot_vacuum:%s\n", formatYesNo(rs.config.snapshotVacuum))
+	snapshotsPrunedString := fmt.Sprintf("snapshots_pruned:%d\n", atomic.LoadUint64(&rs.snapshotsPruned))
 	uptInSecString := fmt.Sprintf("uptime_in_seconds:%d\n", uptimeInSecs)
 	uptInDayString := fmt.Sprintf("uptime_in_days:%d\n", uptimeInDays)
 
@@ -753,8 +1412,29 @@ func (rs *RedisServer) info() []string {
 		connsString,
 		usedMemString,
 		lastSaveString,
+		bgsaveInProgress,
+		lastBgsaveStatus,
+		changesSinceLastSave,
+		aofEnabled,
+		aofRewriteInProgress,
+		aofLastRewriteStatus,
+		aofLastWriteStatus,
+		wtEnabled,
+		wtLastWriteStatus,
+		maxmemory,
+		tierUsedMemory,
+		tierColdKeys,
+		tierEvictedKeys,
+		tierLoadedKeys,
+		pubsubChannels,
+		pubsubPatterns,
+		snapshotKeepString,
+		snapshotMaxAgeString,
+		snapshotVacuumString,
+		snapshotsPrunedString,
 		totConnRecv,
 		totCommProc,
+		expiredKeysString,
 		uptInSecString,
 		uptInDayString,
 	}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sc/list"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxListDiffCells caps the size of the table used to line up the elements of
+// two lists. Lists that differ by more than this are reported as every
+// differing element removed and then added again
+const maxListDiffCells = 1 << 22
+
+// A snapshot diff is reported one change per line, like a unified diff:
+//
+//	+ db0 "key" string          key added with its type
+//	- db0 "key" list            key removed with its type
+//	~ db0 "key" type list set   key changed type
+//	~ db0 "key" "old" "new"     string value changed
+//	~ db0 "key" +"member"       set member added
+//	~ db0 "key" -"member"       set member removed
+//	~ db0 "key" +[i] "elem"     list element inserted at index i of the new list
+//	~ db0 "key" -[i] "elem"     list element removed from index i of the old list
+//	~ db0 "key" +"field" "val"  hash field added
+//	~ db0 "key" -"field" "val"  hash field removed
+//	~ db0 "key" ~"field" "old" "new"  hash field changed value
+//	~ db0 "key" +1-0 "f" "v"    stream entry added with its fields
+//	~ db0 "key" -1-0 "f" "v"    stream entry removed with its fields
+//	~ db0 "key" +"member" 1     sorted set member added with its score
+//	~ db0 "key" -"member" 1     sorted set member removed with its score
+//	~ db0 "key" ~"member" 1 2   sorted set member changed score
+
+// diffSnapshots compares the dbs of two snapshots and returns the changes that
+// turn a into b. When dbIndex is not -1 only that db is compared
+func diffSnapshots(a, b []*DB, dbIndex int) []string {
+	lines := make([]string, 0)
+	for i := range a {
+		if dbIndex != -1 && i != dbIndex {
+			continue
+		}
+		lines = append(lines, diffDB(i, a[i], b[i])...)
+	}
+	return lines
+}
+
+// diffDB compares a single db of two snapshots. Keys are reported in order
+func diffDB(dbIndex int, a, b *DB) []string {
+	keys := make([]string, 0, len(a.tstore)+len(b.tstore))
+	for key := range a.tstore {
+		keys = append(keys, key)
+	}
+	for key := range b.tstore {
+		if _, ok := a.tstore[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0)
+	for _, key := range keys {
+		prefix := fmt.Sprintf("db%d %q", dbIndex, key)
+		typA, inA := a.tstore[key]
+		typB, inB := b.tstore[key]
+		switch {
+		case !inA:
+			lines = append(lines, fmt.Sprintf("+ %s %s", prefix, typB))
+		case !inB:
+			lines = append(lines, fmt.Sprintf("- %s %s", prefix, typA))
+		case typA != typB:
+			lines = append(lines, fmt.Sprintf("~ %s type %s %s", prefix, typA, typB))
+		case typA == tString:
+			if a.kv[key] != b.kv[key] {
+				lines = append(lines, fmt.Sprintf("~ %s %q %q", prefix, a.kv[key], b.kv[key]))
+			}
+		case typA == tSet:
+			for _, change := range diffSet(a.s[key], b.s[key]) {
+				lines = append(lines, "~ "+prefix+" "+change)
+			}
+		case typA == tList:
+			for _, change := range diffList(listValues(a.ll[key]), listValues(b.ll[key])) {
+				lines = append(lines, "~ "+prefix+" "+change)
+			}
+		case typA == tHash:
+			for _, change := range diffHash(a.h[key], b.h[key]) {
+				lines = append(lines, "~ "+prefix+" "+change)
+			}
+		case typA == tStream:
+			for _, change := range diffStream(a.x[key], b.x[key]) {
+				lines = append(lines, "~ "+prefix+" "+change)
+			}
+		case typA == tZset:
+			for _, change := range diffZset(a.z[key], b.z[key]) {
+				lines = append(lines, "~ "+prefix+" "+change)
+			}
+		}
+	}
+	return lines
+}
+
+// diffSet returns the members added to and removed from a set, sorted
+func diffSet(a, b map[string]struct{}) []string {
+	changes := make([]string, 0)
+	for member := range b {
+		if _, ok := a[member]; !ok {
+			changes = append(changes, fmt.Sprintf("+%q", member))
+		}
+	}
+	for member := range a {
+		if _, ok := b[member]; !ok {
+			changes = append(changes, fmt.Sprintf("-%q", member))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// diffHash returns the fields added to, removed from and changed in a hash,
+// in field order
+func diffHash(a, b map[string]string) []string {
+	fields := make([]string, 0, len(a)+len(b))
+	for field := range a {
+		fields = append(fields, field)
+	}
+	for field := range b {
+		if _, ok := a[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := make([]string, 0)
+	for _, field := range fields {
+		valA, inA := a[field]
+		valB, inB := b[field]
+		switch {
+		case !inA:
+			changes = append(changes, fmt.Sprintf("+%q %q", field, valB))
+		case !inB:
+			changes = append(changes, fmt.Sprintf("-%q %q", field, valA))
+		case valA != valB:
+			changes = append(changes, fmt.Sprintf("~%q %q %q", field, valA, valB))
+		}
+	}
+	return changes
+}
+
+// diffZset returns the members added to, removed from and rescored in a
+// sorted set, in member order
+func diffZset(a, b *zset) []string {
+	members := make([]string, 0, len(a.dict)+len(b.dict))
+	for member := range a.dict {
+		members = append(members, member)
+	}
+	for member := range b.dict {
+		if _, ok := a.dict[member]; !ok {
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+
+	changes := make([]string, 0)
+	for _, member := range members {
+		scoreA, inA := a.dict[member]
+		scoreB, inB := b.dict[member]
+		switch {
+		case !inA:
+			changes = append(changes, fmt.Sprintf("+%q %s", member, formatScore(scoreB)))
+		case !inB:
+			changes = append(changes, fmt.Sprintf("-%q %s", member, formatScore(scoreA)))
+		case scoreA != scoreB:
+			changes = append(changes, fmt.Sprintf("~%q %s %s", member, formatScore(scoreA), formatScore(scoreB)))
+		}
+	}
+	return changes
+}
+
+// diffStream returns the entries added to and removed from a stream in id
+// order. Entries are never changed so an entry in both is the same
+func diffStream(a, b *stream) []string {
+	changes := make([]string, 0)
+	entry := func(sign string, e streamEntry) string {
+		var sb strings.Builder
+		sb.WriteString(sign + e.id.String())
+		for _, f := range e.fields {
+			sb.WriteString(" " + strconv.Quote(f))
+		}
+		return sb.String()
+	}
+	i, j := 0, 0
+	for i < len(a.entries) || j < len(b.entries) {
+		switch {
+		case j == len(b.entries) || (i < len(a.entries) && a.entries[i].id.less(b.entries[j].id)):
+			changes = append(changes, entry("-", a.entries[i]))
+			i++
+		case i == len(a.entries) || b.entries[j].id.less(a.entries[i].id):
+			changes = append(changes, entry("+", b.entries[j]))
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return changes
+}
+
+func listValues(l *list.List) []string {
+	vals := make([]string, 0)
+	if l == nil {
+		return vals
+	}
+	for e := l.Front(); e != nil; e = e.Next() {
+		vals = append(vals, e.Value)
+	}
+	return vals
+}
+
+// diffList returns the elements removed from a and inserted into b using the
+// longest common subsequence of the two lists. Removals carry their index in
+// a and insertions their index in b
+func diffList(a, b []string) []string {
+	changes := make([]string, 0)
+	// the common head and tail are never part of the diff
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		head++
+	}
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+	midA, midB := a[head:len(a)-tail], b[head:len(b)-tail]
+
+	removed := func(i int) {
+		changes = append(changes, fmt.Sprintf("-[%d] %q", head+i, midA[i]))
+	}
+	inserted := func(j int) {
+		changes = append(changes, fmt.Sprintf("+[%d] %q", head+j, midB[j]))
+	}
+
+	if len(midA)*len(midB) > maxListDiffCells {
+		for i := range midA {
+			removed(i)
+		}
+		for j := range midB {
+			inserted(j)
+		}
+		return changes
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of midA[i:]
+	// and midB[j:]
+	lcs := make([][]int, len(midA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(midB)+1)
+	}
+	for i := len(midA) - 1; i >= 0; i-- {
+		for j := len(midB) - 1; j >= 0; j-- {
+			if midA[i] == midB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(midA) && j < len(midB) {
+		switch {
+		case midA[i] == midB[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			removed(i)
+			i++
+		default:
+			inserted(j)
+			j++
+		}
+	}
+	for ; i < len(midA); i++ {
+		removed(i)
+	}
+	for ; j < len(midB); j++ {
+		inserted(j)
+	}
+	return changes
+}
+
+// diffSaveDB diffs the first databases dbs of the snapshots refA and refB (a
+// saveID or unix time each) of the save db at path. Each snapshot is read as
+// it was when it was taken so keys that had expired by then are left out. The
+// error returned is ready to be sent to a client
+func diffSaveDB(path, refA, refB string, dbIndex, databases int) ([]string, error) {
+	saveDb, err := openSaveDB(path)
+	if os.IsNotExist(err) {
+		return nil, errNoSuchSnapshot
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ERR %v", err)
+	}
+	defer saveDb.Close()
+
+	var stores [2][]*DB
+	for i, ref := range []string{refA, refB} {
+		snap, err := resolveSnapshot(saveDb, ref)
+		if err == errNoSuchSnapshot || err == errNoSnapshotAt {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ERR %v", err)
+		}
+		stores[i], err = readSnapshot(saveDb, snap.saveID, snap.lastsave*1000, databases)
+		if err != nil {
+			return nil, fmt.Errorf("ERR %v", err)
+		}
+	}
+	return diffSnapshots(stores[0], stores[1], dbIndex), nil
+}
+
+// snapshotDiffCommand replies with the changes between two snapshots, one
+// line per change
+func snapshotDiffCommand(rs *RedisServer, cl *RedisClient, refA, refB string, dbIndex int) bool {
+	lines, err := diffSaveDB(rs.config.dbFilename, refA, refB, dbIndex, len(rs.store))
+	if err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	if len(lines) == 0 {
+		return replyEmptySetOrList(cl.conn)
+	}
+	return replyMultiBulkString(cl.conn, lines)
+}
+
+// runDiffCLI is the offline form of SNAPSHOT DIFF which reads the save db
+// directly without starting a server:
+//
+//	sc diff [-file save.db] [-databases n] [-db n] <saveA> <saveB>
+//
+// It returns the exit code for the process
+func runDiffCLI(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("file", saveDBFile, "save db to read the snapshots from")
+	databases := fs.Int("databases", NumDBs, "number of dbs the snapshots were saved with")
+	db := fs.String("db", "", "only compare this db index")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: sc diff [-file save.db] [-databases n] [-db n] <saveA> <saveB>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	if *databases < 1 {
+		fmt.Fprintf(stderr, "invalid number of databases %d\n", *databases)
+		return 2
+	}
+	dbIndex := -1
+	if *db != "" {
+		index, err := strconv.Atoi(*db)
+		if err != nil || index < 0 || index >= *databases {
+			fmt.Fprintf(stderr, "invalid db index %q\n", *db)
+			return 2
+		}
+		dbIndex = index
+	}
+
+	lines, err := diffSaveDB(*file, fs.Arg(0), fs.Arg(1), dbIndex, *databases)
+	if err != nil {
+		fmt.Fprintln(stderr, strings.TrimPrefix(err.Error(), "ERR "))
+		return 1
+	}
+	for _, line := range lines {
+		fmt.Fprintln(stdout, line)
+	}
+	return 0
+}
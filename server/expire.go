@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// activeExpireInterval is how often the background job samples keys
+	activeExpireInterval = 100 * time.Millisecond
+	// activeExpireSampleSize is how many keys with a ttl are looked at per
+	// db on each pass of the background job
+	activeExpireSampleSize = 20
+)
+
+// nowMs returns the current unix time in milliseconds which is the unit the
+// expires table is stored in
+func nowMs() int64 {
+	return time.Now().UnixMilli()
+}
+
+// isExpired reports whether key has a ttl that has already passed
+func (db *DB) isExpired(key string, now int64) bool {
+	at, ok := db.expires[key]
+	return ok && at <= now
+}
+
+// expireIfNeeded lazily removes key when its ttl has passed. It returns true
+// when the key was removed
+func (rs *RedisServer) expireIfNeeded(db *DB, key string) bool {
+	if !db.isExpired(key, nowMs()) {
+		return false
+	}
+	rs.del(db, key)
+	rs.expiredKeys++
+	return true
+}
+
+// purgeExpired removes every key of the db that has expired
+func (rs *RedisServer) purgeExpired(db *DB) {
+	now := nowMs()
+	for key := range db.expires {
+		if db.isExpired(key, now) {
+			rs.del(db, key)
+			rs.expiredKeys++
+		}
+	}
+}
+
+// setExpire sets the absolute expire time (in unix ms) of an existing key.
+// A time in the past deletes the key straight away
+func (rs *RedisServer) setExpire(db *DB, key string, at int64) bool {
+	if rs.getDBType(db, key) == tNone {
+		return false
+	}
+	if at <= nowMs() {
+		rs.del(db, key)
+		return true
+	}
+	db.expires[key] = at
+	rs.dirty++
+	rs.signalModifiedTTL(db, key)
+	return true
+}
+
+// pttl returns the remaining time to live of key in milliseconds, -2 if the
+// key does not exist and -1 if the key has no ttl
+func (rs *RedisServer) pttl(db *DB, key string) int64 {
+	if rs.getDBType(db, key) == tNone {
+		return -2
+	}
+	at, ok := db.expires[key]
+	if !ok {
+		return -1
+	}
+	ttl := at - nowMs()
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// activeExpireCycle is the background job that removes expired keys which are
+// never accessed again. Each pass samples a few keys with a ttl from every db
+// and keeps going on a db while more than a quarter of the sample expired
+func (rs *RedisServer) activeExpireCycle() {
+	ticker := time.NewTicker(activeExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+		}
+		rs.lock.Lock()
+		for _, db := range rs.store {
+			for {
+				sampled, expired := 0, 0
+				now := nowMs()
+				// map iteration order is random which gives us our sample
+				for key := range db.expires {
+					if sampled == activeExpireSampleSize {
+						break
+					}
+					sampled++
+					if db.isExpired(key, now) {
+						rs.del(db, key)
+						rs.expiredKeys++
+						expired++
+					}
+				}
+				if expired*4 <= sampled {
+					break
+				}
+			}
+		}
+		rs.flushWriteThrough()
+		rs.lock.Unlock()
+	}
+}
+
+// Commands Operating on Expiration
+
+// expireGeneric backs EXPIRE, PEXPIRE and EXPIREAT. unit is the number of
+// milliseconds in one unit of the argument and relative says if the argument
+// is an offset from now rather than a unix time
+func expireGeneric(rs *RedisServer, cl *RedisClient, args []string, unit int64, relative bool) bool {
+	when, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return replyInvalidTypeIntegerError(cl.conn)
+	}
+	at := when * unit
+	if relative {
+		at += nowMs()
+	}
+	if rs.setExpire(rs.store[cl.db], args[0], at) {
+		return replyInteger(cl.conn, "1")
+	}
+	return replyInteger(cl.conn, "0")
+}
+
+func expireCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return expireGeneric(rs, cl, args, 1000, true)
+}
+
+func pexpireCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return expireGeneric(rs, cl, args, 1, true)
+}
+
+func expireatCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return expireGeneric(rs, cl, args, 1000, false)
+}
+
+func pexpireatCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return expireGeneric(rs, cl, args, 1, false)
+}
+
+func ttlCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	ttl := rs.pttl(rs.store[cl.db], args[0])
+	if ttl > 0 {
+		// round to the nearest second like redis does
+		ttl = (ttl + 500) / 1000
+	}
+	return replyInteger(cl.conn, fmt.Sprintf("%d", ttl))
+}
+
+func pttlCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, fmt.Sprintf("%d", rs.pttl(rs.store[cl.db], args[0])))
+}
+
+func persistCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	if _, ok := db.expires[args[0]]; !ok {
+		return replyInteger(cl.conn, "0")
+	}
+	delete(db.expires, args[0])
+	rs.dirty++
+	rs.signalModifiedTTL(db, args[0])
+	return replyInteger(cl.conn, "1")
+}
+
+func setexCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return replyInvalidTypeIntegerError(cl.conn)
+	}
+	if seconds <= 0 {
+		return replySimpleError(cl.conn, "ERR invalid expire time in 'setex' command")
+	}
+	db := rs.store[cl.db]
+	rs.set(db, args[0], args[2])
+	db.expires[args[0]] = nowMs() + seconds*1000
+	return replyOK(cl.conn)
+}
@@ -7,6 +7,7 @@ toolchain go1.22.3
 require (
 	github.com/gobwas/glob v0.2.3
 	github.com/google/uuid v1.6.0
+	github.com/yuin/gopher-lua v1.1.1
 	modernc.org/sqlite v1.29.10
 )
 
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Log levels from the most to the least verbose, named like the loglevel
+// config option
+const (
+	logDebug int32 = iota
+	logVerbose
+	logNotice
+	logWarning
+)
+
+var logLevelNames = []string{"debug", "verbose", "notice", "warning"}
+
+// logLevel is the least severe level that is still logged. It is shared by
+// every server in the process like the log package itself
+var logLevel = logNotice
+
+func parseLogLevel(val string) (int32, error) {
+	for i, name := range logLevelNames {
+		if strings.ToLower(val) == name {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("argument must be one of 'debug', 'verbose', 'notice' or 'warning'")
+}
+
+func setLogLevel(level int32) {
+	atomic.StoreInt32(&logLevel, level)
+}
+
+// serverLog logs the message when level is at or above the configured level
+func serverLog(level int32, format string, args ...interface{}) {
+	if level < atomic.LoadInt32(&logLevel) {
+		return
+	}
+	log.Printf(format, args...)
+}
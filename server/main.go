@@ -1,22 +1,27 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	lua "github.com/yuin/gopher-lua"
 )
 
 // Delimeter is used to denote the end of a reply/request
 const Delimeter = "\r\n"
 
-// NumDBs is the number of databases for the server to hold
+// NumDBs is the number of databases for the server to hold unless the
+// config file sets databases
 const NumDBs = 10
 
 // ServerVersion is the current version of the software
@@ -33,46 +38,172 @@ func check(err error) {
 
 // RedisServer is the container object for the server and its connections
 type RedisServer struct {
+	// port is the port the server listens on (like ":8081") and addr the
+	// address it is bound to (empty for every interface)
 	port string
 	addr string
 	l    net.Listener
-	// sp is the pointer into the store (the select pointer [or store pointer]) that we are referring to
-	sp    int64
-	store [NumDBs]*DB
+
+	store []*DB
 
 	lock sync.Mutex
 
-	conns    map[int]net.Conn
+	// clients holds every connected client keyed by its id
+	clients  map[int]*RedisClient
 	lastsave int64
 
+	// pubsubChannels and pubsubPatterns hold the clients subscribed to each
+	// channel and pattern
+	pubsubChannels map[string]map[*RedisClient]struct{}
+	pubsubPatterns map[string]*pubsubPattern
+
+	// blockedClients holds the clients waiting on each key in the order they
+	// blocked and readyKeys the keys with list pops waiting on them that
+	// were modified by the running command, see serveBlockedPops
+	blockedClients map[blockKey][]*RedisClient
+	readyKeys      []blockKey
+	// watchedKeys holds the keys clients WATCH
+	watchedKeys map[blockKey]*watchedKey
+
+	// scripts holds the compiled scripts by the SHA1 of their source
+	scripts map[string]*lua.FunctionProto
+	// script is the script being run, it is guarded by scriptLock rather
+	// than lock so SCRIPT KILL can get to it while the script holds lock
+	scriptLock sync.Mutex
+	script     *runningScript
+
+	// saveLock makes sure only one snapshot is written to the save db at a time
+	saveLock sync.Mutex
+	// bgsaveInProgress is 1 while a BGSAVE is writing its snapshot
+	bgsaveInProgress int32
+	// lastBgsaveStatus is "ok" or "err" for the last SAVE or BGSAVE that
+	// finished
+	lastBgsaveStatus atomic.Value
+	// lastBgsaveTry is the unix time the last BGSAVE was started
+	lastBgsaveTry int64
+	// dirty counts the changes made to the dataset since the last save
+	dirty uint64
+
+	// aof is the append only file while appendonly is on
+	aof *os.File
+	// aofSelectedDB is the db the append only file last selected (-1 when
+	// the next command has to select one)
+	aofSelectedDB int
+	// aofRewriteInProgress is 1 while a BGREWRITEAOF is running
+	aofRewriteInProgress int32
+	// aofRewriteBuf collects the commands written while a rewrite runs
+	aofRewriteBuf        []byte
+	aofLastWriteStatus   string
+	aofLastRewriteStatus string
+	// aofLog holds the commands the running command is logged as until they
+	// are written, see logAppendOnly
+	aofLog [][]string
+
+	// wt keeps the write through db in step with the dataset while
+	// writethrough is on
+	wt                *writeThrough
+	wtLastWriteStatus string
+
+	// tier holds the values of cold keys while maxmemory is set
+	tier *tier
+
 	totalConnsReceived uint64
 	commandsProcessed  uint64
+	expiredKeys        uint64
+	snapshotsPruned    uint64
 
 	timeStarted int64
+
+	config serverConfig
+	// configFile is the absolute path of the config file the server was
+	// started with, CONFIG REWRITE writes to it (empty without one)
+	configFile string
+
+	// done is closed when the server shuts down to stop background jobs,
+	// doneOnce makes sure that only happens once
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
 // NewRedisServer returns a pointer to a RedisServer object
 func NewRedisServer(port string) *RedisServer {
-	// listen on all interfaces
-	ln, err := net.Listen("tcp", port)
+	return newRedisServer(port, defaultConfig())
+}
+
+// newRedisServer returns a RedisServer that starts out with cfg. The dataset
+// is loaded from the append only file when appendonly is on and the file
+// exists, then from the write through db when writethrough is on and it
+// exists, otherwise from the newest snapshot
+func newRedisServer(port string, cfg serverConfig) *RedisServer {
+	// an empty bind listens on all interfaces
+	ln, err := net.Listen("tcp", net.JoinHostPort(cfg.bind, strings.TrimPrefix(port, ":")))
 	check(err)
 	fmt.Printf("Listening on Port %s\n", port)
 
-	var store [NumDBs]*DB
+	store := make([]*DB, cfg.databases)
 
 	rs := &RedisServer{
 		l:           ln,
 		port:        port,
-		addr:        "localhost",
+		addr:        cfg.bind,
 		store:       store,
-		conns:       make(map[int]net.Conn),
+		clients:     make(map[int]*RedisClient),
 		timeStarted: time.Now().Unix(),
+		config:      cfg,
+		done:        make(chan struct{}),
+
+		pubsubChannels: make(map[string]map[*RedisClient]struct{}),
+		pubsubPatterns: make(map[string]*pubsubPattern),
+		blockedClients: make(map[blockKey][]*RedisClient),
+		watchedKeys:    make(map[blockKey]*watchedKey),
+		scripts:        make(map[string]*lua.FunctionProto),
+
+		aofLastWriteStatus:   "ok",
+		aofLastRewriteStatus: "ok",
+		wtLastWriteStatus:    "ok",
 	}
 
+	setLogLevel(cfg.logLevel)
+	rs.lastBgsaveStatus.Store("ok")
 	rs.flushall()
+	_, aofErr := os.Stat(appendOnlyFile)
+	_, wtErr := os.Stat(writeThroughFile)
+	switch {
+	case rs.config.appendOnly && aofErr == nil:
+		check(rs.loadAppendOnlyFile())
+		check(rs.openAppendOnlyFile())
+	case rs.config.writeThrough && wtErr == nil:
+		check(rs.loadWriteThrough())
+	default:
+		check(rs.loadLatestSnapshot())
+	}
+	if rs.config.appendOnly && rs.aof == nil {
+		check(rs.startAppendOnly())
+	}
+	if rs.config.writeThrough && rs.wt == nil {
+		check(rs.startWriteThrough())
+	}
+	if rs.config.maxmemory > 0 {
+		check(rs.startTier())
+	}
+	// nothing has changed since the data that was just loaded
+	rs.dirty = 0
+	go rs.activeExpireCycle()
+	go rs.autoSaveCycle()
+	go rs.aofFsyncCycle()
+	go rs.tierCycle()
+	go rs.clientTimeoutCycle()
+	if cfg.pidFile != "" {
+		check(os.WriteFile(cfg.pidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644))
+	}
 	return rs
 }
 
+// closeDone stops the background jobs, it is safe to call more than once
+func (rs *RedisServer) closeDone() {
+	rs.doneOnce.Do(func() { close(rs.done) })
+}
+
 // Listen on the specified tcp port and handle incoming client connections
 func (rs *RedisServer) Listen() {
 	i := 0
@@ -81,546 +212,165 @@ func (rs *RedisServer) Listen() {
 		conn, err := rs.l.Accept()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				log.Printf("Listener Temp Accept Error: %v\n", ne)
+				serverLog(logWarning, "Listener Temp Accept Error: %v\n", ne)
 				continue
 			}
 
-			log.Printf("Listener Accept Error: %v\n", err)
+			serverLog(logWarning, "Listener Accept Error: %v\n", err)
 			return
 		}
 		rs.lock.Lock()
-		rs.conns[i] = conn
+		if len(rs.clients) >= rs.config.maxClients {
+			rs.lock.Unlock()
+			replySimpleError(conn, "ERR max number of clients reached")
+			conn.Close()
+			continue
+		}
+		cl := NewRedisClient(i, conn)
+		rs.clients[i] = cl
 		rs.lock.Unlock()
 		atomic.AddUint64(&rs.totalConnsReceived, 1)
-		go rs.handleClient(i)
+		go rs.handleClient(cl)
 		i++
 	}
 }
 
-// ExecuteCommand takes a connection a command string and a variable number of args
-// the command will be performed on the server and a reply will be written to the
-// connection
-// Note: this could also use varargs
-func (rs *RedisServer) ExecuteCommand(c io.WriteCloser, connIndex int, command string, args []string) bool {
-	argsLen := len(args)
-	switch command {
-	case "PING":
-		if argsLen == 0 {
-			return replySimpleString(c, "PONG")
-		}
-		if argsLen == 1 {
-			return replySimpleString(c, args[0])
-		}
+// ExecuteCommand takes a client a command string and a variable number of args
+// the command is looked up in the command table, its arity and key types are
+// checked, and then it is performed on the server against the clients
+// selected db with the reply written to the clients connection
+//
+// Commands run one at a time while holding the server lock, a client in a
+// transaction has them queued instead (see multi.go)
+func (rs *RedisServer) ExecuteCommand(cl *RedisClient, command string, args []string) bool {
+	c := cl.conn
+	cmd, ok := commandTable[command]
+	if !ok {
+		// the transaction the command was meant for fails as a whole
+		cl.flagTransaction()
+		return replyInvalidCommandError(c)
+	}
+	if !cmd.checkArity(len(args) + 1) {
+		cl.flagTransaction()
 		return replyInvalidNumberOfArgsError(c, command)
-	case "QUIT":
-		if argsLen != 0 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		c.Close()
-		rs.lock.Lock()
-		delete(rs.conns, connIndex)
-		rs.lock.Unlock()
-		return true
-	case "INFO":
-		if argsLen != 0 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		return replyMultiBulkString(c, rs.info())
-	// Persistent Control Commands
-	case "SAVE":
-		if argsLen != 0 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		rs.save()
-		return replyOK(c)
-	case "BGSAVE":
-		if argsLen != 0 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		go rs.save()
-		return replyOK(c)
-	case "LASTSAVE":
-		return replyInteger(c, fmt.Sprintf("%d", rs.lastsave))
-	case "SHUTDOWN":
-		rs.lock.Lock()
-		defer rs.lock.Unlock()
-		rs.save()
-		for _, conn := range rs.conns {
-			conn.Close()
-		}
-		rs.l.Close()
-		return false
-	// Commands Operating on Key Space
-	case "KEYS":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		val, ok := rs.keys(args[0])
-		if !ok {
-			return replyInvalidGlobPatternError(c, args[0])
-		}
-		if len(val) == 0 {
-			return replyEmptySetOrList(c)
-		}
-		return replyMultiBulkString(c, val)
-	case "RANDOMKEY":
-		if argsLen != 0 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		return replyBulkString(c, rs.random_key())
-	case "RENAME":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		if args[0] == args[1] {
-			return replySimpleError(c, "Keys Must be Different")
-		}
-		rs.rename(args[0], args[1])
-		return replyOK(c)
-	case "RENAMENX":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		return replyInteger(c, rs.rename_nx(args[0], args[1]))
-	case "DBSIZE":
-		if argsLen != 0 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		return replyInteger(c, rs.dbsize())
-	// Commands Operating on DB
-	case "SELECT":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		index, err := strconv.Atoi(args[0])
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		if index > 9 || index < 0 {
-			return replyInvalidTypeIntegerError(c)
-		}
-		atomic.StoreInt64(&rs.sp, int64(index))
-		return replyOK(c)
-	case "MOVE":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		dbIndex, err := strconv.Atoi(args[1])
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		return replyInteger(c, rs.move(args[0], dbIndex))
-	case "FLUSHDB":
-		rs.flushDB()
-		return replyOK(c)
-	case "FLUSHALL":
-		rs.flushall()
-		return replyOK(c)
-	// Commands Operating on Strings
-	case "SET":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		// with 2 args we know that we have the correct amount to set a key to a value
-		rs.set(args[0], args[1])
-		return replyOK(c)
-	case "SETNX":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		// with 2 args we know that we have the correct amount to set a key to a value
-		if _, ok := rs.get(args[0]); !ok {
-			rs.set(args[0], args[1])
-			return replyInteger(c, "1")
-		}
-		return replyInteger(c, "0")
-	case "GET":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		if rs.getDBType(args[0]) != "string" {
-			return replyWrongTypeOperationError(c)
-		}
-		val, _ := rs.get(args[0])
-		return replyBulkString(c, val)
-	case "EXISTS":
-		// TODO: Eventually support variable number of args
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		t := rs.getDBType(args[0])
-		if t != "none" {
-			return replyInteger(c, "1")
-		}
-		return replyInteger(c, "0")
-	case "INCR":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "list" || typ == "set" {
-			return replyWrongTypeOperationError(c)
-		}
-		v, ok := rs.get(args[0])
-		if !ok {
-			rs.set(args[0], "0")
-			return replyInteger(c, "0")
-		}
-		val, err := strconv.Atoi(v)
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		val++
-		vs := fmt.Sprintf("%d", val)
-		rs.set(args[0], vs)
-		return replyInteger(c, vs)
-	case "INCRBY":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "list" || typ == "set" {
-			return replyWrongTypeOperationError(c)
-		}
-		v, ok := rs.get(args[0])
-		if !ok {
-			vv, err := strconv.Atoi(args[1])
-			if err != nil {
-				return replyInvalidTypeIntegerError(c)
-			}
-			vs := fmt.Sprintf("%d", vv)
-			rs.set(args[0], vs)
-			return replyInteger(c, vs)
-		}
-		val, err := strconv.Atoi(v)
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		vv, err := strconv.Atoi(args[1])
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		val += vv
-		vs := fmt.Sprintf("%d", val)
-		rs.set(args[0], vs)
-		return replyInteger(c, vs)
-	case "DECR":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "list" || typ == "set" {
-			return replyWrongTypeOperationError(c)
-		}
-		v, ok := rs.get(args[0])
-		if !ok {
-			rs.set(args[0], "-1")
-			replyInteger(c, "-1")
-		}
-		val, err := strconv.Atoi(v)
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		val--
-		vs := fmt.Sprintf("%d", val)
-		rs.set(args[0], vs)
-		return replyInteger(c, vs)
-	case "DECRBY":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "list" || typ == "set" {
-			return replyWrongTypeOperationError(c)
-		}
-		if v, ok := rs.get(args[0]); ok {
-			val, err := strconv.Atoi(v)
-			if err != nil {
-				return replyInvalidTypeIntegerError(c)
-			}
-			vv, err := strconv.Atoi(args[1])
-			if err != nil {
-				return replyInvalidTypeIntegerError(c)
-			}
-			val -= vv
-			vs := fmt.Sprintf("%d", val)
-			rs.set(args[0], vs)
-			return replyInteger(c, vs)
-		}
-		vv, err := strconv.Atoi(args[1])
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		vs := fmt.Sprintf("%d", -vv)
-		rs.set(args[0], vs)
-		return replyInteger(c, vs)
-	case "DEL":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		exists := rs.del(args[0])
-		if exists {
-			return replyInteger(c, "1")
-		}
-		return replyInteger(c, "0")
-	case "TYPE":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		t := rs.getDBType(args[0])
-		c.Write([]byte(t + Delimeter))
-		return true
-	// Commands Operating on Lists
-	case "LPUSH":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "none" || typ == "list" {
-			val := rs.lpush(args[0], args[1])
-			return replyInteger(c, val)
-		}
-		return replyWrongTypeOperationError(c)
-	case "RPUSH":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "none" || typ == "list" {
-			val := rs.rpush(args[0], args[1])
-			return replyInteger(c, val)
-		}
-		return replyWrongTypeOperationError(c)
-	case "LLEN":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "none" {
-			// 0 if the key doesnt exist
-			return replyInteger(c, "0")
-		}
-		if typ != "list" {
-			return replyWrongTypeOperationError(c)
-		}
-		val := rs.llen(args[0])
-		return replyInteger(c, val)
-	case "LRANGE":
-		if argsLen != 3 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "string" || typ == "set" {
-			return replyWrongTypeOperationError(c)
-		}
-		if typ == "none" {
-			return replyEmptySetOrList(c)
-		}
-		start, err := strconv.Atoi(args[1])
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		end, err := strconv.Atoi(args[2])
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		val := rs.lrange(args[0], start, end)
-		if len(val) == 0 {
-			return replyEmptySetOrList(c)
-		}
-		return replyMultiBulkString(c, val)
-	case "LINDEX":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "string" || typ == "set" {
-			return replyWrongTypeOperationError(c)
-		}
-		if typ == "none" {
-			return replyEmptyBulkString(c)
-		}
-		index, err := strconv.Atoi(args[1])
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		val := rs.lindex(args[0], index)
-		if val == emptyBulkString {
-			return replyEmptyBulkString(c)
-		}
-		return replyBulkString(c, val)
-	case "LPOP":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "string" || typ == "set" {
-			return replyWrongTypeOperationError(c)
-		}
-		if typ == "none" {
-			return replyEmptyBulkString(c)
-		}
-		return replyBulkString(c, rs.lpop(args[0]))
-	case "RPOP":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "string" || typ == "set" {
-			return replyWrongTypeOperationError(c)
-		}
-		if typ == "none" {
-			return replyEmptyBulkString(c)
-		}
-		return replyBulkString(c, rs.rpop(args[0]))
-	case "LTRIM":
-		if argsLen != 3 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "string" || typ == "set" {
-			return replyWrongTypeOperationError(c)
-		}
-		if typ == "none" {
-			return replyEmptySetOrList(c)
-		}
-		start, err := strconv.Atoi(args[1])
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		end, err := strconv.Atoi(args[2])
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		ok := rs.ltrim(args[0], start, end)
-		if !ok {
-			// delete the key because the indexes resulted in an empty list
-			rs.del(args[0])
-			return replyEmptySetOrList(c)
-		}
-		return replyOK(c)
-	case "LSET":
-		if argsLen != 3 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "string" || typ == "set" {
-			return replyWrongTypeOperationError(c)
-		}
-		if typ == "none" {
-			return replyNoSuchKey(c)
-		}
-		index, err := strconv.Atoi(args[1])
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		ok := rs.lset(args[0], index, args[2])
-		if !ok {
-			return replyInvalidTypeIntegerError(c)
-		}
-		return replyOK(c)
-	case "LREM":
-		if argsLen != 3 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		typ := rs.getDBType(args[0])
-		if typ == "string" || typ == "set" {
-			return replyInteger(c, "-2")
-		}
-		if typ == "none" {
-			return replyInteger(c, "-1")
-		}
-		count, err := strconv.Atoi(args[1])
-		if err != nil {
-			return replyInvalidTypeIntegerError(c)
-		}
-		return replyInteger(c, rs.lrem(args[0], count, args[2]))
-	// Commands Operating on Sets
-	case "SADD":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		val := rs.sadd(args[0], args[1])
-		return replyInteger(c, val)
-	case "SREM":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		return replyInteger(c, rs.srem(args[0], args[1]))
-	case "SCARD":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		return replyInteger(c, rs.scard(args[0]))
-	case "SISMEMBER":
-		if argsLen != 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		return replyInteger(c, rs.sismember(args[0], args[1]))
-	case "SINTER":
-		if argsLen == 0 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
+	}
+	// subscriptions only change on the clients own goroutine so they can be
+	// read before taking the lock
+	if cl.subscriptions() > 0 && !subscriberCommands[command] {
+		return replySimpleError(c, fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(command)))
+	}
+	// a script that runs for longer than lua-time-limit holds the lock, the
+	// other clients are told so and may only kill it
+	if isScriptKill(command, args) {
+		return scriptKillCommand(rs, cl, args)
+	}
+	if rs.scriptBusy() {
+		cl.flagTransaction()
+		return replySimpleError(c, errScriptBusy.Error())
+	}
+	// like subscriptions a transaction is only changed by the client itself
+	if cl.hasFlag(flagMulti) && cmd.hasFlag(cmdNoMulti) {
+		cl.flagTransaction()
+		return replySimpleError(c, errNotInMulti.Error())
+	}
+	if cl.hasFlag(flagMulti) && !transactionCommands[command] {
+		cl.queueCommand(cmd, command, args)
+		return replySimpleString(c, "QUEUED")
+	}
 
-		// Check if any have the wrong type
-		for _, v := range args {
-			if rs.getDBType(v) == "none" {
-				return replyEmptySetOrList(c)
-			}
-			if rs.getDBType(v) != "set" {
-				return replyWrongTypeOperationError(c)
-			}
-		}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	writes := cmd.hasFlag(cmdWrite) || (command == "EXEC" && cl.hasFlag(flagMulti) && cl.queuesWrite())
+	if writes && rs.writeThroughRefuses() {
+		if command == "EXEC" {
+			rs.unwatchAll(cl)
+			cl.discardTransaction()
+		}
+		return replySimpleError(c, errWriteThroughMisconf.Error())
+	}
+	// with writethrough on a write is only acknowledged once it is in the
+	// write through db, which is written before the unlock so the next
+	// command sees it
+	var held *heldConn
+	if rs.wt != nil && (cmd.hasFlag(cmdWrite) || command == "EXEC") {
+		held = holdReplies(cl)
+	}
 
-		val := rs.sinter(args...)
-		if len(val) == 0 {
-			return replyEmptySetOrList(c)
-		}
-		return replyMultiBulkString(c, val)
-	case "SINTERSTORE":
-		if argsLen < 2 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		if rs.getDBType(args[0]) != "none" || rs.getDBType(args[0]) == "set" {
-			return replyWrongTypeOperationError(c)
-		}
-		// Check if any have the wrong type
-		for _, v := range args[1:] {
-			if rs.getDBType(v) == "none" {
-				return replyEmptySetOrList(c)
-			}
-			if rs.getDBType(v) != "set" {
-				return replyWrongTypeOperationError(c)
+	ok = rs.call(cl, cmd, command, args)
+	rs.serveBlockedPops()
+	err := rs.flushWriteThrough()
+	if held != nil {
+		releaseReplies(cl, held, err)
+	}
+	return ok
+}
+
+// call performs cmd for cl and logs it to the append only file when it
+// changed the dataset. The caller must hold rs.lock
+func (rs *RedisServer) call(cl *RedisClient, cmd *redisCommand, command string, args []string) bool {
+	if err := rs.prepareKeys(cl, cmd.keys(args), cmd.keyType); err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	dirty := rs.dirty
+	ok := cmd.proc(rs, cl, args)
+	if rs.aof != nil && cmd.hasFlag(cmdWrite) && rs.dirty != dirty {
+		rs.feedAppendOnlyFile(cl.db, command, args)
+	}
+	return ok
+}
+
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// prepareKeys gets keys of the clients db ready for a command. Expired keys
+// are deleted, cold keys are loaded back from the tier and when keyType is
+// not empty every key that exists has to hold it. Commands with keys that are
+// only known once their arguments are parsed call it themselves. The caller
+// must hold rs.lock
+func (rs *RedisServer) prepareKeys(cl *RedisClient, keys []string, keyType dbTyp) error {
+	db := rs.store[cl.db]
+	for _, key := range keys {
+		rs.expireIfNeeded(db, key)
+	}
+	if rs.tier != nil {
+		// cold keys are brought back so commands only ever see hot ones
+		for _, key := range keys {
+			if err := rs.loadIfCold(db, key); err != nil {
+				return fmt.Errorf("ERR failed to load key from the tier: %v", err)
 			}
+			rs.tier.touch(cl.db, key)
 		}
-		rs.sinterstore(args[0], args[1:]...)
-		return replyOK(c)
-	case "SMEMBERS":
-		if argsLen != 1 {
-			return replyInvalidNumberOfArgsError(c, command)
-		}
-		val, ok := rs.smembers(args[0])
-		if !ok {
-			return replyEmptySetOrList(c)
+	}
+	if keyType != "" {
+		for _, key := range keys {
+			typ := rs.getDBType(db, key)
+			if typ != tNone && typ != keyType {
+				return errWrongType
+			}
 		}
-		return replyMultiBulkString(c, val)
-	// TODO: Commands Operating on Hashes
-	// TODO: Commands Operating on Pub/Sub
-	// TODO: Commands Operating on Streams
-	default:
-		return replyInvalidCommandError(c)
 	}
+	return nil
 }
 
-func (rs *RedisServer) handleClient(connIndex int) {
-	rs.lock.Lock()
-	c := rs.conns[connIndex]
-	rs.lock.Unlock()
+func (rs *RedisServer) handleClient(cl *RedisClient) {
+	defer func() {
+		rs.lock.Lock()
+		delete(rs.clients, cl.id)
+		rs.pubsubUnsubscribeAll(cl)
+		rs.unwatchAll(cl)
+		rs.lock.Unlock()
+	}()
 	for {
-		commandAndArgs, err := readCommand(c)
+		if cl.hasFlag(flagClosed) {
+			return
+		}
+		commandAndArgs, err := readCommand(cl.r)
 		if err != nil {
+			if err == io.EOF {
+				cl.close()
+				return
+			}
 			// log.Printf("Failed to Read Command: %v\n", err)
-			ok := replyInvalidCommandError(c)
+			ok := replyInvalidCommandError(cl.conn)
 			if !ok {
 				return
 			}
@@ -630,7 +380,8 @@ func (rs *RedisServer) handleClient(connIndex int) {
 			continue
 		}
 		command := strings.ToUpper(commandAndArgs[0])
-		ok := rs.ExecuteCommand(c, connIndex, command, commandAndArgs[1:])
+		atomic.StoreInt64(&cl.lastCmdAt, time.Now().Unix())
+		ok := rs.ExecuteCommand(cl, command, commandAndArgs[1:])
 		if !ok {
 			// This should only be false from a shutdown command so return then
 			return
@@ -639,8 +390,92 @@ func (rs *RedisServer) handleClient(connIndex int) {
 	}
 }
 
+// serverFlags maps each command line flag of the server to the config option
+// it overrides
+var serverFlags = []struct{ flag, option, usage string }{
+	{"port", "port", "tcp port to listen on"},
+	{"bind", "bind", "address to listen on (every interface when empty)"},
+	{"dir", "dir", "working directory for the save db and other files"},
+	{"dbfilename", "dbfilename", "name of the save db inside dir"},
+	{"databases", "databases", "number of databases"},
+	{"loglevel", "loglevel", "debug, verbose, notice or warning"},
+	{"pidfile", "pidfile", "file to write the process id to"},
+}
+
+// parseServerFlags builds the config the server starts with from its command
+// line:
+//
+//	sc [--config file] [--port n] [--bind addr] [--dir dir] [--dbfilename file]
+//	   [--databases n] [--loglevel level] [--pidfile file] [config file]
+//
+// The config file is read first and every flag that is given overrides the
+// option it names. It also returns the absolute path of the config file
+// (empty without one)
+func parseServerFlags(args []string, stderr io.Writer) (serverConfig, string, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("sc", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	config := fs.String("config", "", "config file to read before the flags")
+	for _, f := range serverFlags {
+		fs.String(f.flag, "", f.usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: sc [flags] [config file]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, "", err
+	}
+	if fs.NArg() > 1 || (fs.NArg() == 1 && *config != "") {
+		fs.Usage()
+		return cfg, "", fmt.Errorf("only one config file may be given")
+	}
+	configFile := *config
+	if fs.NArg() == 1 {
+		configFile = fs.Arg(0)
+	}
+	if configFile != "" {
+		// the path is made absolute before the server changes to dir
+		path, err := filepath.Abs(configFile)
+		if err != nil {
+			return cfg, "", err
+		}
+		if err := loadConfigFile(path, &cfg); err != nil {
+			return cfg, "", err
+		}
+		configFile = path
+	}
+
+	var err error
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range serverFlags {
+			if f.flag != fl.Name || err != nil {
+				continue
+			}
+			p := lookupConfigParam(f.option)
+			if serr := p.set(&cfg, fl.Value.String()); serr != nil {
+				err = fmt.Errorf("invalid value %q for flag --%s: %v", fl.Value.String(), fl.Name, serr)
+			}
+		}
+	})
+	return cfg, configFile, err
+}
+
 func main() {
-	s := NewRedisServer(":8081")
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		os.Exit(runDiffCLI(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	cfg, configFile, err := parseServerFlags(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	check(os.Chdir(cfg.dir))
+	s := newRedisServer(":"+strconv.Itoa(cfg.port), cfg)
+	s.configFile = configFile
 	s.Listen()
 	s.l.Close()
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// A client that sends MULTI has every command it sends after it queued
+// rather than run, until EXEC runs the whole queue under the server lock so
+// no other client sees the dataset half way through. WATCH makes the next
+// EXEC fail when one of the watched keys was modified since it was watched,
+// every watched key has a version that signalModifiedKey moves on
+
+var (
+	errNestedMulti    = errors.New("ERR MULTI calls can not be nested")
+	errExecNoMulti    = errors.New("ERR EXEC without MULTI")
+	errDiscardNoMulti = errors.New("ERR DISCARD without MULTI")
+	errWatchInMulti   = errors.New("ERR WATCH inside MULTI is not allowed")
+	errExecAbort      = errors.New("EXECABORT Transaction discarded because of previous errors.")
+	errNotInMulti     = errors.New("ERR Command not allowed inside a transaction")
+)
+
+// transactionCommands are run straight away rather than queued by a client
+// in a transaction
+var transactionCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"QUIT":    true,
+}
+
+// queuedCommand is a command a client sent inside MULTI
+type queuedCommand struct {
+	cmd  *redisCommand
+	name string
+	args []string
+}
+
+// watchedKey is a key that clients WATCH. version counts the modifications
+// of the key from when it was first watched and watchers the clients that
+// watch it, the key is only tracked while there are any
+type watchedKey struct {
+	version  uint64
+	watchers int
+}
+
+// queueCommand queues a command of a client in a transaction
+func (cl *RedisClient) queueCommand(cmd *redisCommand, name string, args []string) {
+	cl.queued = append(cl.queued, queuedCommand{cmd, name, args})
+}
+
+// queuesWrite reports whether a command the client queued may modify the
+// dataset
+func (cl *RedisClient) queuesWrite() bool {
+	for _, q := range cl.queued {
+		if q.cmd.hasFlag(cmdWrite) {
+			return true
+		}
+	}
+	return false
+}
+
+// flagTransaction makes the next EXEC of a client in a transaction fail, it
+// is called when a command could not be queued
+func (cl *RedisClient) flagTransaction() {
+	if cl.hasFlag(flagMulti) {
+		cl.flags |= flagMultiError
+	}
+}
+
+// discardTransaction drops the queue of the client and ends its transaction
+func (cl *RedisClient) discardTransaction() {
+	cl.queued = nil
+	cl.flags &^= flagMulti | flagMultiError
+}
+
+// watchKey makes the next EXEC of cl fail if key of the clients db is
+// modified. The caller must hold rs.lock
+func (rs *RedisServer) watchKey(cl *RedisClient, key string) {
+	k := blockKey{cl.db, key}
+	if _, ok := cl.watched[k]; ok {
+		return
+	}
+	w, ok := rs.watchedKeys[k]
+	if !ok {
+		w = &watchedKey{}
+		rs.watchedKeys[k] = w
+	}
+	w.watchers++
+	cl.watched[k] = w.version
+}
+
+// unwatchAll forgets every key cl watches. The caller must hold rs.lock
+func (rs *RedisServer) unwatchAll(cl *RedisClient) {
+	for k := range cl.watched {
+		w := rs.watchedKeys[k]
+		w.watchers--
+		if w.watchers == 0 {
+			delete(rs.watchedKeys, k)
+		}
+	}
+	cl.watched = make(map[blockKey]uint64)
+}
+
+// touchWatchedKey moves the version of key of db dbIndex on if it is watched
+func (rs *RedisServer) touchWatchedKey(dbIndex int, key string) {
+	if w, ok := rs.watchedKeys[blockKey{dbIndex, key}]; ok {
+		w.version++
+	}
+}
+
+// touchWatchedDB moves the version of every watched key of db dbIndex on
+func (rs *RedisServer) touchWatchedDB(dbIndex int) {
+	for k, w := range rs.watchedKeys {
+		if k.dbIndex == dbIndex {
+			w.version++
+		}
+	}
+}
+
+// watchedKeyModified reports whether a key cl watches was modified since it
+// was watched. A watched key that has expired since counts as modified
+func (rs *RedisServer) watchedKeyModified(cl *RedisClient) bool {
+	for k, version := range cl.watched {
+		rs.expireIfNeeded(rs.store[k.dbIndex], k.key)
+		if rs.watchedKeys[k].version != version {
+			return true
+		}
+	}
+	return false
+}
+
+// Commands Operating on Transactions
+
+func multiCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if cl.hasFlag(flagMulti) {
+		return replySimpleError(cl.conn, errNestedMulti.Error())
+	}
+	cl.flags |= flagMulti
+	return replyOK(cl.conn)
+}
+
+func discardCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if !cl.hasFlag(flagMulti) {
+		return replySimpleError(cl.conn, errDiscardNoMulti.Error())
+	}
+	cl.discardTransaction()
+	rs.unwatchAll(cl)
+	return replyOK(cl.conn)
+}
+
+// execCommand runs the queued commands of the transaction and replies with
+// an array of their replies. It replies with a nil array instead when a
+// watched key was modified, and fails when a command could not be queued.
+// The commands are logged to the append only file between MULTI and EXEC so
+// a replay runs them together too
+func execCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	if !cl.hasFlag(flagMulti) {
+		return replySimpleError(c, errExecNoMulti.Error())
+	}
+	defer rs.unwatchAll(cl)
+	defer cl.discardTransaction()
+	if cl.hasFlag(flagMultiError) {
+		return replySimpleError(c, errExecAbort.Error())
+	}
+	if rs.watchedKeyModified(cl) {
+		return replyEmptySetOrList(c)
+	}
+
+	if _, err := c.Write([]byte("*" + strconv.Itoa(len(cl.queued)) + Delimeter)); err != nil {
+		return false
+	}
+	ok := true
+	logged := false
+	for _, q := range cl.queued {
+		if rs.aof != nil && !logged && q.cmd.hasFlag(cmdWrite) {
+			rs.feedAppendOnlyFile(cl.db, "MULTI", nil)
+			logged = true
+		}
+		// every queued command runs even when the client is gone so the
+		// transaction is never applied in part
+		if !rs.call(cl, q.cmd, q.name, q.args) {
+			ok = false
+		}
+	}
+	if logged {
+		rs.feedAppendOnlyFile(cl.db, "EXEC", nil)
+	}
+	return ok
+}
+
+func watchCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if cl.hasFlag(flagMulti) {
+		return replySimpleError(cl.conn, errWatchInMulti.Error())
+	}
+	for _, key := range args {
+		rs.watchKey(cl, key)
+	}
+	return replyOK(cl.conn)
+}
+
+func unwatchCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	rs.unwatchAll(cl)
+	return replyOK(cl.conn)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gobwas/glob"
+)
+
+// pubsubQueueLen is how many replies and messages a subscribed client may have
+// waiting to be written before it is disconnected for being too slow
+const pubsubQueueLen = 1024
+
+var errSlowSubscriber = errors.New("subscriber is not reading its messages fast enough")
+
+var errPubsubConnClosed = errors.New("subscriber connection is closed")
+
+// subscriberCommands are the only commands a client may send while it is
+// subscribed to a channel or pattern
+var subscriberCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+}
+
+// pubsubConn replaces the connection of a client once it subscribes. Every
+// write is queued and sent by a goroutine of its own so a publisher never
+// waits on a slow subscriber, replies to the client go through the same queue
+// so they stay in order with its messages
+type pubsubConn struct {
+	io.ReadWriteCloser
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPubsubConn(conn io.ReadWriteCloser) *pubsubConn {
+	pc := &pubsubConn{
+		ReadWriteCloser: conn,
+		queue:           make(chan []byte, pubsubQueueLen),
+		done:            make(chan struct{}),
+	}
+	go pc.writeLoop()
+	return pc
+}
+
+// Write queues p for the client. A client with a full queue is closed rather
+// than making the writer wait
+func (pc *pubsubConn) Write(p []byte) (int, error) {
+	buf := append([]byte(nil), p...)
+	select {
+	case <-pc.done:
+		return 0, errPubsubConnClosed
+	case pc.queue <- buf:
+		return len(p), nil
+	default:
+		serverLog(logVerbose, "Closing subscriber: %v\n", errSlowSubscriber)
+		pc.Close()
+		return 0, errSlowSubscriber
+	}
+}
+
+// Close stops the write loop and closes the connection, it may be called
+// more than once
+func (pc *pubsubConn) Close() error {
+	var err error
+	pc.closeOnce.Do(func() {
+		close(pc.done)
+		err = pc.ReadWriteCloser.Close()
+	})
+	return err
+}
+
+func (pc *pubsubConn) writeLoop() {
+	for {
+		select {
+		case <-pc.done:
+			return
+		case buf := <-pc.queue:
+			if _, err := pc.ReadWriteCloser.Write(buf); err != nil {
+				pc.Close()
+				return
+			}
+		}
+	}
+}
+
+// pubsubPattern holds the clients subscribed to a pattern
+type pubsubPattern struct {
+	g       glob.Glob
+	clients map[*RedisClient]struct{}
+}
+
+// subscriptions is the number of channels and patterns cl is subscribed to
+func (cl *RedisClient) subscriptions() int {
+	return len(cl.channels) + len(cl.patterns)
+}
+
+// enterSubscriberMode switches the connection of cl over to a queued one the
+// first time it subscribes. The client keeps it after unsubscribing so
+// messages that are still queued are not overtaken by later replies
+func (cl *RedisClient) enterSubscriberMode() {
+	if _, ok := cl.conn.(*pubsubConn); !ok {
+		cl.conn = newPubsubConn(cl.conn)
+	}
+}
+
+// appendPubsubReply appends a reply of the subscribe family, a nil name is
+// sent as a nil bulk string
+func appendPubsubReply(buf []byte, kind string, name *string, count int) []byte {
+	buf = append(buf, "*3"+Delimeter...)
+	buf = appendBulkString(buf, kind)
+	if name == nil {
+		buf = append(buf, emptyBulkString...)
+	} else {
+		buf = appendBulkString(buf, *name)
+	}
+	return append(buf, ":"+strconv.Itoa(count)+Delimeter...)
+}
+
+// subscribe adds cl to channel and reports whether it was not subscribed yet
+func (rs *RedisServer) subscribe(cl *RedisClient, channel string) bool {
+	if _, ok := cl.channels[channel]; ok {
+		return false
+	}
+	cl.channels[channel] = struct{}{}
+	clients, ok := rs.pubsubChannels[channel]
+	if !ok {
+		clients = make(map[*RedisClient]struct{})
+		rs.pubsubChannels[channel] = clients
+	}
+	clients[cl] = struct{}{}
+	return true
+}
+
+// unsubscribe removes cl from channel and reports whether it was subscribed
+func (rs *RedisServer) unsubscribe(cl *RedisClient, channel string) bool {
+	if _, ok := cl.channels[channel]; !ok {
+		return false
+	}
+	delete(cl.channels, channel)
+	clients := rs.pubsubChannels[channel]
+	delete(clients, cl)
+	if len(clients) == 0 {
+		delete(rs.pubsubChannels, channel)
+	}
+	return true
+}
+
+// psubscribe adds cl to the pattern g was compiled from and reports whether
+// it was not subscribed yet
+func (rs *RedisServer) psubscribe(cl *RedisClient, pattern string, g glob.Glob) bool {
+	if _, ok := cl.patterns[pattern]; ok {
+		return false
+	}
+	cl.patterns[pattern] = struct{}{}
+	p, ok := rs.pubsubPatterns[pattern]
+	if !ok {
+		p = &pubsubPattern{g: g, clients: make(map[*RedisClient]struct{})}
+		rs.pubsubPatterns[pattern] = p
+	}
+	p.clients[cl] = struct{}{}
+	return true
+}
+
+// punsubscribe removes cl from pattern and reports whether it was subscribed
+func (rs *RedisServer) punsubscribe(cl *RedisClient, pattern string) bool {
+	if _, ok := cl.patterns[pattern]; !ok {
+		return false
+	}
+	delete(cl.patterns, pattern)
+	p := rs.pubsubPatterns[pattern]
+	delete(p.clients, cl)
+	if len(p.clients) == 0 {
+		delete(rs.pubsubPatterns, pattern)
+	}
+	return true
+}
+
+// pubsubUnsubscribeAll removes every subscription of a client that is going
+// away
+func (rs *RedisServer) pubsubUnsubscribeAll(cl *RedisClient) {
+	for channel := range cl.channels {
+		rs.unsubscribe(cl, channel)
+	}
+	for pattern := range cl.patterns {
+		rs.punsubscribe(cl, pattern)
+	}
+}
+
+// publish sends message to every client subscribed to channel or to a
+// pattern matching it and returns how many clients it was sent to. Messages
+// are only queued so a slow subscriber never holds up the publisher
+func (rs *RedisServer) publish(channel, message string) int {
+	receivers := 0
+	if clients, ok := rs.pubsubChannels[channel]; ok {
+		var buf []byte
+		buf = append(buf, "*3"+Delimeter...)
+		buf = appendBulkString(buf, "message")
+		buf = appendBulkString(buf, channel)
+		buf = appendBulkString(buf, message)
+		for cl := range clients {
+			cl.conn.Write(buf)
+			receivers++
+		}
+	}
+	for pattern, p := range rs.pubsubPatterns {
+		if !p.g.Match(channel) {
+			continue
+		}
+		var buf []byte
+		buf = append(buf, "*4"+Delimeter...)
+		buf = appendBulkString(buf, "pmessage")
+		buf = appendBulkString(buf, pattern)
+		buf = appendBulkString(buf, channel)
+		buf = appendBulkString(buf, message)
+		for cl := range p.clients {
+			cl.conn.Write(buf)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// Commands Operating on Pub/Sub
+
+func subscribeCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	cl.enterSubscriberMode()
+	var buf []byte
+	for i := range args {
+		rs.subscribe(cl, args[i])
+		buf = appendPubsubReply(buf, "subscribe", &args[i], cl.subscriptions())
+	}
+	_, err := cl.conn.Write(buf)
+	return isNil(err)
+}
+
+func unsubscribeCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if len(args) == 0 {
+		for channel := range cl.channels {
+			args = append(args, channel)
+		}
+		sort.Strings(args)
+		if len(args) == 0 {
+			_, err := cl.conn.Write(appendPubsubReply(nil, "unsubscribe", nil, cl.subscriptions()))
+			return isNil(err)
+		}
+	}
+	var buf []byte
+	for i := range args {
+		rs.unsubscribe(cl, args[i])
+		buf = appendPubsubReply(buf, "unsubscribe", &args[i], cl.subscriptions())
+	}
+	_, err := cl.conn.Write(buf)
+	return isNil(err)
+}
+
+func psubscribeCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	globs := make([]glob.Glob, len(args))
+	for i, pattern := range args {
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return replySimpleError(cl.conn, fmt.Sprintf("ERR Invalid Glob Pattern '%s'", pattern))
+		}
+		globs[i] = g
+	}
+	cl.enterSubscriberMode()
+	var buf []byte
+	for i := range args {
+		rs.psubscribe(cl, args[i], globs[i])
+		buf = appendPubsubReply(buf, "psubscribe", &args[i], cl.subscriptions())
+	}
+	_, err := cl.conn.Write(buf)
+	return isNil(err)
+}
+
+func punsubscribeCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	if len(args) == 0 {
+		for pattern := range cl.patterns {
+			args = append(args, pattern)
+		}
+		sort.Strings(args)
+		if len(args) == 0 {
+			_, err := cl.conn.Write(appendPubsubReply(nil, "punsubscribe", nil, cl.subscriptions()))
+			return isNil(err)
+		}
+	}
+	var buf []byte
+	for i := range args {
+		rs.punsubscribe(cl, args[i])
+		buf = appendPubsubReply(buf, "punsubscribe", &args[i], cl.subscriptions())
+	}
+	_, err := cl.conn.Write(buf)
+	return isNil(err)
+}
+
+func publishCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return replyInteger(cl.conn, strconv.Itoa(rs.publish(args[0], args[1])))
+}
+
+func pubsubCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	switch strings.ToUpper(args[0]) {
+	case "CHANNELS":
+		if len(args) > 2 {
+			return replyInvalidNumberOfArgsError(c, "PUBSUB")
+		}
+		var g glob.Glob
+		if len(args) == 2 {
+			var err error
+			if g, err = glob.Compile(args[1]); err != nil {
+				return replySimpleError(c, fmt.Sprintf("ERR Invalid Glob Pattern '%s'", args[1]))
+			}
+		}
+		channels := make([]string, 0, len(rs.pubsubChannels))
+		for channel := range rs.pubsubChannels {
+			if g == nil || g.Match(channel) {
+				channels = append(channels, channel)
+			}
+		}
+		sort.Strings(channels)
+		return replyMultiBulkString(c, channels)
+	case "NUMSUB":
+		var buf []byte
+		buf = append(buf, fmt.Sprintf("*%d%s", 2*(len(args)-1), Delimeter)...)
+		for _, channel := range args[1:] {
+			buf = appendBulkString(buf, channel)
+			buf = append(buf, fmt.Sprintf(":%d%s", len(rs.pubsubChannels[channel]), Delimeter)...)
+		}
+		_, err := c.Write(buf)
+		return isNil(err)
+	case "NUMPAT":
+		if len(args) != 1 {
+			return replyInvalidNumberOfArgsError(c, "PUBSUB")
+		}
+		return replyInteger(c, strconv.Itoa(len(rs.pubsubPatterns)))
+	}
+	return replyInvalidCommandError(c)
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"net"
+	"io"
 	"strconv"
 )
 
@@ -38,7 +38,7 @@ func readBulkString(r *bufio.Reader) (string, error) {
 	}
 	// add 2 to length for the \r\n bytes
 	buf := make([]byte, length+2)
-	bytesRead, err := r.Read(buf)
+	bytesRead, err := io.ReadFull(r, buf)
 	if err != nil || bytesRead != length+2 {
 		return "", fmt.Errorf("Failed to Read Bulk String. Error: %v. Buffer Length: %d, Bytes Read: %d", err, length, bytesRead)
 	}
@@ -94,10 +94,12 @@ func readArray(r *bufio.Reader) ([]string, error) {
 	return returnVals, nil
 }
 
-func readCommand(c net.Conn) ([]string, error) {
+func readCommand(reader *bufio.Reader) ([]string, error) {
 	// will listen for message to process ending in carriage return (\r)
-	reader := bufio.NewReader(c)
 	b, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
 	if b != '*' {
 		return nil, fmt.Errorf("First Byte was not '*' -- Currently Only Supporting Bulk Commands")
 	}
@@ -47,6 +47,13 @@ func replyBulkString(c io.Writer, val string) bool {
 	return isNil(err)
 }
 
+// appendBulkString appends val as a bulk string to a reply being built
+func appendBulkString(buf []byte, val string) []byte {
+	buf = append(buf, "$"+strconv.Itoa(len(val))+Delimeter...)
+	buf = append(buf, val...)
+	return append(buf, Delimeter...)
+}
+
 func replyMultiBulkString(c io.Writer, val []string) bool {
 	sb := strings.Builder{}
 	_, err := sb.WriteString(fmt.Sprintf("*%d\r\n", len(val)))
@@ -63,6 +70,22 @@ func replyMultiBulkString(c io.Writer, val []string) bool {
 	return isNil(err)
 }
 
+// replyMultiBulkStringOrNil is like replyMultiBulkString but the values that
+// do not exist are sent as nil bulk strings
+func replyMultiBulkStringOrNil(c io.Writer, val []string, exists []bool) bool {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("*%d\r\n", len(val)))
+	for i, v := range val {
+		if !exists[i] {
+			sb.WriteString(emptyBulkString)
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(v), v))
+	}
+	_, err := c.Write([]byte(sb.String()))
+	return isNil(err)
+}
+
 func replyInteger(c io.Writer, val string) bool {
 	integer, err := strconv.Atoi(val)
 	if !isNil(err) {
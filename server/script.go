@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// EVAL runs a Lua script under the server lock so no other client sees the
+// dataset half way through it. The script calls commands with redis.call and
+// redis.pcall, which go through the same dispatcher as the commands clients
+// send, and the replies are converted to Lua values and back. Compiled
+// scripts are cached by the SHA1 of their source for EVALSHA. A script that
+// runs for longer than lua-time-limit makes the server reply BUSY to other
+// clients until it is done or stopped with SCRIPT KILL
+
+var (
+	errNoScript        = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+	errNegativeKeys    = errors.New("ERR Number of keys can't be negative")
+	errTooManyKeys     = errors.New("ERR Number of keys can't be greater than number of args")
+	errScriptBusy      = errors.New("BUSY Redis is busy running a script. You can only call SCRIPT KILL.")
+	errScriptNotBusy   = errors.New("NOTBUSY No scripts in execution right now.")
+	errScriptWrote     = errors.New("UNKILLABLE Sorry the script already executed write commands against the dataset. You can only wait for it to finish.")
+	errScriptKilled    = errors.New("ERR Script killed by user with SCRIPT KILL...")
+	errUnknownCommand  = errors.New("ERR Unknown Redis command called from script")
+	errScriptArity     = errors.New("ERR Wrong number of args calling Redis command from script")
+	errNotFromScript   = errors.New("ERR This Redis command is not allowed from scripts")
+	errScriptArgType   = errors.New("ERR Lua redis lib command arguments must be strings or integers")
+	errScriptNoCommand = errors.New("ERR Please specify at least one argument for this redis lib call")
+)
+
+// runningScript is the script EVAL is running. The clients that come in
+// while it holds rs.lock look at it under rs.scriptLock instead
+type runningScript struct {
+	// busyAt is when the script has run for longer than lua-time-limit
+	// (zero when there is no limit)
+	busyAt time.Time
+	cancel context.CancelFunc
+	// wrote is set before the script calls its first write command, it can
+	// not be killed from then on. killed is set once SCRIPT KILL stopped it
+	wrote  bool
+	killed bool
+}
+
+// scriptSHA returns the SHA1 of the source of a script in hex, the name it is
+// cached under
+func scriptSHA(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
+
+// compileScript compiles the source of a script into the function EVAL calls
+func compileScript(src string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(src), "user_script")
+	if err == nil {
+		var proto *lua.FunctionProto
+		if proto, err = lua.Compile(chunk, "user_script"); err == nil {
+			return proto, nil
+		}
+	}
+	return nil, fmt.Errorf("ERR Error compiling script (new function): %v", err)
+}
+
+// loadScript compiles a script unless it is cached already and returns its
+// SHA1. The caller must hold rs.lock
+func (rs *RedisServer) loadScript(src string) (string, error) {
+	sha := scriptSHA(src)
+	if _, ok := rs.scripts[sha]; ok {
+		return sha, nil
+	}
+	proto, err := compileScript(src)
+	if err != nil {
+		return "", err
+	}
+	rs.scripts[sha] = proto
+	return sha, nil
+}
+
+// newScriptState returns a Lua state with only the libraries a script needs,
+// nothing that reaches the file system or the process
+func newScriptState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "require", "module", "print"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// scriptConn is the connection of the client a script calls commands as, it
+// holds the reply of the last command
+type scriptConn struct {
+	bytes.Buffer
+}
+
+func (*scriptConn) Close() error { return nil }
+
+// scriptRun is a single run of a script
+type scriptRun struct {
+	rs *RedisServer
+	// caller is the client that sent EVAL and cl the one the script calls
+	// commands as, it starts out with the db of the caller selected
+	caller *RedisClient
+	cl     *RedisClient
+	conn   *scriptConn
+	// logged is set once MULTI was logged to the append only file ahead of
+	// the first write command of the script
+	logged bool
+}
+
+// redisLib returns the redis table scripts call commands through
+func (sr *scriptRun) redisLib(L *lua.LState) *lua.LTable {
+	return L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"call": func(L *lua.LState) int {
+			reply := sr.call(L)
+			if isErrorReply(reply) {
+				L.Error(reply, 1)
+			}
+			L.Push(reply)
+			return 1
+		},
+		"pcall": func(L *lua.LState) int {
+			L.Push(sr.call(L))
+			return 1
+		},
+		"error_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "err", L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "ok", L.CheckString(1)))
+			return 1
+		},
+	})
+}
+
+// call runs the command the arguments on the Lua stack make up and returns
+// its reply as a Lua value, errors are returned as error tables
+func (sr *scriptRun) call(L *lua.LState) lua.LValue {
+	rs := sr.rs
+	n := L.GetTop()
+	if n == 0 {
+		return replyTable(L, "err", errScriptNoCommand.Error())
+	}
+	args := make([]string, n)
+	for i := 1; i <= n; i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			args[i-1] = string(v)
+		case lua.LNumber:
+			args[i-1] = v.String()
+		default:
+			return replyTable(L, "err", errScriptArgType.Error())
+		}
+	}
+	command := strings.ToUpper(args[0])
+	cmd, ok := commandTable[command]
+	switch {
+	case !ok:
+		return replyTable(L, "err", errUnknownCommand.Error())
+	case !cmd.checkArity(n):
+		return replyTable(L, "err", errScriptArity.Error())
+	case cmd.hasFlag(cmdNoScript):
+		return replyTable(L, "err", errNotFromScript.Error())
+	}
+	if cmd.hasFlag(cmdWrite) {
+		if !rs.markScriptWrite() {
+			L.RaiseError(errScriptKilled.Error())
+		}
+		// the writes are logged between MULTI and EXEC so a replay applies
+		// them together, inside EXEC they already are
+		if rs.aof != nil && !sr.logged && !sr.caller.hasFlag(flagMulti) {
+			rs.feedAppendOnlyFile(sr.caller.db, "MULTI", nil)
+			sr.logged = true
+		}
+	}
+	sr.conn.Reset()
+	rs.call(sr.cl, cmd, command, args[1:])
+	reply, err := replyToLua(L, bufio.NewReader(&sr.conn.Buffer))
+	if err != nil {
+		return replyTable(L, "err", "ERR "+err.Error())
+	}
+	return reply
+}
+
+// replyTable returns the table a status (field ok) or error (field err) reply
+// is in Lua
+func replyTable(L *lua.LState, field, msg string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString(field, lua.LString(msg))
+	return t
+}
+
+func isErrorReply(v lua.LValue) bool {
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return false
+	}
+	_, ok = t.RawGetString("err").(lua.LString)
+	return ok
+}
+
+// replyToLua reads a reply written by a command and converts it to Lua.
+// Integers become numbers, bulk strings strings, arrays tables and a nil bulk
+// string or array false
+func replyToLua(L *lua.LState, r *bufio.Reader) (lua.LValue, error) {
+	line, err := r.ReadString('\n')
+	// a few error replies go without the delimiter
+	if err != nil && (err != io.EOF || line == "") {
+		return lua.LNil, fmt.Errorf("no reply from the command")
+	}
+	line = strings.TrimSuffix(line, Delimeter)
+	if line == "" {
+		return lua.LNil, fmt.Errorf("empty reply from the command")
+	}
+	typ, rest := line[0], line[1:]
+	switch typ {
+	case '+':
+		return replyTable(L, "ok", rest), nil
+	case '-':
+		return replyTable(L, "err", rest), nil
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		return lua.LNumber(n), err
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return lua.LFalse, err
+		}
+		buf := make([]byte, n+len(Delimeter))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return lua.LNil, err
+		}
+		return lua.LString(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return lua.LFalse, err
+		}
+		t := L.CreateTable(n, 0)
+		for i := 0; i < n; i++ {
+			v, err := replyToLua(L, r)
+			if err != nil {
+				return lua.LNil, err
+			}
+			t.Append(v)
+		}
+		return t, nil
+	}
+	return lua.LNil, fmt.Errorf("unknown reply %q", line)
+}
+
+// appendLuaReply appends v to a reply being built. Numbers are truncated to
+// integers, true becomes 1 and false or nil a nil bulk string. A table is an
+// array up to its first nil unless it is a status or error reply
+func appendLuaReply(buf []byte, v lua.LValue) []byte {
+	switch v := v.(type) {
+	case lua.LString:
+		return appendBulkString(buf, string(v))
+	case lua.LNumber:
+		return append(buf, ":"+strconv.FormatInt(int64(v), 10)+Delimeter...)
+	case lua.LBool:
+		if v {
+			return append(buf, ":1"+Delimeter...)
+		}
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return append(buf, "-"+string(msg)+Delimeter...)
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			return append(buf, "+"+string(msg)+Delimeter...)
+		}
+		n := 0
+		for v.RawGetInt(n+1) != lua.LNil {
+			n++
+		}
+		buf = append(buf, "*"+strconv.Itoa(n)+Delimeter...)
+		for i := 1; i <= n; i++ {
+			buf = appendLuaReply(buf, v.RawGetInt(i))
+		}
+		return buf
+	}
+	return append(buf, emptyBulkString...)
+}
+
+func stringsTable(L *lua.LState, vals []string) *lua.LTable {
+	t := L.CreateTable(len(vals), 0)
+	for _, v := range vals {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+// runScript runs the compiled script sha for cl with args (numkeys, the keys
+// and the other arguments) and replies with what it returned. The commands
+// the script called are logged to the append only file rather than the
+// script, so a replay does not need the script cache. The caller must hold
+// rs.lock
+func (rs *RedisServer) runScript(cl *RedisClient, sha string, proto *lua.FunctionProto, args []string) bool {
+	c := cl.conn
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return replyInvalidTypeIntegerError(c)
+	}
+	if numKeys < 0 {
+		return replySimpleError(c, errNegativeKeys.Error())
+	}
+	if numKeys > len(args)-1 {
+		return replySimpleError(c, errTooManyKeys.Error())
+	}
+
+	L := newScriptState()
+	defer L.Close()
+	sr := &scriptRun{rs: rs, caller: cl, conn: &scriptConn{}}
+	sr.cl = NewRedisClient(-1, sr.conn)
+	sr.cl.db = cl.db
+	sr.cl.flags |= flagScript
+	L.SetGlobal("KEYS", stringsTable(L, args[1:1+numKeys]))
+	L.SetGlobal("ARGV", stringsTable(L, args[1+numKeys:]))
+	L.SetGlobal("redis", sr.redisLib(L))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	L.SetContext(ctx)
+	rs.startScript(cancel)
+	err = L.CallByParam(lua.P{Fn: L.NewFunctionFromProto(proto), NRet: 1, Protect: true})
+	killed := rs.stopScript()
+	if sr.logged {
+		rs.feedAppendOnlyFile(cl.db, "EXEC", nil)
+	}
+
+	if killed {
+		return replySimpleError(c, errScriptKilled.Error())
+	}
+	if err != nil {
+		var obj lua.LValue = lua.LString(err.Error())
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			obj = apiErr.Object
+		}
+		// an error reply raised by redis.call is passed on as it is
+		if isErrorReply(obj) {
+			_, err := c.Write(appendLuaReply(nil, obj))
+			return err == nil
+		}
+		return replySimpleError(c, fmt.Sprintf("ERR Error running script (call to f_%s): %s", sha, obj.String()))
+	}
+	_, err = c.Write(appendLuaReply(nil, L.Get(-1)))
+	return err == nil
+}
+
+// startScript makes the script about to run the one SCRIPT KILL stops
+func (rs *RedisServer) startScript(cancel context.CancelFunc) {
+	s := &runningScript{cancel: cancel}
+	if rs.config.luaTimeLimit > 0 {
+		s.busyAt = time.Now().Add(time.Duration(rs.config.luaTimeLimit) * time.Millisecond)
+	}
+	rs.scriptLock.Lock()
+	rs.script = s
+	rs.scriptLock.Unlock()
+}
+
+// stopScript forgets the script that finished and reports whether it was
+// killed
+func (rs *RedisServer) stopScript() bool {
+	rs.scriptLock.Lock()
+	defer rs.scriptLock.Unlock()
+	killed := rs.script.killed
+	rs.script = nil
+	return killed
+}
+
+// markScriptWrite makes the running script unkillable ahead of a write
+// command. It reports false when the script was killed already
+func (rs *RedisServer) markScriptWrite() bool {
+	rs.scriptLock.Lock()
+	defer rs.scriptLock.Unlock()
+	if rs.script.killed {
+		return false
+	}
+	rs.script.wrote = true
+	return true
+}
+
+// scriptBusy reports whether a script has been running for longer than
+// lua-time-limit. It does not need rs.lock, which the script holds
+func (rs *RedisServer) scriptBusy() bool {
+	rs.scriptLock.Lock()
+	defer rs.scriptLock.Unlock()
+	return rs.script != nil && !rs.script.busyAt.IsZero() && time.Now().After(rs.script.busyAt)
+}
+
+// isScriptKill reports whether a command is SCRIPT KILL, which is run without
+// rs.lock so it gets through while a script holds it
+func isScriptKill(command string, args []string) bool {
+	return command == "SCRIPT" && strings.EqualFold(args[0], "KILL")
+}
+
+// Commands Operating on Scripts
+
+func evalCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	sha, err := rs.loadScript(args[0])
+	if err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	return rs.runScript(cl, sha, rs.scripts[sha], args[1:])
+}
+
+func evalshaCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	sha := strings.ToLower(args[0])
+	proto, ok := rs.scripts[sha]
+	if !ok {
+		return replySimpleError(cl.conn, errNoScript.Error())
+	}
+	return rs.runScript(cl, sha, proto, args[1:])
+}
+
+func scriptCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	switch strings.ToUpper(args[0]) {
+	case "LOAD":
+		if len(args) != 2 {
+			return replyInvalidNumberOfArgsError(c, "SCRIPT")
+		}
+		sha, err := rs.loadScript(args[1])
+		if err != nil {
+			return replySimpleError(c, err.Error())
+		}
+		return replyBulkString(c, sha)
+	case "EXISTS":
+		if len(args) < 2 {
+			return replyInvalidNumberOfArgsError(c, "SCRIPT")
+		}
+		sb := strings.Builder{}
+		sb.WriteString("*" + strconv.Itoa(len(args)-1) + Delimeter)
+		for _, sha := range args[1:] {
+			if _, ok := rs.scripts[strings.ToLower(sha)]; ok {
+				sb.WriteString(":1" + Delimeter)
+			} else {
+				sb.WriteString(":0" + Delimeter)
+			}
+		}
+		_, err := c.Write([]byte(sb.String()))
+		return isNil(err)
+	case "FLUSH":
+		// ASYNC and SYNC are accepted, the cache is always dropped at once
+		if len(args) > 2 || (len(args) == 2 && !strings.EqualFold(args[1], "ASYNC") && !strings.EqualFold(args[1], "SYNC")) {
+			return replyInvalidNumberOfArgsError(c, "SCRIPT")
+		}
+		rs.scripts = make(map[string]*lua.FunctionProto)
+		return replyOK(c)
+	}
+	return replyInvalidCommandError(c)
+}
+
+// scriptKillCommand stops the running script unless it has written to the
+// dataset. It is run without rs.lock
+func scriptKillCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	if len(args) != 1 {
+		return replyInvalidNumberOfArgsError(c, "SCRIPT")
+	}
+	rs.scriptLock.Lock()
+	defer rs.scriptLock.Unlock()
+	switch {
+	case rs.script == nil:
+		return replySimpleError(c, errScriptNotBusy.Error())
+	case rs.script.wrote:
+		return replySimpleError(c, errScriptWrote.Error())
+	}
+	rs.script.killed = true
+	rs.script.cancel()
+	return replyOK(c)
+}
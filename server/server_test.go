@@ -3,21 +3,41 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"database/sql"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const PORT = ":8081"
 
-func init() {
+// packageDir is the dir of the package, the tests themselves run in a
+// temporary dir so the data files they write do not end up in the tree
+var packageDir string
+
+func TestMain(m *testing.M) {
+	var err error
+	packageDir, err = os.Getwd()
+	check(err)
+	dir, err := os.MkdirTemp("", "sc-test")
+	check(err)
+	check(os.Chdir(dir))
 	s := NewRedisServer(PORT)
-	os.Remove("save.db")
 	go func() {
 		s.Listen()
 	}()
+	code := m.Run()
+	os.Chdir(packageDir)
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 
 func TestConnectToServer(t *testing.T) {
@@ -89,6 +109,16 @@ func TestBulkCommands(t *testing.T) {
 			[]byte("*2\r\n$3\r\nget\r\n$6\r\nmykey1\r\n"),
 			[]byte("$3\r\nbar\r\n"),
 		},
+		{
+			"GET a key that does not exist",
+			mbrr("get nosuchkey"),
+			[]byte(emptyBulkString),
+		},
+		{
+			"Command that is not in the command table",
+			mbrr("notacommand mykey"),
+			[]byte(invalidCommandError),
+		},
 		{
 			"SET an integer (uppercase command)",
 			[]byte("*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n:1\r\n"),
@@ -293,12 +323,12 @@ func TestBulkCommands(t *testing.T) {
 		{
 			"TYPE of key that exists",
 			mbrr("type heywork"),
-			[]byte("string\r\n"),
+			[]byte("+string\r\n"),
 		},
 		{
 			"TYPE of key that does not exists",
 			mbrr("type fsawrqsafrwq"),
-			[]byte("none\r\n"),
+			[]byte("+none\r\n"),
 		},
 		{
 			"TYPE with too many args",
@@ -318,7 +348,7 @@ func TestBulkCommands(t *testing.T) {
 		{
 			"TYPE on the key that we just deleted (need to make sure it is deleted from tstore",
 			mbrr("type heywork"),
-			[]byte("none\r\n"),
+			[]byte("+none\r\n"),
 		},
 		{
 			"SET another variable to use to test wrongtype check",
@@ -1020,12 +1050,12 @@ func TestBulkCommands(t *testing.T) {
 		{
 			"TYPE on LISTTYPE should return 'list'",
 			mbrr("type LISTTYPE"),
-			[]byte("list\r\n"),
+			[]byte("+list\r\n"),
 		},
 		{
 			"TYPE on list2 should return 'none'",
 			mbrr("type list2"),
-			[]byte("none\r\n"),
+			[]byte("+none\r\n"),
 		},
 		{
 			"RENAMENX but the target key already exists",
@@ -1043,9 +1073,9 @@ func TestBulkCommands(t *testing.T) {
 			[]byte(":-3\r\n"),
 		},
 		{
-			"SADD with too many args",
+			"SADD with several members",
 			mbrr("sadd 0 1 1 1 1 34"),
-			mial("sadd"),
+			[]byte(":2\r\n"),
 		},
 		{
 			"SADD with too few args",
@@ -1053,9 +1083,9 @@ func TestBulkCommands(t *testing.T) {
 			mial("sadd"),
 		},
 		{
-			"SREM with too many args",
+			"SREM with several members removes the emptied set",
 			mbrr("SREM 0 1 1 1 1 34"),
-			mial("SREM"),
+			[]byte(":2\r\n"),
 		},
 		{
 			"SREM with too few args",
@@ -1328,7 +1358,7 @@ func TestBulkCommands(t *testing.T) {
 		{
 			"TYPE on newly created set to see 'set'",
 			mbrr("type set123"),
-			[]byte("set\r\n"),
+			[]byte("+set\r\n"),
 		},
 		{
 			"SINTERSTORE with stringtype as the dest key",
@@ -1487,20 +1517,23 @@ func TestBulkCommands(t *testing.T) {
 		// },
 	}
 
+	// all of the cases share one connection because state such as the
+	// selected db belongs to the connection
+	conn, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
 	for _, tc := range tt {
 		t.Run(tc.test, func(t *testing.T) {
-			conn, err := net.Dial("tcp", PORT)
-			if err != nil {
-				t.Error("connection error: ", err)
-			}
-			defer conn.Close()
-
 			if _, err := conn.Write(tc.payload); err != nil {
 				t.Error("write error:", err)
 			}
 
 			buf := make([]byte, len(tc.want))
-			if out, err := bufio.NewReader(conn).Read(buf); err == nil {
+			if out, err := io.ReadFull(reader, buf); err == nil {
 				if bytes.Compare(buf, tc.want) != 0 {
 					t.Errorf("actual did not match expected.\nActual:   %q\nExpected: %q", string(buf), tc.want)
 				}
@@ -1514,31 +1547,2599 @@ func TestBulkCommands(t *testing.T) {
 	}
 }
 
-func BenchmarkExecuteCommand(b *testing.B) {
-	s := NewRedisServer(":15615")
+func TestSelectIsPerConnection(t *testing.T) {
+	c1, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer c1.Close()
+	c2, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer c2.Close()
+	r1 := bufio.NewReader(c1)
+	r2 := bufio.NewReader(c2)
+
+	steps := []struct {
+		conn    net.Conn
+		r       *bufio.Reader
+		payload []byte
+		want    []byte
+	}{
+		{c1, r1, mbrr("select 2"), []byte(okStatus)},
+		{c1, r1, mbrr("set perconn db2"), []byte(okStatus)},
+		{c2, r2, mbrr("set perconn db0"), []byte(okStatus)},
+		{c1, r1, mbrr("get perconn"), []byte("$3\r\ndb2\r\n")},
+		{c2, r2, mbrr("get perconn"), []byte("$3\r\ndb0\r\n")},
+		{c2, r2, mbrr("del perconn"), []byte(":1\r\n")},
+		{c1, r1, mbrr("del perconn"), []byte(":1\r\n")},
+	}
+	for i, s := range steps {
+		expectReply(t, i, s.conn, s.r, s.payload, s.want)
+	}
+}
+
+func TestRenameOntoOtherType(t *testing.T) {
+	s := newRedisServer(":15650", defaultConfig())
 	defer s.l.Close()
-	f, err := os.Open(os.DevNull)
-	check(err)
-	defer f.Close()
+	defer close(s.done)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+	// how to create a key of each type holding elem and how to read it back
+	types := []struct {
+		create func(key, elem string) []string
+		read   func(key string) []string
+	}{
+		{func(k, e string) []string { return []string{"SET", k, e} }, func(k string) []string { return []string{"GET", k} }},
+		{func(k, e string) []string { return []string{"RPUSH", k, e} }, func(k string) []string { return []string{"LRANGE", k, "0", "-1"} }},
+		{func(k, e string) []string { return []string{"SADD", k, e} }, func(k string) []string { return []string{"SMEMBERS", k} }},
+		{func(k, e string) []string { return []string{"HSET", k, e, "v"} }, func(k string) []string { return []string{"HKEYS", k} }},
+		{func(k, e string) []string { return []string{"ZADD", k, "1", e} }, func(k string) []string { return []string{"ZRANGE", k, "0", "-1"} }},
+		{func(k, e string) []string { return []string{"XADD", k, "*", e, "v"} }, func(k string) []string { return []string{"XLEN", k} }},
+	}
+	do := func(c []string) string {
+		conn.Reset()
+		s.ExecuteCommand(cl, c[0], c[1:])
+		return conn.String()
+	}
+	for i, src := range types {
+		for j, dst := range types {
+			if i == j {
+				continue
+			}
+			do([]string{"FLUSHALL"})
+			do(dst.create("fresh", "new"))
+			want := do(dst.read("fresh"))
+			// the old value of the destination must not come back once the
+			// renamed value is deleted
+			do(dst.create("dst", "old"))
+			do(src.create("src", "v"))
+			if got := do([]string{"RENAME", "src", "dst"}); got != okStatus {
+				t.Fatalf("%d onto %d: RENAME replied %q", i, j, got)
+			}
+			do([]string{"DEL", "dst"})
+			do(dst.create("dst", "new"))
+			if got := do(dst.read("dst")); got != want {
+				t.Errorf("%d onto %d: actual did not match expected.\nActual:   %q\nExpected: %q", i, j, got, want)
+			}
+		}
+	}
+}
 
-	for i := 0; i < b.N; i++ {
-		s.ExecuteCommand(f, 0, "SADD", []string{"mykey1234", fmt.Sprintf("%d", i)})
+func TestKeyExpiration(t *testing.T) {
+	conn, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	steps := []struct {
+		payload []byte
+		want    []byte
+	}{
+		{mbrr("select 3"), []byte(okStatus)},
+		{mbrr("set ttlkey value"), []byte(okStatus)},
+		{mbrr("ttl ttlkey"), []byte(":-1\r\n")},
+		{mbrr("ttl nosuchttlkey"), []byte(":-2\r\n")},
+		{mbrr("expire nosuchttlkey 100"), []byte(":0\r\n")},
+		{mbrr("expire ttlkey 100"), []byte(":1\r\n")},
+		{mbrr("ttl ttlkey"), []byte(":100\r\n")},
+		{mbrr("persist ttlkey"), []byte(":1\r\n")},
+		{mbrr("persist ttlkey"), []byte(":0\r\n")},
+		{mbrr("ttl ttlkey"), []byte(":-1\r\n")},
+		{mbrr("setex ttlkey2 0 value"), []byte("-ERR invalid expire time in 'setex' command\r\n")},
+		{mbrr("setex ttlkey2 50 value"), []byte(okStatus)},
+		{mbrr("ttl ttlkey2"), []byte(":50\r\n")},
+		{mbrr("set ttlkey2 value"), []byte(okStatus)},
+		{mbrr("ttl ttlkey2"), []byte(":-1\r\n")},
+		{mbrr("expire ttlkey2 50"), []byte(":1\r\n")},
+		{mbrr("rename ttlkey2 ttlkey3"), []byte(okStatus)},
+		{mbrr("ttl ttlkey3"), []byte(":50\r\n")},
+		{mbrr("expireat ttlkey3 1"), []byte(":1\r\n")},
+		{mbrr("exists ttlkey3"), []byte(":0\r\n")},
+		{mbrr("pexpire ttlkey 20"), []byte(":1\r\n")},
+		{mbrr("dbsize"), []byte(":1\r\n")},
+	}
+	for i, s := range steps {
+		expectReply(t, i, conn, r, s.payload, s.want)
 	}
+
+	time.Sleep(50 * time.Millisecond)
+	expectReply(t, len(steps), conn, r, mbrr("dbsize"), []byte(":0\r\n"))
+	expectReply(t, len(steps)+1, conn, r, mbrr("keys *"), []byte(emptySetOrList))
+	expectReply(t, len(steps)+2, conn, r, mbrr("get ttlkey"), []byte(emptyBulkString))
 }
 
-// mbrr - make bulk resp request
-// takes a string with space separated command+args? and
-// retunrs the correct resp byte slice
-func mbrr(req string) []byte {
-	splitWs := strings.Split(req, " ")
-	var sb strings.Builder
-	header := fmt.Sprintf("*%d%s", len(splitWs), Delimeter)
-	sb.WriteString(header)
-	for _, v := range splitWs {
-		l := len(v)
-		sb.WriteString(fmt.Sprintf("$%d%s%s%s", l, Delimeter, v, Delimeter))
+func TestLoadSnapshotOnStartup(t *testing.T) {
+	conn, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	steps := []struct {
+		payload []byte
+		want    []byte
+	}{
+		{mbrr("select 5"), []byte(okStatus)},
+		{mbrr("set loadstr value"), []byte(okStatus)},
+		{mbrr("rpush loadlist a"), []byte(":1\r\n")},
+		{mbrr("rpush loadlist b"), []byte(":2\r\n")},
+		{mbrr("rpush loadlist c"), []byte(":3\r\n")},
+		{mbrr("sadd loadset x"), []byte(":1\r\n")},
+		{mbrr("expire loadset 100"), []byte(":1\r\n")},
+		{mbrr("save"), []byte(okStatus)},
+	}
+	for i, s := range steps {
+		expectReply(t, i, conn, r, s.payload, s.want)
+	}
+
+	s := NewRedisServer(":15616")
+	defer s.l.Close()
+	defer close(s.done)
+
+	if s.lastsave == 0 {
+		t.Error("lastsave was not loaded from the snapshot")
+	}
+	db := s.store[5]
+	if db.kv["loadstr"] != "value" || db.tstore["loadstr"] != tString {
+		t.Errorf("string key was not loaded: %q %q", db.kv["loadstr"], db.tstore["loadstr"])
+	}
+	if got := s.lrange(db, "loadlist", 0, -1); strings.Join(got, " ") != "a b c" {
+		t.Errorf("list was not loaded in order: %q", got)
+	}
+	if _, ok := db.s["loadset"]["x"]; !ok || db.tstore["loadset"] != tSet {
+		t.Error("set key was not loaded")
+	}
+	if ttl := s.pttl(db, "loadset"); ttl <= 0 || ttl > 100*1000 {
+		t.Errorf("ttl was not loaded: %d", ttl)
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	conn, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	steps := []struct {
+		payload []byte
+		want    []byte
+	}{
+		{mbrr("config set snapshot-keep abc"), []byte("-ERR Invalid argument 'abc' for CONFIG SET 'snapshot-keep' - argument must be a non negative integer\r\n")},
+		{mbrr("config set no-such-param 1"), []byte("-ERR Unsupported CONFIG parameter: no-such-param\r\n")},
+		{mbrr("config set snapshot-keep 2"), []byte(okStatus)},
+		{mbrr("config get snapshot-keep"), mbrr("snapshot-keep 2")},
+		{mbrr("save"), []byte(okStatus)},
+		{mbrr("save"), []byte(okStatus)},
+		{mbrr("save"), []byte(okStatus)},
+	}
+	for i, s := range steps {
+		expectReply(t, i, conn, r, s.payload, s.want)
+	}
+	defer expectReply(t, len(steps), conn, r, mbrr("config set snapshot-keep 0"), []byte(okStatus))
+
+	saveDb, err := sql.Open("sqlite", saveDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+	snapshots, err := listSnapshots(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Errorf("expected 2 snapshots to be kept, got %d", len(snapshots))
+	}
+	for _, table := range snapshotStoreTables {
+		var orphans int
+		err := saveDb.QueryRow(`SELECT COUNT(*) FROM ` + table + ` WHERE saveID NOT IN (SELECT saveID FROM lastsave);`).Scan(&orphans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if orphans != 0 {
+			t.Errorf("%s still has %d rows from pruned snapshots", table, orphans)
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	conn, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	steps := []struct {
+		payload []byte
+		want    []byte
+	}{
+		// keep only the snapshot this test saves so the LIST reply is known
+		{mbrr("config set snapshot-keep 1"), []byte(okStatus)},
+		{mbrr("select 6"), []byte(okStatus)},
+		{mbrr("set restorekey six"), []byte(okStatus)},
+		{mbrr("select 7"), []byte(okStatus)},
+		{mbrr("set restorekey seven"), []byte(okStatus)},
+		{mbrr("save"), []byte(okStatus)},
+	}
+	for i, s := range steps {
+		expectReply(t, i, conn, r, s.payload, s.want)
+	}
+	defer expectReply(t, len(steps), conn, r, mbrr("config set snapshot-keep 0"), []byte(okStatus))
+
+	saveDb, err := sql.Open("sqlite", saveDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+	saveID, lastsave, err := latestSaveID(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps = []struct {
+		payload []byte
+		want    []byte
+	}{
+		{mbrr("snapshot list"), mbrr(saveID + " " + fmt.Sprint(lastsave))},
+		{mbrr("snapshot restore nosuchsnapshot"), []byte("-ERR no such snapshot\r\n")},
+		{mbrr("snapshot restore " + saveID + " db 10"), []byte(integerOutOfRangeError)},
+		{mbrr("flushall"), []byte(okStatus)},
+		{mbrr("get restorekey"), []byte(emptyBulkString)},
+		{mbrr("snapshot restore " + saveID + " db 6"), []byte(okStatus)},
+		{mbrr("get restorekey"), []byte(emptyBulkString)},
+		{mbrr("select 6"), []byte(okStatus)},
+		{mbrr("get restorekey"), []byte("$3\r\nsix\r\n")},
+		{mbrr("snapshot restore " + saveID), []byte(okStatus)},
+		{mbrr("select 7"), []byte(okStatus)},
+		{mbrr("get restorekey"), []byte("$5\r\nseven\r\n")},
+		{mbrr("flushall"), []byte(okStatus)},
+	}
+	for i, s := range steps {
+		expectReply(t, i, conn, r, s.payload, s.want)
+	}
+}
+
+func TestTimeTravelReads(t *testing.T) {
+	conn, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	steps := []struct {
+		payload []byte
+		want    []byte
+	}{
+		{mbrr("select 8"), []byte(okStatus)},
+		{mbrr("set ttstr old"), []byte(okStatus)},
+		{mbrr("rpush ttlist a"), []byte(":1\r\n")},
+		{mbrr("rpush ttlist b"), []byte(":2\r\n")},
+		{mbrr("sadd ttset m"), []byte(":1\r\n")},
+		{mbrr("save"), []byte(okStatus)},
+	}
+	for i, s := range steps {
+		expectReply(t, i, conn, r, s.payload, s.want)
+	}
+
+	saveDb, err := sql.Open("sqlite", saveDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+	saveID, lastsave, err := latestSaveID(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := fmt.Sprint(lastsave)
+
+	steps = []struct {
+		payload []byte
+		want    []byte
+	}{
+		{mbrr("set ttstr new"), []byte(okStatus)},
+		{mbrr("del ttlist"), []byte(":1\r\n")},
+		{mbrr("getat " + saveID + " ttstr"), []byte("$3\r\nold\r\n")},
+		{mbrr("getat " + at + " ttstr"), []byte("$3\r\nold\r\n")},
+		{mbrr("getat 1 ttstr"), []byte("-ERR no snapshot at or before that time\r\n")},
+		{mbrr("getat nosuchsnapshot ttstr"), []byte("-ERR no such snapshot\r\n")},
+		{mbrr("getat " + saveID + " nosuchkey"), []byte(emptyBulkString)},
+		{mbrr("getat " + saveID + " ttlist"), []byte(wrongTypeError)},
+		{mbrr("typeat " + saveID + " ttlist"), []byte("+list\r\n")},
+		{mbrr("typeat " + saveID + " ttset"), []byte("+set\r\n")},
+		{mbrr("lrangeat " + saveID + " ttlist 0 -1"), mbrr("a b")},
+		{mbrr("smembersat " + at + " ttset"), mbrr("m")},
+		{mbrr("get ttstr"), []byte("$3\r\nnew\r\n")},
+	}
+	for i, s := range steps {
+		expectReply(t, i, conn, r, s.payload, s.want)
+	}
+
+	// a save that is still writing its snapshot does not hold up readers
+	writer, err := saveDb.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	if _, err := writer.ExecContext(context.Background(), `BEGIN EXCLUSIVE; INSERT INTO lastsave(saveID, lastsave) VALUES ('unfinished', 0);`); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, 0, conn, r, mbrr("getat "+saveID+" ttstr"), []byte("$3\r\nold\r\n"))
+	if _, err := writer.ExecContext(context.Background(), `ROLLBACK;`); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, 1, conn, r, mbrr("flushdb"), []byte(okStatus))
+}
+
+func TestOldSaveDBIsOnlyRead(t *testing.T) {
+	// a save db from before hashes, sorted sets, streams and ttls were saved
+	path := filepath.Join(t.TempDir(), "old.db")
+	saveDb, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+	for _, tableSQL := range append(saveDBTableSQL[:4:4], saveDBTableSQL[len(saveDBTableSQL)-1]) {
+		if _, err := saveDb.Exec(tableSQL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = saveDb.Exec(`INSERT INTO lastsave(saveID, lastsave) VALUES ('old', 1);
+		INSERT INTO typeStore(dbID, key, typ, saveID) VALUES (0, 'k', 'string', 'old');
+		INSERT INTO kvStore(dbID, key, val, saveID) VALUES (0, 'k', 'v', 'old');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := func() string {
+		var sb strings.Builder
+		rows, err := saveDb.Query(`SELECT name FROM sqlite_master ORDER BY name;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			rows.Scan(&name)
+			sb.WriteString(name + " ")
+		}
+		return sb.String()
+	}
+	before := schema()
+
+	if _, err := diffSaveDB(path, "old", "old", -1, NumDBs); err != nil {
+		t.Fatal(err)
+	}
+	readDb, err := openSaveDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readDb.Close()
+	store, err := readSnapshot(readDb, "old", 0, NumDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store[0].kv["k"] != "v" {
+		t.Errorf("old snapshot was not read: %v", store[0].kv)
+	}
+	if _, err := readDb.Exec(`INSERT INTO lastsave(saveID, lastsave) VALUES ('new', 2);`); err == nil {
+		t.Error("save db was opened for writing")
+	}
+	if after := schema(); after != before {
+		t.Errorf("reading the save db changed its tables from %q to %q", before, after)
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	conn, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	saveDb, err := sql.Open("sqlite", saveDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+
+	steps := []struct {
+		payload []byte
+		want    []byte
+	}{
+		{mbrr("select 9"), []byte(okStatus)},
+		{mbrr("set ds one"), []byte(okStatus)},
+		{mbrr("set dgone bye"), []byte(okStatus)},
+		{mbrr("set dtyp str"), []byte(okStatus)},
+		{mbrr("rpush dl a"), []byte(":1\r\n")},
+		{mbrr("rpush dl b"), []byte(":2\r\n")},
+		{mbrr("rpush dl c"), []byte(":3\r\n")},
+		{mbrr("sadd dset x"), []byte(":1\r\n")},
+		{mbrr("sadd dset y"), []byte(":1\r\n")},
+		{mbrr("save"), []byte(okStatus)},
+	}
+	for i, s := range steps {
+		expectReply(t, i, conn, r, s.payload, s.want)
+	}
+	saveA, _, err := latestSaveID(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps = []struct {
+		payload []byte
+		want    []byte
+	}{
+		{mbrr("set ds two"), []byte(okStatus)},
+		{mbrr("del dgone"), []byte(":1\r\n")},
+		{mbrr("set dnew hi"), []byte(okStatus)},
+		{mbrr("del dtyp"), []byte(":1\r\n")},
+		{mbrr("sadd dtyp m"), []byte(":1\r\n")},
+		{mbrr("lrem dl 1 b"), []byte(":1\r\n")},
+		{mbrr("rpush dl d"), []byte(":3\r\n")},
+		{mbrr("srem dset x"), []byte(":1\r\n")},
+		{mbrr("sadd dset z"), []byte(":1\r\n")},
+		{mbrr("save"), []byte(okStatus)},
+	}
+	for i, s := range steps {
+		expectReply(t, i, conn, r, s.payload, s.want)
+	}
+	saveB, _, err := latestSaveID(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff := []string{
+		`- db9 "dgone" string`,
+		`~ db9 "dl" -[1] "b"`,
+		`~ db9 "dl" +[2] "d"`,
+		`+ db9 "dnew" string`,
+		`~ db9 "ds" "one" "two"`,
+		`~ db9 "dset" +"z"`,
+		`~ db9 "dset" -"x"`,
+		`~ db9 "dtyp" type string set`,
+	}
+	steps = []struct {
+		payload []byte
+		want    []byte
+	}{
+		{mbrr("snapshot diff " + saveA + " " + saveB + " db 9"), mbrl(diff...)},
+		{mbrr("snapshot diff " + saveA + " " + saveA), []byte(emptySetOrList)},
+		{mbrr("snapshot diff " + saveA + " " + saveB + " db 8"), []byte(emptySetOrList)},
+		{mbrr("snapshot diff " + saveA + " nosuchsnapshot"), []byte("-ERR no such snapshot\r\n")},
+		{mbrr("snapshot diff " + saveA + " " + saveB + " db 10"), []byte(integerOutOfRangeError)},
+		{mbrr("snapshot diff " + saveA), mial("snapshot")},
+		{mbrr("flushdb"), []byte(okStatus)},
+	}
+	for i, s := range steps {
+		expectReply(t, i, conn, r, s.payload, s.want)
+	}
+
+	// the offline mode reads the same save db without a server
+	var stdout, stderr bytes.Buffer
+	if code := runDiffCLI([]string{"-db", "9", saveA, saveB}, &stdout, &stderr); code != 0 {
+		t.Fatalf("diff exited with %d: %s", code, stderr.String())
+	}
+	if want := strings.Join(diff, "\n") + "\n"; stdout.String() != want {
+		t.Errorf("diff output did not match expected.\nActual:   %q\nExpected: %q", stdout.String(), want)
+	}
+	if code := runDiffCLI([]string{saveA}, &stdout, &stderr); code != 2 {
+		t.Errorf("diff with one saveID exited with %d, expected 2", code)
+	}
+}
+
+func TestSaveIsTransactional(t *testing.T) {
+	conn, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// enough elements to need more than one batch per table
+	steps := []struct {
+		payload []byte
+		want    []byte
+	}{
+		{mbrr("select 4"), []byte(okStatus)},
+	}
+	for i := 1; i <= 3*saveBatchSize; i++ {
+		steps = append(steps, struct {
+			payload []byte
+			want    []byte
+		}{mbrr(fmt.Sprintf("rpush txlist %d", i)), []byte(fmt.Sprintf(":%d\r\n", i))})
+	}
+	steps = append(steps, struct {
+		payload []byte
+		want    []byte
+	}{mbrr("save"), []byte(okStatus)})
+	for i, s := range steps {
+		expectReply(t, i, conn, r, s.payload, s.want)
+	}
+
+	saveDb, err := sql.Open("sqlite", saveDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+	saveID, _, err := latestSaveID(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := readSnapshot(saveDb, saveID, nowMs(), NumDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := store[4].ll["txlist"]; got == nil || got.Len() != 3*saveBatchSize || got.Back().Value != fmt.Sprint(3*saveBatchSize) {
+		t.Errorf("list was not saved in full")
+	}
+
+	// fail the save on its very last insert
+	_, err = saveDb.Exec(`CREATE TRIGGER failsave BEFORE INSERT ON lastsave BEGIN SELECT RAISE(ABORT, 'save failed'); END;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rowsBefore, rowsAfter int
+	if err := saveDb.QueryRow(`SELECT COUNT(*) FROM listStore;`).Scan(&rowsBefore); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(mbrr("save")); err != nil {
+		t.Fatal("write error:", err)
+	}
+	reply, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal("read error: ", err)
+	}
+	if !strings.HasPrefix(reply, "-ERR ") {
+		t.Errorf("failed save replied %q, expected an error", reply)
+	}
+	if err := saveDb.QueryRow(`SELECT COUNT(*) FROM listStore;`).Scan(&rowsAfter); err != nil {
+		t.Fatal(err)
+	}
+	if rowsAfter != rowsBefore {
+		t.Errorf("failed save left %d rows behind", rowsAfter-rowsBefore)
+	}
+	if info := readInfo(t, conn, r); !strings.Contains(info, "rdb_last_bgsave_status:err\n") {
+		t.Errorf("INFO does not report the failed save:\n%s", info)
+	}
+	if _, err := saveDb.Exec(`DROP TRIGGER failsave;`); err != nil {
+		t.Fatal(err)
+	}
+
+	expectReply(t, 0, conn, r, mbrr("save"), []byte(okStatus))
+	if info := readInfo(t, conn, r); !strings.Contains(info, "rdb_last_bgsave_status:ok\n") {
+		t.Errorf("INFO does not report the successful save:\n%s", info)
+	}
+	expectReply(t, 1, conn, r, mbrr("flushdb"), []byte(okStatus))
+}
+
+func TestAutoSave(t *testing.T) {
+	s := NewRedisServer(":15618")
+	defer s.l.Close()
+	defer close(s.done)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+
+	s.ExecuteCommand(cl, "CONFIG", []string{"SET", "save", "1 3"})
+	s.ExecuteCommand(cl, "CONFIG", []string{"GET", "save"})
+	s.ExecuteCommand(cl, "CONFIG", []string{"SET", "save", "1"})
+	s.ExecuteCommand(cl, "FLUSHALL", nil)
+	s.ExecuteCommand(cl, "SET", []string{"autokey", "a"})
+	want := "+OK\r\n" + string(mbrl("save", "1 3")) +
+		"-ERR Invalid argument '1' for CONFIG SET 'save' - save rules must be pairs of seconds and changes\r\n" +
+		"+OK\r\n+OK\r\n"
+	if conn.String() != want {
+		t.Errorf("actual did not match expected.\nActual:   %q\nExpected: %q", conn.String(), want)
+	}
+	s.lock.Lock()
+	if info := strings.Join(s.info(), ""); !strings.Contains(info, "changes_since_last_save:2\n") {
+		t.Errorf("INFO does not count the changes:\n%s", info)
+	}
+	s.lock.Unlock()
+
+	// two changes are not enough for the rule, however long we wait
+	time.Sleep(1100 * time.Millisecond)
+	s.lock.Lock()
+	if s.dirty != 2 || atomic.LoadInt32(&s.bgsaveInProgress) == 1 {
+		t.Fatal("saved before the save rule was met")
+	}
+	s.lock.Unlock()
+	s.ExecuteCommand(cl, "RPUSH", []string{"autolist", "a"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.lock.Lock()
+		dirty := s.dirty
+		s.lock.Unlock()
+		if dirty == 0 && atomic.LoadInt32(&s.bgsaveInProgress) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the save rule did not start a save")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := s.lastBgsaveStatus.Load(); status != "ok" {
+		t.Errorf("automatic save finished with status %q", status)
+	}
+}
+
+func TestAppendOnlyFile(t *testing.T) {
+	os.Remove(appendOnlyFile)
+	defer os.Remove(appendOnlyFile)
+	cfg := defaultConfig()
+	cfg.appendOnly = true
+	cfg.appendFsync = fsyncAlways
+
+	// restart stops the running server and loads the next one, each on a
+	// port of its own
+	port := 15619
+	var s *RedisServer
+	stop := func() {
+		if s != nil {
+			s.lock.Lock()
+			s.stopAppendOnly()
+			s.lock.Unlock()
+			close(s.done)
+			s.l.Close()
+		}
+	}
+	restart := func() {
+		stop()
+		s = newRedisServer(fmt.Sprintf(":%d", port), cfg)
+		port++
+	}
+	defer stop()
+	restart()
+
+	cl := NewRedisClient(0, &bufConn{})
+	commands := [][]string{
+		{"FLUSHALL"},
+		{"SET", "k", "v"},
+		{"SETEX", "tk", "100", "val"},
+		{"EXPIRE", "k", "1000"},
+		{"RPUSH", "l", "a"},
+		{"RPUSH", "l", "b"},
+		{"LPUSH", "k", "x"},
+		{"GET", "k"},
+		{"SELECT", "3"},
+		{"SADD", "s", "m"},
+		{"SET", "n", "5"},
+		{"INCR", "n"},
+	}
+	for _, c := range commands {
+		s.ExecuteCommand(cl, c[0], c[1:])
+	}
+	kAt, tkAt := s.store[0].expires["k"], s.store[0].expires["tk"]
+	var want []byte
+	want = appendCommandRESP(want, "SELECT", "0")
+	want = appendCommandRESP(want, "FLUSHALL")
+	want = appendCommandRESP(want, "SET", "k", "v")
+	want = appendCommandRESP(want, "SET", "tk", "val")
+	want = appendCommandRESP(want, "PEXPIREAT", "tk", fmt.Sprint(tkAt))
+	want = appendCommandRESP(want, "PEXPIREAT", "k", fmt.Sprint(kAt))
+	want = appendCommandRESP(want, "RPUSH", "l", "a")
+	want = appendCommandRESP(want, "RPUSH", "l", "b")
+	want = appendCommandRESP(want, "SELECT", "3")
+	want = appendCommandRESP(want, "SADD", "s", "m")
+	want = appendCommandRESP(want, "SET", "n", "5")
+	want = appendCommandRESP(want, "INCR", "n")
+	aof, err := os.ReadFile(appendOnlyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(aof, want) {
+		t.Fatalf("append only file did not end with the write commands.\nActual:   %q\nExpected: %q", aof, want)
+	}
+
+	checkDataset := func(step string) {
+		t.Helper()
+		db0, db3 := s.store[0], s.store[3]
+		if db0.kv["k"] != "v" || db0.expires["k"] != kAt || db0.kv["tk"] != "val" || db0.expires["tk"] != tkAt {
+			t.Errorf("%s: strings were not restored: %q %d %q %d", step, db0.kv["k"], db0.expires["k"], db0.kv["tk"], db0.expires["tk"])
+		}
+		if got := s.lrange(db0, "l", 0, -1); strings.Join(got, " ") != "a b" {
+			t.Errorf("%s: list was not restored: %q", step, got)
+		}
+		if _, ok := db3.s["s"]["m"]; !ok || db3.kv["n"] != "6" {
+			t.Errorf("%s: db 3 was not restored: %q", step, db3.kv["n"])
+		}
+	}
+	restart()
+	checkDataset("replay")
+
+	// a crash part way through a write leaves half a command at the end
+	f, err := os.OpenFile(appendOnlyFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\n"))
+	f.Close()
+	restart()
+	checkDataset("truncated")
+	if fi, err := os.Stat(appendOnlyFile); err != nil || fi.Size() != int64(len(aof)) {
+		t.Errorf("truncated append only file was not cut back to %d bytes", len(aof))
+	}
+
+	// hold the lock so the write lands while the rewrite is running
+	s.lock.Lock()
+	if err := s.bgrewriteAppendOnlyFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.bgrewriteAppendOnlyFile(); err != errAOFRewriteInProgress {
+		t.Errorf("second rewrite returned %v", err)
+	}
+	s.set(s.store[0], "during", "rewrite")
+	s.feedAppendOnlyFile(0, "SET", []string{"during", "rewrite"})
+	s.lock.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&s.aofRewriteInProgress) == 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("BGREWRITEAOF did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	aof, err = os.ReadFile(appendOnlyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(aof, []byte("INCR")) || bytes.Contains(aof, []byte("FLUSHALL")) {
+		t.Errorf("append only file was not rewritten: %q", aof)
+	}
+	restart()
+	checkDataset("rewrite")
+	if s.store[0].kv["during"] != "rewrite" {
+		t.Error("write made during the rewrite was lost")
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	removeWriteThroughFiles := func() {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			os.Remove(writeThroughFile + suffix)
+		}
+	}
+	removeWriteThroughFiles()
+	defer removeWriteThroughFiles()
+	cfg := defaultConfig()
+	cfg.writeThrough = true
+
+	s := newRedisServer(":15624", cfg)
+	defer s.l.Close()
+	defer close(s.done)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+	commands := [][]string{
+		{"FLUSHALL"},
+		{"SET", "k", "v"},
+		{"SET", "gone", "v"},
+		{"DEL", "gone"},
+		{"RPUSH", "l", "a"},
+		{"RPUSH", "l", "b"},
+		{"RPUSH", "l", "a"},
+		{"LREM", "l", "1", "a"},
+		{"SADD", "s", "x"},
+		{"SADD", "s", "y"},
+		{"SREM", "s", "x"},
+		{"EXPIRE", "s", "1000"},
+		{"RENAME", "k", "k2"},
+		{"HSET", "h", "f", "v"},
+		{"ZADD", "z", "1", "a", "2.5", "b"},
+		{"ZREM", "z", "a"},
+		{"XADD", "x", "1-0", "a", "1"},
+		{"XADD", "x", "2-0", "b", "2"},
+		{"XDEL", "x", "1-0"},
+		{"XADD", "x", "3-0", "c", "3", "d", "4"},
+		{"LPUSH", "l", "c"},
+		{"LPUSH", "l", "d"},
+		{"RPOP", "l"},
+		{"RPUSH", "l", "e"},
+		{"LPOP", "l"},
+		{"HSET", "h", "f", "v2"},
+		{"HSET", "h", "g", "w"},
+		{"HDEL", "h", "f"},
+		{"ZADD", "z", "3", "b", "4", "c"},
+		{"SADD", "s", "z"},
+		{"PERSIST", "s"},
+		{"EXPIRE", "s", "2000"},
+		{"SELECT", "2"},
+		{"SET", "flushed", "v"},
+		{"FLUSHDB"},
+		{"SET", "m", "v"},
+		{"MOVE", "m", "3"},
+		{"INFO"},
+	}
+	for _, c := range commands {
+		s.ExecuteCommand(cl, c[0], c[1:])
+	}
+	if !strings.Contains(conn.String(), "writethrough_enabled:1\n") || !strings.Contains(conn.String(), "writethrough_last_write_status:ok\n") {
+		t.Errorf("INFO does not report write through:\n%s", conn.String())
+	}
+
+	// load a second server from the db while the first is still running, as
+	// if it had crashed
+	s2 := newRedisServer(":15625", cfg)
+	defer s2.l.Close()
+	defer close(s2.done)
+	if diff := diffSnapshots(s.store, s2.store, -1); len(diff) != 0 {
+		t.Errorf("write through db does not match the dataset:\n%s", strings.Join(diff, "\n"))
+	}
+	if at := s2.store[0].expires["s"]; at != s.store[0].expires["s"] {
+		t.Errorf("ttl was not written through: %d", at)
+	}
+
+	// a write to a big key only writes the elements it changed
+	s.ExecuteCommand(cl, "SELECT", []string{"0"})
+	for i := 0; i < 100; i++ {
+		s.ExecuteCommand(cl, "HSET", []string{"bigh", strconv.Itoa(i), "v"})
+		s.ExecuteCommand(cl, "RPUSH", []string{"bigl", strconv.Itoa(i)})
+	}
+	for _, c := range [][]string{{"HSET", "bigh", "1", "w"}, {"LPUSH", "bigl", "x"}, {"RPOP", "bigl"}} {
+		var before, after int
+		s.wt.db.QueryRow(`SELECT total_changes();`).Scan(&before)
+		s.ExecuteCommand(cl, c[0], c[1:])
+		s.wt.db.QueryRow(`SELECT total_changes();`).Scan(&after)
+		if after-before > 2 {
+			t.Errorf("%v wrote %d rows", c, after-before)
+		}
+	}
+	s3 := newRedisServer(":15649", cfg)
+	defer s3.l.Close()
+	defer close(s3.done)
+	if diff := diffSnapshots(s.store, s3.store, -1); len(diff) != 0 {
+		t.Errorf("write through db does not match the dataset:\n%s", strings.Join(diff, "\n"))
+	}
+
+	// a write that can not be written through is not acknowledged, and
+	// later writes are refused until the db can be written again
+	if _, err := s.wt.db.Exec(`CREATE TRIGGER failWrites BEFORE INSERT ON keyspace BEGIN SELECT RAISE(ABORT, 'disk full'); END;`); err != nil {
+		t.Fatal(err)
+	}
+	conn.Reset()
+	s.ExecuteCommand(cl, "SET", []string{"lost", "v"})
+	if !strings.HasPrefix(conn.String(), "-ERR Write through failed") {
+		t.Errorf("failed write through was acknowledged: %q", conn.String())
+	}
+	misconf := "-" + errWriteThroughMisconf.Error() + "\r\n"
+	steps := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"SET", "refused", "v"}, misconf},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "refused", "v"}, "+QUEUED\r\n"},
+		{[]string{"EXEC"}, misconf},
+		{[]string{"GET", "k2"}, "$1\r\nv\r\n"},
+		{[]string{"INFO"}, ""},
+	}
+	for i, step := range steps {
+		conn.Reset()
+		s.ExecuteCommand(cl, step.cmd[0], step.cmd[1:])
+		if step.want != "" && conn.String() != step.want {
+			t.Errorf("step %d %v: actual did not match expected.\nActual:   %q\nExpected: %q", i, step.cmd, conn.String(), step.want)
+		}
+	}
+	if !strings.Contains(conn.String(), "writethrough_last_write_status:err\n") {
+		t.Errorf("INFO does not report the failed write through")
+	}
+	if _, err := s.wt.db.Exec(`DROP TRIGGER failWrites;`); err != nil {
+		t.Fatal(err)
+	}
+	conn.Reset()
+	s.ExecuteCommand(cl, "SET", []string{"accepted", "v"})
+	if conn.String() != "+OK\r\n" {
+		t.Errorf("write was refused once the db could be written: %q", conn.String())
+	}
+	s4 := newRedisServer(":15651", cfg)
+	defer s4.l.Close()
+	defer close(s4.done)
+	if diff := diffSnapshots(s.store, s4.store, -1); len(diff) != 0 {
+		t.Errorf("write through db does not match the dataset:\n%s", strings.Join(diff, "\n"))
+	}
+
+	conn.Reset()
+	s.ExecuteCommand(cl, "CONFIG", []string{"SET", "writethrough", "no"})
+	s.ExecuteCommand(cl, "SET", []string{"after", "off"})
+	s.ExecuteCommand(cl, "CONFIG", []string{"GET", "writethrough"})
+	if want := "+OK\r\n+OK\r\n" + string(mbrr("writethrough no")); conn.String() != want {
+		t.Errorf("actual did not match expected.\nActual:   %q\nExpected: %q", conn.String(), want)
+	}
+	var n int
+	if err := s2.wt.db.QueryRow(`SELECT COUNT(*) FROM keyspace WHERE key = 'after';`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("write was written through after writethrough was turned off: %d %v", n, err)
+	}
+}
+
+func TestTieredStorage(t *testing.T) {
+	cfg := defaultConfig()
+	// every key is over the limit so they all go cold
+	cfg.maxmemory = 1
+	s := newRedisServer(":15626", cfg)
+	defer s.l.Close()
+	defer close(s.done)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+	commands := [][]string{
+		{"FLUSHALL"},
+		{"SET", "k", "v"},
+		{"RPUSH", "l", "a"},
+		{"RPUSH", "l", "b"},
+		{"SADD", "s", "x"},
+		{"EXPIRE", "s", "1000"},
+		{"SET", "gone", "v"},
+		{"PEXPIRE", "gone", "50"},
+	}
+	for _, c := range commands {
+		s.ExecuteCommand(cl, c[0], c[1:])
+	}
+	s.lock.Lock()
+	if err := s.enforceMaxmemory(); err != nil {
+		t.Fatal(err)
+	}
+	db := s.store[0]
+	if len(db.cold) != 4 || len(db.kv) != 0 || len(db.ll) != 0 || len(db.s) != 0 {
+		t.Errorf("keys were not moved to the tier: cold %v", db.cold)
+	}
+	s.lock.Unlock()
+
+	// cold keys are saved with their values
+	conn.Reset()
+	s.ExecuteCommand(cl, "SAVE", nil)
+	saveDb, err := sql.Open("sqlite", saveDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+	saveID, _, err := latestSaveID(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := readSnapshot(saveDb, saveID, nowMs(), NumDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store[0].kv["k"] != "v" || len(listValues(store[0].ll["l"])) != 2 || len(store[0].s["s"]) != 1 {
+		t.Errorf("snapshot is missing the values of cold keys")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	commands = [][]string{
+		{"GET", "k"},
+		{"LRANGE", "l", "0", "-1"},
+		{"SMEMBERS", "s"},
+		{"TYPE", "l"},
+		{"GET", "gone"},
+		{"KEYS", "*"},
+	}
+	for _, c := range commands {
+		s.ExecuteCommand(cl, c[0], c[1:])
+	}
+	want := "+OK\r\n" +
+		"$1\r\nv\r\n" +
+		string(mbrr("a b")) +
+		string(mbrr("x")) +
+		"+list\r\n" +
+		"$-1\r\n" +
+		string(mbrr("k l s"))
+	if conn.String() != want {
+		t.Errorf("actual did not match expected.\nActual:   %q\nExpected: %q", conn.String(), want)
+	}
+	info := strings.Join(s.info(), "")
+	if !strings.Contains(info, "maxmemory:1\n") || !strings.Contains(info, "tier_loaded_keys:3\n") {
+		t.Errorf("INFO does not report the tier:\n%s", info)
+	}
+
+	// turning maxmemory off brings every key back
+	conn.Reset()
+	s.ExecuteCommand(cl, "CONFIG", []string{"SET", "maxmemory", "0"})
+	s.ExecuteCommand(cl, "CONFIG", []string{"SET", "maxmemory", "ten"})
+	want = "+OK\r\n-ERR Invalid argument 'ten' for CONFIG SET 'maxmemory' - argument must be a memory value\r\n"
+	if conn.String() != want {
+		t.Errorf("actual did not match expected.\nActual:   %q\nExpected: %q", conn.String(), want)
+	}
+	s.lock.Lock()
+	if s.tier != nil || len(db.cold) != 0 || db.kv["k"] != "v" || db.ll["l"].Len() != 2 || len(db.s["s"]) != 1 {
+		t.Errorf("keys were not brought back when maxmemory was turned off: cold %v", db.cold)
+	}
+	s.lock.Unlock()
+	if _, err := os.Stat(tierFile); !os.IsNotExist(err) {
+		t.Errorf("tier db was not removed: %v", err)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	conf := `# a comment
+port 7000
+bind 127.0.0.1
+databases 16
+dbfilename "my save.db"
+save 900 1
+save 60 100
+loglevel warning
+maxclients 2
+timeout 30
+`
+	cfg := defaultConfig()
+	if err := parseConfig(strings.NewReader(conf), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.port != 7000 || cfg.bind != "127.0.0.1" || cfg.databases != 16 || cfg.dbFilename != "my save.db" ||
+		formatSaveRules(cfg.saveRules) != "900 1 60 100" || cfg.logLevel != logWarning || cfg.maxClients != 2 || cfg.timeout != 30 {
+		t.Errorf("config file was not parsed: %+v", cfg)
+	}
+	// the example config file sets every option to its default
+	example := defaultConfig()
+	example.port = 0
+	if err := loadConfigFile(filepath.Join(packageDir, "sc.conf"), &example); err != nil {
+		t.Fatal(err)
+	}
+	defaults := defaultConfig()
+	for _, p := range configParams {
+		if p.get(&example) != p.get(&defaults) {
+			t.Errorf("sc.conf sets %s to %q rather than %q", p.name, p.get(&example), p.get(&defaults))
+		}
+	}
+	for _, bad := range []string{"nosuchoption yes", "port", "port 1 2", "databases 0", `dbfilename "open`} {
+		if err := parseConfig(strings.NewReader(bad), &cfg); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+
+	cfg = defaultConfig()
+	cfg.databases = 16
+	s := newRedisServer(":15627", cfg)
+	defer s.l.Close()
+	defer close(s.done)
+	go s.Listen()
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+	commands := [][]string{
+		{"SELECT", "15"},
+		{"SELECT", "16"},
+		{"CONFIG", "SET", "port", "7000"},
+		{"CONFIG", "REWRITE"},
+		{"CONFIG", "GET", "databases"},
+	}
+	for _, c := range commands {
+		s.ExecuteCommand(cl, c[0], c[1:])
+	}
+	want := "+OK\r\n" +
+		"-ERR value is not an integer or out of range\r\n" +
+		"-ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config\r\n" +
+		"-ERR The server is running without a config file\r\n" +
+		string(mbrr("databases 16"))
+	if conn.String() != want {
+		t.Errorf("actual did not match expected.\nActual:   %q\nExpected: %q", conn.String(), want)
+	}
+
+	// CONFIG REWRITE keeps comments and rewrites options in place
+	path := filepath.Join(t.TempDir(), "test.conf")
+	if err := os.WriteFile(path, []byte("# keep me\nsave 900 1\nport 7000\nsave 60 100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.configFile = path
+	conn.Reset()
+	commands = [][]string{
+		{"CONFIG", "SET", "save", "10 1"},
+		{"CONFIG", "SET", "maxclients", "1"},
+		{"CONFIG", "REWRITE"},
+	}
+	for _, c := range commands {
+		s.ExecuteCommand(cl, c[0], c[1:])
+	}
+	if want := "+OK\r\n+OK\r\n+OK\r\n"; conn.String() != want {
+		t.Errorf("actual did not match expected.\nActual:   %q\nExpected: %q", conn.String(), want)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantConf := "# keep me\nsave 10 1\nport 8081\n# Generated by CONFIG REWRITE\ndatabases 16\nmaxclients 1\n"
+	if string(data) != wantConf {
+		t.Errorf("rewritten config did not match expected.\nActual:   %q\nExpected: %q", data, wantConf)
+	}
+
+	// maxclients turns away the client over the limit
+	c1, err := net.Dial("tcp", ":15627")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	r1 := bufio.NewReader(c1)
+	expectReply(t, 0, c1, r1, mbrr("ping"), []byte("+PONG\r\n"))
+	c2, err := net.Dial("tcp", ":15627")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	line, err := bufio.NewReader(c2).ReadString('\n')
+	if err != nil || line != "-ERR max number of clients reached\r\n" {
+		t.Errorf("client over maxclients got %q %v", line, err)
+	}
+
+	// timeout closes the idle client
+	s.ExecuteCommand(cl, "CONFIG", []string{"SET", "timeout", "1"})
+	c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r1.ReadByte(); err != io.EOF {
+		t.Errorf("idle client was not closed: %v", err)
+	}
+}
+
+func TestServerFlags(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.conf")
+	if err := os.WriteFile(path, []byte("port 7000\ndatabases 4\nloglevel warning\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	cfg, configFile, err := parseServerFlags([]string{"--config", path, "--port", "7001", "--dbfilename=x.db"}, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configFile != path || cfg.port != 7001 || cfg.databases != 4 || cfg.logLevel != logWarning || cfg.dbFilename != "x.db" {
+		t.Errorf("flags did not override the config file: %s %+v", configFile, cfg)
+	}
+	cfg, _, err = parseServerFlags([]string{"--databases", "2", path}, &stderr)
+	if err != nil || cfg.port != 7000 || cfg.databases != 2 {
+		t.Errorf("flags did not override the config file: %+v %v", cfg, err)
+	}
+	for _, bad := range [][]string{{"--port", "abc"}, {"--config", path, path}, {"--nosuchflag"}, {"--loglevel", "loud"}} {
+		if _, _, err := parseServerFlags(bad, &stderr); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+
+	cfg = defaultConfig()
+	cfg.bind = "127.0.0.1"
+	cfg.pidFile = filepath.Join(dir, "sc.pid")
+	s := newRedisServer(":15628", cfg)
+	defer s.l.Close()
+	if s.addr != "127.0.0.1" || s.l.Addr().String() != "127.0.0.1:15628" {
+		t.Errorf("server is not bound to its address: %q %s", s.addr, s.l.Addr())
+	}
+	pid, err := os.ReadFile(cfg.pidFile)
+	if err != nil || string(pid) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("pid file holds %q %v", pid, err)
+	}
+	s.ExecuteCommand(NewRedisClient(0, &bufConn{}), "SHUTDOWN", nil)
+	if _, err := os.Stat(cfg.pidFile); !os.IsNotExist(err) {
+		t.Errorf("pid file was not removed on SHUTDOWN: %v", err)
+	}
+}
+
+func TestHashes(t *testing.T) {
+	os.Remove(appendOnlyFile)
+	defer os.Remove(appendOnlyFile)
+	cfg := defaultConfig()
+	cfg.appendOnly = true
+	cfg.appendFsync = fsyncAlways
+	s := newRedisServer(":15629", cfg)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+	steps := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"FLUSHALL"}, "+OK\r\n"},
+		{[]string{"HSET", "h", "f1", "v1", "f2", "v2"}, ":2\r\n"},
+		{[]string{"HSET", "h", "f1", "x"}, ":0\r\n"},
+		{[]string{"HSET", "h", "f1", "a", "f2"}, string(mial("hset"))},
+		{[]string{"HGET", "h", "f1"}, "$1\r\nx\r\n"},
+		{[]string{"HGET", "h", "nope"}, "$-1\r\n"},
+		{[]string{"HMGET", "h", "f1", "nope", "f2"}, "*3\r\n$1\r\nx\r\n$-1\r\n$2\r\nv2\r\n"},
+		{[]string{"HGETALL", "h"}, string(mbrr("f1 x f2 v2"))},
+		{[]string{"HKEYS", "h"}, string(mbrr("f1 f2"))},
+		{[]string{"HVALS", "h"}, string(mbrr("x v2"))},
+		{[]string{"HLEN", "h"}, ":2\r\n"},
+		{[]string{"HEXISTS", "h", "f2"}, ":1\r\n"},
+		{[]string{"HEXISTS", "h", "nope"}, ":0\r\n"},
+		{[]string{"HSTRLEN", "h", "f2"}, ":2\r\n"},
+		{[]string{"HSETNX", "h", "f1", "y"}, ":0\r\n"},
+		{[]string{"HSETNX", "h", "n", "3"}, ":1\r\n"},
+		{[]string{"HINCRBY", "h", "n", "5"}, ":8\r\n"},
+		{[]string{"HINCRBY", "h", "f1", "1"}, "-ERR hash value is not an integer\r\n"},
+		{[]string{"HINCRBY", "h", "n", "9223372036854775807"}, "-ERR increment or decrement would overflow\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "fl", "1.5"}, "$3\r\n1.5\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "fl", "0.25"}, "$4\r\n1.75\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "fl", "x"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "f1", "1"}, "-ERR hash value is not a float\r\n"},
+		{[]string{"TYPE", "h"}, "+hash\r\n"},
+		{[]string{"GET", "h"}, wrongTypeError},
+		{[]string{"SET", "str", "v"}, "+OK\r\n"},
+		{[]string{"HGET", "str", "f"}, wrongTypeError},
+		{[]string{"HDEL", "h", "f1", "f2", "nope"}, ":2\r\n"},
+		{[]string{"HDEL", "h", "n", "fl"}, ":2\r\n"},
+		{[]string{"EXISTS", "h"}, ":0\r\n"},
+		{[]string{"HGETALL", "h"}, emptySetOrList},
+		{[]string{"HMSET", "h2", "a", "1", "b", "2"}, "+OK\r\n"},
+		{[]string{"HINCRBYFLOAT", "h2", "b", "0.5"}, "$3\r\n2.5\r\n"},
+		{[]string{"RENAME", "h2", "h3"}, "+OK\r\n"},
+		{[]string{"MOVE", "h3", "4"}, ":1\r\n"},
+		{[]string{"SELECT", "4"}, "+OK\r\n"},
+		{[]string{"HGETALL", "h3"}, string(mbrr("a 1 b 2.5"))},
+	}
+	for i, step := range steps {
+		conn.Reset()
+		s.ExecuteCommand(cl, step.cmd[0], step.cmd[1:])
+		if got := conn.String(); got != step.want {
+			t.Errorf("step %d %v: actual did not match expected.\nActual:   %q\nExpected: %q", i, step.cmd, got, step.want)
+		}
+	}
+
+	// hashes are kept by a snapshot and replayed from the append only file
+	conn.Reset()
+	s.ExecuteCommand(cl, "SAVE", nil)
+	saveDb, err := sql.Open("sqlite", saveDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+	saveID, _, err := latestSaveID(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := readSnapshot(saveDb, saveID, nowMs(), NumDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := store[4].h["h3"]; len(h) != 2 || h["a"] != "1" || h["b"] != "2.5" {
+		t.Errorf("snapshot did not keep the hash: %q", h)
+	}
+	s.lock.Lock()
+	s.stopAppendOnly()
+	s.lock.Unlock()
+	close(s.done)
+	s.l.Close()
+	s = newRedisServer(":15630", cfg)
+	defer s.l.Close()
+	defer close(s.done)
+	if h := s.store[4].h["h3"]; len(h) != 2 || h["a"] != "1" || h["b"] != "2.5" {
+		t.Errorf("append only file did not restore the hash: %q", h)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopAppendOnly()
+}
+
+func TestPubSub(t *testing.T) {
+	sub, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer sub.Close()
+	pub, err := net.Dial("tcp", PORT)
+	if err != nil {
+		t.Fatal("connection error: ", err)
+	}
+	defer pub.Close()
+	rSub := bufio.NewReader(sub)
+	rPub := bufio.NewReader(pub)
+
+	// pushed messages are read with an empty payload
+	steps := []struct {
+		conn    net.Conn
+		r       *bufio.Reader
+		payload []byte
+		want    []byte
+	}{
+		{sub, rSub, mbrr("subscribe news other"), []byte("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$5\r\nother\r\n:2\r\n")},
+		{sub, rSub, mbrr("psubscribe n*"), []byte("*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:3\r\n")},
+		{sub, rSub, mbrr("get k"), []byte("-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n")},
+		{sub, rSub, mbrr("ping"), mbrl("pong", "")},
+		{pub, rPub, mbrr("publish news hi"), []byte(":2\r\n")},
+		{sub, rSub, nil, mbrl("message", "news", "hi")},
+		{sub, rSub, nil, mbrl("pmessage", "n*", "news", "hi")},
+		{pub, rPub, mbrr("publish nope hi"), []byte(":1\r\n")},
+		{sub, rSub, nil, mbrl("pmessage", "n*", "nope", "hi")},
+		{pub, rPub, mbrr("publish zzz hi"), []byte(":0\r\n")},
+		{pub, rPub, mbrr("pubsub channels"), mbrl("news", "other")},
+		{pub, rPub, mbrr("pubsub channels o*"), mbrl("other")},
+		{pub, rPub, mbrr("pubsub numsub news zzz"), []byte("*4\r\n$4\r\nnews\r\n:1\r\n$3\r\nzzz\r\n:0\r\n")},
+		{pub, rPub, mbrr("pubsub numpat"), []byte(":1\r\n")},
+		{sub, rSub, mbrr("unsubscribe"), []byte("*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:2\r\n*3\r\n$11\r\nunsubscribe\r\n$5\r\nother\r\n:1\r\n")},
+		{sub, rSub, mbrr("punsubscribe"), []byte("*3\r\n$12\r\npunsubscribe\r\n$2\r\nn*\r\n:0\r\n")},
+		{sub, rSub, mbrr("unsubscribe"), []byte("*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n")},
+		{sub, rSub, mbrr("ping"), []byte("+PONG\r\n")},
+		{pub, rPub, mbrr("publish news hi"), []byte(":0\r\n")},
+		{pub, rPub, mbrr("pubsub numpat"), []byte(":0\r\n")},
+	}
+	for i, s := range steps {
+		expectReply(t, i, s.conn, s.r, s.payload, s.want)
+	}
+
+	// a subscriber that goes away is unsubscribed
+	expectReply(t, len(steps), sub, rSub, mbrr("subscribe gone"), []byte("*3\r\n$9\r\nsubscribe\r\n$4\r\ngone\r\n:1\r\n"))
+	sub.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		expectReply(t, len(steps)+1, pub, rPub, mbrr("pubsub numsub gone"), []byte("*2\r\n$4\r\ngone\r\n"))
+		buf, err := rPub.ReadString('\n')
+		if err != nil {
+			t.Fatal("read error: ", err)
+		}
+		if buf == ":0\r\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed subscriber was not unsubscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	s := newRedisServer(":15631", defaultConfig())
+	defer s.l.Close()
+	defer close(s.done)
+
+	// nothing reads the other end of the pipe so every write blocks
+	client, other := net.Pipe()
+	defer other.Close()
+	subscriber := NewRedisClient(1, client)
+	s.ExecuteCommand(subscriber, "SUBSCRIBE", []string{"ch"})
+	pc := subscriber.conn.(*pubsubConn)
+
+	publisher := NewRedisClient(2, &bufConn{})
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*pubsubQueueLen; i++ {
+			s.ExecuteCommand(publisher, "PUBLISH", []string{"ch", "msg"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher was blocked by a slow subscriber")
+	}
+	select {
+	case <-pc.done:
+	default:
+		t.Error("slow subscriber was not closed")
+	}
+}
+
+func TestStreams(t *testing.T) {
+	s, start, stop := newAOFTestServer(t)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+
+	// entries takes each entry as its id followed by its fields
+	entries := func(es ...[]string) string {
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("*%d\r\n", len(es)))
+		for _, e := range es {
+			sb.WriteString(fmt.Sprintf("*2\r\n$%d\r\n%s\r\n", len(e[0]), e[0]))
+			sb.Write(mbrl(e[1:]...))
+		}
+		return sb.String()
+	}
+	steps := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"FLUSHALL"}, "+OK\r\n"},
+		{[]string{"XADD", "s", "1-1", "a", "1"}, "$3\r\n1-1\r\n"},
+		{[]string{"XADD", "s", "1-1", "a", "1"}, "-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n"},
+		{[]string{"XADD", "s", "0-0", "a", "1"}, "-ERR The ID specified in XADD must be greater than 0-0\r\n"},
+		{[]string{"XADD", "s", "x-1", "a", "1"}, "-ERR Invalid stream ID specified as stream command argument\r\n"},
+		{[]string{"XADD", "s", "1-*", "b", "2"}, "$3\r\n1-2\r\n"},
+		{[]string{"XADD", "s", "5", "c", "3", "d", "4"}, "$3\r\n5-0\r\n"},
+		{[]string{"XADD", "s", "6-0", "a", "1", "b"}, string(mial("xadd"))},
+		{[]string{"XADD", "s", "NOMKSTREAM", "MAXLEN", "1"}, string(mial("xadd"))},
+		{[]string{"XADD", "s", "MAXLEN", "=", "1"}, string(mial("xadd"))},
+		{[]string{"XADD", "s", "MAXLEN", "1", "6-0"}, string(mial("xadd"))},
+		{[]string{"XLEN", "s"}, ":3\r\n"},
+		{[]string{"XLEN", "nope"}, ":0\r\n"},
+		{[]string{"XRANGE", "s", "-", "+"}, entries([]string{"1-1", "a", "1"}, []string{"1-2", "b", "2"}, []string{"5-0", "c", "3", "d", "4"})},
+		{[]string{"XRANGE", "s", "(1-1", "5", "COUNT", "1"}, entries([]string{"1-2", "b", "2"})},
+		{[]string{"XRANGE", "s", "1", "1"}, entries([]string{"1-1", "a", "1"}, []string{"1-2", "b", "2"})},
+		{[]string{"XREVRANGE", "s", "+", "-", "COUNT", "2"}, entries([]string{"5-0", "c", "3", "d", "4"}, []string{"1-2", "b", "2"})},
+		{[]string{"XRANGE", "s", "6", "+"}, emptySetOrList},
+		{[]string{"XRANGE", "nope", "-", "+"}, emptySetOrList},
+		{[]string{"XDEL", "s", "1-2", "9-9"}, ":1\r\n"},
+		{[]string{"XTRIM", "s", "MAXLEN", "1"}, ":1\r\n"},
+		{[]string{"XRANGE", "s", "-", "+"}, entries([]string{"5-0", "c", "3", "d", "4"})},
+		{[]string{"XTRIM", "s", "MAXLEN", "1", "LIMIT", "1"}, "-ERR syntax error, LIMIT cannot be used without the special ~ option\r\n"},
+		{[]string{"XADD", "s", "MAXLEN", "=", "1", "7-0", "e", "5"}, "$3\r\n7-0\r\n"},
+		{[]string{"XADD", "s", "MINID", "~", "8", "8-0", "f", "6"}, "$3\r\n8-0\r\n"},
+		{[]string{"XRANGE", "s", "-", "+"}, entries([]string{"8-0", "f", "6"})},
+		{[]string{"XADD", "nope", "NOMKSTREAM", "*", "a", "1"}, "$-1\r\n"},
+		{[]string{"EXISTS", "nope"}, ":0\r\n"},
+		{[]string{"TYPE", "s"}, "+stream\r\n"},
+		{[]string{"XSETID", "s", "7-0"}, "-ERR The ID specified in XSETID is smaller than the target stream top item\r\n"},
+		{[]string{"XSETID", "s", "9-0"}, "+OK\r\n"},
+		{[]string{"XADD", "s", "9-0", "g", "7"}, "-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n"},
+		{[]string{"SET", "str", "v"}, "+OK\r\n"},
+		{[]string{"XLEN", "str"}, wrongTypeError},
+		{[]string{"XREAD", "STREAMS", "str", "0"}, wrongTypeError},
+		{[]string{"XREAD", "STREAMS", "s", "t", "0"}, "-ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.\r\n"},
+		{[]string{"XREAD", "COUNT", "1", "STREAMS", "s", "nope", "0", "0"}, "*1\r\n*2\r\n$1\r\ns\r\n" + entries([]string{"8-0", "f", "6"})},
+		{[]string{"XREAD", "STREAMS", "s", "$"}, emptySetOrList},
+		{[]string{"XREAD", "BLOCK", "20", "STREAMS", "s", "$"}, emptySetOrList},
+		{[]string{"XADD", "e", "3-0", "a", "1"}, "$3\r\n3-0\r\n"},
+		{[]string{"XDEL", "e", "3-0"}, ":1\r\n"},
+	}
+	for i, step := range steps {
+		conn.Reset()
+		s.ExecuteCommand(cl, step.cmd[0], step.cmd[1:])
+		if got := conn.String(); got != step.want {
+			t.Errorf("step %d %v: actual did not match expected.\nActual:   %q\nExpected: %q", i, step.cmd, got, step.want)
+		}
+	}
+	conn.Reset()
+	s.ExecuteCommand(cl, "XADD", []string{"auto", "*", "a", "1"})
+	if id, err := parseStreamID(strings.Split(conn.String(), "\r\n")[1], 0); err != nil || id.ms == 0 {
+		t.Errorf("XADD * replied with %q", conn.String())
+	}
+
+	// a blocked XREAD is woken by an XADD from another client
+	readConn := &bufConn{}
+	reader := NewRedisClient(1, readConn)
+	done := make(chan struct{})
+	go func() {
+		s.ExecuteCommand(reader, "XREAD", []string{"BLOCK", "0", "STREAMS", "other", "s", "$", "$"})
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.lock.Lock()
+		blocked := len(s.blockedClients)
+		s.lock.Unlock()
+		if blocked == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("XREAD did not block")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.ExecuteCommand(cl, "XADD", []string{"s", "10-0", "h", "8"})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked XREAD was not woken")
+	}
+	if want := "*1\r\n*2\r\n$1\r\ns\r\n" + entries([]string{"10-0", "h", "8"}); readConn.String() != want {
+		t.Errorf("blocked XREAD replied %q, expected %q", readConn.String(), want)
+	}
+	if len(s.blockedClients) != 0 {
+		t.Error("woken client is still blocked")
+	}
+
+	checkStreams := func(step string, store []*DB) {
+		t.Helper()
+		st := store[0].x["s"]
+		if st == nil || len(st.entries) != 2 || st.entries[0].id != (streamID{8, 0}) || st.entries[1].id != (streamID{10, 0}) ||
+			strings.Join(st.entries[1].fields, " ") != "h 8" || st.lastID != (streamID{10, 0}) {
+			t.Errorf("%s: stream was not kept: %+v", step, st)
+		}
+		if e := store[0].x["e"]; e == nil || len(e.entries) != 0 || e.lastID != (streamID{3, 0}) {
+			t.Errorf("%s: empty stream was not kept: %+v", step, e)
+		}
+		if store[0].tstore["auto"] != tStream {
+			t.Errorf("%s: stream with an automatic id was not kept", step)
+		}
+	}
+
+	conn.Reset()
+	s.ExecuteCommand(cl, "SAVE", nil)
+	saveDb, err := sql.Open("sqlite", saveDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+	saveID, _, err := latestSaveID(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := readSnapshot(saveDb, saveID, nowMs(), NumDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStreams("snapshot", store)
+
+	stop()
+	s = start()
+	checkStreams("append only file", s.store)
+	s.lock.Lock()
+	err = writeAppendOnlyFileFrom(appendOnlyFile, s.store, nil, nil)
+	s.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	s = start()
+	checkStreams("rewritten append only file", s.store)
+}
+
+func TestStreamGroups(t *testing.T) {
+	s, start, stop := newAOFTestServer(t)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+
+	// entries takes each entry as its id followed by its fields
+	entries := func(es ...[]string) string {
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("*%d\r\n", len(es)))
+		for _, e := range es {
+			sb.WriteString(fmt.Sprintf("*2\r\n$%d\r\n%s\r\n", len(e[0]), e[0]))
+			sb.Write(mbrl(e[1:]...))
+		}
+		return sb.String()
+	}
+	read := func(key, entries string) string {
+		return fmt.Sprintf("*1\r\n*2\r\n$%d\r\n%s\r\n%s", len(key), key, entries)
+	}
+	steps := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"FLUSHALL"}, "+OK\r\n"},
+		{[]string{"XGROUP", "CREATE", "g", "grp", "$"}, "-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.\r\n"},
+		{[]string{"XGROUP", "CREATE", "g", "grp", "$", "MKSTREAM"}, "+OK\r\n"},
+		{[]string{"XGROUP", "CREATE", "g", "grp", "0"}, "-BUSYGROUP Consumer Group name already exists\r\n"},
+		{[]string{"XADD", "g", "1-0", "a", "1"}, "$3\r\n1-0\r\n"},
+		{[]string{"XADD", "g", "2-0", "b", "2"}, "$3\r\n2-0\r\n"},
+		{[]string{"XADD", "g", "3-0", "c", "3"}, "$3\r\n3-0\r\n"},
+		{[]string{"XREADGROUP", "GROUP", "grp", "alice", "COUNT", "2", "STREAMS", "g", ">"}, read("g", entries([]string{"1-0", "a", "1"}, []string{"2-0", "b", "2"}))},
+		{[]string{"XREADGROUP", "GROUP", "grp", "bob", "STREAMS", "g", ">"}, read("g", entries([]string{"3-0", "c", "3"}))},
+		{[]string{"XREADGROUP", "GROUP", "grp", "bob", "STREAMS", "g", ">"}, emptySetOrList},
+		{[]string{"XREADGROUP", "GROUP", "grp", "alice", "STREAMS", "g", "0"}, read("g", entries([]string{"1-0", "a", "1"}, []string{"2-0", "b", "2"}))},
+		{[]string{"XREADGROUP", "GROUP", "grp", "alice", "STREAMS", "g", "h", ">"}, "-ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified.\r\n"},
+		{[]string{"XREADGROUP", "GROUP", "nope", "alice", "STREAMS", "g", ">"}, "-NOGROUP No such key 'g' or consumer group 'nope'\r\n"},
+		{[]string{"XPENDING", "g", "grp"}, "*4\r\n:3\r\n$3\r\n1-0\r\n$3\r\n3-0\r\n*2\r\n" + string(mbrl("alice", "2")) + string(mbrl("bob", "1"))},
+		{[]string{"XPENDING", "g", "grp", "IDLE", "100000", "-", "+", "10"}, emptySetOrList},
+		{[]string{"XPENDING", "nope", "grp"}, "-NOGROUP No such key 'nope' or consumer group 'grp'\r\n"},
+		{[]string{"XACK", "g", "grp", "1-0", "9-0"}, ":1\r\n"},
+		{[]string{"XDEL", "g", "2-0"}, ":1\r\n"},
+		{[]string{"XREADGROUP", "GROUP", "grp", "alice", "STREAMS", "g", "0"}, read("g", "*1\r\n*2\r\n$3\r\n2-0\r\n*-1\r\n")},
+		{[]string{"XCLAIM", "g", "grp", "bob", "0", "2-0", "3-0", "JUSTID"}, "*1\r\n$3\r\n3-0\r\n"},
+		{[]string{"XCLAIM", "g", "grp", "carol", "100000", "3-0"}, emptySetOrList},
+		{[]string{"XCLAIM", "g", "grp", "carol", "0", "3-0"}, entries([]string{"3-0", "c", "3"})},
+		{[]string{"XAUTOCLAIM", "g", "grp", "bob", "0", "-", "COUNT", "10"}, "*3\r\n$3\r\n0-0\r\n" + entries([]string{"3-0", "c", "3"}) + "*0\r\n"},
+		{[]string{"XPENDING", "g", "grp"}, "*4\r\n:1\r\n$3\r\n3-0\r\n$3\r\n3-0\r\n*1\r\n" + string(mbrl("bob", "1"))},
+		{[]string{"XGROUP", "CREATECONSUMER", "g", "grp", "dave"}, ":1\r\n"},
+		{[]string{"XGROUP", "CREATECONSUMER", "g", "grp", "dave"}, ":0\r\n"},
+		{[]string{"XGROUP", "DELCONSUMER", "g", "grp", "dave"}, ":0\r\n"},
+		{[]string{"XINFO", "GROUPS", "g"}, "*1\r\n*8\r\n$4\r\nname\r\n$3\r\ngrp\r\n$9\r\nconsumers\r\n:3\r\n$7\r\npending\r\n:1\r\n$17\r\nlast-delivered-id\r\n$3\r\n3-0\r\n"},
+		{[]string{"XINFO", "STREAM", "g"}, "*10\r\n$6\r\nlength\r\n:2\r\n$17\r\nlast-generated-id\r\n$3\r\n3-0\r\n$6\r\ngroups\r\n:1\r\n" +
+			"$11\r\nfirst-entry\r\n" + entries([]string{"1-0", "a", "1"})[4:] + "$10\r\nlast-entry\r\n" + entries([]string{"3-0", "c", "3"})[4:]},
+		{[]string{"XINFO", "STREAM", "nope"}, noSuchKeyError},
+		{[]string{"XINFO", "CONSUMERS", "g", "nope"}, "-NOGROUP No such key 'g' or consumer group 'nope'\r\n"},
+		{[]string{"XGROUP", "CREATE", "g", "other", "$"}, "+OK\r\n"},
+		{[]string{"XGROUP", "DESTROY", "g", "other"}, ":1\r\n"},
+		{[]string{"XGROUP", "DESTROY", "g", "other"}, ":0\r\n"},
+		{[]string{"XGROUP", "CREATE", "z", "tmp", "$", "MKSTREAM"}, "+OK\r\n"},
+		{[]string{"XGROUP", "DESTROY", "z", "tmp"}, ":1\r\n"},
+		{[]string{"SET", "str", "v"}, "+OK\r\n"},
+		{[]string{"XGROUP", "CREATE", "str", "grp", "$"}, wrongTypeError},
+	}
+	for i, step := range steps {
+		conn.Reset()
+		s.ExecuteCommand(cl, step.cmd[0], step.cmd[1:])
+		if got := conn.String(); got != step.want {
+			t.Errorf("step %d %v: actual did not match expected.\nActual:   %q\nExpected: %q", i, step.cmd, got, step.want)
+		}
+	}
+
+	// entries that were deleted or trimmed stay pending
+	for _, c := range [][]string{
+		{"XADD", "d", "1-0", "a", "1"},
+		{"XADD", "d", "2-0", "b", "2"},
+		{"XADD", "d", "3-0", "c", "3"},
+		{"XADD", "d", "4-0", "d", "4"},
+		{"XADD", "d", "5-0", "e", "5"},
+		{"XGROUP", "CREATE", "d", "dg", "0"},
+		{"XREADGROUP", "GROUP", "dg", "c", "STREAMS", "d", ">"},
+		{"XDEL", "d", "2-0"},
+		{"XTRIM", "d", "MAXLEN", "2"},
+		{"XSETID", "d", "9-0"},
+	} {
+		s.ExecuteCommand(cl, c[0], c[1:])
+	}
+
+	// a blocked XREADGROUP is woken by an XADD from another client
+	readConn := &bufConn{}
+	reader := NewRedisClient(1, readConn)
+	done := make(chan struct{})
+	go func() {
+		s.ExecuteCommand(reader, "XREADGROUP", []string{"GROUP", "grp", "erin", "BLOCK", "0", "STREAMS", "g", ">"})
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.lock.Lock()
+		blocked := len(s.blockedClients)
+		s.lock.Unlock()
+		if blocked == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("XREADGROUP did not block")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.ExecuteCommand(cl, "XADD", []string{"g", "4-0", "d", "4"})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked XREADGROUP was not woken")
+	}
+	if want := read("g", entries([]string{"4-0", "d", "4"})); readConn.String() != want {
+		t.Errorf("blocked XREADGROUP replied %q, expected %q", readConn.String(), want)
+	}
+
+	// 3-0 went to bob, carol and bob again after its first delivery
+	checkGroups := func(step string, store []*DB) {
+		t.Helper()
+		st := store[0].x["g"]
+		if st == nil || len(st.groups) != 1 || st.groups["grp"] == nil {
+			t.Fatalf("%s: groups were not kept: %+v", step, st)
+		}
+		g := st.groups["grp"]
+		if g.lastID != (streamID{4, 0}) || len(g.consumers) != 4 || g.consumers["erin"] == nil || len(g.pending) != 2 {
+			t.Errorf("%s: group was not kept: %+v", step, g)
+		}
+		if p := g.pending[streamID{3, 0}]; p == nil || p.consumer != "bob" || p.deliveryCount != 3 {
+			t.Errorf("%s: pending entry 3-0 was not kept: %+v", step, p)
+		}
+		if p := g.pending[streamID{4, 0}]; p == nil || p.consumer != "erin" || p.deliveryCount != 1 {
+			t.Errorf("%s: pending entry 4-0 was not kept: %+v", step, p)
+		}
+		if z := store[0].x["z"]; z == nil || len(z.entries) != 0 || z.lastID != (streamID{}) || len(z.groups) != 0 {
+			t.Errorf("%s: empty stream was not kept: %+v", step, z)
+		}
+		d := store[0].x["d"]
+		if d == nil || len(d.entries) != 2 || d.entries[0].id != (streamID{4, 0}) || d.lastID != (streamID{9, 0}) || d.groups["dg"] == nil {
+			t.Fatalf("%s: trimmed stream was not kept: %+v", step, d)
+		}
+		if n := len(d.groups["dg"].pending); n != 5 {
+			t.Errorf("%s: %d entries pending rather than 5", step, n)
+		}
+	}
+	checkGroups("dataset", s.store)
+
+	conn.Reset()
+	s.ExecuteCommand(cl, "SAVE", nil)
+	saveDb, err := sql.Open("sqlite", saveDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+	saveID, _, err := latestSaveID(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := readSnapshot(saveDb, saveID, nowMs(), NumDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGroups("snapshot", store)
+
+	stop()
+	s = start()
+	checkGroups("append only file", s.store)
+	s.lock.Lock()
+	err = writeAppendOnlyFileFrom(appendOnlyFile, s.store, nil, nil)
+	s.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	s = start()
+	checkGroups("rewritten append only file", s.store)
+}
+
+func TestSortedSets(t *testing.T) {
+	s, start, stop := newAOFTestServer(t)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+	steps := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"FLUSHALL"}, "+OK\r\n"},
+		{[]string{"ZADD", "z", "1", "a", "2", "b", "3", "c"}, ":3\r\n"},
+		{[]string{"ZADD", "z", "CH", "4", "c", "5", "d"}, ":2\r\n"},
+		{[]string{"ZADD", "z", "NX", "10", "a"}, ":0\r\n"},
+		{[]string{"ZADD", "z", "GT", "0", "a"}, ":0\r\n"},
+		{[]string{"ZADD", "z", "XX", "INCR", "1", "a"}, "$1\r\n2\r\n"},
+		{[]string{"ZADD", "z", "NX", "INCR", "1", "a"}, "$-1\r\n"},
+		{[]string{"ZADD", "z", "XX", "NX", "1", "a"}, "-ERR XX and NX options at the same time are not compatible\r\n"},
+		{[]string{"ZADD", "z", "GT", "LT", "1", "a"}, "-ERR GT, LT, and/or NX options at the same time are not compatible\r\n"},
+		{[]string{"ZADD", "z", "INCR", "1", "a", "2", "b"}, "-ERR INCR option supports a single increment-element pair\r\n"},
+		{[]string{"ZADD", "z", "x", "a"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"ZADD", "z", "1", "a", "2"}, "-ERR syntax error\r\n"},
+		{[]string{"ZINCRBY", "z", "1.5", "d"}, "$3\r\n6.5\r\n"},
+		{[]string{"ZSCORE", "z", "c"}, "$1\r\n4\r\n"},
+		{[]string{"ZSCORE", "z", "nope"}, "$-1\r\n"},
+		{[]string{"ZCARD", "z"}, ":4\r\n"},
+		{[]string{"ZCARD", "nope"}, ":0\r\n"},
+		{[]string{"ZCOUNT", "z", "2", "4"}, ":3\r\n"},
+		{[]string{"ZCOUNT", "z", "(2", "+inf"}, ":2\r\n"},
+		{[]string{"ZCOUNT", "z", "x", "4"}, "-ERR min or max is not a float\r\n"},
+		{[]string{"ZRANK", "z", "c"}, ":2\r\n"},
+		{[]string{"ZREVRANK", "z", "c"}, ":1\r\n"},
+		{[]string{"ZRANK", "z", "nope"}, "$-1\r\n"},
+		{[]string{"ZRANGE", "z", "0", "-1"}, string(mbrr("a b c d"))},
+		{[]string{"ZRANGE", "z", "0", "1", "WITHSCORES"}, string(mbrr("a 2 b 2"))},
+		{[]string{"ZRANGE", "z", "0", "-1", "REV"}, string(mbrr("d c b a"))},
+		{[]string{"ZRANGE", "z", "5", "10"}, emptySetOrList},
+		{[]string{"ZRANGE", "z", "(2", "6.5", "BYSCORE"}, string(mbrr("c d"))},
+		{[]string{"ZRANGE", "z", "+inf", "-inf", "BYSCORE", "REV", "LIMIT", "1", "2"}, string(mbrr("c b"))},
+		{[]string{"ZRANGE", "z", "0", "-1", "LIMIT", "0", "1"}, "-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX\r\n"},
+		{[]string{"ZRANGEBYSCORE", "z", "-inf", "4", "WITHSCORES", "LIMIT", "1", "5"}, string(mbrr("b 2 c 4"))},
+		{[]string{"ZADD", "l", "0", "a", "0", "b", "0", "c", "0", "d"}, ":4\r\n"},
+		{[]string{"ZRANGE", "l", "[b", "+", "BYLEX"}, string(mbrr("b c d"))},
+		{[]string{"ZRANGE", "l", "(c", "-", "BYLEX", "REV"}, string(mbrr("b a"))},
+		{[]string{"ZRANGE", "l", "-", "+", "BYLEX", "LIMIT", "1", "1"}, string(mbrr("b"))},
+		{[]string{"ZRANGE", "l", "x", "+", "BYLEX"}, "-ERR min or max not valid string range item\r\n"},
+		{[]string{"ZREMRANGEBYLEX", "l", "-", "(c"}, ":2\r\n"},
+		{[]string{"ZRANGE", "l", "0", "-1"}, string(mbrr("c d"))},
+		{[]string{"ZREMRANGEBYRANK", "l", "0", "-1"}, ":2\r\n"},
+		{[]string{"EXISTS", "l"}, ":0\r\n"},
+		{[]string{"ZPOPMIN", "z"}, string(mbrr("a 2"))},
+		{[]string{"ZPOPMAX", "z", "2"}, string(mbrr("d 6.5 c 4"))},
+		{[]string{"ZPOPMAX", "z", "-1"}, "-ERR value is out of range, must be positive\r\n"},
+		{[]string{"ZPOPMIN", "z", "5"}, string(mbrr("b 2"))},
+		{[]string{"EXISTS", "z"}, ":0\r\n"},
+		{[]string{"ZADD", "z1", "1", "a", "2", "b", "3", "c"}, ":3\r\n"},
+		{[]string{"ZADD", "z2", "10", "b", "20", "c", "30", "d"}, ":3\r\n"},
+		{[]string{"SADD", "s", "c"}, ":1\r\n"},
+		{[]string{"ZUNIONSTORE", "out", "2", "z1", "z2"}, ":4\r\n"},
+		{[]string{"ZRANGE", "out", "0", "-1", "WITHSCORES"}, string(mbrr("a 1 b 12 c 23 d 30"))},
+		{[]string{"ZINTERSTORE", "out", "2", "z1", "z2", "WEIGHTS", "2", "1", "AGGREGATE", "MAX"}, ":2\r\n"},
+		{[]string{"ZRANGE", "out", "0", "-1", "WITHSCORES"}, string(mbrr("b 10 c 20"))},
+		{[]string{"ZINTERSTORE", "out", "2", "z1", "s", "AGGREGATE", "MIN"}, ":1\r\n"},
+		{[]string{"ZRANGE", "out", "0", "-1", "WITHSCORES"}, string(mbrr("c 1"))},
+		{[]string{"ZUNIONSTORE", "out", "1", "nope"}, ":0\r\n"},
+		{[]string{"EXISTS", "out"}, ":0\r\n"},
+		{[]string{"ZINTERSTORE", "out", "0", "z1"}, "-ERR at least 1 input key is needed for ZUNIONSTORE/ZINTERSTORE\r\n"},
+		{[]string{"ZUNIONSTORE", "out", "2", "z1"}, "-ERR syntax error\r\n"},
+		{[]string{"ZREMRANGEBYSCORE", "z1", "(1", "2"}, ":1\r\n"},
+		{[]string{"ZRANGE", "z1", "0", "-1"}, string(mbrr("a c"))},
+		{[]string{"TYPE", "z1"}, "+zset\r\n"},
+		{[]string{"GET", "z1"}, wrongTypeError},
+		{[]string{"SET", "str", "v"}, "+OK\r\n"},
+		{[]string{"ZADD", "str", "1", "a"}, wrongTypeError},
+		{[]string{"ZUNIONSTORE", "out", "1", "str"}, wrongTypeError},
+		{[]string{"ZREM", "z1", "a", "c", "nope"}, ":2\r\n"},
+		{[]string{"EXISTS", "z1"}, ":0\r\n"},
+		{[]string{"ZADD", "z2", "-inf", "e"}, ":1\r\n"},
+		{[]string{"RENAME", "z2", "z3"}, "+OK\r\n"},
+		{[]string{"MOVE", "z3", "4"}, ":1\r\n"},
+		{[]string{"SELECT", "4"}, "+OK\r\n"},
+		{[]string{"ZRANGE", "z3", "0", "-1", "WITHSCORES"}, string(mbrr("e -inf b 10 c 20 d 30"))},
+	}
+	for i, step := range steps {
+		conn.Reset()
+		s.ExecuteCommand(cl, step.cmd[0], step.cmd[1:])
+		if got := conn.String(); got != step.want {
+			t.Errorf("step %d %v: actual did not match expected.\nActual:   %q\nExpected: %q", i, step.cmd, got, step.want)
+		}
+	}
+
+	// sorted sets are kept by a snapshot and replayed from the append only
+	// file, both as written and once it is rewritten
+	checkZset := func(step string, store []*DB) {
+		t.Helper()
+		z := store[4].z["z3"]
+		if z == nil || z.zsl.Len() != 4 || len(z.dict) != 4 {
+			t.Fatalf("%s: sorted set was not kept: %+v", step, z)
+		}
+		var got []string
+		for e := z.zsl.Front(); e != nil; e = e.Next() {
+			got = append(got, e.Member+" "+formatScore(e.Score))
+		}
+		if strings.Join(got, ",") != "e -inf,b 10,c 20,d 30" {
+			t.Errorf("%s: sorted set was not kept: %q", step, got)
+		}
+	}
+
+	conn.Reset()
+	s.ExecuteCommand(cl, "SAVE", nil)
+	saveDb, err := sql.Open("sqlite", saveDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+	saveID, _, err := latestSaveID(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := readSnapshot(saveDb, saveID, nowMs(), NumDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkZset("snapshot", store)
+
+	stop()
+	s = start()
+	checkZset("append only file", s.store)
+	s.lock.Lock()
+	err = writeAppendOnlyFileFrom(appendOnlyFile, s.store, nil, nil)
+	s.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	s = start()
+	checkZset("rewritten append only file", s.store)
+}
+
+func TestSets(t *testing.T) {
+	s, start, stop := newAOFTestServer(t)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+	steps := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"FLUSHALL"}, "+OK\r\n"},
+		{[]string{"SADD", "a", "1", "2", "3", "4", "1"}, ":4\r\n"},
+		{[]string{"SADD", "b", "3", "4", "5"}, ":3\r\n"},
+		{[]string{"SADD", "c", "4", "9"}, ":2\r\n"},
+		{[]string{"SMISMEMBER", "a", "1", "9", "4"}, "*3\r\n:1\r\n:0\r\n:1\r\n"},
+		{[]string{"SMISMEMBER", "nope", "1"}, "*1\r\n:0\r\n"},
+		{[]string{"SUNION", "a", "b"}, string(mbrr("1 2 3 4 5"))},
+		{[]string{"SUNION", "nope"}, emptySetOrList},
+		{[]string{"SDIFF", "a", "b", "c"}, string(mbrr("1 2"))},
+		{[]string{"SDIFF", "a", "nope"}, string(mbrr("1 2 3 4"))},
+		{[]string{"SINTER", "a", "b", "c"}, string(mbrr("4"))},
+		{[]string{"SINTER", "a", "nope"}, emptySetOrList},
+		{[]string{"SUNIONSTORE", "u", "a", "c"}, ":5\r\n"},
+		{[]string{"SMEMBERS", "u"}, string(mbrr("1 2 3 4 9"))},
+		{[]string{"SDIFFSTORE", "d", "a", "b"}, ":2\r\n"},
+		{[]string{"SMEMBERS", "d"}, string(mbrr("1 2"))},
+		{[]string{"SDIFFSTORE", "d", "b", "b"}, ":0\r\n"},
+		{[]string{"EXISTS", "d"}, ":0\r\n"},
+		{[]string{"SINTERSTORE", "d", "a", "b"}, "+OK\r\n"},
+		{[]string{"SMEMBERS", "d"}, string(mbrr("3 4"))},
+		{[]string{"SINTERSTORE", "d", "b", "d", "c"}, "+OK\r\n"},
+		{[]string{"SMEMBERS", "d"}, string(mbrr("4"))},
+		{[]string{"SINTERCARD", "2", "a", "b"}, ":2\r\n"},
+		{[]string{"SINTERCARD", "2", "a", "b", "LIMIT", "1"}, ":1\r\n"},
+		{[]string{"SINTERCARD", "2", "a", "b", "LIMIT", "0"}, ":2\r\n"},
+		{[]string{"SINTERCARD", "2", "a", "nope"}, ":0\r\n"},
+		{[]string{"SINTERCARD", "0", "a"}, "-ERR numkeys should be greater than 0\r\n"},
+		{[]string{"SINTERCARD", "3", "a", "b"}, "-ERR Number of keys can't be greater than number of args\r\n"},
+		{[]string{"SINTERCARD", "1", "a", "LIMIT", "-1"}, "-ERR LIMIT can't be negative\r\n"},
+		{[]string{"SINTERCARD", "1", "a", "FOO", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"SMOVE", "a", "b", "1"}, ":1\r\n"},
+		{[]string{"SMOVE", "a", "b", "1"}, ":0\r\n"},
+		{[]string{"SMOVE", "c", "c", "9"}, ":1\r\n"},
+		{[]string{"SMEMBERS", "b"}, string(mbrr("1 3 4 5"))},
+		{[]string{"SMOVE", "c", "new", "9"}, ":1\r\n"},
+		{[]string{"SMOVE", "c", "new", "4"}, ":1\r\n"},
+		{[]string{"EXISTS", "c"}, ":0\r\n"},
+		{[]string{"SMEMBERS", "new"}, string(mbrr("4 9"))},
+		{[]string{"SREM", "new", "4", "9", "nope"}, ":2\r\n"},
+		{[]string{"EXISTS", "new"}, ":0\r\n"},
+		{[]string{"SET", "str", "v"}, "+OK\r\n"},
+		{[]string{"SUNION", "a", "str"}, wrongTypeError},
+		{[]string{"SDIFFSTORE", "d", "str"}, wrongTypeError},
+		{[]string{"SMOVE", "a", "str", "2"}, wrongTypeError},
+		{[]string{"SINTERCARD", "1", "str"}, wrongTypeError},
+		{[]string{"SPOP", "str"}, wrongTypeError},
+		{[]string{"SADD", "one", "x"}, ":1\r\n"},
+		{[]string{"SRANDMEMBER", "one"}, "$1\r\nx\r\n"},
+		{[]string{"SRANDMEMBER", "one", "5"}, string(mbrr("x"))},
+		{[]string{"SRANDMEMBER", "one", "-3"}, string(mbrr("x x x"))},
+		{[]string{"SRANDMEMBER", "one", "0"}, emptySetOrList},
+		{[]string{"SRANDMEMBER", "nope"}, "$-1\r\n"},
+		{[]string{"SRANDMEMBER", "nope", "-3"}, emptySetOrList},
+		{[]string{"SRANDMEMBER", "one", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"SRANDMEMBER", "one", "-9223372036854775808"}, "-ERR value is out of range\r\n"},
+		{[]string{"SRANDMEMBER", "one", "-2500"}, "*2500\r\n" + strings.Repeat("$1\r\nx\r\n", 2500)},
+		{[]string{"SPOP", "one", "-1"}, "-ERR value is out of range, must be positive\r\n"},
+		{[]string{"SPOP", "one", "1", "2"}, "-ERR syntax error\r\n"},
+		{[]string{"SPOP", "one"}, "$1\r\nx\r\n"},
+		{[]string{"EXISTS", "one"}, ":0\r\n"},
+		{[]string{"SPOP", "one"}, "$-1\r\n"},
+		{[]string{"SPOP", "one", "2"}, emptySetOrList},
+	}
+	for i, step := range steps {
+		conn.Reset()
+		s.ExecuteCommand(cl, step.cmd[0], step.cmd[1:])
+		if got := conn.String(); got != step.want {
+			t.Errorf("step %d %v: actual did not match expected.\nActual:   %q\nExpected: %q", i, step.cmd, got, step.want)
+		}
+	}
+
+	// the members SPOP picked at random are logged so a replay pops the same
+	conn.Reset()
+	s.ExecuteCommand(cl, "SPOP", []string{"u", "2"})
+	if n := strings.Count(conn.String(), "$1\r\n"); n != 2 || len(s.store[0].s["u"]) != 3 {
+		t.Fatalf("SPOP did not pop 2 members: %q", conn.String())
+	}
+	s.ExecuteCommand(cl, "SPOP", []string{"u"})
+	left := sortedMembers(s.store[0].s["u"])
+	stop()
+	s = start()
+	if got := sortedMembers(s.store[0].s["u"]); strings.Join(got, " ") != strings.Join(left, " ") {
+		t.Errorf("append only file replayed SPOP as %q, expected %q", got, left)
+	}
+}
+
+func TestBlockingLists(t *testing.T) {
+	s, start, stop := newAOFTestServer(t)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+	steps := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"FLUSHALL"}, "+OK\r\n"},
+		{[]string{"RPUSH", "q", "a"}, ":1\r\n"},
+		{[]string{"RPUSH", "q", "b"}, ":2\r\n"},
+		{[]string{"BLPOP", "nope", "q", "0"}, string(mbrr("q a"))},
+		{[]string{"BRPOP", "q", "0"}, string(mbrr("q b"))},
+		{[]string{"EXISTS", "q"}, ":0\r\n"},
+		{[]string{"BLPOP", "q", "0.01"}, emptySetOrList},
+		{[]string{"BLPOP", "q", "x"}, "-ERR timeout is not a float or out of range\r\n"},
+		{[]string{"BLPOP", "q", "-1"}, "-ERR timeout is negative\r\n"},
+		{[]string{"SET", "str", "v"}, "+OK\r\n"},
+		{[]string{"BLPOP", "q", "str", "0"}, wrongTypeError},
+		{[]string{"RPUSH", "src", "1"}, ":1\r\n"},
+		{[]string{"RPUSH", "src", "2"}, ":2\r\n"},
+		{[]string{"BRPOPLPUSH", "src", "dst", "0"}, "$1\r\n2\r\n"},
+		{[]string{"BLMOVE", "src", "dst", "LEFT", "RIGHT", "0"}, "$1\r\n1\r\n"},
+		{[]string{"LRANGE", "dst", "0", "-1"}, string(mbrr("2 1"))},
+		{[]string{"BLMOVE", "dst", "dst", "RIGHT", "LEFT", "0"}, "$1\r\n1\r\n"},
+		{[]string{"LRANGE", "dst", "0", "-1"}, string(mbrr("1 2"))},
+		{[]string{"BLMOVE", "dst", "src", "UP", "LEFT", "0"}, "-ERR syntax error\r\n"},
+		{[]string{"BRPOPLPUSH", "dst", "str", "0"}, wrongTypeError},
+		{[]string{"BRPOPLPUSH", "src", "dst", "0.01"}, emptySetOrList},
+	}
+	for i, step := range steps {
+		conn.Reset()
+		s.ExecuteCommand(cl, step.cmd[0], step.cmd[1:])
+		if got := conn.String(); got != step.want {
+			t.Errorf("step %d %v: actual did not match expected.\nActual:   %q\nExpected: %q", i, step.cmd, got, step.want)
+		}
+	}
+
+	waitBlocked := func(key string, n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s.lock.Lock()
+			blocked := len(s.blockedClients[blockKey{0, key}])
+			s.lock.Unlock()
+			if blocked == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d clients are blocked on %s, expected %d", blocked, key, n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitDone := func(done chan struct{}) {
+		t.Helper()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("blocked client was not served")
+		}
+	}
+
+	// clients waiting on a list are served in the order they blocked
+	var waiters []*bufConn
+	var dones []chan struct{}
+	for i := 0; i < 3; i++ {
+		waitConn := &bufConn{}
+		waiter := NewRedisClient(10+i, waitConn)
+		done := make(chan struct{})
+		go func() {
+			s.ExecuteCommand(waiter, "BRPOP", []string{"other", "jobs", "0"})
+			close(done)
+		}()
+		waitBlocked("jobs", i+1)
+		waiters = append(waiters, waitConn)
+		dones = append(dones, done)
+	}
+	for i, job := range []string{"j1", "j2", "j3"} {
+		conn.Reset()
+		s.ExecuteCommand(cl, "LPUSH", []string{"jobs", job})
+		waitDone(dones[i])
+		if want := string(mbrr("jobs " + job)); waiters[i].String() != want {
+			t.Errorf("waiter %d was served %q, expected %q", i, waiters[i].String(), want)
+		}
+	}
+	s.lock.Lock()
+	if _, ok := s.store[0].tstore["jobs"]; ok || len(s.blockedClients) != 0 {
+		t.Error("served clients are still blocked or the list was not emptied")
+	}
+	s.lock.Unlock()
+
+	// a move onto a list another client waits on serves that client too
+	moveConn, popConn := &bufConn{}, &bufConn{}
+	mover, popper := NewRedisClient(20, moveConn), NewRedisClient(21, popConn)
+	moved, popped := make(chan struct{}), make(chan struct{})
+	go func() {
+		s.ExecuteCommand(mover, "BLMOVE", []string{"in", "out", "LEFT", "LEFT", "0"})
+		close(moved)
+	}()
+	waitBlocked("in", 1)
+	go func() {
+		s.ExecuteCommand(popper, "BLPOP", []string{"out", "0"})
+		close(popped)
+	}()
+	waitBlocked("out", 1)
+	s.ExecuteCommand(cl, "RPUSH", []string{"in", "x"})
+	waitDone(moved)
+	waitDone(popped)
+	if moveConn.String() != "$1\r\nx\r\n" || popConn.String() != string(mbrr("out x")) {
+		t.Errorf("chained move replied %q and %q", moveConn.String(), popConn.String())
+	}
+
+	// a client that disconnects while blocked is not served
+	client, other := net.Pipe()
+	gone := NewRedisClient(30, client)
+	done := make(chan struct{})
+	go func() {
+		s.ExecuteCommand(gone, "BLPOP", []string{"gone", "0"})
+		close(done)
+	}()
+	waitBlocked("gone", 1)
+	other.Close()
+	waitBlocked("gone", 0)
+	waitDone(done)
+	s.ExecuteCommand(cl, "RPUSH", []string{"gone", "kept"})
+	if l := s.store[0].ll["gone"]; l == nil || l.Len() != 1 {
+		t.Error("element was popped for a disconnected client")
+	}
+
+	// a command sent while blocked is read once the client is served
+	client, other = net.Pipe()
+	defer other.Close()
+	piped := NewRedisClient(31, client)
+	done = make(chan struct{})
+	go func() {
+		s.ExecuteCommand(piped, "BLPOP", []string{"piped", "0"})
+		close(done)
+	}()
+	waitBlocked("piped", 1)
+	if _, err := other.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	s.ExecuteCommand(cl, "RPUSH", []string{"piped", "y"})
+	want := string(mbrr("piped y"))
+	reply := make([]byte, len(want))
+	if _, err := io.ReadFull(other, reply); err != nil || string(reply) != want {
+		t.Errorf("piped client was served %q (%v), expected %q", reply, err, want)
+	}
+	waitDone(done)
+	if cmd, err := readCommand(piped.r); err != nil || strings.Join(cmd, " ") != "PING" {
+		t.Errorf("command sent while blocked was read as %q (%v)", cmd, err)
+	}
+
+	// the pops are logged as LPOP and RPOP so a replay never blocks
+	checkLists := func(step string, store []*DB) {
+		t.Helper()
+		for key, want := range map[string]string{"dst": "1 2", "out": "", "in": "", "jobs": "", "gone": "kept", "piped": ""} {
+			var got []string
+			if l := store[0].ll[key]; l != nil {
+				for e := l.Front(); e != nil; e = e.Next() {
+					got = append(got, e.Value)
+				}
+			}
+			if strings.Join(got, " ") != want {
+				t.Errorf("%s: list %s is %q, expected %q", step, key, got, want)
+			}
+		}
+	}
+	checkLists("dataset", s.store)
+
+	// a client still blocked when the server shuts down is given up on
+	done = make(chan struct{})
+	go func() {
+		s.ExecuteCommand(popper, "BLPOP", []string{"never", "0"})
+		close(done)
+	}()
+	waitBlocked("never", 1)
+	popConn.Reset()
+	stop()
+	waitDone(done)
+	if popConn.String() != emptySetOrList {
+		t.Errorf("client blocked at shutdown replied %q", popConn.String())
+	}
+
+	s = start()
+	checkLists("append only file", s.store)
+}
+
+func TestTransactions(t *testing.T) {
+	s, start, stop := newAOFTestServer(t)
+	conn, otherConn := &bufConn{}, &bufConn{}
+	cl, other := NewRedisClient(0, conn), NewRedisClient(1, otherConn)
+	steps := []struct {
+		other bool
+		cmd   []string
+		want  string
+	}{
+		{false, []string{"FLUSHALL"}, "+OK\r\n"},
+		{false, []string{"RPUSH", "items", "x"}, ":1\r\n"},
+		{false, []string{"MULTI"}, "+OK\r\n"},
+		{false, []string{"MULTI"}, "-ERR MULTI calls can not be nested\r\n"},
+		{false, []string{"RPOP", "items"}, "+QUEUED\r\n"},
+		{false, []string{"SADD", "done", "x"}, "+QUEUED\r\n"},
+		{true, []string{"EXISTS", "done"}, ":0\r\n"},
+		{false, []string{"EXEC"}, "*2\r\n$1\r\nx\r\n:1\r\n"},
+		{false, []string{"SMEMBERS", "done"}, string(mbrr("x"))},
+		{false, []string{"EXISTS", "items"}, ":0\r\n"},
+		{false, []string{"EXEC"}, "-ERR EXEC without MULTI\r\n"},
+		{false, []string{"DISCARD"}, "-ERR DISCARD without MULTI\r\n"},
+		{false, []string{"MULTI"}, "+OK\r\n"},
+		{false, []string{"SET", "k", "v"}, "+QUEUED\r\n"},
+		{false, []string{"DISCARD"}, "+OK\r\n"},
+		{false, []string{"EXISTS", "k"}, ":0\r\n"},
+		// a command that can not be queued fails the whole transaction
+		{false, []string{"MULTI"}, "+OK\r\n"},
+		{false, []string{"SET", "k", "v"}, "+QUEUED\r\n"},
+		{false, []string{"SET", "k"}, string(mial("SET"))},
+		{false, []string{"NOSUCH"}, invalidCommandError},
+		{false, []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{false, []string{"EXISTS", "k"}, ":0\r\n"},
+		// an error while running does not stop the rest
+		{false, []string{"SET", "str", "v"}, "+OK\r\n"},
+		{false, []string{"MULTI"}, "+OK\r\n"},
+		{false, []string{"LPUSH", "str", "1"}, "+QUEUED\r\n"},
+		{false, []string{"SET", "k", "v"}, "+QUEUED\r\n"},
+		{false, []string{"EXEC"}, "*2\r\n" + wrongTypeError + "+OK\r\n"},
+		// a watched key modified by another client fails EXEC
+		{false, []string{"WATCH", "k", "missing"}, "+OK\r\n"},
+		{true, []string{"SET", "k", "v2"}, "+OK\r\n"},
+		{false, []string{"MULTI"}, "+OK\r\n"},
+		{false, []string{"SET", "k", "mine"}, "+QUEUED\r\n"},
+		{false, []string{"EXEC"}, emptySetOrList},
+		{false, []string{"GET", "k"}, "$2\r\nv2\r\n"},
+		{false, []string{"WATCH", "k"}, "+OK\r\n"},
+		{false, []string{"MULTI"}, "+OK\r\n"},
+		{false, []string{"SET", "k", "mine"}, "+QUEUED\r\n"},
+		{false, []string{"EXEC"}, "*1\r\n+OK\r\n"},
+		{false, []string{"GET", "k"}, "$4\r\nmine\r\n"},
+		{false, []string{"WATCH", "missing"}, "+OK\r\n"},
+		{true, []string{"SET", "missing", "now"}, "+OK\r\n"},
+		{false, []string{"MULTI"}, "+OK\r\n"},
+		{false, []string{"EXEC"}, emptySetOrList},
+		{false, []string{"WATCH", "k"}, "+OK\r\n"},
+		{true, []string{"SET", "k", "v3"}, "+OK\r\n"},
+		{false, []string{"UNWATCH"}, "+OK\r\n"},
+		{false, []string{"MULTI"}, "+OK\r\n"},
+		{false, []string{"WATCH", "k"}, "-ERR WATCH inside MULTI is not allowed\r\n"},
+		{false, []string{"SET", "k", "x"}, "+QUEUED\r\n"},
+		{false, []string{"EXEC"}, "*1\r\n+OK\r\n"},
+		{false, []string{"WATCH", "k"}, "+OK\r\n"},
+		{true, []string{"FLUSHDB"}, "+OK\r\n"},
+		{false, []string{"MULTI"}, "+OK\r\n"},
+		{false, []string{"EXEC"}, emptySetOrList},
+		// a blocking command inside a transaction does not block
+		{false, []string{"MULTI"}, "+OK\r\n"},
+		{false, []string{"BLPOP", "nothing", "0"}, "+QUEUED\r\n"},
+		{false, []string{"EXEC"}, "*1\r\n" + emptySetOrList},
+		// SHUTDOWN can not be queued, it fails the transaction instead
+		{false, []string{"MULTI"}, "+OK\r\n"},
+		{false, []string{"SHUTDOWN"}, "-ERR Command not allowed inside a transaction\r\n"},
+		{false, []string{"SHUTDOWN"}, "-ERR Command not allowed inside a transaction\r\n"},
+		{false, []string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{true, []string{"PING"}, "+PONG\r\n"},
+	}
+	for i, step := range steps {
+		c, b := cl, conn
+		if step.other {
+			c, b = other, otherConn
+		}
+		b.Reset()
+		s.ExecuteCommand(c, step.cmd[0], step.cmd[1:])
+		if got := b.String(); got != step.want {
+			t.Errorf("step %d %v: actual did not match expected.\nActual:   %q\nExpected: %q", i, step.cmd, got, step.want)
+		}
+	}
+
+	select {
+	case <-s.done:
+		t.Fatal("SHUTDOWN inside MULTI shut the server down")
+	default:
+	}
+
+	// a watched key that expires fails EXEC
+	conn.Reset()
+	s.ExecuteCommand(cl, "SET", []string{"e", "v"})
+	s.ExecuteCommand(cl, "PEXPIRE", []string{"e", "20"})
+	s.ExecuteCommand(cl, "WATCH", []string{"e"})
+	time.Sleep(30 * time.Millisecond)
+	s.ExecuteCommand(cl, "MULTI", nil)
+	conn.Reset()
+	s.ExecuteCommand(cl, "EXEC", nil)
+	if conn.String() != emptySetOrList {
+		t.Errorf("EXEC with an expired watched key replied %q", conn.String())
+	}
+	if len(s.watchedKeys) != 0 || len(cl.watched) != 0 {
+		t.Errorf("keys are still watched after EXEC: %v", s.watchedKeys)
+	}
+
+	// no other client sees a transaction half way through
+	s.ExecuteCommand(cl, "SET", []string{"n", "0"})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		incr := NewRedisClient(2, &bufConn{})
+		for i := 0; i < 100; i++ {
+			s.ExecuteCommand(incr, "MULTI", nil)
+			s.ExecuteCommand(incr, "INCR", []string{"n"})
+			s.ExecuteCommand(incr, "INCR", []string{"n"})
+			s.ExecuteCommand(incr, "EXEC", nil)
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		otherConn.Reset()
+		s.ExecuteCommand(other, "GET", []string{"n"})
+		reply := strings.Split(otherConn.String(), "\r\n")
+		if len(reply) == 3 {
+			if n, _ := strconv.Atoi(reply[1]); n%2 != 0 {
+				t.Fatalf("saw a transaction half way through: n is %d", n)
+			}
+		}
+	}
+
+	// transactions are logged between MULTI and EXEC so a replay only runs
+	// them whole
+	stop()
+	f, err := os.OpenFile(appendOnlyFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(appendCommandRESP(appendCommandRESP(nil, "MULTI"), "SET", "partial", "1"))
+	f.Close()
+	s = start()
+	if n, _ := s.get(s.store[0], "n"); n != "200" {
+		t.Errorf("append only file restored n as %q", n)
+	}
+	if _, ok := s.get(s.store[0], "partial"); ok {
+		t.Error("append only file applied a transaction without its EXEC")
+	}
+	// the dangling MULTI was cut off so writes after the restart are not
+	// queued behind it by the next replay
+	s.ExecuteCommand(cl, "SET", []string{"after", "2"})
+	s = start()
+	if after, _ := s.get(s.store[0], "after"); after != "2" {
+		t.Errorf("write after a transaction without its EXEC was lost: %q", after)
+	}
+}
+
+func TestScripting(t *testing.T) {
+	s, start, stop := newAOFTestServer(t)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+	cas := "if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('SET', KEYS[1], ARGV[2]) end return false"
+	echo := "return ARGV[1]"
+	echoSHA := scriptSHA(echo)
+	steps := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"FLUSHALL"}, "+OK\r\n"},
+		{[]string{"EVAL", "return 1", "0"}, ":1\r\n"},
+		{[]string{"EVAL", "return 3.9", "0"}, ":3\r\n"},
+		{[]string{"EVAL", "return {KEYS[1], ARGV[1], {true, false}, nil, 'after nil'}", "1", "k", "a"}, "*3\r\n$1\r\nk\r\n$1\r\na\r\n*2\r\n:1\r\n$-1\r\n"},
+		{[]string{"EVAL", "return redis.call('SET', KEYS[1], ARGV[1])", "1", "k", "v"}, "+OK\r\n"},
+		{[]string{"EVAL", "return redis.call('GET', KEYS[1])", "1", "k"}, "$1\r\nv\r\n"},
+		{[]string{"EVAL", "return redis.call('TYPE', KEYS[1])", "1", "k"}, "+string\r\n"},
+		{[]string{"EVAL", "return redis.call('TYPE', KEYS[1]).ok", "1", "nothing"}, "$4\r\nnone\r\n"},
+		{[]string{"EVAL", "return redis.call('GET', 'missing') == false", "0"}, ":1\r\n"},
+		{[]string{"EVAL", "redis.call('RPUSH', 'l', 'a') redis.call('RPUSH', 'l', 2) return redis.call('LRANGE', 'l', 0, -1)", "0"}, string(mbrr("a 2"))},
+		{[]string{"EVAL", "return redis.call('LLEN', 'l') + 1", "0"}, ":3\r\n"},
+		// compare and set
+		{[]string{"EVAL", cas, "1", "k", "old", "new"}, "$-1\r\n"},
+		{[]string{"EVAL", cas, "1", "k", "v", "new"}, "+OK\r\n"},
+		{[]string{"GET", "k"}, "$3\r\nnew\r\n"},
+		// errors
+		{[]string{"EVAL", "return redis.call('LPUSH', KEYS[1], 'x')", "1", "k"}, wrongTypeError},
+		{[]string{"EVAL", "local r = redis.pcall('LPUSH', KEYS[1], 'x') return r.err", "1", "k"}, "$" + strconv.Itoa(len(wrongTypeError)-3) + "\r\n" + wrongTypeError[1:]},
+		{[]string{"EVAL", "return redis.error_reply('MY error')", "0"}, "-MY error\r\n"},
+		{[]string{"EVAL", "return redis.status_reply('FINE')", "0"}, "+FINE\r\n"},
+		{[]string{"EVAL", "return redis.pcall('NOSUCH')", "0"}, "-ERR Unknown Redis command called from script\r\n"},
+		{[]string{"EVAL", "return redis.pcall('GET')", "0"}, "-ERR Wrong number of args calling Redis command from script\r\n"},
+		{[]string{"EVAL", "return redis.pcall('MULTI')", "0"}, "-ERR This Redis command is not allowed from scripts\r\n"},
+		{[]string{"EVAL", "return redis.pcall('GET', {})", "0"}, "-ERR Lua redis lib command arguments must be strings or integers\r\n"},
+		{[]string{"EVAL", "return 1", "x"}, integerOutOfRangeError},
+		{[]string{"EVAL", "return 1", "-1"}, "-ERR Number of keys can't be negative\r\n"},
+		{[]string{"EVAL", "return 1", "2", "a"}, "-ERR Number of keys can't be greater than number of args\r\n"},
+		{[]string{"EVAL", "return dofile('/etc/passwd')", "0"}, "-ERR Error running script (call to f_" + scriptSHA("return dofile('/etc/passwd')") + "): user_script:1: attempt to call a non-function object\r\n"},
+		// a blocking command inside a script does not block
+		{[]string{"EVAL", "return redis.call('BLPOP', 'nothing', 0)", "0"}, "$-1\r\n"},
+		// the script cache
+		{[]string{"SCRIPT", "LOAD", echo}, "$40\r\n" + echoSHA + "\r\n"},
+		{[]string{"EVALSHA", echoSHA, "0", "hi"}, "$2\r\nhi\r\n"},
+		{[]string{"EVALSHA", strings.ToUpper(echoSHA), "0", "hi"}, "$2\r\nhi\r\n"},
+		{[]string{"SCRIPT", "EXISTS", echoSHA, scriptSHA("return 1"), scriptSHA("nope")}, "*3\r\n:1\r\n:1\r\n:0\r\n"},
+		{[]string{"SCRIPT", "FLUSH"}, "+OK\r\n"},
+		{[]string{"SCRIPT", "EXISTS", echoSHA}, "*1\r\n:0\r\n"},
+		{[]string{"EVALSHA", echoSHA, "0"}, "-NOSCRIPT No matching script. Please use EVAL.\r\n"},
+		{[]string{"SCRIPT", "KILL"}, "-NOTBUSY No scripts in execution right now.\r\n"},
+		{[]string{"SCRIPT", "NOSUCH"}, invalidCommandError},
+	}
+	for i, step := range steps {
+		conn.Reset()
+		s.ExecuteCommand(cl, step.cmd[0], step.cmd[1:])
+		if got := conn.String(); got != step.want {
+			t.Errorf("step %d %v: actual did not match expected.\nActual:   %q\nExpected: %q", i, step.cmd, got, step.want)
+		}
+	}
+	conn.Reset()
+	s.ExecuteCommand(cl, "EVAL", []string{"return +", "0"})
+	if got := conn.String(); !strings.HasPrefix(got, "-ERR Error compiling script (new function): ") {
+		t.Errorf("a script that does not compile replied %q", got)
+	}
+
+	// a script that runs past lua-time-limit makes other clients busy until
+	// it is killed
+	s.ExecuteCommand(cl, "CONFIG", []string{"SET", "lua-time-limit", "10"})
+	busyConn := &bufConn{}
+	busy := NewRedisClient(1, busyConn)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ExecuteCommand(busy, "EVAL", []string{"while true do end", "0"})
+	}()
+	for !s.scriptBusy() {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Reset()
+	s.ExecuteCommand(cl, "GET", []string{"k"})
+	s.ExecuteCommand(cl, "SCRIPT", []string{"KILL"})
+	<-done
+	if want := "-BUSY Redis is busy running a script. You can only call SCRIPT KILL.\r\n+OK\r\n"; conn.String() != want {
+		t.Errorf("a busy script made other clients reply %q rather than %q", conn.String(), want)
+	}
+	if want := "-ERR Script killed by user with SCRIPT KILL...\r\n"; busyConn.String() != want {
+		t.Errorf("the killed script replied %q rather than %q", busyConn.String(), want)
+	}
+	conn.Reset()
+	s.ExecuteCommand(cl, "GET", []string{"k"})
+	if conn.String() != "$3\r\nnew\r\n" {
+		t.Errorf("the server is still busy after the script was killed: %q", conn.String())
+	}
+
+	// the commands a script called are logged in place of the script
+	s.ExecuteCommand(cl, "EVAL", []string{"redis.call('SET', 'a', ARGV[1]) redis.call('SELECT', 1) redis.call('SET', 'b', ARGV[1])", "0", "1"})
+	stop()
+	aof, err := os.ReadFile(appendOnlyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(aof, []byte("EVAL")) || !bytes.Contains(aof, []byte("MULTI")) {
+		t.Errorf("scripts were not logged as the commands they called:\n%q", aof)
+	}
+	s = start()
+	a, _ := s.get(s.store[0], "a")
+	b, _ := s.get(s.store[1], "b")
+	if a != "1" || b != "1" {
+		t.Errorf("append only file restored a as %q and b as %q", a, b)
+	}
+	if len(s.scripts) != 0 {
+		t.Errorf("scripts were cached from the append only file: %v", s.scripts)
+	}
+}
+
+func TestBgsave(t *testing.T) {
+	s := NewRedisServer(":15617")
+	defer s.l.Close()
+	defer close(s.done)
+	conn := &bufConn{}
+	cl := NewRedisClient(0, conn)
+
+	// hold the save db so the BGSAVE stays in progress until we let it go
+	s.saveLock.Lock()
+	s.ExecuteCommand(cl, "FLUSHALL", nil)
+	s.ExecuteCommand(cl, "SET", []string{"bgkey", "before"})
+	s.ExecuteCommand(cl, "BGSAVE", nil)
+	s.ExecuteCommand(cl, "SET", []string{"bgkey", "after"})
+	s.ExecuteCommand(cl, "BGSAVE", nil)
+	s.ExecuteCommand(cl, "SAVE", nil)
+	want := "+OK\r\n+OK\r\n+OK\r\n+OK\r\n" +
+		"-ERR Background save already in progress\r\n" +
+		"-ERR Background save already in progress\r\n"
+	if conn.String() != want {
+		t.Errorf("actual did not match expected.\nActual:   %q\nExpected: %q", conn.String(), want)
+	}
+	if info := strings.Join(s.info(), ""); !strings.Contains(info, "bgsave_in_progress:1\n") {
+		t.Errorf("INFO does not report the BGSAVE in progress:\n%s", info)
+	}
+	s.saveLock.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&s.bgsaveInProgress) == 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("BGSAVE did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	info := strings.Join(s.info(), "")
+	if !strings.Contains(info, "bgsave_in_progress:0\n") || !strings.Contains(info, "rdb_last_bgsave_status:ok\n") {
+		t.Errorf("INFO does not report the finished BGSAVE:\n%s", info)
+	}
+
+	// the snapshot holds the dataset as it was when BGSAVE was called
+	saveDb, err := sql.Open("sqlite", saveDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saveDb.Close()
+	saveID, _, err := latestSaveID(saveDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := readSnapshot(saveDb, saveID, nowMs(), NumDBs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := store[0].kv["bgkey"]; got != "before" {
+		t.Errorf("BGSAVE saved %q, expected %q", got, "before")
+	}
+}
+
+// newAOFTestServer starts a server that syncs its append only file on every
+// write. The test runs in a temporary dir so every data file is written there,
+// and the server listens on an ephemeral port. stop shuts the server down and
+// start brings up a new one from the files the last one left, whichever is
+// running when the test ends is shut down
+func newAOFTestServer(t *testing.T) (s *RedisServer, start func() *RedisServer, stop func()) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.appendOnly = true
+	cfg.appendFsync = fsyncAlways
+	var running *RedisServer
+	stop = func() {
+		if running == nil {
+			return
+		}
+		running.lock.Lock()
+		running.stopAppendOnly()
+		running.lock.Unlock()
+		running.closeDone()
+		running.l.Close()
+		running = nil
+	}
+	start = func() *RedisServer {
+		stop()
+		running = newRedisServer(":0", cfg)
+		return running
+	}
+	t.Cleanup(func() {
+		stop()
+		os.Chdir(wd)
+	})
+	return start(), start, stop
+}
+
+// bufConn is a client connection that keeps every reply written to it
+type bufConn struct {
+	bytes.Buffer
+}
+
+func (c *bufConn) Close() error { return nil }
+
+// expectReply writes payload to conn and checks that the next reply read
+// from r matches want
+func expectReply(t *testing.T, step int, conn net.Conn, r *bufio.Reader, payload, want []byte) {
+	t.Helper()
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal("write error:", err)
+	}
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal("read error: ", err)
+	}
+	if !bytes.Equal(buf, want) {
+		t.Errorf("step %d: actual did not match expected.\nActual:   %q\nExpected: %q", step, buf, want)
+	}
+}
+
+// readInfo sends INFO and returns its lines joined together
+func readInfo(t *testing.T, conn net.Conn, r *bufio.Reader) string {
+	t.Helper()
+	if _, err := conn.Write(mbrr("info")); err != nil {
+		t.Fatal("write error:", err)
+	}
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		t.Fatal("read error: ", err)
+	}
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		var l int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &l); err != nil {
+			t.Fatal("read error: ", err)
+		}
+		buf := make([]byte, l+len(Delimeter))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal("read error: ", err)
+		}
+		sb.Write(buf[:l])
+	}
+	return sb.String()
+}
+
+func BenchmarkExecuteCommand(b *testing.B) {
+	s := NewRedisServer(":15615")
+	defer s.l.Close()
+	f, err := os.Open(os.DevNull)
+	check(err)
+	defer f.Close()
+	cl := NewRedisClient(0, f)
+
+	for i := 0; i < b.N; i++ {
+		s.ExecuteCommand(cl, "SADD", []string{"mykey1234", fmt.Sprintf("%d", i)})
+	}
+}
+
+// mbrr - make bulk resp request
+// takes a string with space separated command+args? and
+// retunrs the correct resp byte slice
+func mbrr(req string) []byte {
+	splitWs := strings.Split(req, " ")
+	var sb strings.Builder
+	header := fmt.Sprintf("*%d%s", len(splitWs), Delimeter)
+	sb.WriteString(header)
+	for _, v := range splitWs {
+		l := len(v)
+		sb.WriteString(fmt.Sprintf("$%d%s%s%s", l, Delimeter, v, Delimeter))
+	}
+	// log.Printf("%q", sb.String())
+	return []byte(sb.String())
+}
+
+// mbrl - make bulk resp list
+// like mbrr but each item is used as is so it may contain spaces
+func mbrl(items ...string) []byte {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("*%d%s", len(items), Delimeter))
+	for _, v := range items {
+		sb.WriteString(fmt.Sprintf("$%d%s%s%s", len(v), Delimeter, v, Delimeter))
 	}
-	// log.Printf("%q", sb.String())
 	return []byte(sb.String())
 }
 
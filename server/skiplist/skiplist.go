@@ -0,0 +1,382 @@
+// Package skiplist implements the skiplist that sorted sets keep their members
+// in. Elements are ordered by score and then by member, and every link keeps
+// the number of elements it skips over (its span) so the rank of an element
+// and the element at a rank are found in O(log n) just like a lookup.
+//
+// To iterate over a skiplist (where sl is a *SkipList):
+//
+//	for e := sl.Front(); e != nil; e = e.Next() {
+//		// do something with e.Member and e.Score
+//	}
+//
+// A skiplist does not check that a member is only added once, the sorted set
+// keeps the score of every member in a map of its own for that.
+package skiplist
+
+import "math/rand"
+
+// MaxLevel is the most levels an element can have, enough for 2^64 elements
+const MaxLevel = 32
+
+// p is the chance that an element with a level also has the one above it
+const p = 0.25
+
+// level is a link of an element to the next element with that level
+type level struct {
+	forward *Element
+	// span is the number of elements the link moves forward by
+	span int
+}
+
+// Element is an element of a skiplist.
+type Element struct {
+	Member string
+	Score  float64
+
+	// backward is the previous element, nil for the first
+	backward *Element
+	levels   []level
+}
+
+// Next returns the next element or nil.
+func (e *Element) Next() *Element {
+	return e.levels[0].forward
+}
+
+// Prev returns the previous element or nil.
+func (e *Element) Prev() *Element {
+	return e.backward
+}
+
+// before reports whether e orders before score and member
+func (e *Element) before(score float64, member string) bool {
+	return e.Score < score || (e.Score == score && e.Member < member)
+}
+
+// SkipList is a list of members ordered by score.
+type SkipList struct {
+	// header is a sentinel element with every level, it is not part of the
+	// list
+	header *Element
+	tail   *Element
+	length int
+	// level is the most levels any element has
+	level int
+}
+
+// New returns an empty skiplist.
+func New() *SkipList {
+	return &SkipList{header: &Element{levels: make([]level, MaxLevel)}, level: 1}
+}
+
+// Len returns the number of elements of sl.
+func (sl *SkipList) Len() int { return sl.length }
+
+// Front returns the first element of sl or nil if it is empty.
+func (sl *SkipList) Front() *Element { return sl.header.levels[0].forward }
+
+// Back returns the last element of sl or nil if it is empty.
+func (sl *SkipList) Back() *Element { return sl.tail }
+
+func randomLevel() int {
+	lvl := 1
+	for lvl < MaxLevel && rand.Float64() < p {
+		lvl++
+	}
+	return lvl
+}
+
+// Insert adds member with score and returns its element. The member must not
+// be in sl already.
+func (sl *SkipList) Insert(score float64, member string) *Element {
+	var update [MaxLevel]*Element
+	// rank[i] is the rank of update[i]
+	var rank [MaxLevel]int
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			rank[i] += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+	lvl := randomLevel()
+	if lvl > sl.level {
+		for i := sl.level; i < lvl; i++ {
+			update[i] = sl.header
+			update[i].levels[i].span = sl.length
+		}
+		sl.level = lvl
+	}
+	x = &Element{Member: member, Score: score, levels: make([]level, lvl)}
+	for i := 0; i < lvl; i++ {
+		x.levels[i].forward = update[i].levels[i].forward
+		update[i].levels[i].forward = x
+		x.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = rank[0] - rank[i] + 1
+	}
+	// the links above x now skip over one more element
+	for i := lvl; i < sl.level; i++ {
+		update[i].levels[i].span++
+	}
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.levels[0].forward != nil {
+		x.levels[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+	return x
+}
+
+// find fills update with the last element before score and member on every
+// level and returns the element after them
+func (sl *SkipList) find(score float64, member string, update *[MaxLevel]*Element) *Element {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+	return x.levels[0].forward
+}
+
+// unlink takes x out of sl, update holds the elements before it as filled in
+// by find
+func (sl *SkipList) unlink(x *Element, update *[MaxLevel]*Element) {
+	for i := 0; i < sl.level; i++ {
+		if update[i].levels[i].forward == x {
+			update[i].levels[i].span += x.levels[i].span - 1
+			update[i].levels[i].forward = x.levels[i].forward
+		} else {
+			update[i].levels[i].span--
+		}
+	}
+	if x.levels[0].forward != nil {
+		x.levels[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.levels[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+}
+
+// Delete removes the element with score and member and reports whether there
+// was one.
+func (sl *SkipList) Delete(score float64, member string) bool {
+	var update [MaxLevel]*Element
+	x := sl.find(score, member, &update)
+	if x == nil || x.Score != score || x.Member != member {
+		return false
+	}
+	sl.unlink(x, &update)
+	return true
+}
+
+// UpdateScore changes the score of the element with score and member to
+// newScore and returns it, nil when there is no such element.
+func (sl *SkipList) UpdateScore(score float64, member string, newScore float64) *Element {
+	var update [MaxLevel]*Element
+	x := sl.find(score, member, &update)
+	if x == nil || x.Score != score || x.Member != member {
+		return nil
+	}
+	// the element is changed in place when it still orders between its
+	// neighbours
+	if (x.backward == nil || x.backward.before(newScore, member)) &&
+		(x.levels[0].forward == nil || !x.levels[0].forward.before(newScore, member)) {
+		x.Score = newScore
+		return x
+	}
+	sl.unlink(x, &update)
+	return sl.Insert(newScore, member)
+}
+
+// Rank returns the rank of the element with score and member counting from 1,
+// 0 when there is no such element.
+func (sl *SkipList) Rank(score float64, member string) int {
+	rank := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for next := x.levels[i].forward; next != nil && (next.before(score, member) || (next.Score == score && next.Member == member)); next = x.levels[i].forward {
+			rank += x.levels[i].span
+			x = next
+		}
+		if x != sl.header && x.Score == score && x.Member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// ByRank returns the element at rank counting from 1, nil when rank is out of
+// range.
+func (sl *SkipList) ByRank(rank int) *Element {
+	if rank < 1 || rank > sl.length {
+		return nil
+	}
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && traversed+x.levels[i].span <= rank {
+			traversed += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// Range is a range of scores, Min and Max are left out of it when MinEx and
+// MaxEx are set.
+type Range struct {
+	Min, Max     float64
+	MinEx, MaxEx bool
+}
+
+func (r Range) gteMin(score float64) bool {
+	if r.MinEx {
+		return score > r.Min
+	}
+	return score >= r.Min
+}
+
+func (r Range) lteMax(score float64) bool {
+	if r.MaxEx {
+		return score < r.Max
+	}
+	return score <= r.Max
+}
+
+// Empty reports whether no score can be in r.
+func (r Range) Empty() bool {
+	return r.Min > r.Max || (r.Min == r.Max && (r.MinEx || r.MaxEx))
+}
+
+// Contains reports whether score is in r.
+func (r Range) Contains(score float64) bool {
+	return r.gteMin(score) && r.lteMax(score)
+}
+
+// FirstInRange returns the first element with a score in r or nil.
+func (sl *SkipList) FirstInRange(r Range) *Element {
+	if r.Empty() {
+		return nil
+	}
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && !r.gteMin(x.levels[i].forward.Score) {
+			x = x.levels[i].forward
+		}
+	}
+	x = x.levels[0].forward
+	if x == nil || !r.lteMax(x.Score) {
+		return nil
+	}
+	return x
+}
+
+// LastInRange returns the last element with a score in r or nil.
+func (sl *SkipList) LastInRange(r Range) *Element {
+	if r.Empty() {
+		return nil
+	}
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && r.lteMax(x.levels[i].forward.Score) {
+			x = x.levels[i].forward
+		}
+	}
+	if x == sl.header || !r.gteMin(x.Score) {
+		return nil
+	}
+	return x
+}
+
+// LexRange is a range of members, meant for skiplists where every element has
+// the same score. Min and Max are left out of it when MinEx and MaxEx are set,
+// and MinInf and MaxInf make it start before every member and end after every
+// member.
+type LexRange struct {
+	Min, Max       string
+	MinEx, MaxEx   bool
+	MinInf, MaxInf bool
+}
+
+func (r LexRange) gteMin(member string) bool {
+	switch {
+	case r.MinInf:
+		return true
+	case r.MinEx:
+		return member > r.Min
+	}
+	return member >= r.Min
+}
+
+func (r LexRange) lteMax(member string) bool {
+	switch {
+	case r.MaxInf:
+		return true
+	case r.MaxEx:
+		return member < r.Max
+	}
+	return member <= r.Max
+}
+
+// Empty reports whether no member can be in r.
+func (r LexRange) Empty() bool {
+	if r.MinInf || r.MaxInf {
+		return false
+	}
+	return r.Min > r.Max || (r.Min == r.Max && (r.MinEx || r.MaxEx))
+}
+
+// Contains reports whether member is in r.
+func (r LexRange) Contains(member string) bool {
+	return r.gteMin(member) && r.lteMax(member)
+}
+
+// FirstInLexRange returns the first element with a member in r or nil.
+func (sl *SkipList) FirstInLexRange(r LexRange) *Element {
+	if r.Empty() {
+		return nil
+	}
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && !r.gteMin(x.levels[i].forward.Member) {
+			x = x.levels[i].forward
+		}
+	}
+	x = x.levels[0].forward
+	if x == nil || !r.lteMax(x.Member) {
+		return nil
+	}
+	return x
+}
+
+// LastInLexRange returns the last element with a member in r or nil.
+func (sl *SkipList) LastInLexRange(r LexRange) *Element {
+	if r.Empty() {
+		return nil
+	}
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && r.lteMax(x.levels[i].forward.Member) {
+			x = x.levels[i].forward
+		}
+	}
+	if x == sl.header || !r.gteMin(x.Member) {
+		return nil
+	}
+	return x
+}
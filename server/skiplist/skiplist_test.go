@@ -0,0 +1,221 @@
+package skiplist
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// entry is an element of the sorted slice the skiplist is compared against
+type entry struct {
+	member string
+	score  float64
+}
+
+func sortEntries(entries []entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		return a.score < b.score || (a.score == b.score && a.member < b.member)
+	})
+}
+
+// check compares sl with the sorted entries want, walking it both ways and
+// looking every element up by rank, and checks the span of every link
+func check(t *testing.T, sl *SkipList, want []entry) {
+	t.Helper()
+	if sl.Len() != len(want) {
+		t.Fatalf("Len is %d, want %d", sl.Len(), len(want))
+	}
+	rank := make(map[*Element]int, len(want))
+	i := 0
+	for e := sl.Front(); e != nil; e = e.Next() {
+		if i == len(want) || e.Member != want[i].member || e.Score != want[i].score {
+			t.Fatalf("element %d is %s %v, want %v", i, e.Member, e.Score, want)
+		}
+		i++
+		rank[e] = i
+	}
+	if i != len(want) {
+		t.Fatalf("walked %d elements, want %d", i, len(want))
+	}
+	for e := sl.Back(); e != nil; e = e.Prev() {
+		i--
+		if e.Member != want[i].member {
+			t.Fatalf("walking back element %d is %s, want %s", i, e.Member, want[i].member)
+		}
+	}
+	for i, w := range want {
+		if r := sl.Rank(w.score, w.member); r != i+1 {
+			t.Fatalf("Rank of %s is %d, want %d", w.member, r, i+1)
+		}
+		if e := sl.ByRank(i + 1); e == nil || e.Member != w.member {
+			t.Fatalf("ByRank(%d) is %v, want %s", i+1, e, w.member)
+		}
+	}
+	if e := sl.ByRank(0); e != nil {
+		t.Fatalf("ByRank(0) is %s", e.Member)
+	}
+	if e := sl.ByRank(len(want) + 1); e != nil {
+		t.Fatalf("ByRank(%d) is %s", len(want)+1, e.Member)
+	}
+	// following the links of any level has to add up to the ranks
+	for lvl := 0; lvl < MaxLevel; lvl++ {
+		x, pos := sl.header, 0
+		for next := x.levels[lvl].forward; next != nil; next = x.levels[lvl].forward {
+			if lvl >= sl.level {
+				t.Fatalf("link at level %d above the skiplist level %d", lvl, sl.level)
+			}
+			pos += x.levels[lvl].span
+			if rank[next] != pos {
+				t.Fatalf("link at level %d to %s spans to %d, want %d", lvl, next.Member, pos, rank[next])
+			}
+			x = next
+		}
+	}
+}
+
+func TestSkipListRandomized(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	sl := New()
+	var want []entry
+	// few distinct scores so members often tie on them
+	score := func() float64 { return float64(r.Intn(20)) / 2 }
+	for n := 0; n < 3000; n++ {
+		switch op := r.Intn(10); {
+		case op < 5 || len(want) == 0:
+			e := entry{fmt.Sprintf("m%d", n), score()}
+			if x := sl.Insert(e.score, e.member); x.Member != e.member || x.Score != e.score {
+				t.Fatalf("Insert returned %s %v", x.Member, x.Score)
+			}
+			want = append(want, e)
+			sortEntries(want)
+		case op < 7:
+			i := r.Intn(len(want))
+			if !sl.Delete(want[i].score, want[i].member) {
+				t.Fatalf("Delete of %s found nothing", want[i].member)
+			}
+			want = append(want[:i], want[i+1:]...)
+		case op < 8:
+			// a member with another score is not deleted
+			i := r.Intn(len(want))
+			if sl.Delete(want[i].score+100, want[i].member) || sl.Delete(want[i].score, "missing") {
+				t.Fatalf("Delete removed an element that is not there")
+			}
+		default:
+			i := r.Intn(len(want))
+			s := score()
+			if x := sl.UpdateScore(want[i].score, want[i].member, s); x == nil || x.Score != s || x.Member != want[i].member {
+				t.Fatalf("UpdateScore of %s returned %v", want[i].member, x)
+			}
+			want[i].score = s
+			sortEntries(want)
+		}
+		check(t, sl, want)
+	}
+	if sl.UpdateScore(-1, "missing", 1) != nil {
+		t.Errorf("UpdateScore changed an element that is not there")
+	}
+	if sl.Rank(-1, "missing") != 0 {
+		t.Errorf("Rank found an element that is not there")
+	}
+}
+
+func TestSkipListRange(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	sl := New()
+	var want []entry
+	for i := 0; i < 200; i++ {
+		e := entry{fmt.Sprintf("m%d", i), float64(r.Intn(50))}
+		sl.Insert(e.score, e.member)
+		want = append(want, e)
+	}
+	sortEntries(want)
+	for n := 0; n < 2000; n++ {
+		rg := Range{
+			Min:   float64(r.Intn(60) - 5),
+			Max:   float64(r.Intn(60) - 5),
+			MinEx: r.Intn(2) == 0,
+			MaxEx: r.Intn(2) == 0,
+		}
+		var first, last *entry
+		for i := range want {
+			if rg.Contains(want[i].score) {
+				if first == nil {
+					first = &want[i]
+				}
+				last = &want[i]
+			}
+		}
+		if first != nil && rg.Empty() {
+			t.Fatalf("%+v is empty but contains %v", rg, first.score)
+		}
+		if got := sl.FirstInRange(rg); !same(got, first) {
+			t.Fatalf("FirstInRange(%+v) is %v, want %v", rg, got, first)
+		}
+		if got := sl.LastInRange(rg); !same(got, last) {
+			t.Fatalf("LastInRange(%+v) is %v, want %v", rg, got, last)
+		}
+	}
+}
+
+func TestSkipListLexRange(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	sl := New()
+	var want []entry
+	letters := "abcdefghij"
+	word := func() string {
+		b := make([]byte, 1+r.Intn(3))
+		for i := range b {
+			b[i] = letters[r.Intn(len(letters))]
+		}
+		return string(b)
+	}
+	seen := make(map[string]bool)
+	for len(want) < 200 {
+		m := word()
+		if seen[m] {
+			continue
+		}
+		seen[m] = true
+		sl.Insert(0, m)
+		want = append(want, entry{m, 0})
+	}
+	sortEntries(want)
+	for n := 0; n < 2000; n++ {
+		rg := LexRange{
+			Min:    word(),
+			Max:    word(),
+			MinEx:  r.Intn(2) == 0,
+			MaxEx:  r.Intn(2) == 0,
+			MinInf: r.Intn(8) == 0,
+			MaxInf: r.Intn(8) == 0,
+		}
+		var first, last *entry
+		for i := range want {
+			if rg.Contains(want[i].member) {
+				if first == nil {
+					first = &want[i]
+				}
+				last = &want[i]
+			}
+		}
+		if first != nil && rg.Empty() {
+			t.Fatalf("%+v is empty but contains %s", rg, first.member)
+		}
+		if got := sl.FirstInLexRange(rg); !same(got, first) {
+			t.Fatalf("FirstInLexRange(%+v) is %v, want %v", rg, got, first)
+		}
+		if got := sl.LastInLexRange(rg); !same(got, last) {
+			t.Fatalf("LastInLexRange(%+v) is %v, want %v", rg, got, last)
+		}
+	}
+}
+
+// same reports whether the element e is the entry w, both may be nil
+func same(e *Element, w *entry) bool {
+	if e == nil || w == nil {
+		return e == nil && w == nil
+	}
+	return e.Member == w.member && e.Score == w.score
+}
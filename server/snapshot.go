@@ -0,0 +1,547 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"sc/list"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openSaveDB opens the save db at path read only to read snapshots from.
+// Unlike createSaveDBIfNotExists it will not create the file, an error
+// satisfying os.IsNotExist is returned when nothing has been saved yet
+func openSaveDB(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	saveDb, err := sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// temporary tables only exist on the connection that created them
+	saveDb.SetMaxOpenConns(1)
+	if err := addMissingSaveDBTables(saveDb); err != nil {
+		saveDb.Close()
+		return nil, err
+	}
+	return saveDb, nil
+}
+
+// addMissingSaveDBTables stands an empty temporary table in for every table
+// an older save db is missing, which leaves the file itself untouched
+func addMissingSaveDBTables(saveDb *sql.DB) error {
+	const create = "CREATE TABLE IF NOT EXISTS "
+	for _, tableSQL := range saveDBTableSQL {
+		name := strings.TrimPrefix(tableSQL, create)
+		name = name[:strings.Index(name, "(")]
+		var n int
+		err := saveDb.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;`, name).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := saveDb.Exec("CREATE TEMP TABLE " + strings.TrimPrefix(tableSQL, create)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latestSaveID returns the saveID and lastsave time of the newest snapshot in
+// the save db. sql.ErrNoRows is returned when nothing has been saved yet
+func latestSaveID(saveDb *sql.DB) (string, int64, error) {
+	var saveID string
+	var lastsave int64
+	// rowid breaks the tie between snapshots taken in the same second
+	row := saveDb.QueryRow(`SELECT saveID, lastsave FROM lastsave ORDER BY lastsave DESC, rowid DESC LIMIT 1;`)
+	err := row.Scan(&saveID, &lastsave)
+	return saveID, lastsave, err
+}
+
+// eachSnapshotRow runs query (which must take the saveID as its only
+// parameter) and calls fn for every row returned
+func eachSnapshotRow(saveDb *sql.DB, query, saveID string, fn func(rows *sql.Rows) error) error {
+	rows, err := saveDb.Query(query, saveID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// readSnapshot rebuilds the first databases dbs that were saved under saveID.
+// Keys with a ttl at or before now (in unix ms) are left out
+func readSnapshot(saveDb *sql.DB, saveID string, now int64, databases int) ([]*DB, error) {
+	store := make([]*DB, databases)
+	for i := range store {
+		store[i] = NewDB()
+	}
+	// dbFor returns nil for rows that belong to a db index we do not have
+	dbFor := func(dbID int) *DB {
+		if dbID < 0 || dbID >= len(store) {
+			return nil
+		}
+		return store[dbID]
+	}
+
+	var dbID int
+	var key, val, typ string
+	err := eachSnapshotRow(saveDb, `SELECT dbID, key, typ FROM typeStore WHERE saveID = ?;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &typ); err != nil {
+			return err
+		}
+		db := dbFor(dbID)
+		if db == nil {
+			return nil
+		}
+		db.tstore[key] = dbTyp(typ)
+		// create the containers up front so empty sets and lists survive
+		switch dbTyp(typ) {
+		case tList:
+			db.ll[key] = list.New()
+		case tSet:
+			db.s[key] = make(map[string]struct{})
+		case tHash:
+			db.h[key] = make(map[string]string)
+		case tStream:
+			db.x[key] = newStream()
+		case tZset:
+			db.z[key] = newZset()
+		}
+		return nil
+	})
+	if err != nil {
+		return store, err
+	}
+
+	err = eachSnapshotRow(saveDb, `SELECT dbID, key, val FROM kvStore WHERE saveID = ?;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &val); err != nil {
+			return err
+		}
+		if db := dbFor(dbID); db != nil {
+			db.kv[key] = val
+		}
+		return nil
+	})
+	if err != nil {
+		return store, err
+	}
+
+	err = eachSnapshotRow(saveDb, `SELECT dbID, key, val FROM setStore WHERE saveID = ?;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &val); err != nil {
+			return err
+		}
+		db := dbFor(dbID)
+		if db == nil {
+			return nil
+		}
+		if _, ok := db.s[key]; !ok {
+			db.s[key] = make(map[string]struct{})
+		}
+		db.s[key][val] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return store, err
+	}
+
+	err = eachSnapshotRow(saveDb, `SELECT dbID, key, val FROM listStore WHERE saveID = ? ORDER BY dbID, key, elemIndex;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &val); err != nil {
+			return err
+		}
+		db := dbFor(dbID)
+		if db == nil {
+			return nil
+		}
+		if _, ok := db.ll[key]; !ok {
+			db.ll[key] = list.New()
+		}
+		db.ll[key].PushBack(val)
+		return nil
+	})
+	if err != nil {
+		return store, err
+	}
+
+	var field string
+	err = eachSnapshotRow(saveDb, `SELECT dbID, key, field, val FROM hashStore WHERE saveID = ?;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &field, &val); err != nil {
+			return err
+		}
+		db := dbFor(dbID)
+		if db == nil {
+			return nil
+		}
+		if _, ok := db.h[key]; !ok {
+			db.h[key] = make(map[string]string)
+		}
+		db.h[key][field] = val
+		return nil
+	})
+	if err != nil {
+		return store, err
+	}
+
+	var member, score string
+	err = eachSnapshotRow(saveDb, `SELECT dbID, key, member, score FROM zsetStore WHERE saveID = ?;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &member, &score); err != nil {
+			return err
+		}
+		db := dbFor(dbID)
+		if db == nil || db.z[key] == nil {
+			return nil
+		}
+		f, err := parseScore(score)
+		db.z[key].set(member, f)
+		return err
+	})
+	if err != nil {
+		return store, err
+	}
+
+	var lastID string
+	err = eachSnapshotRow(saveDb, `SELECT dbID, key, lastID FROM streamStore WHERE saveID = ?;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &lastID); err != nil {
+			return err
+		}
+		db := dbFor(dbID)
+		if db == nil || db.x[key] == nil {
+			return nil
+		}
+		id, err := parseStreamID(lastID, 0)
+		db.x[key].lastID = id
+		return err
+	})
+	if err != nil {
+		return store, err
+	}
+
+	var entryID string
+	err = eachSnapshotRow(saveDb, `SELECT dbID, key, entryID, field, val FROM streamEntryStore WHERE saveID = ? ORDER BY dbID, key, entryIndex, fieldIndex;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &entryID, &field, &val); err != nil {
+			return err
+		}
+		db := dbFor(dbID)
+		if db == nil || db.x[key] == nil {
+			return nil
+		}
+		return db.x[key].loadField(entryID, field, val)
+	})
+	if err != nil {
+		return store, err
+	}
+
+	var groupName string
+	err = eachSnapshotRow(saveDb, `SELECT dbID, key, groupName, lastID FROM streamGroupStore WHERE saveID = ?;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &groupName, &lastID); err != nil {
+			return err
+		}
+		db := dbFor(dbID)
+		if db == nil || db.x[key] == nil {
+			return nil
+		}
+		return db.x[key].loadGroup(groupName, lastID)
+	})
+	if err != nil {
+		return store, err
+	}
+
+	var consumer string
+	var seenTime int64
+	err = eachSnapshotRow(saveDb, `SELECT dbID, key, groupName, consumer, seenTime FROM streamConsumerStore WHERE saveID = ?;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &groupName, &consumer, &seenTime); err != nil {
+			return err
+		}
+		if db := dbFor(dbID); db != nil && db.x[key] != nil {
+			db.x[key].loadConsumer(groupName, consumer, seenTime)
+		}
+		return nil
+	})
+	if err != nil {
+		return store, err
+	}
+
+	var deliveryTime, deliveryCount int64
+	err = eachSnapshotRow(saveDb, `SELECT dbID, key, groupName, entryID, consumer, deliveryTime, deliveryCount FROM streamPendingStore WHERE saveID = ?;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &groupName, &entryID, &consumer, &deliveryTime, &deliveryCount); err != nil {
+			return err
+		}
+		db := dbFor(dbID)
+		if db == nil || db.x[key] == nil {
+			return nil
+		}
+		return db.x[key].loadPending(groupName, entryID, consumer, deliveryTime, deliveryCount)
+	})
+	if err != nil {
+		return store, err
+	}
+
+	var expireAt int64
+	err = eachSnapshotRow(saveDb, `SELECT dbID, key, expireAt FROM expireStore WHERE saveID = ?;`, saveID, func(rows *sql.Rows) error {
+		if err := rows.Scan(&dbID, &key, &expireAt); err != nil {
+			return err
+		}
+		db := dbFor(dbID)
+		if db == nil {
+			return nil
+		}
+		if expireAt <= now {
+			delete(db.tstore, key)
+			delete(db.kv, key)
+			delete(db.s, key)
+			delete(db.ll, key)
+			delete(db.h, key)
+			delete(db.x, key)
+			delete(db.z, key)
+			return nil
+		}
+		db.expires[key] = expireAt
+		return nil
+	})
+	return store, err
+}
+
+// loadLatestSnapshot replaces the dataset with the newest snapshot in the save
+// db. It does nothing when there is no save db or it holds no snapshots
+func (rs *RedisServer) loadLatestSnapshot() error {
+	saveDb, err := openSaveDB(rs.config.dbFilename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer saveDb.Close()
+
+	saveID, lastsave, err := latestSaveID(saveDb)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	store, err := readSnapshot(saveDb, saveID, nowMs(), len(rs.store))
+	if err != nil {
+		return err
+	}
+	rs.store = store
+	rs.lastsave = lastsave
+	serverLog(logNotice, "Loaded snapshot %s in %v", saveID, time.Since(start))
+	return nil
+}
+
+// snapshotInfo identifies a single snapshot in the save db
+type snapshotInfo struct {
+	saveID   string
+	lastsave int64
+}
+
+// listSnapshots returns every snapshot in the save db, newest first
+func listSnapshots(saveDb *sql.DB) ([]snapshotInfo, error) {
+	rows, err := saveDb.Query(`SELECT saveID, lastsave FROM lastsave ORDER BY lastsave DESC, rowid DESC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	snapshots := make([]snapshotInfo, 0)
+	for rows.Next() {
+		var snap snapshotInfo
+		if err := rows.Scan(&snap.saveID, &snap.lastsave); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, rows.Err()
+}
+
+// snapshotStoreTables are the tables that hold the dataset rows of every
+// snapshot keyed by saveID
+var snapshotStoreTables = []string{"typeStore", "kvStore", "setStore", "listStore", "hashStore", "zsetStore", "streamStore", "streamEntryStore", "streamGroupStore", "streamConsumerStore", "streamPendingStore", "expireStore"}
+
+// pruneSnapshots deletes the snapshots that the retention policy in cfg no
+// longer keeps and returns how many were removed. A snapshot is kept when it
+// is one of the newest snapshotKeep snapshots or is younger than
+// snapshotMaxAge, and the newest snapshot is always kept so there is
+// something to load on startup
+func pruneSnapshots(saveDb *sql.DB, cfg serverConfig) (int, error) {
+	if cfg.snapshotKeep <= 0 && cfg.snapshotMaxAge <= 0 {
+		return 0, nil
+	}
+	snapshots, err := listSnapshots(saveDb)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+	prune := make([]string, 0)
+	for i, snap := range snapshots {
+		if i == 0 {
+			continue
+		}
+		keptByCount := cfg.snapshotKeep > 0 && i < cfg.snapshotKeep
+		keptByAge := cfg.snapshotMaxAge > 0 && now-snap.lastsave < cfg.snapshotMaxAge
+		if keptByCount || keptByAge {
+			continue
+		}
+		prune = append(prune, snap.saveID)
+	}
+	if len(prune) == 0 {
+		return 0, nil
+	}
+
+	// remove every row of the pruned snapshots or none of them
+	tx, err := saveDb.Begin()
+	if err != nil {
+		return 0, err
+	}
+	tables := append([]string{"lastsave"}, snapshotStoreTables...)
+	for _, table := range tables {
+		stmt, err := tx.Prepare(`DELETE FROM ` + table + ` WHERE saveID = ?;`)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		for _, saveID := range prune {
+			if _, err := stmt.Exec(saveID); err != nil {
+				stmt.Close()
+				tx.Rollback()
+				return 0, err
+			}
+		}
+		stmt.Close()
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if cfg.snapshotVacuum {
+		if _, err := saveDb.Exec(`VACUUM;`); err != nil {
+			return len(prune), err
+		}
+	}
+	return len(prune), nil
+}
+
+// Commands Operating on Snapshots
+
+func snapshotCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	switch strings.ToUpper(args[0]) {
+	case "LIST":
+		if len(args) != 1 {
+			return replyInvalidNumberOfArgsError(c, "SNAPSHOT")
+		}
+		return snapshotListCommand(rs, cl)
+	case "RESTORE":
+		// SNAPSHOT RESTORE <saveID> [DB <n>]
+		if len(args) != 2 && len(args) != 4 {
+			return replyInvalidNumberOfArgsError(c, "SNAPSHOT")
+		}
+		dbIndex := -1
+		if len(args) == 4 {
+			if strings.ToUpper(args[2]) != "DB" {
+				return replySimpleError(c, "ERR syntax error")
+			}
+			index, err := strconv.Atoi(args[3])
+			if err != nil || index < 0 || index >= len(rs.store) {
+				return replyInvalidTypeIntegerError(c)
+			}
+			dbIndex = index
+		}
+		return snapshotRestoreCommand(rs, cl, args[1], dbIndex)
+	case "DIFF":
+		// SNAPSHOT DIFF <saveA> <saveB> [DB <n>]
+		if len(args) != 3 && len(args) != 5 {
+			return replyInvalidNumberOfArgsError(c, "SNAPSHOT")
+		}
+		dbIndex := -1
+		if len(args) == 5 {
+			if strings.ToUpper(args[3]) != "DB" {
+				return replySimpleError(c, "ERR syntax error")
+			}
+			index, err := strconv.Atoi(args[4])
+			if err != nil || index < 0 || index >= len(rs.store) {
+				return replyInvalidTypeIntegerError(c)
+			}
+			dbIndex = index
+		}
+		return snapshotDiffCommand(rs, cl, args[1], args[2], dbIndex)
+	}
+	return replyInvalidCommandError(c)
+}
+
+// snapshotListCommand replies with the saveID and lastsave time of every
+// snapshot, newest first
+func snapshotListCommand(rs *RedisServer, cl *RedisClient) bool {
+	saveDb, err := openSaveDB(rs.config.dbFilename)
+	if os.IsNotExist(err) {
+		return replyEmptySetOrList(cl.conn)
+	}
+	if err != nil {
+		return replySimpleError(cl.conn, "ERR "+err.Error())
+	}
+	defer saveDb.Close()
+
+	snapshots, err := listSnapshots(saveDb)
+	if err != nil {
+		return replySimpleError(cl.conn, "ERR "+err.Error())
+	}
+	if len(snapshots) == 0 {
+		return replyEmptySetOrList(cl.conn)
+	}
+	result := make([]string, 0, len(snapshots)*2)
+	for _, snap := range snapshots {
+		result = append(result, snap.saveID, strconv.FormatInt(snap.lastsave, 10))
+	}
+	return replyMultiBulkString(cl.conn, result)
+}
+
+// snapshotRestoreCommand replaces the dataset with the snapshot saved under
+// saveID. When dbIndex is not -1 only that db is replaced
+func snapshotRestoreCommand(rs *RedisServer, cl *RedisClient, saveID string, dbIndex int) bool {
+	saveDb, err := openSaveDB(rs.config.dbFilename)
+	if os.IsNotExist(err) {
+		return replySimpleError(cl.conn, errNoSuchSnapshot.Error())
+	}
+	if err != nil {
+		return replySimpleError(cl.conn, "ERR "+err.Error())
+	}
+	defer saveDb.Close()
+
+	var exists int
+	err = saveDb.QueryRow(`SELECT COUNT(*) FROM lastsave WHERE saveID = ?;`, saveID).Scan(&exists)
+	if err != nil {
+		return replySimpleError(cl.conn, "ERR "+err.Error())
+	}
+	if exists == 0 {
+		return replySimpleError(cl.conn, errNoSuchSnapshot.Error())
+	}
+
+	store, err := readSnapshot(saveDb, saveID, nowMs(), len(rs.store))
+	if err != nil {
+		return replySimpleError(cl.conn, "ERR "+err.Error())
+	}
+	if dbIndex == -1 {
+		rs.store = store
+		for _, db := range rs.store {
+			rs.signalModifiedDB(db)
+		}
+	} else {
+		rs.store[dbIndex] = store[dbIndex]
+		rs.signalModifiedDB(rs.store[dbIndex])
+	}
+	rs.dirty++
+	serverLog(logNotice, "Restored snapshot %s", saveID)
+	return replyOK(cl.conn)
+}
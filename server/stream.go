@@ -0,0 +1,761 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A stream is an append only log of entries, each a list of field value
+// pairs. Every entry has an id greater than the id of every entry added
+// before it, made of the unix time in ms it was added at and a sequence number
+// for the entries added in the same ms:
+//
+//	1526919030474-0
+//
+// The entries are kept in a slice in id order so ranges are found with a
+// binary search. The id of the last entry ever added is kept apart so ids are
+// never handed out twice after the newest entries are deleted
+
+var (
+	errInvalidStreamID    = errors.New("ERR Invalid stream ID specified as stream command argument")
+	errStreamIDTooSmall   = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	errStreamIDZero       = errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	errStreamIDExhausted  = errors.New("ERR The stream has exhausted the last possible ID, unable to add more items")
+	errSyntax             = errors.New("ERR syntax error")
+	errStreamTrimLimit    = errors.New("ERR syntax error, LIMIT cannot be used without the special ~ option")
+	errXsetidTooSmall     = errors.New("ERR The ID specified in XSETID is smaller than the target stream top item")
+	errNegativeTimeout    = errors.New("ERR timeout is negative")
+	errUnbalancedXreadIDs = errors.New("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+)
+
+// streamID is the id of a stream entry
+type streamID struct {
+	ms, seq uint64
+}
+
+// maxStreamID is the largest possible id, "+" in a range
+var maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(o streamID) bool {
+	return id.ms < o.ms || (id.ms == o.ms && id.seq < o.seq)
+}
+
+// next returns the smallest id after id, ok is false when id is the largest
+func (id streamID) next() (streamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return streamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// prev returns the largest id before id, ok is false when id is 0-0
+func (id streamID) prev() (streamID, bool) {
+	switch {
+	case id.seq > 0:
+		return streamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return streamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// parseStreamID parses an id written as ms-seq, or as just ms in which case
+// the sequence number is seq
+func parseStreamID(s string, seq uint64) (streamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	if hasSeq {
+		if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return streamID{}, errInvalidStreamID
+		}
+	}
+	return streamID{ms, seq}, nil
+}
+
+// parseRangeStart parses the start of an XRANGE. "-" is the smallest id and
+// a leading "(" leaves the id itself out of the range
+func parseRangeStart(s string) (streamID, error) {
+	switch s {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+	if !strings.HasPrefix(s, "(") {
+		return parseStreamID(s, 0)
+	}
+	id, err := parseStreamID(s[1:], 0)
+	if err != nil {
+		return id, err
+	}
+	if id, ok := id.next(); ok {
+		return id, nil
+	}
+	return id, errInvalidStreamID
+}
+
+// parseRangeEnd parses the end of an XRANGE. "+" is the largest id and a
+// leading "(" leaves the id itself out of the range
+func parseRangeEnd(s string) (streamID, error) {
+	switch s {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+	if !strings.HasPrefix(s, "(") {
+		return parseStreamID(s, math.MaxUint64)
+	}
+	id, err := parseStreamID(s[1:], math.MaxUint64)
+	if err != nil {
+		return id, err
+	}
+	if id, ok := id.prev(); ok {
+		return id, nil
+	}
+	return id, errInvalidStreamID
+}
+
+// streamEntry is a single entry of a stream. The fields are never changed
+// once the entry is added so copies of a stream share them
+type streamEntry struct {
+	id     streamID
+	fields []string
+}
+
+// stream is the value of a stream key
+type stream struct {
+	entries []streamEntry
+	// lastID is the id of the newest entry ever added
+	lastID streamID
+	// groups holds the consumer groups of the stream by name
+	groups map[string]*streamGroup
+}
+
+func newStream() *stream {
+	return &stream{groups: make(map[string]*streamGroup)}
+}
+
+// clone returns a copy of the stream that can be changed without changing st
+func (st *stream) clone() *stream {
+	c := &stream{lastID: st.lastID, entries: make([]streamEntry, len(st.entries)), groups: make(map[string]*streamGroup, len(st.groups))}
+	copy(c.entries, st.entries)
+	for name, g := range st.groups {
+		c.groups[name] = g.clone()
+	}
+	return c
+}
+
+// search returns the index of the first entry with an id of at least id
+func (st *stream) search(id streamID) int {
+	return sort.Search(len(st.entries), func(i int) bool {
+		return !st.entries[i].id.less(id)
+	})
+}
+
+// entry returns the entry with id and reports whether there is one
+func (st *stream) entry(id streamID) (streamEntry, bool) {
+	i := st.search(id)
+	if i == len(st.entries) || st.entries[i].id != id {
+		return streamEntry{}, false
+	}
+	return st.entries[i], true
+}
+
+// resolveID turns the id argument of XADD into the id of the new entry. "*"
+// picks the next id from the time now (in unix ms) and "ms-*" the next
+// sequence number of ms
+func (st *stream) resolveID(arg string, now uint64) (streamID, error) {
+	var id streamID
+	switch {
+	case arg == "*":
+		if st.lastID.ms < now {
+			return streamID{now, 0}, nil
+		}
+		next, ok := st.lastID.next()
+		if !ok {
+			return id, errStreamIDExhausted
+		}
+		return next, nil
+	case strings.HasSuffix(arg, "-*"):
+		ms, err := strconv.ParseUint(strings.TrimSuffix(arg, "-*"), 10, 64)
+		if err != nil {
+			return id, errInvalidStreamID
+		}
+		id = streamID{ms, 0}
+		if ms == st.lastID.ms {
+			if st.lastID.seq == math.MaxUint64 {
+				return id, errStreamIDTooSmall
+			}
+			id.seq = st.lastID.seq + 1
+		}
+		if ms == 0 && id.seq == 0 {
+			id.seq = 1
+		}
+	default:
+		var err error
+		if id, err = parseStreamID(arg, 0); err != nil {
+			return id, err
+		}
+		if id == (streamID{}) {
+			return id, errStreamIDZero
+		}
+	}
+	if !st.lastID.less(id) {
+		return id, errStreamIDTooSmall
+	}
+	return id, nil
+}
+
+// rangeEntries returns the entries with ids from start to end, up to count
+// of them when count is not -1. With rev set they are taken from end
+// backwards
+func (st *stream) rangeEntries(start, end streamID, count int, rev bool) []streamEntry {
+	if end.less(start) {
+		return nil
+	}
+	lo := st.search(start)
+	hi := sort.Search(len(st.entries), func(i int) bool {
+		return end.less(st.entries[i].id)
+	})
+	if count >= 0 && hi-lo > count {
+		if rev {
+			lo = hi - count
+		} else {
+			hi = lo + count
+		}
+	}
+	entries := make([]streamEntry, hi-lo)
+	copy(entries, st.entries[lo:hi])
+	if rev {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	return entries
+}
+
+// del removes the entry with id and reports whether there was one
+func (st *stream) del(id streamID) bool {
+	i := st.search(id)
+	if i == len(st.entries) || st.entries[i].id != id {
+		return false
+	}
+	st.entries = append(st.entries[:i], st.entries[i+1:]...)
+	return true
+}
+
+// streamTrim is the trimming asked for by XADD or XTRIM
+type streamTrim struct {
+	// strategy is MAXLEN or MINID, an empty strategy does not trim
+	strategy string
+	maxLen   int64
+	minID    streamID
+	// limit caps how many entries are removed when it is not 0
+	limit int64
+}
+
+// parseStreamTrim parses a trim that starts at args[i] (which is MAXLEN or
+// MINID) and returns it with the index of the argument after it:
+//
+//	MAXLEN|MINID [=|~] threshold [LIMIT count]
+//
+// Trimming is always exact so ~ only allows LIMIT to be given
+func parseStreamTrim(args []string, i int) (streamTrim, int, error) {
+	t := streamTrim{strategy: strings.ToUpper(args[i])}
+	i++
+	approx := false
+	if i < len(args) && (args[i] == "=" || args[i] == "~") {
+		approx = args[i] == "~"
+		i++
+	}
+	if i >= len(args) {
+		return t, i, errSyntax
+	}
+	if t.strategy == "MAXLEN" {
+		n, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil || n < 0 {
+			return t, i, errors.New("ERR The MAXLEN argument must be >= 0.")
+		}
+		t.maxLen = n
+	} else {
+		id, err := parseStreamID(args[i], 0)
+		if err != nil {
+			return t, i, err
+		}
+		t.minID = id
+	}
+	i++
+	if i < len(args) && strings.ToUpper(args[i]) == "LIMIT" {
+		if !approx {
+			return t, i, errStreamTrimLimit
+		}
+		if i+1 >= len(args) {
+			return t, i, errSyntax
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n < 0 {
+			return t, i, errors.New("ERR The LIMIT argument must be >= 0.")
+		}
+		t.limit = n
+		i += 2
+	}
+	return t, i, nil
+}
+
+// trim removes entries from the start of the stream as t asks and returns how
+// many it removed
+func (st *stream) trim(t streamTrim) int {
+	n := 0
+	switch t.strategy {
+	case "MAXLEN":
+		if int64(len(st.entries)) > t.maxLen {
+			n = len(st.entries) - int(t.maxLen)
+		}
+	case "MINID":
+		n = st.search(t.minID)
+	}
+	if t.limit > 0 && int64(n) > t.limit {
+		n = int(t.limit)
+	}
+	st.entries = st.entries[n:]
+	return n
+}
+
+// loadField adds a field of an entry read back from a save. The fields have
+// to be added in order, an entry at a time
+func (st *stream) loadField(entryID, field, val string) error {
+	id, err := parseStreamID(entryID, 0)
+	if err != nil {
+		return err
+	}
+	if n := len(st.entries); n == 0 || st.entries[n-1].id != id {
+		st.entries = append(st.entries, streamEntry{id: id})
+	}
+	e := &st.entries[len(st.entries)-1]
+	e.fields = append(e.fields, field, val)
+	return nil
+}
+
+// streamJSON is how a stream is encoded in the tier db, each entry is its id
+// followed by its fields
+type streamJSON struct {
+	LastID  string                     `json:"lastID"`
+	Entries [][]string                 `json:"entries"`
+	Groups  map[string]streamGroupJSON `json:"groups,omitempty"`
+}
+
+func (st *stream) toJSON() streamJSON {
+	sj := streamJSON{LastID: st.lastID.String(), Entries: make([][]string, len(st.entries))}
+	for i, e := range st.entries {
+		sj.Entries[i] = append([]string{e.id.String()}, e.fields...)
+	}
+	if len(st.groups) > 0 {
+		sj.Groups = make(map[string]streamGroupJSON, len(st.groups))
+		for name, g := range st.groups {
+			sj.Groups[name] = g.toJSON()
+		}
+	}
+	return sj
+}
+
+func (sj streamJSON) toStream() (*stream, error) {
+	st := newStream()
+	lastID, err := parseStreamID(sj.LastID, 0)
+	if err != nil {
+		return nil, err
+	}
+	st.lastID = lastID
+	for _, e := range sj.Entries {
+		if len(e) == 0 {
+			continue
+		}
+		id, err := parseStreamID(e[0], 0)
+		if err != nil {
+			return nil, err
+		}
+		st.entries = append(st.entries, streamEntry{id: id, fields: e[1:]})
+	}
+	for name, gj := range sj.Groups {
+		if err := st.loadJSON(name, gj); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// Methods for operating on stream portion of db
+
+// xadd adds an entry to the stream at key, creating the stream if needed. id
+// must already be checked to be greater than the last id of the stream
+func (rs *RedisServer) xadd(db *DB, key string, id streamID, fields []string) {
+	st, ok := db.x[key]
+	if !ok {
+		st = newStream()
+		db.x[key] = st
+		db.tstore[key] = tStream
+	}
+	st.entries = append(st.entries, streamEntry{id: id, fields: fields})
+	st.lastID = id
+	rs.dirty++
+	rs.signalStreamAppended(db, key)
+}
+
+// xtrim trims the stream at key and returns how many entries were removed
+func (rs *RedisServer) xtrim(db *DB, key string, t streamTrim) int {
+	st, ok := db.x[key]
+	if !ok {
+		return 0
+	}
+	n := st.trim(t)
+	if n > 0 {
+		rs.dirty++
+		rs.signalModifiedKey(db, key)
+	}
+	return n
+}
+
+// xdel removes the entries with ids from the stream at key and returns how
+// many there were
+func (rs *RedisServer) xdel(db *DB, key string, ids []streamID) int {
+	st, ok := db.x[key]
+	if !ok {
+		return 0
+	}
+	n := 0
+	for _, id := range ids {
+		if st.del(id) {
+			n++
+		}
+	}
+	if n > 0 {
+		rs.dirty++
+		rs.signalModifiedKey(db, key)
+	}
+	return n
+}
+
+// xsetid sets the last id of the stream at key
+func (rs *RedisServer) xsetid(db *DB, key string, id streamID) {
+	db.x[key].lastID = id
+	rs.dirty++
+	rs.signalModifiedKey(db, key)
+}
+
+// appendStreamEntries appends entries as an array of [id, [field, value ...]]
+func appendStreamEntries(buf []byte, entries []streamEntry) []byte {
+	buf = append(buf, "*"+strconv.Itoa(len(entries))+Delimeter...)
+	for _, e := range entries {
+		buf = appendStreamEntry(buf, e)
+	}
+	return buf
+}
+
+// appendStreamEntry appends e as [id, [field, value ...]], an entry without
+// fields is one that was deleted and they are sent as nil
+func appendStreamEntry(buf []byte, e streamEntry) []byte {
+	buf = append(buf, "*2"+Delimeter...)
+	buf = appendBulkString(buf, e.id.String())
+	if e.fields == nil {
+		return append(buf, emptySetOrList...)
+	}
+	buf = append(buf, "*"+strconv.Itoa(len(e.fields))+Delimeter...)
+	for _, f := range e.fields {
+		buf = appendBulkString(buf, f)
+	}
+	return buf
+}
+
+// xaddArgs are the arguments of XADD after the key
+type xaddArgs struct {
+	noMkStream bool
+	trim       streamTrim
+	// idIndex is the index of the id in the arguments
+	idIndex int
+}
+
+// parseXaddArgs parses the arguments of XADD:
+//
+//	XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func parseXaddArgs(args []string) (xaddArgs, error) {
+	var a xaddArgs
+	i := 1
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NOMKSTREAM":
+			a.noMkStream = true
+			continue
+		case "MAXLEN", "MINID":
+			t, next, err := parseStreamTrim(args, i)
+			if err != nil {
+				return a, err
+			}
+			a.trim = t
+			i = next - 1
+			continue
+		}
+		break
+	}
+	a.idIndex = i
+	return a, nil
+}
+
+// Commands Operating on Streams
+
+func xaddCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	a, err := parseXaddArgs(args)
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	// the options may use up every argument and leave no id
+	if a.idIndex >= len(args) {
+		return replyInvalidNumberOfArgsError(c, "XADD")
+	}
+	fields := args[a.idIndex+1:]
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return replyInvalidNumberOfArgsError(c, "XADD")
+	}
+	db := rs.store[cl.db]
+	st, ok := db.x[args[0]]
+	if !ok {
+		if a.noMkStream {
+			return replyEmptyBulkString(c)
+		}
+		st = newStream()
+	}
+	id, err := st.resolveID(args[a.idIndex], uint64(nowMs()))
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	rs.xadd(db, args[0], id, append([]string(nil), fields...))
+	rs.xtrim(db, args[0], a.trim)
+	return replyBulkString(c, id.String())
+}
+
+func xlenCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	n := 0
+	if st, ok := rs.store[cl.db].x[args[0]]; ok {
+		n = len(st.entries)
+	}
+	return replyInteger(cl.conn, strconv.Itoa(n))
+}
+
+// xrange replies with a range of the stream at args[0] for XRANGE and
+// XREVRANGE, which takes the end of the range first and replies with it
+// backwards
+func xrange(rs *RedisServer, cl *RedisClient, args []string, rev bool) bool {
+	c := cl.conn
+	startArg, endArg := args[1], args[2]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, err := parseRangeStart(startArg)
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	end, err := parseRangeEnd(endArg)
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	count := -1
+	if len(args) > 3 {
+		if len(args) != 5 || strings.ToUpper(args[3]) != "COUNT" {
+			return replySimpleError(c, errSyntax.Error())
+		}
+		if count, err = strconv.Atoi(args[4]); err != nil {
+			return replyInvalidTypeIntegerError(c)
+		}
+		if count < 0 {
+			count = 0
+		}
+	}
+	st, ok := rs.store[cl.db].x[args[0]]
+	if !ok {
+		return replyEmptySetOrList(c)
+	}
+	entries := st.rangeEntries(start, end, count, rev)
+	if len(entries) == 0 {
+		return replyEmptySetOrList(c)
+	}
+	_, err = c.Write(appendStreamEntries(nil, entries))
+	return isNil(err)
+}
+
+func xrangeCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return xrange(rs, cl, args, false)
+}
+
+func xrevrangeCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return xrange(rs, cl, args, true)
+}
+
+func xdelCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	ids := make([]streamID, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return replySimpleError(cl.conn, err.Error())
+		}
+		ids = append(ids, id)
+	}
+	n := rs.xdel(rs.store[cl.db], args[0], ids)
+	return replyInteger(cl.conn, strconv.Itoa(n))
+}
+
+func xtrimCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	if strategy := strings.ToUpper(args[1]); strategy != "MAXLEN" && strategy != "MINID" {
+		return replySimpleError(c, errSyntax.Error())
+	}
+	t, next, err := parseStreamTrim(args, 1)
+	if err == nil && next != len(args) {
+		err = errSyntax
+	}
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	n := rs.xtrim(rs.store[cl.db], args[0], t)
+	return replyInteger(c, strconv.Itoa(n))
+}
+
+func xsetidCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	id, err := parseStreamID(args[1], 0)
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	db := rs.store[cl.db]
+	st, ok := db.x[args[0]]
+	if !ok {
+		return replyNoSuchKey(c)
+	}
+	if n := len(st.entries); n > 0 && id.less(st.entries[n-1].id) {
+		return replySimpleError(c, errXsetidTooSmall.Error())
+	}
+	rs.xsetid(db, args[0], id)
+	return replyOK(c)
+}
+
+// xreadCommand reads the entries after an id from one or more streams:
+//
+//	XREAD [COUNT count] [BLOCK ms] STREAMS key [key ...] id [id ...]
+//
+// An id of $ is the last id of the stream when XREAD was called. With BLOCK
+// the client waits up to ms (forever for 0) for an entry when none is there
+func xreadCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	count := -1
+	block := false
+	var deadline time.Time
+	i := 0
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "STREAMS":
+			break options
+		case "COUNT", "BLOCK":
+			if i+1 >= len(args) {
+				return replySimpleError(c, errSyntax.Error())
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return replyInvalidTypeIntegerError(c)
+			}
+			if strings.ToUpper(args[i]) == "COUNT" {
+				count = int(n)
+				if count < 0 {
+					count = 0
+				}
+			} else {
+				if n < 0 {
+					return replySimpleError(c, errNegativeTimeout.Error())
+				}
+				block = true
+				if n > 0 {
+					deadline = time.Now().Add(time.Duration(n) * time.Millisecond)
+				}
+			}
+			i++
+		default:
+			return replySimpleError(c, errSyntax.Error())
+		}
+	}
+	if i == len(args) {
+		return replySimpleError(c, errSyntax.Error())
+	}
+	streams := args[i+1:]
+	if len(streams) == 0 || len(streams)%2 != 0 {
+		return replySimpleError(c, errUnbalancedXreadIDs.Error())
+	}
+	keys, idArgs := streams[:len(streams)/2], streams[len(streams)/2:]
+	if err := rs.prepareKeys(cl, keys, tStream); err != nil {
+		return replySimpleError(c, err.Error())
+	}
+
+	// $ is only looked up once so a blocked read waits for entries added
+	// after it was called
+	ids := make([]streamID, len(keys))
+	for j, arg := range idArgs {
+		if arg == "$" {
+			if st, ok := rs.store[cl.db].x[keys[j]]; ok {
+				ids[j] = st.lastID
+			}
+			continue
+		}
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return replySimpleError(c, err.Error())
+		}
+		ids[j] = id
+	}
+
+	for {
+		db := rs.store[cl.db]
+		var buf []byte
+		n := 0
+		for j, key := range keys {
+			st, ok := db.x[key]
+			if !ok {
+				continue
+			}
+			start, ok := ids[j].next()
+			if !ok {
+				continue
+			}
+			entries := st.rangeEntries(start, maxStreamID, count, false)
+			if len(entries) == 0 {
+				continue
+			}
+			buf = append(buf, "*2"+Delimeter...)
+			buf = appendBulkString(buf, key)
+			buf = appendStreamEntries(buf, entries)
+			n++
+		}
+		if n > 0 {
+			_, err := c.Write(append([]byte("*"+strconv.Itoa(n)+Delimeter), buf...))
+			return isNil(err)
+		}
+		if !block || !rs.blockClient(cl, keys, deadline) {
+			return replyEmptySetOrList(c)
+		}
+		// the keys may have expired or gone cold while the lock was released
+		if err := rs.prepareKeys(cl, keys, tStream); err != nil {
+			return replySimpleError(c, err.Error())
+		}
+	}
+}
@@ -0,0 +1,986 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A consumer group hands the entries of a stream out to a set of consumers so
+// every entry goes to just one of them. The group remembers the id of the
+// last entry it handed out, and every entry it hands out stays in its pending
+// entries list (PEL) until the consumer acknowledges it with XACK. An entry a
+// consumer never acknowledges can be claimed by another one once it has been
+// idle long enough, so every entry is processed at least once
+
+var (
+	errBusyGroup               = errors.New("BUSYGROUP Consumer Group name already exists")
+	errXgroupNoKey             = errors.New("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	errUnbalancedXreadgroupIDs = errors.New("ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified.")
+	errInvalidMinIdleTime      = errors.New("ERR Invalid min-idle-time argument for XCLAIM")
+	errXautoclaimCount         = errors.New("ERR COUNT must be > 0")
+)
+
+// errNoGroup is the error for a stream or group that does not exist
+func errNoGroup(key, group string) error {
+	return fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+}
+
+// streamPending is an entry of the PEL of a group
+type streamPending struct {
+	consumer string
+	// deliveryTime is the unix time in ms the entry was last delivered at
+	deliveryTime  int64
+	deliveryCount int64
+}
+
+// streamConsumer is a consumer of a group, its pending entries are the ones
+// in the PEL of the group that name it
+type streamConsumer struct {
+	// seenTime is the unix time in ms the consumer last read or claimed at
+	seenTime int64
+}
+
+// streamGroup is a consumer group of a stream
+type streamGroup struct {
+	// lastID is the id of the last entry delivered to the group
+	lastID    streamID
+	pending   map[streamID]*streamPending
+	consumers map[string]*streamConsumer
+}
+
+func newStreamGroup(lastID streamID) *streamGroup {
+	return &streamGroup{
+		lastID:    lastID,
+		pending:   make(map[streamID]*streamPending),
+		consumers: make(map[string]*streamConsumer),
+	}
+}
+
+// clone returns a copy of the group that can be changed without changing g
+func (g *streamGroup) clone() *streamGroup {
+	c := newStreamGroup(g.lastID)
+	for id, p := range g.pending {
+		cp := *p
+		c.pending[id] = &cp
+	}
+	for name, cons := range g.consumers {
+		cc := *cons
+		c.consumers[name] = &cc
+	}
+	return c
+}
+
+// consumer returns the consumer called name and reports whether it had to be
+// added to the group
+func (g *streamGroup) consumer(name string, now int64) (*streamConsumer, bool) {
+	if cons, ok := g.consumers[name]; ok {
+		return cons, false
+	}
+	cons := &streamConsumer{seenTime: now}
+	g.consumers[name] = cons
+	return cons, true
+}
+
+// deliver adds id to the PEL as delivered to consumer at now. An entry that
+// was pending already starts over with the new consumer
+func (g *streamGroup) deliver(id streamID, consumer string, now int64) *streamPending {
+	p := &streamPending{consumer: consumer, deliveryTime: now, deliveryCount: 1}
+	g.pending[id] = p
+	return p
+}
+
+// pendingIDs returns the ids in the PEL from start to end in order, only the
+// ones of consumer when it is not empty
+func (g *streamGroup) pendingIDs(start, end streamID, consumer string) []streamID {
+	var ids []streamID
+	for id, p := range g.pending {
+		if id.less(start) || end.less(id) || (consumer != "" && p.consumer != consumer) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+	return ids
+}
+
+// pendingCounts returns how many entries of the PEL each consumer has
+func (g *streamGroup) pendingCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, p := range g.pending {
+		counts[p.consumer]++
+	}
+	return counts
+}
+
+// sortedGroups returns the names of the groups of st in order
+func (st *stream) sortedGroups() []string {
+	names := make([]string, 0, len(st.groups))
+	for name := range st.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadGroup adds a group read back from a save
+func (st *stream) loadGroup(name, lastID string) error {
+	id, err := parseStreamID(lastID, 0)
+	if err != nil {
+		return err
+	}
+	st.groups[name] = newStreamGroup(id)
+	return nil
+}
+
+// loadConsumer adds a consumer read back from a save, its group has to be
+// loaded first
+func (st *stream) loadConsumer(group, name string, seenTime int64) {
+	if g, ok := st.groups[group]; ok {
+		g.consumers[name] = &streamConsumer{seenTime: seenTime}
+	}
+}
+
+// loadPending adds a PEL entry read back from a save, its group has to be
+// loaded first
+func (st *stream) loadPending(group, entryID, consumer string, deliveryTime, deliveryCount int64) error {
+	g, ok := st.groups[group]
+	if !ok {
+		return nil
+	}
+	id, err := parseStreamID(entryID, 0)
+	if err != nil {
+		return err
+	}
+	g.pending[id] = &streamPending{consumer: consumer, deliveryTime: deliveryTime, deliveryCount: deliveryCount}
+	return nil
+}
+
+// streamGroupJSON is how a group is encoded in the tier db, consumers map to
+// their seen time
+type streamGroupJSON struct {
+	LastID    string              `json:"lastID"`
+	Consumers map[string]int64    `json:"consumers"`
+	Pending   []streamPendingJSON `json:"pending"`
+}
+
+type streamPendingJSON struct {
+	ID            string `json:"id"`
+	Consumer      string `json:"consumer"`
+	DeliveryTime  int64  `json:"deliveryTime"`
+	DeliveryCount int64  `json:"deliveryCount"`
+}
+
+func (g *streamGroup) toJSON() streamGroupJSON {
+	gj := streamGroupJSON{LastID: g.lastID.String(), Consumers: make(map[string]int64, len(g.consumers))}
+	for name, cons := range g.consumers {
+		gj.Consumers[name] = cons.seenTime
+	}
+	for _, id := range g.pendingIDs(streamID{}, maxStreamID, "") {
+		p := g.pending[id]
+		gj.Pending = append(gj.Pending, streamPendingJSON{ID: id.String(), Consumer: p.consumer, DeliveryTime: p.deliveryTime, DeliveryCount: p.deliveryCount})
+	}
+	return gj
+}
+
+// loadJSON adds the group encoded in gj to st
+func (st *stream) loadJSON(name string, gj streamGroupJSON) error {
+	if err := st.loadGroup(name, gj.LastID); err != nil {
+		return err
+	}
+	for consumer, seenTime := range gj.Consumers {
+		st.loadConsumer(name, consumer, seenTime)
+	}
+	for _, p := range gj.Pending {
+		if err := st.loadPending(name, p.ID, p.Consumer, p.DeliveryTime, p.DeliveryCount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Methods for operating on the consumer groups of the stream portion of db
+
+// xgroupCreate adds a group to the stream at key, creating an empty stream
+// when there is none
+func (rs *RedisServer) xgroupCreate(db *DB, key, group string, lastID streamID) {
+	st, ok := db.x[key]
+	if !ok {
+		st = newStream()
+		db.x[key] = st
+		db.tstore[key] = tStream
+	}
+	st.groups[group] = newStreamGroup(lastID)
+	rs.streamModified(db, key)
+}
+
+// streamModified records a change made to the groups of the stream at key
+func (rs *RedisServer) streamModified(db *DB, key string) {
+	rs.dirty++
+	rs.signalModifiedKey(db, key)
+}
+
+// logGroupClaim logs the PEL entry p of id as it is now
+func (rs *RedisServer) logGroupClaim(key, group string, id streamID, p *streamPending) {
+	rs.logAppendOnly(groupClaimCommand(key, group, id, p)...)
+}
+
+// groupClaimCommand is the XCLAIM that puts the PEL entry p of id back as it
+// is
+func groupClaimCommand(key, group string, id streamID, p *streamPending) []string {
+	return []string{"XCLAIM", key, group, p.consumer, "0", id.String(),
+		"TIME", strconv.FormatInt(p.deliveryTime, 10),
+		"RETRYCOUNT", strconv.FormatInt(p.deliveryCount, 10),
+		"FORCE", "JUSTID"}
+}
+
+// appendStreamIDs appends ids as an array of bulk strings
+func appendStreamIDs(buf []byte, ids []streamID) []byte {
+	buf = append(buf, "*"+strconv.Itoa(len(ids))+Delimeter...)
+	for _, id := range ids {
+		buf = appendBulkString(buf, id.String())
+	}
+	return buf
+}
+
+// idleTime is how long ago in ms the unix time in ms t was
+func idleTime(t, now int64) int64 {
+	if t > now {
+		return 0
+	}
+	return now - t
+}
+
+// Commands Operating on Stream Consumer Groups
+
+// xgroupCommand manages the groups of a stream:
+//
+//	XGROUP CREATE key group id|$ [MKSTREAM]
+//	XGROUP SETID key group id|$
+//	XGROUP DESTROY key group
+//	XGROUP CREATECONSUMER key group consumer
+//	XGROUP DELCONSUMER key group consumer
+func xgroupCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	db := rs.store[cl.db]
+	key, group := args[1], args[2]
+	st, ok := db.x[key]
+	// resolveID reads the id of CREATE and SETID where $ is the last id
+	resolveID := func(arg string) (streamID, error) {
+		if arg == "$" {
+			if ok {
+				return st.lastID, nil
+			}
+			return streamID{}, nil
+		}
+		return parseStreamID(arg, 0)
+	}
+	var g *streamGroup
+	if ok {
+		g = st.groups[group]
+	}
+	switch strings.ToUpper(args[0]) {
+	case "CREATE":
+		if len(args) != 4 && len(args) != 5 {
+			return replyInvalidNumberOfArgsError(c, "XGROUP")
+		}
+		if len(args) == 5 && strings.ToUpper(args[4]) != "MKSTREAM" {
+			return replySimpleError(c, errSyntax.Error())
+		}
+		if !ok && len(args) != 5 {
+			return replySimpleError(c, errXgroupNoKey.Error())
+		}
+		id, err := resolveID(args[3])
+		if err != nil {
+			return replySimpleError(c, err.Error())
+		}
+		if g != nil {
+			return replySimpleError(c, errBusyGroup.Error())
+		}
+		rs.xgroupCreate(db, key, group, id)
+		return replyOK(c)
+	case "SETID":
+		if len(args) != 4 {
+			return replyInvalidNumberOfArgsError(c, "XGROUP")
+		}
+		id, err := resolveID(args[3])
+		if err != nil {
+			return replySimpleError(c, err.Error())
+		}
+		if g == nil {
+			return replySimpleError(c, errNoGroup(key, group).Error())
+		}
+		g.lastID = id
+		rs.streamModified(db, key)
+		return replyOK(c)
+	case "DESTROY":
+		if len(args) != 3 {
+			return replyInvalidNumberOfArgsError(c, "XGROUP")
+		}
+		if !ok {
+			return replySimpleError(c, errXgroupNoKey.Error())
+		}
+		if g == nil {
+			return replyInteger(c, "0")
+		}
+		delete(st.groups, group)
+		rs.streamModified(db, key)
+		return replyInteger(c, "1")
+	case "CREATECONSUMER":
+		if len(args) != 4 {
+			return replyInvalidNumberOfArgsError(c, "XGROUP")
+		}
+		if g == nil {
+			return replySimpleError(c, errNoGroup(key, group).Error())
+		}
+		if _, added := g.consumer(args[3], nowMs()); !added {
+			return replyInteger(c, "0")
+		}
+		rs.streamModified(db, key)
+		return replyInteger(c, "1")
+	case "DELCONSUMER":
+		if len(args) != 4 {
+			return replyInvalidNumberOfArgsError(c, "XGROUP")
+		}
+		if g == nil {
+			return replySimpleError(c, errNoGroup(key, group).Error())
+		}
+		if _, ok := g.consumers[args[3]]; !ok {
+			return replyInteger(c, "0")
+		}
+		n := 0
+		for id, p := range g.pending {
+			if p.consumer == args[3] {
+				delete(g.pending, id)
+				n++
+			}
+		}
+		delete(g.consumers, args[3])
+		rs.streamModified(db, key)
+		return replyInteger(c, strconv.Itoa(n))
+	}
+	return replyInvalidCommandError(c)
+}
+
+// xreadgroupCommand reads entries of streams as a consumer of a group:
+//
+//	XREADGROUP GROUP group consumer [COUNT count] [BLOCK ms] [NOACK] STREAMS key [key ...] id [id ...]
+//
+// An id of > reads the entries never delivered to the group and adds them to
+// its PEL unless NOACK is given, only a read of new entries can block. Any
+// other id reads the pending entries of the consumer after it again, an entry
+// that was deleted from the stream since is sent without its fields
+func xreadgroupCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	if strings.ToUpper(args[0]) != "GROUP" {
+		return replySimpleError(c, errSyntax.Error())
+	}
+	group, consumer := args[1], args[2]
+	count := -1
+	block, noack := false, false
+	var deadline time.Time
+	i := 3
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "STREAMS":
+			break options
+		case "NOACK":
+			noack = true
+		case "COUNT", "BLOCK":
+			if i+1 >= len(args) {
+				return replySimpleError(c, errSyntax.Error())
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return replyInvalidTypeIntegerError(c)
+			}
+			if strings.ToUpper(args[i]) == "COUNT" {
+				count = int(n)
+				if count < 0 {
+					count = 0
+				}
+			} else {
+				if n < 0 {
+					return replySimpleError(c, errNegativeTimeout.Error())
+				}
+				block = true
+				if n > 0 {
+					deadline = time.Now().Add(time.Duration(n) * time.Millisecond)
+				}
+			}
+			i++
+		default:
+			return replySimpleError(c, errSyntax.Error())
+		}
+	}
+	if i == len(args) {
+		return replySimpleError(c, errSyntax.Error())
+	}
+	streams := args[i+1:]
+	if len(streams) == 0 || len(streams)%2 != 0 {
+		return replySimpleError(c, errUnbalancedXreadgroupIDs.Error())
+	}
+	keys, idArgs := streams[:len(streams)/2], streams[len(streams)/2:]
+	if err := rs.prepareKeys(cl, keys, tStream); err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	ids := make([]streamID, len(keys))
+	history := false
+	for j, arg := range idArgs {
+		if arg == ">" {
+			continue
+		}
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return replySimpleError(c, err.Error())
+		}
+		ids[j] = id
+		history = true
+	}
+
+	for {
+		db := rs.store[cl.db]
+		// every group is looked up before any is changed so a missing one
+		// does not leave the read half done
+		groups := make([]*streamGroup, len(keys))
+		for j, key := range keys {
+			if st, ok := db.x[key]; ok {
+				groups[j] = st.groups[group]
+			}
+			if groups[j] == nil {
+				return replySimpleError(c, errNoGroup(key, group).Error())
+			}
+		}
+		now := nowMs()
+		var buf []byte
+		n := 0
+		for j, key := range keys {
+			st, g := db.x[key], groups[j]
+			changed := false
+			cons, added := g.consumer(consumer, now)
+			cons.seenTime = now
+			if added {
+				rs.logAppendOnly("XGROUP", "CREATECONSUMER", key, group, consumer)
+				changed = true
+			}
+			var entries []streamEntry
+			if idArgs[j] == ">" {
+				if start, ok := g.lastID.next(); ok {
+					entries = st.rangeEntries(start, maxStreamID, count, false)
+				}
+				for _, e := range entries {
+					if !noack {
+						rs.logGroupClaim(key, group, e.id, g.deliver(e.id, consumer, now))
+					}
+				}
+				if len(entries) > 0 {
+					g.lastID = entries[len(entries)-1].id
+					rs.logAppendOnly("XGROUP", "SETID", key, group, g.lastID.String())
+					changed = true
+				}
+			} else {
+				var pending []streamID
+				if start, ok := ids[j].next(); ok {
+					pending = g.pendingIDs(start, maxStreamID, consumer)
+				}
+				if count >= 0 && len(pending) > count {
+					pending = pending[:count]
+				}
+				for _, id := range pending {
+					p := g.pending[id]
+					p.deliveryTime = now
+					p.deliveryCount++
+					e, ok := st.entry(id)
+					if ok {
+						rs.logGroupClaim(key, group, id, p)
+					} else {
+						e = streamEntry{id: id}
+					}
+					entries = append(entries, e)
+					changed = true
+				}
+			}
+			if changed {
+				rs.streamModified(db, key)
+			}
+			// a read of pending entries always replies with the stream
+			if len(entries) == 0 && idArgs[j] == ">" {
+				continue
+			}
+			buf = append(buf, "*2"+Delimeter...)
+			buf = appendBulkString(buf, key)
+			buf = appendStreamEntries(buf, entries)
+			n++
+		}
+		if n > 0 {
+			_, err := c.Write(append([]byte("*"+strconv.Itoa(n)+Delimeter), buf...))
+			return isNil(err)
+		}
+		if !block || history || !rs.blockClient(cl, keys, deadline) {
+			return replyEmptySetOrList(c)
+		}
+		// the keys may have expired or gone cold while the lock was released
+		if err := rs.prepareKeys(cl, keys, tStream); err != nil {
+			return replySimpleError(c, err.Error())
+		}
+	}
+}
+
+func xackCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	ids := make([]streamID, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return replySimpleError(cl.conn, err.Error())
+		}
+		ids = append(ids, id)
+	}
+	db := rs.store[cl.db]
+	st, ok := db.x[args[0]]
+	if !ok || st.groups[args[1]] == nil {
+		return replyInteger(cl.conn, "0")
+	}
+	g := st.groups[args[1]]
+	n := 0
+	for _, id := range ids {
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			n++
+		}
+	}
+	if n > 0 {
+		rs.streamModified(db, args[0])
+	}
+	return replyInteger(cl.conn, strconv.Itoa(n))
+}
+
+// xpendingCommand looks at the PEL of a group:
+//
+//	XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+//
+// Without a range it replies with the number of pending entries, the
+// smallest and largest of their ids and how many each consumer has
+func xpendingCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	key, group := args[0], args[1]
+	var minIdle int64
+	i := 2
+	if len(args) > 2 && strings.ToUpper(args[2]) == "IDLE" {
+		if len(args) < 4 {
+			return replySimpleError(c, errSyntax.Error())
+		}
+		var err error
+		if minIdle, err = strconv.ParseInt(args[3], 10, 64); err != nil {
+			return replyInvalidTypeIntegerError(c)
+		}
+		i = 4
+	}
+	summary := len(args) == 2
+	if !summary && len(args) != i+3 && len(args) != i+4 {
+		return replySimpleError(c, errSyntax.Error())
+	}
+	var start, end streamID
+	count := 0
+	if !summary {
+		var err error
+		if start, err = parseRangeStart(args[i]); err != nil {
+			return replySimpleError(c, err.Error())
+		}
+		if end, err = parseRangeEnd(args[i+1]); err != nil {
+			return replySimpleError(c, err.Error())
+		}
+		if count, err = strconv.Atoi(args[i+2]); err != nil {
+			return replyInvalidTypeIntegerError(c)
+		}
+	}
+	st, ok := rs.store[cl.db].x[key]
+	if !ok || st.groups[group] == nil {
+		return replySimpleError(c, errNoGroup(key, group).Error())
+	}
+	g := st.groups[group]
+
+	if summary {
+		ids := g.pendingIDs(streamID{}, maxStreamID, "")
+		var buf []byte
+		buf = append(buf, "*4"+Delimeter...)
+		buf = append(buf, ":"+strconv.Itoa(len(ids))+Delimeter...)
+		if len(ids) == 0 {
+			buf = append(buf, emptyBulkString+emptyBulkString+emptySetOrList...)
+			_, err := c.Write(buf)
+			return isNil(err)
+		}
+		buf = appendBulkString(buf, ids[0].String())
+		buf = appendBulkString(buf, ids[len(ids)-1].String())
+		counts := g.pendingCounts()
+		consumers := make([]string, 0, len(counts))
+		for consumer := range counts {
+			consumers = append(consumers, consumer)
+		}
+		sort.Strings(consumers)
+		buf = append(buf, "*"+strconv.Itoa(len(consumers))+Delimeter...)
+		for _, consumer := range consumers {
+			buf = append(buf, "*2"+Delimeter...)
+			buf = appendBulkString(buf, consumer)
+			buf = appendBulkString(buf, strconv.Itoa(counts[consumer]))
+		}
+		_, err := c.Write(buf)
+		return isNil(err)
+	}
+
+	consumer := ""
+	if len(args) == i+4 {
+		consumer = args[i+3]
+	}
+	now := nowMs()
+	var buf []byte
+	n := 0
+	for _, id := range g.pendingIDs(start, end, consumer) {
+		if n >= count {
+			break
+		}
+		p := g.pending[id]
+		idle := idleTime(p.deliveryTime, now)
+		if idle < minIdle {
+			continue
+		}
+		buf = append(buf, "*4"+Delimeter...)
+		buf = appendBulkString(buf, id.String())
+		buf = appendBulkString(buf, p.consumer)
+		buf = append(buf, ":"+strconv.FormatInt(idle, 10)+Delimeter...)
+		buf = append(buf, ":"+strconv.FormatInt(p.deliveryCount, 10)+Delimeter...)
+		n++
+	}
+	if n == 0 {
+		return replyEmptySetOrList(c)
+	}
+	_, err := c.Write(append([]byte("*"+strconv.Itoa(n)+Delimeter), buf...))
+	return isNil(err)
+}
+
+// xclaimCommand hands pending entries over to another consumer:
+//
+//	XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-ms] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID id]
+//
+// Only entries idle for at least min-idle-time are claimed. FORCE adds an
+// entry of the stream to the PEL when it is not there, and an entry that was
+// deleted from the stream is dropped from the PEL instead of being claimed
+func xclaimCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	key, group, consumer := args[0], args[1], args[2]
+	minIdle, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return replySimpleError(c, errInvalidMinIdleTime.Error())
+	}
+	var ids []streamID
+	i := 4
+	for ; i < len(args); i++ {
+		id, err := parseStreamID(args[i], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	now := nowMs()
+	deliveryTime := now
+	retryCount := int64(-1)
+	force, justID := false, false
+	var lastID *streamID
+	for ; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "FORCE":
+			force = true
+		case "JUSTID":
+			justID = true
+		case "IDLE", "TIME", "RETRYCOUNT", "LASTID":
+			if i+1 >= len(args) {
+				return replySimpleError(c, errSyntax.Error())
+			}
+			i++
+			if option == "LASTID" {
+				id, err := parseStreamID(args[i], 0)
+				if err != nil {
+					return replySimpleError(c, err.Error())
+				}
+				lastID = &id
+				continue
+			}
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return replyInvalidTypeIntegerError(c)
+			}
+			switch option {
+			case "IDLE":
+				deliveryTime = now - n
+			case "TIME":
+				deliveryTime = n
+			case "RETRYCOUNT":
+				retryCount = n
+			}
+		default:
+			return replySimpleError(c, fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", args[i]))
+		}
+	}
+	if deliveryTime > now {
+		deliveryTime = now
+	}
+	db := rs.store[cl.db]
+	st, ok := db.x[key]
+	if !ok || st.groups[group] == nil {
+		return replySimpleError(c, errNoGroup(key, group).Error())
+	}
+	g := st.groups[group]
+
+	changed := false
+	cons, added := g.consumer(consumer, now)
+	cons.seenTime = now
+	if added {
+		rs.logAppendOnly("XGROUP", "CREATECONSUMER", key, group, consumer)
+		changed = true
+	}
+	if lastID != nil && g.lastID.less(*lastID) {
+		g.lastID = *lastID
+		rs.logAppendOnly("XGROUP", "SETID", key, group, g.lastID.String())
+		changed = true
+	}
+	var claimed []streamEntry
+	for _, id := range ids {
+		e, exists := st.entry(id)
+		p, ok := g.pending[id]
+		if !ok {
+			if !force || !exists {
+				continue
+			}
+			p = &streamPending{}
+			g.pending[id] = p
+		} else if !exists {
+			delete(g.pending, id)
+			rs.logAppendOnly("XACK", key, group, id.String())
+			changed = true
+			continue
+		} else if minIdle > 0 && idleTime(p.deliveryTime, now) < minIdle {
+			continue
+		}
+		p.consumer = consumer
+		p.deliveryTime = deliveryTime
+		if retryCount >= 0 {
+			p.deliveryCount = retryCount
+		} else if !justID {
+			p.deliveryCount++
+		}
+		rs.logGroupClaim(key, group, id, p)
+		changed = true
+		claimed = append(claimed, e)
+	}
+	if changed {
+		rs.streamModified(db, key)
+	}
+	if len(claimed) == 0 {
+		return replyEmptySetOrList(c)
+	}
+	if !justID {
+		_, err = c.Write(appendStreamEntries(nil, claimed))
+		return isNil(err)
+	}
+	claimedIDs := make([]streamID, len(claimed))
+	for j, e := range claimed {
+		claimedIDs[j] = e.id
+	}
+	_, err = c.Write(appendStreamIDs(nil, claimedIDs))
+	return isNil(err)
+}
+
+// xautoclaimCommand claims the pending entries idle for long enough in id
+// order, like an XCLAIM of the ids XPENDING would list:
+//
+//	XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+//
+// It replies with the id to start the next call at (0-0 once the whole PEL
+// was scanned), the entries claimed and the ids dropped from the PEL because
+// they were deleted from the stream. At most count*10 entries are looked at
+// in one call
+func xautoclaimCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	key, group, consumer := args[0], args[1], args[2]
+	minIdle, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return replySimpleError(c, errInvalidMinIdleTime.Error())
+	}
+	start, err := parseRangeStart(args[4])
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	count := 100
+	justID := false
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "JUSTID":
+			justID = true
+		case "COUNT":
+			if i+1 >= len(args) {
+				return replySimpleError(c, errSyntax.Error())
+			}
+			i++
+			if count, err = strconv.Atoi(args[i]); err != nil {
+				return replyInvalidTypeIntegerError(c)
+			}
+			if count <= 0 {
+				return replySimpleError(c, errXautoclaimCount.Error())
+			}
+		default:
+			return replySimpleError(c, errSyntax.Error())
+		}
+	}
+	db := rs.store[cl.db]
+	st, ok := db.x[key]
+	if !ok || st.groups[group] == nil {
+		return replySimpleError(c, errNoGroup(key, group).Error())
+	}
+	g := st.groups[group]
+
+	now := nowMs()
+	changed := false
+	cons, added := g.consumer(consumer, now)
+	cons.seenTime = now
+	if added {
+		rs.logAppendOnly("XGROUP", "CREATECONSUMER", key, group, consumer)
+		changed = true
+	}
+	pending := g.pendingIDs(start, maxStreamID, "")
+	attempts := count * 10
+	var claimed []streamEntry
+	var deleted []streamID
+	next := streamID{}
+	for j, id := range pending {
+		if len(claimed) == count || attempts == 0 {
+			next = pending[j]
+			break
+		}
+		attempts--
+		p := g.pending[id]
+		e, exists := st.entry(id)
+		if !exists {
+			delete(g.pending, id)
+			rs.logAppendOnly("XACK", key, group, id.String())
+			deleted = append(deleted, id)
+			changed = true
+			continue
+		}
+		if idleTime(p.deliveryTime, now) < minIdle {
+			continue
+		}
+		p.consumer = consumer
+		p.deliveryTime = now
+		if !justID {
+			p.deliveryCount++
+		}
+		rs.logGroupClaim(key, group, id, p)
+		changed = true
+		claimed = append(claimed, e)
+	}
+	if changed {
+		rs.streamModified(db, key)
+	}
+
+	var buf []byte
+	buf = append(buf, "*3"+Delimeter...)
+	buf = appendBulkString(buf, next.String())
+	if justID {
+		claimedIDs := make([]streamID, len(claimed))
+		for j, e := range claimed {
+			claimedIDs[j] = e.id
+		}
+		buf = appendStreamIDs(buf, claimedIDs)
+	} else {
+		buf = appendStreamEntries(buf, claimed)
+	}
+	buf = appendStreamIDs(buf, deleted)
+	_, err = c.Write(buf)
+	return isNil(err)
+}
+
+// xinfoCommand describes a stream, its groups or the consumers of a group:
+//
+//	XINFO STREAM key
+//	XINFO GROUPS key
+//	XINFO CONSUMERS key group
+//
+// Each is replied with as a list of name value pairs
+func xinfoCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	sub := strings.ToUpper(args[0])
+	if sub != "STREAM" && sub != "GROUPS" && sub != "CONSUMERS" {
+		return replyInvalidCommandError(c)
+	}
+	if (sub == "CONSUMERS") != (len(args) == 3) || len(args) > 3 {
+		return replyInvalidNumberOfArgsError(c, "XINFO")
+	}
+	st, ok := rs.store[cl.db].x[args[1]]
+	if !ok {
+		return replyNoSuchKey(c)
+	}
+	var buf []byte
+	switch sub {
+	case "STREAM":
+		buf = append(buf, "*10"+Delimeter...)
+		buf = appendBulkString(buf, "length")
+		buf = append(buf, ":"+strconv.Itoa(len(st.entries))+Delimeter...)
+		buf = appendBulkString(buf, "last-generated-id")
+		buf = appendBulkString(buf, st.lastID.String())
+		buf = appendBulkString(buf, "groups")
+		buf = append(buf, ":"+strconv.Itoa(len(st.groups))+Delimeter...)
+		buf = appendBulkString(buf, "first-entry")
+		if len(st.entries) == 0 {
+			buf = append(buf, emptyBulkString...)
+		} else {
+			buf = appendStreamEntry(buf, st.entries[0])
+		}
+		buf = appendBulkString(buf, "last-entry")
+		if len(st.entries) == 0 {
+			buf = append(buf, emptyBulkString...)
+		} else {
+			buf = appendStreamEntry(buf, st.entries[len(st.entries)-1])
+		}
+	case "GROUPS":
+		buf = append(buf, "*"+strconv.Itoa(len(st.groups))+Delimeter...)
+		for _, name := range st.sortedGroups() {
+			g := st.groups[name]
+			buf = append(buf, "*8"+Delimeter...)
+			buf = appendBulkString(buf, "name")
+			buf = appendBulkString(buf, name)
+			buf = appendBulkString(buf, "consumers")
+			buf = append(buf, ":"+strconv.Itoa(len(g.consumers))+Delimeter...)
+			buf = appendBulkString(buf, "pending")
+			buf = append(buf, ":"+strconv.Itoa(len(g.pending))+Delimeter...)
+			buf = appendBulkString(buf, "last-delivered-id")
+			buf = appendBulkString(buf, g.lastID.String())
+		}
+	case "CONSUMERS":
+		g, ok := st.groups[args[2]]
+		if !ok {
+			return replySimpleError(c, errNoGroup(args[1], args[2]).Error())
+		}
+		names := make([]string, 0, len(g.consumers))
+		for name := range g.consumers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		counts := g.pendingCounts()
+		now := nowMs()
+		buf = append(buf, "*"+strconv.Itoa(len(names))+Delimeter...)
+		for _, name := range names {
+			buf = append(buf, "*6"+Delimeter...)
+			buf = appendBulkString(buf, "name")
+			buf = appendBulkString(buf, name)
+			buf = appendBulkString(buf, "pending")
+			buf = append(buf, ":"+strconv.Itoa(counts[name])+Delimeter...)
+			buf = appendBulkString(buf, "idle")
+			buf = append(buf, ":"+strconv.FormatInt(idleTime(g.consumers[name].seenTime, now), 10)+Delimeter...)
+		}
+	}
+	_, err := c.Write(buf)
+	return isNil(err)
+}
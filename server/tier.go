@@ -0,0 +1,512 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"sc/list"
+	"sync/atomic"
+	"time"
+)
+
+// tierFile is the sqlite db that holds the values of cold keys while
+// maxmemory is set. It only extends memory so it is recreated on every start
+const tierFile = "tier.db"
+
+const (
+	// tierInterval is how often memory use is checked against maxmemory
+	tierInterval = 100 * time.Millisecond
+	// tierSampleSize is how many hot keys per db are looked at to find the
+	// least recently used one to move out
+	tierSampleSize = 16
+	// keyOverhead and elemOverhead are the rough number of bytes a key and an
+	// element of a list or set take on top of their contents
+	keyOverhead  = 64
+	elemOverhead = 16
+)
+
+var errTierBusy = errors.New("ERR cannot change maxmemory while a background save or rewrite is running")
+
+// tierKey identifies a key of one of the dbs
+type tierKey struct {
+	dbIndex int
+	key     string
+}
+
+// tier moves the values of the least recently used keys out to the tier db
+// once the estimated memory use of the dataset is over maxmemory, and brings
+// them back when a command uses them. A cold key stays in its dbs tstore and
+// expires (so KEYS, TYPE, TTL and the like work as usual) and is listed in
+// the dbs cold set while its value lives on disk
+type tier struct {
+	db *sql.DB
+
+	// sizes holds the estimated size of every hot key
+	sizes map[tierKey]int64
+	// stale holds the keys that changed since their size was estimated
+	stale map[tierKey]struct{}
+	// lastAccess is the unix time in milliseconds each key was last used
+	lastAccess map[tierKey]int64
+	// used is the sum of sizes
+	used int64
+
+	// dropKeys and dropDBs are rows that are no longer needed. They are
+	// removed by the next cycle that does not share the tier with a
+	// background save or rewrite
+	dropKeys map[tierKey]struct{}
+	dropDBs  map[int]struct{}
+
+	evicted uint64
+	loaded  uint64
+}
+
+// openTier creates an empty tier db at path
+func openTier(path string) (*tier, error) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	// the tier is rebuilt on every start so there is nothing to sync
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(OFF)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS tier(
+		"dbID" INTEGER NOT NULL,
+		"key" TEXT NOT NULL,
+		"typ" TEXT NOT NULL,
+		"val" TEXT NOT NULL,
+		PRIMARY KEY (dbID, key)
+	);`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &tier{
+		db:         db,
+		sizes:      make(map[tierKey]int64),
+		stale:      make(map[tierKey]struct{}),
+		lastAccess: make(map[tierKey]int64),
+		dropKeys:   make(map[tierKey]struct{}),
+		dropDBs:    make(map[int]struct{}),
+	}, nil
+}
+
+// close closes and removes the tier db
+func (t *tier) close() error {
+	err := t.db.Close()
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(tierFile + suffix)
+	}
+	return err
+}
+
+// estimateSize returns roughly how many bytes key and its value take in db
+func estimateSize(db *DB, key string) int64 {
+	size := int64(keyOverhead + len(key))
+	switch db.tstore[key] {
+	case tString:
+		size += int64(len(db.kv[key]))
+	case tList:
+		for e := db.ll[key].Front(); e != nil; e = e.Next() {
+			size += int64(elemOverhead + len(e.Value))
+		}
+	case tSet:
+		for member := range db.s[key] {
+			size += int64(elemOverhead + len(member))
+		}
+	case tHash:
+		for field, val := range db.h[key] {
+			size += int64(elemOverhead + len(field) + len(val))
+		}
+	case tStream:
+		for _, e := range db.x[key].entries {
+			size += elemOverhead
+			for _, f := range e.fields {
+				size += int64(len(f))
+			}
+		}
+		for name, g := range db.x[key].groups {
+			size += int64(elemOverhead + len(name))
+			for consumer := range g.consumers {
+				size += int64(elemOverhead + len(consumer))
+			}
+			size += int64(elemOverhead * len(g.pending))
+		}
+	case tZset:
+		// every member is in both the dict and the skiplist
+		for member := range db.z[key].dict {
+			size += int64(2*elemOverhead + len(member))
+		}
+	}
+	return size
+}
+
+// keyChanged records that the value of key may have a new size
+func (t *tier) keyChanged(dbIndex int, key string) {
+	t.stale[tierKey{dbIndex, key}] = struct{}{}
+}
+
+// keyModified is called with every key a write path changed. Commands bring
+// the keys they use back first so a cold key is only ever changed by being
+// deleted after it expired, which leaves its row to be dropped
+func (t *tier) keyModified(db *DB, dbIndex int, key string) {
+	if _, cold := db.cold[key]; cold {
+		delete(db.cold, key)
+		t.dropKeys[tierKey{dbIndex, key}] = struct{}{}
+	}
+	t.keyChanged(dbIndex, key)
+}
+
+// dbReplaced forgets everything about the keys of the db and estimates the
+// size of every key it holds now. The rows of the old cold keys are dropped
+func (t *tier) dbReplaced(dbIndex int, db *DB) {
+	for k, size := range t.sizes {
+		if k.dbIndex == dbIndex {
+			delete(t.sizes, k)
+			delete(t.lastAccess, k)
+			t.used -= size
+		}
+	}
+	for k := range t.stale {
+		if k.dbIndex == dbIndex {
+			delete(t.stale, k)
+		}
+	}
+	for k := range t.dropKeys {
+		if k.dbIndex == dbIndex {
+			delete(t.dropKeys, k)
+		}
+	}
+	t.dropDBs[dbIndex] = struct{}{}
+	for key := range db.tstore {
+		t.keyChanged(dbIndex, key)
+	}
+}
+
+// touch records that a command used key
+func (t *tier) touch(dbIndex int, key string) {
+	t.lastAccess[tierKey{dbIndex, key}] = nowMs()
+}
+
+// updateSizes estimates the size of every key that changed
+func (t *tier) updateSizes(store []*DB) {
+	for k := range t.stale {
+		t.used -= t.sizes[k]
+		delete(t.sizes, k)
+		db := store[k.dbIndex]
+		_, exists := db.tstore[k.key]
+		_, cold := db.cold[k.key]
+		if exists && !cold {
+			size := estimateSize(db, k.key)
+			t.sizes[k] = size
+			t.used += size
+		} else if !exists {
+			delete(t.lastAccess, k)
+		}
+	}
+	t.stale = make(map[tierKey]struct{})
+}
+
+// drop removes the rows that are no longer needed
+func (t *tier) drop() error {
+	for dbIndex := range t.dropDBs {
+		if _, err := t.db.Exec(`DELETE FROM tier WHERE dbID = ?;`, dbIndex); err != nil {
+			return err
+		}
+		delete(t.dropDBs, dbIndex)
+	}
+	for k := range t.dropKeys {
+		if _, err := t.db.Exec(`DELETE FROM tier WHERE dbID = ? AND key = ?;`, k.dbIndex, k.key); err != nil {
+			return err
+		}
+		delete(t.dropKeys, k)
+	}
+	return nil
+}
+
+// coldest returns the least recently used hot key out of a sample from every
+// db. ok is false when there are no hot keys left
+func (t *tier) coldest() (k tierKey, ok bool) {
+	sampled := make(map[int]int)
+	var oldest int64
+	// map iteration order is random which gives us our sample
+	for candidate := range t.sizes {
+		if sampled[candidate.dbIndex] == tierSampleSize {
+			continue
+		}
+		sampled[candidate.dbIndex]++
+		at := t.lastAccess[candidate]
+		if !ok || at < oldest {
+			k, oldest, ok = candidate, at, true
+		}
+	}
+	return k, ok
+}
+
+// encodeValue turns the value of key into the text stored in the tier db
+func encodeValue(db *DB, key string) (string, error) {
+	switch db.tstore[key] {
+	case tString:
+		return db.kv[key], nil
+	case tList:
+		b, err := json.Marshal(listValues(db.ll[key]))
+		return string(b), err
+	case tSet:
+		members := make([]string, 0, len(db.s[key]))
+		for member := range db.s[key] {
+			members = append(members, member)
+		}
+		b, err := json.Marshal(members)
+		return string(b), err
+	case tHash:
+		b, err := json.Marshal(db.h[key])
+		return string(b), err
+	case tStream:
+		b, err := json.Marshal(db.x[key].toJSON())
+		return string(b), err
+	case tZset:
+		// scores are kept as text since json has no infinity
+		scores := make(map[string]string, len(db.z[key].dict))
+		for member, score := range db.z[key].dict {
+			scores[member] = formatScore(score)
+		}
+		b, err := json.Marshal(scores)
+		return string(b), err
+	}
+	return "", errors.New("unknown type " + string(db.tstore[key]))
+}
+
+// decodeValue puts a value read from the tier db back into db
+func decodeValue(db *DB, key string, typ dbTyp, val string) error {
+	switch typ {
+	case tString:
+		db.kv[key] = val
+		return nil
+	case tList:
+		var elems []string
+		if err := json.Unmarshal([]byte(val), &elems); err != nil {
+			return err
+		}
+		l := list.New()
+		for _, elem := range elems {
+			l.PushBack(elem)
+		}
+		db.ll[key] = l
+		return nil
+	case tSet:
+		var members []string
+		if err := json.Unmarshal([]byte(val), &members); err != nil {
+			return err
+		}
+		set := make(map[string]struct{}, len(members))
+		for _, member := range members {
+			set[member] = struct{}{}
+		}
+		db.s[key] = set
+		return nil
+	case tHash:
+		var fields map[string]string
+		if err := json.Unmarshal([]byte(val), &fields); err != nil {
+			return err
+		}
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		db.h[key] = fields
+		return nil
+	case tStream:
+		var sj streamJSON
+		if err := json.Unmarshal([]byte(val), &sj); err != nil {
+			return err
+		}
+		st, err := sj.toStream()
+		if err != nil {
+			return err
+		}
+		db.x[key] = st
+		return nil
+	case tZset:
+		var scores map[string]string
+		if err := json.Unmarshal([]byte(val), &scores); err != nil {
+			return err
+		}
+		z := newZset()
+		for member, s := range scores {
+			score, err := parseScore(s)
+			if err != nil {
+				return err
+			}
+			z.set(member, score)
+		}
+		db.z[key] = z
+		return nil
+	}
+	return errors.New("unknown type " + string(typ))
+}
+
+// evict moves the value of the hot key k out to the tier db
+func (t *tier) evict(tx *sql.Tx, db *DB, k tierKey) error {
+	val, err := encodeValue(db, k.key)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO tier(dbID, key, typ, val) VALUES (?, ?, ?, ?);`, k.dbIndex, k.key, string(db.tstore[k.key]), val)
+	if err != nil {
+		return err
+	}
+	delete(db.kv, k.key)
+	delete(db.ll, k.key)
+	delete(db.s, k.key)
+	delete(db.h, k.key)
+	delete(db.x, k.key)
+	delete(db.z, k.key)
+	db.cold[k.key] = struct{}{}
+	t.used -= t.sizes[k]
+	delete(t.sizes, k)
+	t.evicted++
+	return nil
+}
+
+// readValue reads the value of a cold key into db
+func (t *tier) readValue(dbIndex int, db *DB, key string) error {
+	var typ, val string
+	row := t.db.QueryRow(`SELECT typ, val FROM tier WHERE dbID = ? AND key = ?;`, dbIndex, key)
+	if err := row.Scan(&typ, &val); err != nil {
+		return err
+	}
+	return decodeValue(db, key, dbTyp(typ), val)
+}
+
+// valueDB returns a DB that holds the value of key of db. That is db itself
+// for a hot key (or when there is no tier), for a cold key it is a DB of its
+// own with the value read from the tier. Only reads the tier db so it can
+// be used on a frozen copy of the store while clients keep running
+func (t *tier) valueDB(dbIndex int, db *DB, key string) (*DB, error) {
+	if _, cold := db.cold[key]; t == nil || !cold {
+		return db, nil
+	}
+	vdb := NewDB()
+	vdb.tstore[key] = db.tstore[key]
+	if at, ok := db.expires[key]; ok {
+		vdb.expires[key] = at
+	}
+	if err := t.readValue(dbIndex, vdb, key); err != nil {
+		return nil, err
+	}
+	return vdb, nil
+}
+
+// tierPaused reports whether a background job reads the tier, in which case
+// no rows may be written or removed
+func (rs *RedisServer) tierPaused() bool {
+	return atomic.LoadInt32(&rs.bgsaveInProgress) == 1 || atomic.LoadInt32(&rs.aofRewriteInProgress) == 1
+}
+
+// loadIfCold brings the value of key back into memory when it is cold. The
+// caller must hold rs.lock
+func (rs *RedisServer) loadIfCold(db *DB, key string) error {
+	if _, cold := db.cold[key]; !cold {
+		return nil
+	}
+	dbIndex := rs.dbIndex(db)
+	if err := rs.tier.readValue(dbIndex, db, key); err != nil {
+		return err
+	}
+	delete(db.cold, key)
+	k := tierKey{dbIndex, key}
+	rs.tier.dropKeys[k] = struct{}{}
+	rs.tier.keyChanged(dbIndex, key)
+	rs.tier.loaded++
+	return nil
+}
+
+// enforceMaxmemory moves the least recently used keys out to the tier db
+// until the dataset fits in maxmemory again. The caller must hold rs.lock
+func (rs *RedisServer) enforceMaxmemory() error {
+	t := rs.tier
+	t.updateSizes(rs.store)
+	if rs.tierPaused() {
+		return nil
+	}
+	if err := t.drop(); err != nil {
+		return err
+	}
+	if t.used <= rs.config.maxmemory {
+		return nil
+	}
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	for t.used > rs.config.maxmemory {
+		k, ok := t.coldest()
+		if !ok {
+			break
+		}
+		if err := t.evict(tx, rs.store[k.dbIndex], k); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// tierCycle is the background job that keeps the dataset under maxmemory
+func (rs *RedisServer) tierCycle() {
+	ticker := time.NewTicker(tierInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+		}
+		rs.lock.Lock()
+		if rs.tier != nil {
+			if err := rs.enforceMaxmemory(); err != nil {
+				serverLog(logWarning, "Failed to Move Keys to the Tier: %v\n", err)
+			}
+		}
+		rs.lock.Unlock()
+	}
+}
+
+// startTier starts keeping the dataset under maxmemory. The caller must hold
+// rs.lock
+func (rs *RedisServer) startTier() error {
+	t, err := openTier(tierFile)
+	if err != nil {
+		return err
+	}
+	for i, db := range rs.store {
+		for key := range db.tstore {
+			t.keyChanged(i, key)
+		}
+	}
+	rs.tier = t
+	return nil
+}
+
+// stopTier brings every cold key back into memory and removes the tier db.
+// The caller must hold rs.lock
+func (rs *RedisServer) stopTier() error {
+	if rs.tier == nil {
+		return nil
+	}
+	if rs.tierPaused() {
+		return errTierBusy
+	}
+	for _, db := range rs.store {
+		for key := range db.cold {
+			if err := rs.loadIfCold(db, key); err != nil {
+				return err
+			}
+		}
+	}
+	err := rs.tier.close()
+	rs.tier = nil
+	return err
+}
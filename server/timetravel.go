@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sc/list"
+	"strconv"
+)
+
+var (
+	errNoSuchSnapshot = errors.New("ERR no such snapshot")
+	errNoSnapshotAt   = errors.New("ERR no snapshot at or before that time")
+)
+
+// resolveSnapshot finds the snapshot that ref refers to. ref is either a
+// saveID or a unix time, in which case the newest snapshot taken at or before
+// that time is used
+func resolveSnapshot(saveDb *sql.DB, ref string) (snapshotInfo, error) {
+	snap := snapshotInfo{}
+	if at, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		row := saveDb.QueryRow(`SELECT saveID, lastsave FROM lastsave WHERE lastsave <= ? ORDER BY lastsave DESC, rowid DESC LIMIT 1;`, at)
+		err := row.Scan(&snap.saveID, &snap.lastsave)
+		if err == sql.ErrNoRows {
+			return snap, errNoSnapshotAt
+		}
+		return snap, err
+	}
+	row := saveDb.QueryRow(`SELECT saveID, lastsave FROM lastsave WHERE saveID = ?;`, ref)
+	err := row.Scan(&snap.saveID, &snap.lastsave)
+	if err == sql.ErrNoRows {
+		return snap, errNoSuchSnapshot
+	}
+	return snap, err
+}
+
+// readKeyAt reads a single key of db dbIndex as it was in snap. The key is
+// returned in a DB of its own so the usual db helpers can be used on it. A
+// key that had already expired when the snapshot was taken is left out
+func readKeyAt(saveDb *sql.DB, snap snapshotInfo, dbIndex int, key string) (*DB, error) {
+	db := NewDB()
+
+	var typ string
+	row := saveDb.QueryRow(`SELECT typ FROM typeStore WHERE saveID = ? AND dbID = ? AND key = ?;`, snap.saveID, dbIndex, key)
+	err := row.Scan(&typ)
+	if err == sql.ErrNoRows {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var expireAt int64
+	row = saveDb.QueryRow(`SELECT expireAt FROM expireStore WHERE saveID = ? AND dbID = ? AND key = ?;`, snap.saveID, dbIndex, key)
+	err = row.Scan(&expireAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil && expireAt <= snap.lastsave*1000 {
+		return db, nil
+	}
+
+	db.tstore[key] = dbTyp(typ)
+	var rows *sql.Rows
+	switch dbTyp(typ) {
+	case tString:
+		var val string
+		row := saveDb.QueryRow(`SELECT val FROM kvStore WHERE saveID = ? AND dbID = ? AND key = ?;`, snap.saveID, dbIndex, key)
+		if err := row.Scan(&val); err != nil {
+			return nil, err
+		}
+		db.kv[key] = val
+		return db, nil
+	case tSet:
+		db.s[key] = make(map[string]struct{})
+		rows, err = saveDb.Query(`SELECT val FROM setStore WHERE saveID = ? AND dbID = ? AND key = ?;`, snap.saveID, dbIndex, key)
+	case tList:
+		db.ll[key] = list.New()
+		rows, err = saveDb.Query(`SELECT val FROM listStore WHERE saveID = ? AND dbID = ? AND key = ? ORDER BY elemIndex;`, snap.saveID, dbIndex, key)
+	case tHash:
+		db.h[key] = make(map[string]string)
+		rows, err := saveDb.Query(`SELECT field, val FROM hashStore WHERE saveID = ? AND dbID = ? AND key = ?;`, snap.saveID, dbIndex, key)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var field, val string
+			if err := rows.Scan(&field, &val); err != nil {
+				return nil, err
+			}
+			db.h[key][field] = val
+		}
+		return db, rows.Err()
+	default:
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var val string
+		if err := rows.Scan(&val); err != nil {
+			return nil, err
+		}
+		if dbTyp(typ) == tSet {
+			db.s[key][val] = struct{}{}
+		} else {
+			db.ll[key].PushBack(val)
+		}
+	}
+	return db, rows.Err()
+}
+
+// Commands Operating on Past Snapshots
+//
+// These take a saveID or unix time followed by a key of the clients selected
+// db and reply with the key as it was in that snapshot. The in memory dataset
+// is never touched
+
+// readAt reads key as it was in the snapshot ref for one of the time travel
+// commands. The error returned is ready to be sent to the client
+func readAt(rs *RedisServer, cl *RedisClient, ref, key string) (*DB, error) {
+	saveDb, err := openSaveDB(rs.config.dbFilename)
+	if os.IsNotExist(err) {
+		return nil, errNoSuchSnapshot
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ERR %v", err)
+	}
+	defer saveDb.Close()
+
+	snap, err := resolveSnapshot(saveDb, ref)
+	if err == errNoSuchSnapshot || err == errNoSnapshotAt {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ERR %v", err)
+	}
+	db, err := readKeyAt(saveDb, snap, cl.db, key)
+	if err != nil {
+		return nil, fmt.Errorf("ERR %v", err)
+	}
+	return db, nil
+}
+
+func getatCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db, err := readAt(rs, cl, args[0], args[1])
+	if err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	switch rs.getDBType(db, args[1]) {
+	case tNone:
+		return replyEmptyBulkString(cl.conn)
+	case tString:
+		val, _ := rs.get(db, args[1])
+		return replyBulkString(cl.conn, val)
+	}
+	return replyWrongTypeOperationError(cl.conn)
+}
+
+func typeatCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db, err := readAt(rs, cl, args[0], args[1])
+	if err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	return replySimpleString(cl.conn, string(rs.getDBType(db, args[1])))
+}
+
+func lrangeatCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	start, err := strconv.Atoi(args[2])
+	if err != nil {
+		return replyInvalidTypeIntegerError(cl.conn)
+	}
+	end, err := strconv.Atoi(args[3])
+	if err != nil {
+		return replyInvalidTypeIntegerError(cl.conn)
+	}
+	db, err := readAt(rs, cl, args[0], args[1])
+	if err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	switch rs.getDBType(db, args[1]) {
+	case tNone:
+		return replyEmptySetOrList(cl.conn)
+	case tList:
+		val := rs.lrange(db, args[1], start, end)
+		if len(val) == 0 {
+			return replyEmptySetOrList(cl.conn)
+		}
+		return replyMultiBulkString(cl.conn, val)
+	}
+	return replyWrongTypeOperationError(cl.conn)
+}
+
+func smembersatCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db, err := readAt(rs, cl, args[0], args[1])
+	if err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	switch rs.getDBType(db, args[1]) {
+	case tNone:
+		return replyEmptySetOrList(cl.conn)
+	case tSet:
+		val, _ := rs.smembers(db, args[1])
+		return replyMultiBulkString(cl.conn, val)
+	}
+	return replyWrongTypeOperationError(cl.conn)
+}
@@ -0,0 +1,895 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"sc/list"
+	"sync"
+	"time"
+)
+
+// writeThroughFile is the sqlite db that holds the dataset while writethrough
+// is on. Unlike the save db it keeps a single copy of every key which is
+// updated by each write command
+const writeThroughFile = "data.db"
+
+// writeThroughTables are the tables of the write through db, the keyspace
+// table holds the type and ttl of every key and the rest its value
+var writeThroughTables = []string{"keyspace", "strings", "lists", "sets", "hashes", "zsets", "streams", "streamEntries", "streamGroups", "streamConsumers", "streamPending"}
+
+// writeThrough keeps the write through db in step with the dataset. Write
+// paths record the keys they change and flush writes them all at the end of
+// the command in one transaction
+type writeThrough struct {
+	db *sql.DB
+	// keys holds how each key changed since the last flush by db index
+	keys map[int]map[string]*keyChange
+	// replaced holds the dbs that were flushed or restored as a whole since
+	// the last flush, their rows are removed before the keys are written
+	replaced map[int]struct{}
+}
+
+// openWriteThrough opens (and creates if needed) the write through db at path
+func openWriteThrough(path string) (*writeThrough, error) {
+	// WAL lets the commit of each command be a single append and
+	// synchronous=FULL syncs it before the commit returns
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// every command is applied in order by the one connection
+	db.SetMaxOpenConns(1)
+	tables := []string{
+		`CREATE TABLE IF NOT EXISTS keyspace(
+			"dbID" INTEGER NOT NULL,
+			"key" TEXT NOT NULL,
+			"typ" TEXT NOT NULL,
+			"expireAt" INTEGER,
+			PRIMARY KEY (dbID, key)
+		);`,
+		`CREATE TABLE IF NOT EXISTS strings(
+			"dbID" INTEGER NOT NULL,
+			"key" TEXT NOT NULL,
+			"val" TEXT NOT NULL,
+			PRIMARY KEY (dbID, key)
+		);`,
+		`CREATE TABLE IF NOT EXISTS lists(
+			"dbID" INTEGER NOT NULL,
+			"key" TEXT NOT NULL,
+			"elemIndex" INTEGER NOT NULL,
+			"val" TEXT NOT NULL,
+			PRIMARY KEY (dbID, key, elemIndex)
+		);`,
+		`CREATE TABLE IF NOT EXISTS sets(
+			"dbID" INTEGER NOT NULL,
+			"key" TEXT NOT NULL,
+			"member" TEXT NOT NULL,
+			PRIMARY KEY (dbID, key, member)
+		);`,
+		`CREATE TABLE IF NOT EXISTS hashes(
+			"dbID" INTEGER NOT NULL,
+			"key" TEXT NOT NULL,
+			"field" TEXT NOT NULL,
+			"val" TEXT NOT NULL,
+			PRIMARY KEY (dbID, key, field)
+		);`,
+		`CREATE TABLE IF NOT EXISTS zsets(
+			"dbID" INTEGER NOT NULL,
+			"key" TEXT NOT NULL,
+			"member" TEXT NOT NULL,
+			"score" TEXT NOT NULL,
+			PRIMARY KEY (dbID, key, member)
+		);`,
+		`CREATE TABLE IF NOT EXISTS streams(
+			"dbID" INTEGER NOT NULL,
+			"key" TEXT NOT NULL,
+			"lastID" TEXT NOT NULL,
+			PRIMARY KEY (dbID, key)
+		);`,
+		`CREATE TABLE IF NOT EXISTS streamEntries(
+			"dbID" INTEGER NOT NULL,
+			"key" TEXT NOT NULL,
+			"entryIndex" INTEGER NOT NULL,
+			"entryID" TEXT NOT NULL,
+			"fieldIndex" INTEGER NOT NULL,
+			"field" TEXT NOT NULL,
+			"val" TEXT NOT NULL,
+			PRIMARY KEY (dbID, key, entryIndex, fieldIndex)
+		);`,
+		`CREATE TABLE IF NOT EXISTS streamGroups(
+			"dbID" INTEGER NOT NULL,
+			"key" TEXT NOT NULL,
+			"groupName" TEXT NOT NULL,
+			"lastID" TEXT NOT NULL,
+			PRIMARY KEY (dbID, key, groupName)
+		);`,
+		`CREATE TABLE IF NOT EXISTS streamConsumers(
+			"dbID" INTEGER NOT NULL,
+			"key" TEXT NOT NULL,
+			"groupName" TEXT NOT NULL,
+			"consumer" TEXT NOT NULL,
+			"seenTime" INTEGER NOT NULL,
+			PRIMARY KEY (dbID, key, groupName, consumer)
+		);`,
+		`CREATE TABLE IF NOT EXISTS streamPending(
+			"dbID" INTEGER NOT NULL,
+			"key" TEXT NOT NULL,
+			"groupName" TEXT NOT NULL,
+			"entryID" TEXT NOT NULL,
+			"consumer" TEXT NOT NULL,
+			"deliveryTime" INTEGER NOT NULL,
+			"deliveryCount" INTEGER NOT NULL,
+			PRIMARY KEY (dbID, key, groupName, entryID)
+		);`,
+	}
+	for _, tableSQL := range tables {
+		if _, err := db.Exec(tableSQL); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &writeThrough{
+		db:       db,
+		keys:     make(map[int]map[string]*keyChange),
+		replaced: make(map[int]struct{}),
+	}, nil
+}
+
+func (wt *writeThrough) close() error {
+	return wt.db.Close()
+}
+
+// keyChange is how a key changed since the last flush. A key changed in a way
+// that is not recorded element by element is rewritten as a whole, otherwise
+// only its keyspace row and the elements that changed are written so a small
+// change to a big key stays small
+type keyChange struct {
+	rewrite bool
+	// members holds the hash fields, set members and sorted set members that
+	// were added, changed or removed
+	members map[string]struct{}
+	// listOps holds the pushes and pops of a list in the order they ran
+	listOps []listOp
+	// appended counts the entries added to the end of a stream
+	appended int
+}
+
+// listOp is a push onto or a pop off one end of a list
+type listOp struct {
+	push, left bool
+	// val is the element a push added
+	val string
+}
+
+// change returns the change of key of db dbIndex to record a write in
+func (wt *writeThrough) change(dbIndex int, key string) *keyChange {
+	keys, ok := wt.keys[dbIndex]
+	if !ok {
+		keys = make(map[string]*keyChange)
+		wt.keys[dbIndex] = keys
+	}
+	c, ok := keys[key]
+	if !ok {
+		c = &keyChange{}
+		keys[key] = c
+	}
+	return c
+}
+
+// dbReplaced records that every row of the db has to be rewritten from db
+func (wt *writeThrough) dbReplaced(dbIndex int, db *DB) {
+	wt.replaced[dbIndex] = struct{}{}
+	wt.keys[dbIndex] = make(map[string]*keyChange, len(db.tstore))
+	for key := range db.tstore {
+		wt.keys[dbIndex][key] = &keyChange{rewrite: true}
+	}
+}
+
+// pending reports whether anything changed since the last flush
+func (wt *writeThrough) pending() bool {
+	return len(wt.keys) > 0 || len(wt.replaced) > 0
+}
+
+// flush writes every changed key of store to the write through db in one
+// transaction, reading the values of cold keys from t. When it fails the
+// changes are kept to be tried again with the next flush
+func (wt *writeThrough) flush(store []*DB, t *tier) error {
+	if !wt.pending() {
+		return nil
+	}
+	tx, err := wt.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := wt.writeChanges(tx, store, t); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	wt.keys = make(map[int]map[string]*keyChange)
+	wt.replaced = make(map[int]struct{})
+	return nil
+}
+
+func (wt *writeThrough) writeChanges(tx *sql.Tx, store []*DB, t *tier) error {
+	for dbIndex := range wt.replaced {
+		for _, table := range writeThroughTables {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE dbID = ?;`, dbIndex); err != nil {
+				return err
+			}
+		}
+	}
+
+	deletes := make([]*sql.Stmt, 0, len(writeThroughTables))
+	defer func() {
+		for _, stmt := range deletes {
+			stmt.Close()
+		}
+	}()
+	for _, table := range writeThroughTables {
+		stmt, err := tx.Prepare(`DELETE FROM ` + table + ` WHERE dbID = ? AND key = ?;`)
+		if err != nil {
+			return err
+		}
+		deletes = append(deletes, stmt)
+	}
+
+	for dbIndex, keys := range wt.keys {
+		db := store[dbIndex]
+		for key, c := range keys {
+			vdb, err := t.valueDB(dbIndex, db, key)
+			if err != nil {
+				return err
+			}
+			if _, ok := vdb.tstore[key]; ok && !c.rewrite {
+				if err := writeKeyChange(tx, dbIndex, vdb, key, c); err != nil {
+					return err
+				}
+				continue
+			}
+			// the key is written from scratch, which also covers deletes
+			for _, stmt := range deletes {
+				if _, err := stmt.Exec(dbIndex, key); err != nil {
+					return err
+				}
+			}
+			if err := writeKeyRows(tx, dbIndex, vdb, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeKeyChange writes the keyspace row of key as it is in db along with
+// only the elements c records as changed
+func writeKeyChange(tx *sql.Tx, dbIndex int, db *DB, key string, c *keyChange) error {
+	var expireAt interface{}
+	if at, ok := db.expires[key]; ok {
+		expireAt = at
+	}
+	_, err := tx.Exec(`INSERT OR REPLACE INTO keyspace(dbID, key, typ, expireAt) VALUES (?, ?, ?, ?);`, dbIndex, key, string(db.tstore[key]), expireAt)
+	if err != nil {
+		return err
+	}
+	for member := range c.members {
+		switch db.tstore[key] {
+		case tSet:
+			if _, ok := db.s[key][member]; ok {
+				_, err = tx.Exec(`INSERT OR IGNORE INTO sets(dbID, key, member) VALUES (?, ?, ?);`, dbIndex, key, member)
+			} else {
+				_, err = tx.Exec(`DELETE FROM sets WHERE dbID = ? AND key = ? AND member = ?;`, dbIndex, key, member)
+			}
+		case tHash:
+			if val, ok := db.h[key][member]; ok {
+				_, err = tx.Exec(`INSERT OR REPLACE INTO hashes(dbID, key, field, val) VALUES (?, ?, ?, ?);`, dbIndex, key, member, val)
+			} else {
+				_, err = tx.Exec(`DELETE FROM hashes WHERE dbID = ? AND key = ? AND field = ?;`, dbIndex, key, member)
+			}
+		case tZset:
+			if score, ok := db.z[key].dict[member]; ok {
+				_, err = tx.Exec(`INSERT OR REPLACE INTO zsets(dbID, key, member, score) VALUES (?, ?, ?, ?);`, dbIndex, key, member, formatScore(score))
+			} else {
+				_, err = tx.Exec(`DELETE FROM zsets WHERE dbID = ? AND key = ? AND member = ?;`, dbIndex, key, member)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// list elements are numbered outwards from the first one pushed, a push
+	// takes the number past the end it goes on so no other row moves
+	for _, op := range c.listOps {
+		end, step := "MIN", -1
+		if !op.left {
+			end, step = "MAX", 1
+		}
+		if op.push {
+			_, err = tx.Exec(`INSERT INTO lists(dbID, key, elemIndex, val) SELECT ?, ?, COALESCE(`+end+`(elemIndex) + ?, 0), ? FROM lists WHERE dbID = ? AND key = ?;`, dbIndex, key, step, op.val, dbIndex, key)
+		} else {
+			_, err = tx.Exec(`DELETE FROM lists WHERE dbID = ? AND key = ? AND elemIndex = (SELECT `+end+`(elemIndex) FROM lists WHERE dbID = ? AND key = ?);`, dbIndex, key, dbIndex, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if c.appended > 0 {
+		return writeStreamAppend(tx, dbIndex, db.x[key], key, c.appended)
+	}
+	return nil
+}
+
+// writeStreamAppend writes the last n entries of the stream st at key after
+// the entries that are already written
+func writeStreamAppend(tx *sql.Tx, dbIndex int, st *stream, key string, n int) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO streams(dbID, key, lastID) VALUES (?, ?, ?);`, dbIndex, key, st.lastID.String())
+	if err != nil {
+		return err
+	}
+	var next int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(entryIndex) + 1, 0) FROM streamEntries WHERE dbID = ? AND key = ?;`, dbIndex, key).Scan(&next); err != nil {
+		return err
+	}
+	from := len(st.entries) - n
+	if from < 0 {
+		from = 0
+	}
+	for i, e := range st.entries[from:] {
+		for j := 0; j < len(e.fields); j += 2 {
+			_, err := tx.Exec(`INSERT INTO streamEntries(dbID, key, entryIndex, entryID, fieldIndex, field, val) VALUES (?, ?, ?, ?, ?, ?, ?);`, dbIndex, key, next+i, e.id.String(), j/2, e.fields[j], e.fields[j+1])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeKeyRows inserts the rows of key as it is in db. A key that no longer
+// exists has no rows
+func writeKeyRows(tx *sql.Tx, dbIndex int, db *DB, key string) error {
+	typ, ok := db.tstore[key]
+	if !ok {
+		return nil
+	}
+	var expireAt interface{}
+	if at, ok := db.expires[key]; ok {
+		expireAt = at
+	}
+	_, err := tx.Exec(`INSERT INTO keyspace(dbID, key, typ, expireAt) VALUES (?, ?, ?, ?);`, dbIndex, key, string(typ), expireAt)
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case tString:
+		_, err = tx.Exec(`INSERT INTO strings(dbID, key, val) VALUES (?, ?, ?);`, dbIndex, key, db.kv[key])
+	case tList:
+		i := 0
+		for e := db.ll[key].Front(); e != nil && err == nil; e = e.Next() {
+			_, err = tx.Exec(`INSERT INTO lists(dbID, key, elemIndex, val) VALUES (?, ?, ?, ?);`, dbIndex, key, i, e.Value)
+			i++
+		}
+	case tSet:
+		for member := range db.s[key] {
+			if _, err = tx.Exec(`INSERT INTO sets(dbID, key, member) VALUES (?, ?, ?);`, dbIndex, key, member); err != nil {
+				break
+			}
+		}
+	case tHash:
+		for field, val := range db.h[key] {
+			if _, err = tx.Exec(`INSERT INTO hashes(dbID, key, field, val) VALUES (?, ?, ?, ?);`, dbIndex, key, field, val); err != nil {
+				break
+			}
+		}
+	case tZset:
+		for member, score := range db.z[key].dict {
+			if _, err = tx.Exec(`INSERT INTO zsets(dbID, key, member, score) VALUES (?, ?, ?, ?);`, dbIndex, key, member, formatScore(score)); err != nil {
+				break
+			}
+		}
+	case tStream:
+		st := db.x[key]
+		_, err = tx.Exec(`INSERT INTO streams(dbID, key, lastID) VALUES (?, ?, ?);`, dbIndex, key, st.lastID.String())
+		for i, e := range st.entries {
+			for j := 0; j < len(e.fields) && err == nil; j += 2 {
+				_, err = tx.Exec(`INSERT INTO streamEntries(dbID, key, entryIndex, entryID, fieldIndex, field, val) VALUES (?, ?, ?, ?, ?, ?, ?);`, dbIndex, key, i, e.id.String(), j/2, e.fields[j], e.fields[j+1])
+			}
+		}
+		for name, g := range st.groups {
+			if err == nil {
+				_, err = tx.Exec(`INSERT INTO streamGroups(dbID, key, groupName, lastID) VALUES (?, ?, ?, ?);`, dbIndex, key, name, g.lastID.String())
+			}
+			for consumer, cons := range g.consumers {
+				if err == nil {
+					_, err = tx.Exec(`INSERT INTO streamConsumers(dbID, key, groupName, consumer, seenTime) VALUES (?, ?, ?, ?, ?);`, dbIndex, key, name, consumer, cons.seenTime)
+				}
+			}
+			for id, p := range g.pending {
+				if err == nil {
+					_, err = tx.Exec(`INSERT INTO streamPending(dbID, key, groupName, entryID, consumer, deliveryTime, deliveryCount) VALUES (?, ?, ?, ?, ?, ?, ?);`, dbIndex, key, name, id.String(), p.consumer, p.deliveryTime, p.deliveryCount)
+				}
+			}
+		}
+	}
+	return err
+}
+
+// load reads the first databases dbs back from the write through db. Keys
+// that expired while the server was down are left out
+func (wt *writeThrough) load(databases int) ([]*DB, error) {
+	store := make([]*DB, databases)
+	for i := range store {
+		store[i] = NewDB()
+	}
+	dbFor := func(dbID int) *DB {
+		if dbID < 0 || dbID >= len(store) {
+			return nil
+		}
+		return store[dbID]
+	}
+
+	now := nowMs()
+	var dbID int
+	var key, val, typ string
+	var expireAt sql.NullInt64
+	rows, err := wt.db.Query(`SELECT dbID, key, typ, expireAt FROM keyspace;`)
+	if err != nil {
+		return store, err
+	}
+	for rows.Next() {
+		if err := rows.Scan(&dbID, &key, &typ, &expireAt); err != nil {
+			rows.Close()
+			return store, err
+		}
+		db := dbFor(dbID)
+		if db == nil || (expireAt.Valid && expireAt.Int64 <= now) {
+			continue
+		}
+		db.tstore[key] = dbTyp(typ)
+		if expireAt.Valid {
+			db.expires[key] = expireAt.Int64
+		}
+		switch dbTyp(typ) {
+		case tList:
+			db.ll[key] = list.New()
+		case tSet:
+			db.s[key] = make(map[string]struct{})
+		case tHash:
+			db.h[key] = make(map[string]string)
+		case tStream:
+			db.x[key] = newStream()
+		case tZset:
+			db.z[key] = newZset()
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return store, err
+	}
+
+	// value rows of keys left out above are skipped by checking tstore
+	queries := []string{
+		`SELECT dbID, key, val FROM strings;`,
+		`SELECT dbID, key, val FROM lists ORDER BY dbID, key, elemIndex;`,
+		`SELECT dbID, key, member FROM sets;`,
+	}
+	for _, query := range queries {
+		rows, err := wt.db.Query(query)
+		if err != nil {
+			return store, err
+		}
+		for rows.Next() {
+			if err := rows.Scan(&dbID, &key, &val); err != nil {
+				rows.Close()
+				return store, err
+			}
+			db := dbFor(dbID)
+			if db == nil {
+				continue
+			}
+			switch db.tstore[key] {
+			case tString:
+				db.kv[key] = val
+			case tList:
+				db.ll[key].PushBack(val)
+			case tSet:
+				db.s[key][val] = struct{}{}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return store, err
+		}
+	}
+
+	var field string
+	rows, err = wt.db.Query(`SELECT dbID, key, field, val FROM hashes;`)
+	if err != nil {
+		return store, err
+	}
+	for rows.Next() {
+		if err := rows.Scan(&dbID, &key, &field, &val); err != nil {
+			rows.Close()
+			return store, err
+		}
+		if db := dbFor(dbID); db != nil && db.tstore[key] == tHash {
+			db.h[key][field] = val
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return store, err
+	}
+
+	var member, score string
+	rows, err = wt.db.Query(`SELECT dbID, key, member, score FROM zsets;`)
+	if err != nil {
+		return store, err
+	}
+	for rows.Next() {
+		if err := rows.Scan(&dbID, &key, &member, &score); err != nil {
+			rows.Close()
+			return store, err
+		}
+		if db := dbFor(dbID); db != nil && db.tstore[key] == tZset {
+			f, err := parseScore(score)
+			if err != nil {
+				rows.Close()
+				return store, err
+			}
+			db.z[key].set(member, f)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return store, err
+	}
+
+	var lastID string
+	rows, err = wt.db.Query(`SELECT dbID, key, lastID FROM streams;`)
+	if err != nil {
+		return store, err
+	}
+	for rows.Next() {
+		if err := rows.Scan(&dbID, &key, &lastID); err != nil {
+			rows.Close()
+			return store, err
+		}
+		if db := dbFor(dbID); db != nil && db.tstore[key] == tStream {
+			if db.x[key].lastID, err = parseStreamID(lastID, 0); err != nil {
+				rows.Close()
+				return store, err
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return store, err
+	}
+
+	var entryID string
+	rows, err = wt.db.Query(`SELECT dbID, key, entryID, field, val FROM streamEntries ORDER BY dbID, key, entryIndex, fieldIndex;`)
+	if err != nil {
+		return store, err
+	}
+	for rows.Next() {
+		if err := rows.Scan(&dbID, &key, &entryID, &field, &val); err != nil {
+			rows.Close()
+			return store, err
+		}
+		if db := dbFor(dbID); db != nil && db.tstore[key] == tStream {
+			if err := db.x[key].loadField(entryID, field, val); err != nil {
+				rows.Close()
+				return store, err
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return store, err
+	}
+	return store, wt.loadStreamGroups(dbFor)
+}
+
+// loadStreamGroups reads the consumer groups of the streams loaded by load
+// back from the write through db
+func (wt *writeThrough) loadStreamGroups(dbFor func(dbID int) *DB) error {
+	// streamAt returns the stream key of db dbID, nil for a key left out
+	streamAt := func(dbID int, key string) *stream {
+		if db := dbFor(dbID); db != nil && db.tstore[key] == tStream {
+			return db.x[key]
+		}
+		return nil
+	}
+	var dbID int
+	var key, group, lastID string
+	rows, err := wt.db.Query(`SELECT dbID, key, groupName, lastID FROM streamGroups;`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		if err := rows.Scan(&dbID, &key, &group, &lastID); err != nil {
+			rows.Close()
+			return err
+		}
+		if st := streamAt(dbID, key); st != nil {
+			if err := st.loadGroup(group, lastID); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var consumer string
+	var seenTime int64
+	rows, err = wt.db.Query(`SELECT dbID, key, groupName, consumer, seenTime FROM streamConsumers;`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		if err := rows.Scan(&dbID, &key, &group, &consumer, &seenTime); err != nil {
+			rows.Close()
+			return err
+		}
+		if st := streamAt(dbID, key); st != nil {
+			st.loadConsumer(group, consumer, seenTime)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var entryID string
+	var deliveryTime, deliveryCount int64
+	rows, err = wt.db.Query(`SELECT dbID, key, groupName, entryID, consumer, deliveryTime, deliveryCount FROM streamPending;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := rows.Scan(&dbID, &key, &group, &entryID, &consumer, &deliveryTime, &deliveryCount); err != nil {
+			return err
+		}
+		if st := streamAt(dbID, key); st != nil {
+			if err := st.loadPending(group, entryID, consumer, deliveryTime, deliveryCount); err != nil {
+				return err
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// dbIndex returns the index of db in the store or -1 for a db that is not
+// part of the dataset (like one read from a snapshot)
+func (rs *RedisServer) dbIndex(db *DB) int {
+	for i, d := range rs.store {
+		if d == db {
+			return i
+		}
+	}
+	return -1
+}
+
+// signalModifiedKey is called by every write path with the key it changed,
+// write through rewrites the key as a whole. The write paths below record
+// what they changed instead
+func (rs *RedisServer) signalModifiedKey(db *DB, key string) {
+	rs.signalModified(db, key, func(c *keyChange) { c.rewrite = true })
+}
+
+// signalModifiedMembers is called by write paths that only added, changed or
+// removed members of a hash, set or sorted set
+func (rs *RedisServer) signalModifiedMembers(db *DB, key string, members ...string) {
+	rs.signalModified(db, key, func(c *keyChange) {
+		if c.rewrite {
+			return
+		}
+		if c.members == nil {
+			c.members = make(map[string]struct{}, len(members))
+		}
+		for _, member := range members {
+			c.members[member] = struct{}{}
+		}
+	})
+}
+
+// signalModifiedList is called by write paths that pushed onto or popped off
+// one end of a list
+func (rs *RedisServer) signalModifiedList(db *DB, key string, op listOp) {
+	rs.signalModified(db, key, func(c *keyChange) {
+		if !c.rewrite {
+			c.listOps = append(c.listOps, op)
+		}
+	})
+}
+
+// signalStreamAppended is called by write paths that added an entry to the
+// end of a stream
+func (rs *RedisServer) signalStreamAppended(db *DB, key string) {
+	rs.signalModified(db, key, func(c *keyChange) { c.appended++ })
+}
+
+// signalModifiedTTL is called by write paths that only changed the ttl of key
+func (rs *RedisServer) signalModifiedTTL(db *DB, key string) {
+	rs.signalModified(db, key, func(c *keyChange) {})
+}
+
+// signalModified lets everything that follows changes to keys know that key
+// changed, record adds how it changed to what write through writes
+func (rs *RedisServer) signalModified(db *DB, key string, record func(c *keyChange)) {
+	if rs.wt == nil && rs.tier == nil && len(rs.blockedClients) == 0 && len(rs.watchedKeys) == 0 {
+		return
+	}
+	i := rs.dbIndex(db)
+	if i == -1 {
+		return
+	}
+	if rs.wt != nil {
+		record(rs.wt.change(i, key))
+	}
+	if rs.tier != nil {
+		rs.tier.keyModified(db, i, key)
+	}
+	rs.signalKeyAsReady(i, key)
+	rs.touchWatchedKey(i, key)
+}
+
+// signalModifiedDB is called when db is flushed or replaced as a whole
+func (rs *RedisServer) signalModifiedDB(db *DB) {
+	if rs.wt == nil && rs.tier == nil && len(rs.blockedClients) == 0 && len(rs.watchedKeys) == 0 {
+		return
+	}
+	i := rs.dbIndex(db)
+	if i == -1 {
+		return
+	}
+	if rs.wt != nil {
+		rs.wt.dbReplaced(i, db)
+	}
+	if rs.tier != nil {
+		rs.tier.dbReplaced(i, db)
+	}
+	rs.signalDBAsReady(i)
+	rs.touchWatchedDB(i)
+}
+
+// flushWriteThrough writes the changes of the last command to the write
+// through db. The caller must hold rs.lock
+func (rs *RedisServer) flushWriteThrough() error {
+	if rs.wt == nil || !rs.wt.pending() {
+		return nil
+	}
+	start := time.Now()
+	if err := rs.wt.flush(rs.store, rs.tier); err != nil {
+		serverLog(logWarning, "Failed to Write Through: %v\n", err)
+		rs.wtLastWriteStatus = "err"
+		return err
+	}
+	rs.wtLastWriteStatus = "ok"
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		serverLog(logWarning, "Slow Write Through took %v", elapsed)
+	}
+	return nil
+}
+
+// errWriteThroughMisconf is the reply to a write while the changes of an
+// earlier command could not be written through
+var errWriteThroughMisconf = errors.New("MISCONF Errors writing to the write through db, commands that may modify the data set are disabled until it can be written again")
+
+// writeThroughRefuses reports whether a write has to be refused because the
+// dataset has changes the write through db does not have. They are tried
+// again first so writes go on once the db can be written. The caller must
+// hold rs.lock
+func (rs *RedisServer) writeThroughRefuses() bool {
+	if rs.wt == nil || rs.wtLastWriteStatus != "err" {
+		return false
+	}
+	return rs.flushWriteThrough() != nil
+}
+
+// heldConn stands in for the connection of a client while it runs a write
+// command with writethrough on. The replies are held back until the change
+// is in the write through db so a client is never told a write succeeded
+// that a crash would lose
+type heldConn struct {
+	io.ReadWriteCloser
+	// mu guards against the write loop of a subscriber connection, which
+	// wraps this one when the command subscribed
+	mu   sync.Mutex
+	held bool
+	buf  []byte
+}
+
+func (h *heldConn) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.held {
+		h.buf = append(h.buf, p...)
+		return len(p), nil
+	}
+	return h.ReadWriteCloser.Write(p)
+}
+
+// holdReplies holds the replies to cl back until releaseReplies
+func holdReplies(cl *RedisClient) *heldConn {
+	h := &heldConn{ReadWriteCloser: cl.conn, held: true}
+	cl.conn = h
+	return h
+}
+
+// releaseReplies sends the replies held for cl, or an error in their place
+// when err says the write through db could not be written. The connection of
+// cl is put back unless the command subscribed, the heldConn then passes every
+// write straight through
+func releaseReplies(cl *RedisClient, h *heldConn, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.held = false
+	if cl.conn == h {
+		cl.conn = h.ReadWriteCloser
+	}
+	if err != nil {
+		h.buf = []byte(fmt.Sprintf("-ERR Write through failed, the change is not durable: %v%s", err, Delimeter))
+	}
+	if len(h.buf) > 0 {
+		h.ReadWriteCloser.Write(h.buf)
+	}
+	h.buf = nil
+}
+
+// startWriteThrough opens the write through db and writes the whole dataset
+// to it. The caller must hold rs.lock
+func (rs *RedisServer) startWriteThrough() error {
+	wt, err := openWriteThrough(writeThroughFile)
+	if err != nil {
+		return err
+	}
+	for i, db := range rs.store {
+		wt.dbReplaced(i, db)
+	}
+	if err := wt.flush(rs.store, rs.tier); err != nil {
+		wt.close()
+		return err
+	}
+	rs.wt = wt
+	rs.wtLastWriteStatus = "ok"
+	return nil
+}
+
+// stopWriteThrough closes the write through db. The caller must hold rs.lock
+func (rs *RedisServer) stopWriteThrough() error {
+	if rs.wt == nil {
+		return nil
+	}
+	err := rs.wt.close()
+	rs.wt = nil
+	return err
+}
+
+// loadWriteThrough replaces the dataset with the contents of the write
+// through db and keeps it open for the writes that follow
+func (rs *RedisServer) loadWriteThrough() error {
+	wt, err := openWriteThrough(writeThroughFile)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	store, err := wt.load(len(rs.store))
+	if err != nil {
+		wt.close()
+		return err
+	}
+	rs.store = store
+	rs.wt = wt
+	serverLog(logNotice, "Loaded Write Through DB in %v", time.Since(start))
+	return nil
+}
@@ -0,0 +1,865 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"sc/skiplist"
+)
+
+// A sorted set is a set of members that each have a score. The score of a
+// member is kept in a map so it is found in O(1), and the members are kept in
+// a skiplist ordered by score (then by member) so ranges by rank, score or
+// member are found in O(log n)
+
+var (
+	errNotFloat         = errors.New("ERR value is not a valid float")
+	errScoreRange       = errors.New("ERR min or max is not a float")
+	errLexRange         = errors.New("ERR min or max not valid string range item")
+	errScoreNaN         = errors.New("ERR resulting score is not a number (NaN)")
+	errZaddXXNX         = errors.New("ERR XX and NX options at the same time are not compatible")
+	errZaddGTLTNX       = errors.New("ERR GT, LT, and/or NX options at the same time are not compatible")
+	errZaddIncrPair     = errors.New("ERR INCR option supports a single increment-element pair")
+	errZrangeLimit      = errors.New("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	errZrangeWithScores = errors.New("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	errNotPositive      = errors.New("ERR value is out of range, must be positive")
+	errZstoreNoKeys     = errors.New("ERR at least 1 input key is needed for ZUNIONSTORE/ZINTERSTORE")
+	errNotInteger       = errors.New("ERR value is not an integer or out of range")
+)
+
+// zset is the value of a sorted set key
+type zset struct {
+	dict map[string]float64
+	zsl  *skiplist.SkipList
+}
+
+func newZset() *zset {
+	return &zset{dict: make(map[string]float64), zsl: skiplist.New()}
+}
+
+// clone returns a copy of the sorted set that can be changed without
+// changing z
+func (z *zset) clone() *zset {
+	c := newZset()
+	for e := z.zsl.Front(); e != nil; e = e.Next() {
+		c.set(e.Member, e.Score)
+	}
+	return c
+}
+
+// set sets the score of member and reports whether the member is new
+func (z *zset) set(member string, score float64) bool {
+	old, ok := z.dict[member]
+	if !ok {
+		z.zsl.Insert(score, member)
+		z.dict[member] = score
+		return true
+	}
+	if old != score {
+		z.zsl.UpdateScore(old, member, score)
+		z.dict[member] = score
+	}
+	return false
+}
+
+// score returns the score of member, a nil sorted set has no members
+func (z *zset) score(member string) (float64, bool) {
+	if z == nil {
+		return 0, false
+	}
+	score, ok := z.dict[member]
+	return score, ok
+}
+
+// remove removes member and reports whether it was there
+func (z *zset) remove(member string) bool {
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	z.zsl.Delete(score, member)
+	delete(z.dict, member)
+	return true
+}
+
+// rank returns the rank of member counting from 0 at the lowest score, or at
+// the highest score with rev set
+func (z *zset) rank(member string, rev bool) (int, bool) {
+	score, ok := z.dict[member]
+	if !ok {
+		return 0, false
+	}
+	rank := z.zsl.Rank(score, member)
+	if rev {
+		return z.zsl.Len() - rank, true
+	}
+	return rank - 1, true
+}
+
+// rangeByIndex returns the elements from index start to stop, which count
+// from the end when negative, taken from the highest score down with rev set
+func (z *zset) rangeByIndex(start, stop int, rev bool) []*skiplist.Element {
+	n := z.zsl.Len()
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= n {
+		return nil
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	elems := make([]*skiplist.Element, 0, stop-start+1)
+	if rev {
+		for e := z.zsl.ByRank(n - start); e != nil && len(elems) < cap(elems); e = e.Prev() {
+			elems = append(elems, e)
+		}
+		return elems
+	}
+	for e := z.zsl.ByRank(start + 1); e != nil && len(elems) < cap(elems); e = e.Next() {
+		elems = append(elems, e)
+	}
+	return elems
+}
+
+// rangeByScore returns the elements with a score in r after skipping offset
+// of them, up to count of them when count is not negative. With rev set they
+// are taken from the highest score down
+func (z *zset) rangeByScore(r skiplist.Range, rev bool, offset, count int) []*skiplist.Element {
+	var elems []*skiplist.Element
+	e := z.zsl.FirstInRange(r)
+	if rev {
+		e = z.zsl.LastInRange(r)
+	}
+	for ; e != nil && r.Contains(e.Score) && (count < 0 || len(elems) < count); e = zsetStep(e, rev) {
+		if offset > 0 {
+			offset--
+			continue
+		}
+		elems = append(elems, e)
+	}
+	return elems
+}
+
+// rangeByLex is rangeByScore for a range of members, which only makes sense
+// when every member has the same score
+func (z *zset) rangeByLex(r skiplist.LexRange, rev bool, offset, count int) []*skiplist.Element {
+	var elems []*skiplist.Element
+	e := z.zsl.FirstInLexRange(r)
+	if rev {
+		e = z.zsl.LastInLexRange(r)
+	}
+	for ; e != nil && r.Contains(e.Member) && (count < 0 || len(elems) < count); e = zsetStep(e, rev) {
+		if offset > 0 {
+			offset--
+			continue
+		}
+		elems = append(elems, e)
+	}
+	return elems
+}
+
+// zsetStep returns the element after e, or the one before it with rev set
+func zsetStep(e *skiplist.Element, rev bool) *skiplist.Element {
+	if rev {
+		return e.Prev()
+	}
+	return e.Next()
+}
+
+// formatScore formats a score the way it is sent to clients and saved
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// parseScore parses a score, which may be inf or -inf but not nan
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errNotFloat
+	}
+	return score, nil
+}
+
+// parseScoreRange parses the min and max of a range of scores, a leading "("
+// leaves the score itself out of the range
+func parseScoreRange(min, max string) (skiplist.Range, error) {
+	var r skiplist.Range
+	var err error
+	if r.Min, r.MinEx, err = parseScoreBound(min); err != nil {
+		return r, err
+	}
+	if r.Max, r.MaxEx, err = parseScoreBound(max); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+func parseScoreBound(s string) (float64, bool, error) {
+	ex := strings.HasPrefix(s, "(")
+	score, err := strconv.ParseFloat(strings.TrimPrefix(s, "("), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false, errScoreRange
+	}
+	return score, ex, nil
+}
+
+// parseLexRange parses the min and max of a range of members. Each is "-" or
+// "+" for the smallest or largest possible member, or a member after "[" to
+// take it in or "(" to leave it out. empty is set for a min of "+" or a max
+// of "-" which no member can be in
+func parseLexRange(min, max string) (r skiplist.LexRange, empty bool, err error) {
+	var minInf, maxInf bool
+	if r.Min, r.MinEx, minInf, err = parseLexBound(min); err != nil {
+		return r, false, err
+	}
+	if r.Max, r.MaxEx, maxInf, err = parseLexBound(max); err != nil {
+		return r, false, err
+	}
+	r.MinInf = min == "-"
+	r.MaxInf = max == "+"
+	empty = (minInf && !r.MinInf) || (maxInf && !r.MaxInf)
+	return r, empty, nil
+}
+
+// parseLexBound parses a bound of a range of members, inf is set for "-" and
+// "+"
+func parseLexBound(s string) (member string, ex bool, inf bool, err error) {
+	switch {
+	case s == "-" || s == "+":
+		return "", false, true, nil
+	case strings.HasPrefix(s, "("):
+		return s[1:], true, false, nil
+	case strings.HasPrefix(s, "["):
+		return s[1:], false, false, nil
+	}
+	return "", false, false, errLexRange
+}
+
+// appendZsetElements appends elems as an array of members, each followed by
+// its score with withScores set
+func appendZsetElements(buf []byte, elems []*skiplist.Element, withScores bool) []byte {
+	n := len(elems)
+	if withScores {
+		n *= 2
+	}
+	buf = append(buf, "*"+strconv.Itoa(n)+Delimeter...)
+	for _, e := range elems {
+		buf = appendBulkString(buf, e.Member)
+		if withScores {
+			buf = appendBulkString(buf, formatScore(e.Score))
+		}
+	}
+	return buf
+}
+
+// replyZsetElements replies with elems like appendZsetElements, and with an
+// empty list when there are none
+func replyZsetElements(c io.Writer, elems []*skiplist.Element, withScores bool) bool {
+	if len(elems) == 0 {
+		return replyEmptySetOrList(c)
+	}
+	_, err := c.Write(appendZsetElements(nil, elems, withScores))
+	return isNil(err)
+}
+
+// Methods for operating on sorted set portion of db
+
+// zadd sets the score of member of the sorted set at key, creating the sorted
+// set if needed, and reports whether the member is new
+func (rs *RedisServer) zadd(db *DB, key, member string, score float64) bool {
+	z, ok := db.z[key]
+	if !ok {
+		z = newZset()
+		db.z[key] = z
+		db.tstore[key] = tZset
+	}
+	added := z.set(member, score)
+	rs.dirty++
+	rs.signalModifiedMembers(db, key, member)
+	return added
+}
+
+// zrem removes member from the sorted set at key and reports whether it was
+// there. Like the other collections a sorted set is removed along with its
+// last member
+func (rs *RedisServer) zrem(db *DB, key, member string) bool {
+	z, ok := db.z[key]
+	if !ok || !z.remove(member) {
+		return false
+	}
+	rs.dirty++
+	if len(z.dict) == 0 {
+		delete(db.z, key)
+		delete(db.tstore, key)
+		delete(db.expires, key)
+		rs.signalModifiedKey(db, key)
+		return true
+	}
+	rs.signalModifiedMembers(db, key, member)
+	return true
+}
+
+// zstore replaces whatever is at key with the sorted set z, an empty z
+// removes key
+func (rs *RedisServer) zstore(db *DB, key string, z *zset) {
+	rs.del(db, key)
+	if len(z.dict) == 0 {
+		return
+	}
+	db.z[key] = z
+	db.tstore[key] = tZset
+	rs.dirty++
+	rs.signalModifiedKey(db, key)
+}
+
+// Commands Operating on Sorted Sets
+
+// zaddCommand sets the score of members:
+//
+//	ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+//
+// NX only adds new members and XX only updates existing ones, GT and LT only
+// update a score that grows or shrinks. It replies with the number of members
+// added (or added and changed with CH), or with the new score for INCR which
+// works like ZINCRBY
+func zaddCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	var nx, xx, gt, lt, ch, incr bool
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return replySimpleError(c, errSyntax.Error())
+	}
+	if nx && xx {
+		return replySimpleError(c, errZaddXXNX.Error())
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		return replySimpleError(c, errZaddGTLTNX.Error())
+	}
+	if incr && len(pairs) != 2 {
+		return replySimpleError(c, errZaddIncrPair.Error())
+	}
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, err := parseScore(pairs[2*j])
+		if err != nil {
+			return replySimpleError(c, err.Error())
+		}
+		scores[j] = score
+	}
+
+	db := rs.store[cl.db]
+	added, changed := 0, 0
+	for j, score := range scores {
+		member := pairs[2*j+1]
+		old, exists := db.z[args[0]].score(member)
+		if (nx && exists) || (xx && !exists) {
+			if incr {
+				return replyEmptyBulkString(c)
+			}
+			continue
+		}
+		if incr && exists {
+			score += old
+			if math.IsNaN(score) {
+				return replySimpleError(c, errScoreNaN.Error())
+			}
+		}
+		if exists && ((gt && score <= old) || (lt && score >= old)) {
+			if incr {
+				return replyEmptyBulkString(c)
+			}
+			continue
+		}
+		if exists && score == old {
+			if incr {
+				return replyBulkString(c, formatScore(score))
+			}
+			continue
+		}
+		if rs.zadd(db, args[0], member, score) {
+			added++
+		} else {
+			changed++
+		}
+		if incr {
+			return replyBulkString(c, formatScore(score))
+		}
+	}
+	if ch {
+		added += changed
+	}
+	return replyInteger(c, strconv.Itoa(added))
+}
+
+func zincrbyCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	incr, err := parseScore(args[1])
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	db := rs.store[cl.db]
+	old, _ := db.z[args[0]].score(args[2])
+	score := old + incr
+	if math.IsNaN(score) {
+		return replySimpleError(c, errScoreNaN.Error())
+	}
+	rs.zadd(db, args[0], args[2], score)
+	return replyBulkString(c, formatScore(score))
+}
+
+func zremCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	db := rs.store[cl.db]
+	n := 0
+	for _, member := range args[1:] {
+		if rs.zrem(db, args[0], member) {
+			n++
+		}
+	}
+	return replyInteger(cl.conn, strconv.Itoa(n))
+}
+
+func zscoreCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	score, ok := rs.store[cl.db].z[args[0]].score(args[1])
+	if !ok {
+		return replyEmptyBulkString(cl.conn)
+	}
+	return replyBulkString(cl.conn, formatScore(score))
+}
+
+func zcardCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	n := 0
+	if z, ok := rs.store[cl.db].z[args[0]]; ok {
+		n = len(z.dict)
+	}
+	return replyInteger(cl.conn, strconv.Itoa(n))
+}
+
+func zcountCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	c := cl.conn
+	r, err := parseScoreRange(args[1], args[2])
+	if err != nil {
+		return replySimpleError(c, err.Error())
+	}
+	n := 0
+	if z, ok := rs.store[cl.db].z[args[0]]; ok {
+		if first := z.zsl.FirstInRange(r); first != nil {
+			last := z.zsl.LastInRange(r)
+			n = z.zsl.Rank(last.Score, last.Member) - z.zsl.Rank(first.Score, first.Member) + 1
+		}
+	}
+	return replyInteger(c, strconv.Itoa(n))
+}
+
+// zrank replies with the rank of a member for ZRANK and ZREVRANK
+func zrank(rs *RedisServer, cl *RedisClient, args []string, rev bool) bool {
+	z, ok := rs.store[cl.db].z[args[0]]
+	if !ok {
+		return replyEmptyBulkString(cl.conn)
+	}
+	rank, ok := z.rank(args[1], rev)
+	if !ok {
+		return replyEmptyBulkString(cl.conn)
+	}
+	return replyInteger(cl.conn, strconv.Itoa(rank))
+}
+
+func zrankCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return zrank(rs, cl, args, false)
+}
+
+func zrevrankCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return zrank(rs, cl, args, true)
+}
+
+// zrangeSpec is the part of a ZRANGE after the key and the range
+type zrangeSpec struct {
+	// by is "BYSCORE", "BYLEX" or empty for a range of indexes
+	by         string
+	rev        bool
+	offset     int
+	count      int
+	withScores bool
+}
+
+// parseZrangeSpec parses the options of a ZRANGE, by is the kind of range
+// when the command itself decides it
+func parseZrangeSpec(args []string, by string) (zrangeSpec, error) {
+	spec := zrangeSpec{by: by, count: -1}
+	limit := false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BYSCORE", "BYLEX":
+			spec.by = strings.ToUpper(args[i])
+		case "REV":
+			spec.rev = true
+		case "WITHSCORES":
+			spec.withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return spec, errSyntax
+			}
+			offset, err1 := strconv.Atoi(args[i+1])
+			count, err2 := strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				return spec, errNotInteger
+			}
+			spec.offset, spec.count = offset, count
+			limit = true
+			i += 2
+		default:
+			return spec, errSyntax
+		}
+	}
+	if limit && spec.by == "" {
+		return spec, errZrangeLimit
+	}
+	if spec.withScores && spec.by == "BYLEX" {
+		return spec, errZrangeWithScores
+	}
+	return spec, nil
+}
+
+// zrange replies with the range of the sorted set at key from start to stop,
+// for REV the range is still given from start to stop but for BYSCORE and
+// BYLEX that means from the max to the min
+func zrange(rs *RedisServer, cl *RedisClient, key, start, stop string, spec zrangeSpec) bool {
+	c := cl.conn
+	if spec.offset < 0 {
+		spec.count = 0
+	}
+	var elems []*skiplist.Element
+	switch spec.by {
+	case "BYSCORE":
+		if spec.rev {
+			start, stop = stop, start
+		}
+		r, err := parseScoreRange(start, stop)
+		if err != nil {
+			return replySimpleError(c, err.Error())
+		}
+		if z, ok := rs.store[cl.db].z[key]; ok {
+			elems = z.rangeByScore(r, spec.rev, spec.offset, spec.count)
+		}
+	case "BYLEX":
+		if spec.rev {
+			start, stop = stop, start
+		}
+		r, empty, err := parseLexRange(start, stop)
+		if err != nil {
+			return replySimpleError(c, err.Error())
+		}
+		if z, ok := rs.store[cl.db].z[key]; ok && !empty {
+			elems = z.rangeByLex(r, spec.rev, spec.offset, spec.count)
+		}
+	default:
+		from, err1 := strconv.Atoi(start)
+		to, err2 := strconv.Atoi(stop)
+		if err1 != nil || err2 != nil {
+			return replyInvalidTypeIntegerError(c)
+		}
+		if z, ok := rs.store[cl.db].z[key]; ok {
+			elems = z.rangeByIndex(from, to, spec.rev)
+		}
+	}
+	return replyZsetElements(c, elems, spec.withScores)
+}
+
+// zrangeCommand replies with a range of members:
+//
+//	ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func zrangeCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	spec, err := parseZrangeSpec(args[3:], "")
+	if err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	return zrange(rs, cl, args[0], args[1], args[2], spec)
+}
+
+// zrangebyscoreCommand is ZRANGE with BYSCORE:
+//
+//	ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func zrangebyscoreCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	for _, arg := range args[3:] {
+		if upper := strings.ToUpper(arg); upper == "BYSCORE" || upper == "BYLEX" || upper == "REV" {
+			return replySimpleError(cl.conn, errSyntax.Error())
+		}
+	}
+	spec, err := parseZrangeSpec(args[3:], "BYSCORE")
+	if err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	return zrange(rs, cl, args[0], args[1], args[2], spec)
+}
+
+// zremrange removes the members elems picks from the sorted set at args[0]
+// for the ZREMRANGEBY commands
+func zremrange(rs *RedisServer, cl *RedisClient, args []string, elems func(z *zset) ([]*skiplist.Element, error)) bool {
+	db := rs.store[cl.db]
+	z, ok := db.z[args[0]]
+	if !ok {
+		z = newZset()
+	}
+	picked, err := elems(z)
+	if err != nil {
+		return replySimpleError(cl.conn, err.Error())
+	}
+	members := make([]string, len(picked))
+	for i, e := range picked {
+		members[i] = e.Member
+	}
+	for _, member := range members {
+		rs.zrem(db, args[0], member)
+	}
+	return replyInteger(cl.conn, strconv.Itoa(len(members)))
+}
+
+func zremrangebyscoreCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return zremrange(rs, cl, args, func(z *zset) ([]*skiplist.Element, error) {
+		r, err := parseScoreRange(args[1], args[2])
+		if err != nil {
+			return nil, err
+		}
+		return z.rangeByScore(r, false, 0, -1), nil
+	})
+}
+
+func zremrangebyrankCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return zremrange(rs, cl, args, func(z *zset) ([]*skiplist.Element, error) {
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return nil, errNotInteger
+		}
+		return z.rangeByIndex(start, stop, false), nil
+	})
+}
+
+func zremrangebylexCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return zremrange(rs, cl, args, func(z *zset) ([]*skiplist.Element, error) {
+		r, empty, err := parseLexRange(args[1], args[2])
+		if err != nil || empty {
+			return nil, err
+		}
+		return z.rangeByLex(r, false, 0, -1), nil
+	})
+}
+
+// zpop removes and replies with the members with the lowest scores for
+// ZPOPMIN, or the highest for ZPOPMAX, each followed by its score
+func zpop(rs *RedisServer, cl *RedisClient, args []string, max bool) bool {
+	c := cl.conn
+	if len(args) > 2 {
+		return replySimpleError(c, errSyntax.Error())
+	}
+	count := 1
+	if len(args) == 2 {
+		var err error
+		if count, err = strconv.Atoi(args[1]); err != nil {
+			return replyInvalidTypeIntegerError(c)
+		}
+		if count < 0 {
+			return replySimpleError(c, errNotPositive.Error())
+		}
+	}
+	db := rs.store[cl.db]
+	z, ok := db.z[args[0]]
+	if !ok || count == 0 {
+		return replyEmptySetOrList(c)
+	}
+	elems := z.rangeByIndex(0, count-1, max)
+	buf := appendZsetElements(nil, elems, true)
+	for _, e := range elems {
+		rs.zrem(db, args[0], e.Member)
+	}
+	_, err := c.Write(buf)
+	return isNil(err)
+}
+
+func zpopminCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return zpop(rs, cl, args, false)
+}
+
+func zpopmaxCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return zpop(rs, cl, args, true)
+}
+
+// zsetOpStore stores the union or intersection of sorted sets at a key:
+//
+//	ZUNIONSTORE|ZINTERSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
+//
+// Each score is multiplied by the weight of its key and the scores a member
+// has in the different keys are combined by the aggregate. A key may also
+// hold a set whose members then have a score of 1. The intersection walks the
+// smallest key and looks its members up in the others
+func zsetOpStore(rs *RedisServer, cl *RedisClient, args []string, inter bool) bool {
+	c := cl.conn
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil {
+		return replyInvalidTypeIntegerError(c)
+	}
+	if numKeys < 1 {
+		return replySimpleError(c, errZstoreNoKeys.Error())
+	}
+	if numKeys > len(args)-2 {
+		return replySimpleError(c, errSyntax.Error())
+	}
+	keys := args[2 : 2+numKeys]
+	weights := make([]float64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := "SUM"
+	for i := 2 + numKeys; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WEIGHTS":
+			if i+numKeys >= len(args) {
+				return replySimpleError(c, errSyntax.Error())
+			}
+			for j := range weights {
+				w, err := strconv.ParseFloat(args[i+1+j], 64)
+				if err != nil || math.IsNaN(w) {
+					return replySimpleError(c, "ERR weight value is not a float")
+				}
+				weights[j] = w
+			}
+			i += numKeys
+		case "AGGREGATE":
+			if i+1 >= len(args) {
+				return replySimpleError(c, errSyntax.Error())
+			}
+			aggregate = strings.ToUpper(args[i+1])
+			if aggregate != "SUM" && aggregate != "MIN" && aggregate != "MAX" {
+				return replySimpleError(c, errSyntax.Error())
+			}
+			i++
+		default:
+			return replySimpleError(c, errSyntax.Error())
+		}
+	}
+	if err := rs.prepareKeys(cl, append([]string{args[0]}, keys...), ""); err != nil {
+		return replySimpleError(c, err.Error())
+	}
+
+	// sources holds the score of every member of each key
+	db := rs.store[cl.db]
+	sources := make([]map[string]float64, numKeys)
+	for i, key := range keys {
+		switch rs.getDBType(db, key) {
+		case tZset:
+			sources[i] = db.z[key].dict
+		case tSet:
+			sources[i] = make(map[string]float64, len(db.s[key]))
+			for member := range db.s[key] {
+				sources[i][member] = 1
+			}
+		case tNone:
+			sources[i] = map[string]float64{}
+		default:
+			return replySimpleError(c, errWrongType.Error())
+		}
+	}
+	combine := func(acc, score float64) float64 {
+		switch aggregate {
+		case "MIN":
+			return math.Min(acc, score)
+		case "MAX":
+			return math.Max(acc, score)
+		}
+		// inf plus -inf is taken to be 0 rather than nan
+		if sum := acc + score; !math.IsNaN(sum) {
+			return sum
+		}
+		return 0
+	}
+	weigh := func(score, weight float64) float64 {
+		if w := score * weight; !math.IsNaN(w) {
+			return w
+		}
+		return 0
+	}
+
+	result := newZset()
+	if inter {
+		smallest := 0
+		for i := range sources {
+			if len(sources[i]) < len(sources[smallest]) {
+				smallest = i
+			}
+		}
+	members:
+		for member, score := range sources[smallest] {
+			acc := weigh(score, weights[smallest])
+			for i := range sources {
+				if i == smallest {
+					continue
+				}
+				other, ok := sources[i][member]
+				if !ok {
+					continue members
+				}
+				acc = combine(acc, weigh(other, weights[i]))
+			}
+			result.set(member, acc)
+		}
+	} else {
+		scores := make(map[string]float64)
+		for i := range sources {
+			for member, score := range sources[i] {
+				w := weigh(score, weights[i])
+				if acc, ok := scores[member]; ok {
+					w = combine(acc, w)
+				}
+				scores[member] = w
+			}
+		}
+		for member, score := range scores {
+			result.set(member, score)
+		}
+	}
+	rs.zstore(db, args[0], result)
+	return replyInteger(c, strconv.Itoa(len(result.dict)))
+}
+
+func zunionstoreCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return zsetOpStore(rs, cl, args, false)
+}
+
+func zinterstoreCommand(rs *RedisServer, cl *RedisClient, args []string) bool {
+	return zsetOpStore(rs, cl, args, true)
+}